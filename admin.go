@@ -0,0 +1,268 @@
+package autodelete
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminPath is where the admin console is served, on the private listener.
+const AdminPath = "/admin/"
+
+// The admin console lets the bot's operator look inside any channel and poke
+// at it, without the cmd/ tools or chat commands. It needs the admin_token
+// from the config in an Authorization: Bearer header, and is off when no
+// token is set.
+
+// adminChannel is a channel's internal state, for the admin console.
+type adminChannel struct {
+	ChannelID string    `json:"channel_id"`
+	GuildID   string    `json:"guild_id"`
+	Name      string    `json:"name"`
+	Loaded    bool      `json:"loaded"`
+	Status    string    `json:"status"`
+	Policy    apiPolicy `json:"policy"`
+	Donor     bool      `json:"donor"`
+	Paused    bool      `json:"paused"`
+
+	LiveMessages int `json:"live_messages"`
+	// Pins and other messages that are never deleted.
+	KeepLookup   []string   `json:"keep_lookup"`
+	NextDeletion *time.Time `json:"next_deletion,omitempty"`
+	// When the channel is due, by label of each queue it is waiting in.
+	Queued map[string]time.Time `json:"queued"`
+
+	Deleted       int       `json:"deleted"`
+	LastLoad      time.Time `json:"last_load"`
+	LoadError     string    `json:"load_error,omitempty"`
+	LastReap      time.Time `json:"last_reap"`
+	LastReapCount int       `json:"last_reap_count"`
+	LastReapError string    `json:"last_reap_error,omitempty"`
+}
+
+// adminQueue is the content of a work queue, for the admin console.
+type adminQueue struct {
+	Waiting  []queueEntry `json:"waiting"`
+	InFlight []string     `json:"in_flight"`
+}
+
+func (c *ManagedChannel) adminState() adminChannel {
+	s := c.Summary()
+	st := adminChannel{
+		ChannelID: c.ChannelID,
+		GuildID:   c.GuildID,
+		Name:      s.Name,
+		Loaded:    true,
+		Status:    s.Status,
+		Policy:    policyOf(s.Conf),
+		Donor:     s.Conf.IsDonor,
+		Paused:    s.Conf.Paused,
+		Queued:    make(map[string]time.Time),
+
+		LiveMessages:  s.Tracked,
+		Deleted:       s.Deleted,
+		LastReap:      s.LastReap,
+		LastReapCount: s.LastReapCount,
+	}
+	if !s.NextDeletion.IsZero() {
+		st.NextDeletion = &s.NextDeletion
+	}
+	for _, q := range c.bot.queues() {
+		if due, ok := q.Scheduled(c); ok {
+			st.Queued[q.label] = due
+		}
+	}
+
+	c.mu.Lock()
+	st.KeepLookup = make([]string, 0, len(c.keepLookup))
+	for id := range c.keepLookup {
+		st.KeepLookup = append(st.KeepLookup, id)
+	}
+	st.LastLoad = c.health.lastLoadOK
+	if c.health.loadErr != nil {
+		st.LoadError = c.health.loadErr.Error()
+	}
+	if c.health.lastReapErr != nil {
+		st.LastReapError = c.health.lastReapErr.Error()
+	}
+	c.mu.Unlock()
+	sort.Strings(st.KeepLookup)
+	return st
+}
+
+func (b *Bot) authorizeAdmin(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.AdminToken)) == 1
+}
+
+// HTTPAdmin serves the admin console under AdminPath.
+func (b *Bot) HTTPAdmin(w http.ResponseWriter, r *http.Request) {
+	if b.AdminToken == "" {
+		apiError(w, http.StatusForbidden, "the admin console is off, set admin_token in the config")
+		return
+	}
+	if !b.authorizeAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="AutoDelete admin"`)
+		apiError(w, http.StatusUnauthorized, "missing or wrong admin token")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPath), "/"), "/")
+	if r.Method != http.MethodGet {
+		fmt.Printf("[admn] %s %s\n", r.Method, r.URL.Path)
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "queues":
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		queues := make(map[string]adminQueue)
+		for _, q := range b.queues() {
+			var aq adminQueue
+			aq.Waiting, aq.InFlight = q.entries()
+			queues[q.label] = aq
+		}
+		writeJSON(w, http.StatusOK, queues)
+	case len(parts) == 2 && parts[0] == "channels":
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		b.adminChannel(w, parts[1])
+	case len(parts) == 3 && parts[0] == "channels":
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		b.adminChannelAction(w, r, parts[1], parts[2])
+	case len(parts) == 3 && parts[0] == "guilds" && parts[2] == "leave":
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		guildID := parts[1]
+		if guildID == b.DonorGuild {
+			apiError(w, http.StatusConflict, "the bot never leaves the donor guild")
+			return
+		}
+		if err := b.api.GuildLeave(guildID); err != nil {
+			apiError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		fmt.Println("[leav]", guildID, "admin console")
+		writeJSON(w, http.StatusOK, map[string]string{"left": guildID})
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (b *Bot) loadedChannel(channelID string) *ManagedChannel {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.channels[channelID]
+}
+
+// adminChannel shows a loaded channel, or the stored config of one that is
+// not loaded.
+func (b *Bot) adminChannel(w http.ResponseWriter, channelID string) {
+	if mCh := b.loadedChannel(channelID); mCh != nil {
+		writeJSON(w, http.StatusOK, mCh.adminState())
+		return
+	}
+	conf, err := b.storage.GetChannel(channelID)
+	if err != nil {
+		apiError(w, http.StatusNotFound, "channel is not configured")
+		return
+	}
+	writeJSON(w, http.StatusOK, adminChannel{
+		ChannelID: channelID,
+		GuildID:   conf.GuildID,
+		Status:    "not loaded",
+		Policy:    policyOf(conf),
+		Donor:     conf.IsDonor,
+		Paused:    conf.Paused,
+	})
+}
+
+// adminChannelAction handles load, reap, disable and donor. All but disable
+// need the channel to be loaded; load loads it from storage if it is not.
+func (b *Bot) adminChannelAction(w http.ResponseWriter, r *http.Request, channelID, action string) {
+	mCh := b.loadedChannel(channelID)
+	switch action {
+	case "load":
+		if mCh == nil {
+			if err := b.reloadChannel(channelID); os.IsNotExist(err) {
+				apiError(w, http.StatusNotFound, "channel is not configured")
+				return
+			} else if err != nil {
+				apiError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			// Loaded already, nothing queued
+			b.adminChannel(w, channelID)
+			return
+		}
+		// Skip the check against loading too often
+		mCh.mu.Lock()
+		mCh.lastLoadBacklog = time.Time{}
+		mCh.mu.Unlock()
+		b.QueueLoadBacklog(mCh, QOSInteractive)
+		writeJSON(w, http.StatusAccepted, map[string]string{"queued": queueLoad})
+	case "reap":
+		if mCh == nil {
+			apiError(w, http.StatusConflict, "channel is not loaded")
+			return
+		}
+		b.reaper.Update(mCh, b.clock.Now())
+		writeJSON(w, http.StatusAccepted, map[string]string{"queued": queueReap})
+	case "disable":
+		guildID := ""
+		if mCh != nil {
+			guildID = mCh.GuildID
+			mCh.Disable()
+		} else if conf, err := b.storage.GetChannel(channelID); err == nil {
+			guildID = conf.GuildID
+		} else {
+			apiError(w, http.StatusNotFound, "channel is not configured")
+			return
+		}
+		if err := b.deleteChannelConfig(channelID); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		b.audit(AuditEntry{GuildID: guildID, ChannelID: channelID, Action: auditOff, Detail: "disabled by the bot administrator"})
+		writeJSON(w, http.StatusOK, map[string]string{"disabled": channelID})
+	case "donor":
+		if mCh == nil {
+			apiError(w, http.StatusConflict, "channel is not loaded")
+			return
+		}
+		donor, err := strconv.ParseBool(r.FormValue("donor"))
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "donor must be true or false")
+			return
+		}
+		mCh.mu.Lock()
+		mCh.IsDonor = donor
+		mCh.mu.Unlock()
+		if err := b.saveChannelConfig(mCh.Export()); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// The donor backlog limit applies on the next load
+		b.QueueLoadBacklog(mCh, QOSInteractive)
+		writeJSON(w, http.StatusOK, mCh.adminState())
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
@@ -0,0 +1,125 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, b *Bot, method, path, token string, out interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, AdminPath+path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	b.HTTPAdmin(w, r)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	if code := adminRequest(t, b, "GET", "queues", "", nil); code != http.StatusForbidden {
+		t.Errorf("without admin_token: %d", code)
+	}
+	b.AdminToken = "secret"
+	if code := adminRequest(t, b, "GET", "queues", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("no token: %d", code)
+	}
+	if code := adminRequest(t, b, "GET", "queues", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: %d", code)
+	}
+	if code := adminRequest(t, b, "GET", "queues", "secret", nil); code != http.StatusOK {
+		t.Errorf("right token: %d", code)
+	}
+}
+
+func TestAdminChannel(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	b.AdminToken = "secret"
+	b.DonorGuild = "999"
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	for i := 0; i < 3; i++ {
+		postAndAdd(c, clock, api)
+	}
+	c.mu.Lock()
+	c.keepLookup = map[string]bool{"42": true}
+	c.mu.Unlock()
+	path := "channels/" + testChannelID
+
+	if code := adminRequest(t, b, "POST", path+"/reap", "secret", nil); code != http.StatusAccepted {
+		t.Errorf("reap: %d", code)
+	}
+	var st adminChannel
+	if code := adminRequest(t, b, "GET", path, "secret", &st); code != http.StatusOK {
+		t.Fatalf("inspect: %d", code)
+	}
+	if st.LiveMessages != 3 || len(st.KeepLookup) != 1 || st.KeepLookup[0] != "42" || st.NextDeletion == nil || !st.NextDeletion.Equal(clock.Now()) {
+		t.Errorf("inspect: %+v", st)
+	}
+
+	var queues map[string]adminQueue
+	adminRequest(t, b, "GET", "queues", "secret", &queues)
+	if reap := queues[queueReap]; len(reap.Waiting) != 1 || reap.Waiting[0].ChannelID != testChannelID || reap.Waiting[0].GuildID != testGuildID {
+		t.Errorf("reap queue %+v", queues[queueReap])
+	}
+
+	if code := adminRequest(t, b, "POST", path+"/donor?donor=true", "secret", &st); code != http.StatusOK || !st.Donor {
+		t.Errorf("donor: %d %+v", code, st)
+	}
+	if saved, err := b.storage.GetChannel(testChannelID); err != nil || !saved.IsDonor {
+		t.Errorf("saved %+v, %v", saved, err)
+	}
+
+	if code := adminRequest(t, b, "POST", path+"/disable", "secret", nil); code != http.StatusOK {
+		t.Errorf("disable: %d", code)
+	}
+	if _, err := b.storage.GetChannel(testChannelID); err == nil {
+		t.Error("config still saved after disabling")
+	}
+	if code := adminRequest(t, b, "GET", path, "secret", nil); code != http.StatusNotFound {
+		t.Errorf("inspect after disabling: %d", code)
+	}
+	entries, _ := b.storage.ListAuditEntries(testGuildID)
+	if len(entries) != 1 || entries[0].Action != auditOff || b.describeActor(testGuildID, entries[0]) != "the bot administrator" {
+		t.Errorf("audit log %+v", entries)
+	}
+
+	if code := adminRequest(t, b, "POST", "guilds/999/leave", "secret", nil); code != http.StatusConflict {
+		t.Errorf("leaving the donor guild: %d", code)
+	}
+	if code := adminRequest(t, b, "POST", "guilds/"+testGuildID+"/leave", "secret", nil); code != http.StatusOK || len(api.left) != 1 || api.left[0] != testGuildID {
+		t.Errorf("leave: %d, left %q", code, api.left)
+	}
+}
+
+func TestAdminLoad(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	b.AdminToken = "secret"
+	if err := b.saveChannelConfig(ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, LiveTime: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	path := "channels/" + testChannelID + "/load"
+
+	// Not loaded: loaded right away
+	var st adminChannel
+	if code := adminRequest(t, b, "POST", path, "secret", &st); code != http.StatusOK || st.ChannelID != testChannelID || st.Policy.LiveTime != "1h0m0s" {
+		t.Errorf("load: %d %+v", code, st)
+	}
+	if b.loadedChannel(testChannelID) == nil {
+		t.Fatal("channel not loaded")
+	}
+
+	// Loaded: the backlog load is queued
+	var queued map[string]string
+	if code := adminRequest(t, b, "POST", path, "secret", &queued); code != http.StatusAccepted || queued["queued"] != queueLoad {
+		t.Errorf("reload: %d %v", code, queued)
+	}
+}
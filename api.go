@@ -0,0 +1,59 @@
+package autodelete
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// DiscordAPI is the subset of the Discord REST API used by the bot. It is
+// satisfied by *discordgo.Session; tests substitute a fake.
+type DiscordAPI interface {
+	Channel(channelID string) (*discordgo.Channel, error)
+	ChannelMessage(channelID, messageID string) (*discordgo.Message, error)
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error)
+	ChannelMessagesPinned(channelID string) ([]*discordgo.Message, error)
+	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string) error
+	ChannelMessagesBulkDelete(channelID string, messages []string) error
+	ChannelMessageUnpin(channelID, messageID string) error
+	MessageReactionAdd(channelID, messageID, emojiID string) error
+	MessageReactionRemove(channelID, messageID, emojiID, userID string) error
+
+	GuildMember(guildID, userID string) (*discordgo.Member, error)
+	GuildLeave(guildID string) error
+	UserChannelPermissions(userID, channelID string) (int64, error)
+	UserChannelCreate(recipientID string) (*discordgo.Channel, error)
+
+	RequestWithBucketID(method, urlStr string, data interface{}, bucketID string) ([]byte, error)
+	RequestWithLockedBucket(method, urlStr, contentType string, b []byte, bucket *discordgo.Bucket, sequence int) ([]byte, error)
+}
+
+var _ DiscordAPI = (*discordgo.Session)(nil)
+
+// A Clock tells the time and makes timers. Tests substitute a fake.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of *time.Timer used by the bot.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
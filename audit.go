@@ -0,0 +1,38 @@
+package autodelete
+
+import "fmt"
+
+// auditLogLength is the number of changes kept for each guild.
+const auditLogLength = 200
+
+// Actions in the audit log.
+const (
+	auditSet      = "set"
+	auditOff      = "off"
+	auditPause    = "pause"
+	auditResume   = "resume"
+	auditGuild    = "guild settings"
+	auditNewToken = "new API token"
+	auditRevoke   = "revoke API token"
+)
+
+// audit records a change made by a user or an API token. The entry's Time is
+// filled in. Failures are only logged, as the change itself went through.
+func (b *Bot) audit(entry AuditEntry) {
+	entry.Time = b.clock.Now()
+	if err := b.storage.AddAuditEntry(entry); err != nil {
+		fmt.Printf("[audt] could not record %s in guild %s: %v\n", entry.Action, entry.GuildID, err)
+	}
+}
+
+// describeGuildSettings summarizes a guild's settings for the audit log.
+func describeGuildSettings(s GuildSettings) string {
+	locale, prefix := "auto", "none"
+	if s.Locale != "" {
+		locale = s.Locale
+	}
+	if s.Prefix != "" {
+		prefix = s.Prefix
+	}
+	return fmt.Sprintf("language %s, prefix %s", locale, prefix)
+}
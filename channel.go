@@ -3,7 +3,6 @@ package autodelete
 import (
 	"encoding/json"
 	"fmt"
-	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -12,6 +11,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	topk "github.com/riking/AutoDelete/go-prometheus-topk"
+	"github.com/riking/AutoDelete/snowflake"
 )
 
 const minTimeBetweenDeletion = time.Second * 5
@@ -102,11 +102,6 @@ func init() {
 	prometheus.MustRegister(mTopDeletionGuilds)
 }
 
-type smallMessage struct {
-	MessageID string
-	PostedAt  time.Time
-}
-
 // A ManagedChannel holds all the AutoDelete-related state for a Discord channel.
 type ManagedChannel struct {
 	bot         *Bot
@@ -118,10 +113,28 @@ type ManagedChannel struct {
 	backlogMu       sync.Mutex // only for LoadBacklog()
 	minNextDelete   time.Time  // channel cannot get sent to deletion before this time
 	lastLoadBacklog time.Time  // last LoadBacklog call
+	lastJobSave     time.Time  // last save by the crawl or single-delete worker
 	// Messages posted to the channel get deleted after
 	MessageLiveTime time.Duration
 	MaxMessages     int
 	KeepMessages    []string
+	EditPolicy      EditPolicy
+	PinPolicy       PinPolicy
+	PinKeepCount    int
+	StickyText      string
+	StickyEvery     int
+	StickyInterval  time.Duration
+	StickyMessageID string
+	WarnMode        WarnMode
+	WarnBefore      time.Duration
+	VoiceChannelID  string
+	VoiceWipeDelay  time.Duration
+	// Work is stopped until the bot's permissions are back, see
+	// permissions.go. A Paused channel stays suspended until it is resumed
+	// through the API.
+	Suspended     bool
+	SuspendReason string
+	Paused        bool
 	// if lower than CriticalMsgSequence, need to send one
 	LastSentUpdate int
 	IsDonor        bool
@@ -134,15 +147,36 @@ type ManagedChannel struct {
 
 	// if false, need to check channel history for messages
 	isStarted chan struct{}
-	// liveMessages contains a list of message IDs and the timestamp they
-	// were posted at, listing the candidates for deletion in this channel.
-	// It should always be sorted with the oldest messages at index 0 and
-	// the newer messages at higher indices.
-	liveMessages []smallMessage
+	// liveMessages lists the candidates for deletion in this channel,
+	// oldest first. Post times are derived from the IDs.
+	liveMessages messageRing
+	// Messages tracked by their edit time, see edits.go.
+	edits editedMessages
 	// Set of message IDs that need to be kept and not deleted.
 	keepLookup map[string]bool
 	// Used in queue.go for exponential backoff
 	loadFailures time.Duration
+	// Results of recent work, for the check command.
+	health channelHealth
+	// Messages too old to bulk delete, worked on by the single-delete queue.
+	singleDelete singleDeleteJob
+	// History past the backlog limit, worked on by the crawl queue.
+	crawl backlogCrawl
+	// Sticky message reposting, see sticky.go.
+	sticky stickyState
+	// Pre-deletion warnings, see warn.go.
+	warn warnState
+	// When to delete everything because the linked voice channel emptied,
+	// see voice.go.
+	voiceWipeAt time.Time
+}
+
+// backlogLimit is how many messages LoadBacklog tracks in a channel.
+func backlogLimit(isDonor bool) int {
+	if isDonor {
+		return backlogLimitDonor
+	}
+	return backlogLimitNonDonor
 }
 
 func InitChannel(b *Bot, chConf ManagedChannelMarshal) (*ManagedChannel, error) {
@@ -154,22 +188,41 @@ func InitChannel(b *Bot, chConf ManagedChannelMarshal) (*ManagedChannel, error)
 	if disCh.GuildID != chConf.GuildID {
 		needsExport = true
 	}
-	return &ManagedChannel{
+	c := &ManagedChannel{
 		bot:             b,
 		ChannelID:       disCh.ID,
 		ChannelName:     disCh.Name,
 		GuildID:         disCh.GuildID,
-		minNextDelete:   time.Now(),
+		minNextDelete:   b.clock.Now(),
 		MessageLiveTime: chConf.LiveTime,
 		MaxMessages:     chConf.MaxMessages,
 		LastSentUpdate:  chConf.LastSentUpdate,
 		KeepMessages:    chConf.KeepMessages,
+		EditPolicy:      chConf.EditPolicy,
+		PinPolicy:       chConf.PinPolicy,
+		PinKeepCount:    chConf.PinKeepCount,
+		StickyText:      chConf.StickyText,
+		StickyEvery:     chConf.StickyEvery,
+		StickyInterval:  chConf.StickyInterval,
+		StickyMessageID: chConf.StickyMessageID,
+		WarnMode:        chConf.WarnMode,
+		WarnBefore:      chConf.WarnBefore,
+		VoiceChannelID:  chConf.VoiceChannelID,
+		VoiceWipeDelay:  chConf.VoiceWipeDelay,
+		Suspended:       chConf.Suspended,
+		SuspendReason:   chConf.SuspendReason,
+		Paused:          chConf.Paused,
 		IsDonor:         chConf.IsDonor,
 		needsExport:     needsExport,
 		isStarted:       make(chan struct{}),
-		liveMessages:    nil,
 		keepLookup:      make(map[string]bool),
-	}, nil
+		crawl:           backlogCrawl{cursor: chConf.CrawlCursor, depth: chConf.CrawlDepth},
+	}
+	if len(chConf.SingleDeletePending) > 0 {
+		// Not shared yet, no need for mu
+		c.restoreSingleDelete(chConf.SingleDeletePending)
+	}
+	return c, nil
 }
 
 func (c *ManagedChannel) Export() ManagedChannelMarshal {
@@ -177,13 +230,31 @@ func (c *ManagedChannel) Export() ManagedChannelMarshal {
 	defer c.mu.Unlock()
 
 	return ManagedChannelMarshal{
-		ID:             c.ChannelID,
-		GuildID:        c.GuildID,
-		LiveTime:       c.MessageLiveTime,
-		MaxMessages:    c.MaxMessages,
-		LastSentUpdate: c.LastSentUpdate,
-		KeepMessages:   c.KeepMessages,
-		IsDonor:        c.IsDonor,
+		ID:              c.ChannelID,
+		GuildID:         c.GuildID,
+		LiveTime:        c.MessageLiveTime,
+		MaxMessages:     c.MaxMessages,
+		LastSentUpdate:  c.LastSentUpdate,
+		KeepMessages:    c.KeepMessages,
+		EditPolicy:      c.EditPolicy,
+		PinPolicy:       c.PinPolicy,
+		PinKeepCount:    c.PinKeepCount,
+		StickyText:      c.StickyText,
+		StickyEvery:     c.StickyEvery,
+		StickyInterval:  c.StickyInterval,
+		StickyMessageID: c.StickyMessageID,
+		WarnMode:        c.WarnMode,
+		WarnBefore:      c.WarnBefore,
+		VoiceChannelID:  c.VoiceChannelID,
+		VoiceWipeDelay:  c.VoiceWipeDelay,
+		Suspended:       c.Suspended,
+		SuspendReason:   c.SuspendReason,
+		Paused:          c.Paused,
+		IsDonor:         c.IsDonor,
+		CrawlCursor:     c.crawl.cursor,
+		CrawlDepth:      c.crawl.depth,
+
+		SingleDeletePending: c.singleDeletePendingIDs(),
 	}
 }
 
@@ -209,8 +280,14 @@ func (c *ManagedChannel) Disable() {
 
 	// reset internal state
 	c.mu.Lock()
-	c.liveMessages = nil
+	c.liveMessages.Clear()
+	c.edits = editedMessages{}
+	c.sticky = stickyState{}
+	c.warn = warnState{}
+	c.voiceWipeAt = time.Time{}
 	c.keepLookup = nil
+	c.clearSingleDelete()
+	c.stopCrawlLocked()
 
 	c.killBit = true // ensure reapq gets our drop message
 	c.mu.Unlock()
@@ -225,7 +302,7 @@ func (b *Bot) Channel(channelID string) (*discordgo.Channel, error) {
 	if ch != nil {
 		return ch, nil
 	}
-	ch, err := b.s.Channel(channelID)
+	ch, err := b.api.Channel(channelID)
 	if err != nil {
 		return ch, err
 	}
@@ -263,9 +340,10 @@ func (c *ManagedChannel) loadPins() ([]*discordgo.Message, error) {
 		var err error
 		if useAlternateRatelimiter {
 			// the string "//reactions//" gets a special ratelimit applied
-			body, err = c.bot.s.RequestWithLockedBucket("GET", discordgo.EndpointChannelMessagesPins(c.ChannelID), "application/json", nil, alternateRL.LockBucket(fmt.Sprintf("/custom/pins/%s//reactions//x", c.ChannelID)), 0)
+			body, err = c.bot.api.RequestWithLockedBucket("GET", discordgo.EndpointChannelMessagesPins(c.ChannelID), "application/json", nil, alternateRL.LockBucket(fmt.Sprintf("/custom/pins/%s//reactions//x", c.ChannelID)), 0)
 		} else {
-			body, err = c.bot.s.RequestWithBucketID("GET", discordgo.EndpointChannelMessagesPins(c.ChannelID), nil, "/custom/pinsGlobal")
+			c.bot.noteBucket(bucketPinsGlobal)
+			body, err = c.bot.api.RequestWithBucketID("GET", discordgo.EndpointChannelMessagesPins(c.ChannelID), nil, bucketPinsGlobal)
 		}
 		if err != nil {
 			return nil, err
@@ -274,10 +352,23 @@ func (c *ManagedChannel) loadPins() ([]*discordgo.Message, error) {
 		err = json.Unmarshal(body, &st)
 		return st, err
 	} else {
-		return c.bot.s.ChannelMessagesPinned(c.ChannelID)
+		return c.bot.api.ChannelMessagesPinned(c.ChannelID)
 	}
 }
 
+// hasPins reports whether loadPins would need to make a request. Channels
+// missing from the state cache are assumed to have pins.
+func (c *ManagedChannel) hasPins() bool {
+	c.mu.Lock()
+	needsPins := c.needsPins()
+	c.mu.Unlock()
+	if !needsPins {
+		return false
+	}
+	disCh, _ := c.bot.s.State.Channel(c.ChannelID)
+	return disCh == nil || disCh.LastPinTimestamp != ""
+}
+
 func (c *ManagedChannel) LoadBacklogNow() {
 	err := c.LoadBacklog()
 	if isRetryableLoadError(err) {
@@ -286,6 +377,12 @@ func (c *ManagedChannel) LoadBacklogNow() {
 }
 
 func (c *ManagedChannel) LoadBacklog() error {
+	err := c.loadBacklog()
+	c.recordLoad(err)
+	return err
+}
+
+func (c *ManagedChannel) loadBacklog() error {
 	timer := prometheus.NewTimer(mBacklogLoadLatency)
 	defer timer.ObserveDuration()
 
@@ -295,11 +392,12 @@ func (c *ManagedChannel) LoadBacklog() error {
 
 	// Early exit if we got multiple calls
 	earlyExit := false
+	now := c.bot.clock.Now()
 	c.mu.Lock()
-	if c.lastLoadBacklog.Add(minTimeBetweenLoadBacklog).After(time.Now()) {
+	if c.lastLoadBacklog.Add(minTimeBetweenLoadBacklog).After(now) {
 		earlyExit = true
 	} else {
-		c.lastLoadBacklog = time.Now()
+		c.lastLoadBacklog = now
 	}
 	c.mu.Unlock()
 	if earlyExit {
@@ -310,26 +408,24 @@ func (c *ManagedChannel) LoadBacklog() error {
 	// Set time even on errors
 	defer func() {
 		c.mu.Lock()
-		c.lastLoadBacklog = time.Now()
+		c.lastLoadBacklog = c.bot.clock.Now()
 		c.mu.Unlock()
 	}()
 
 	// Load messages & pins
-	msgsA, err := c.bot.s.ChannelMessages(c.ChannelID, backlogChunkLimit, "", "", "")
+	c.bot.noteBucket(discordgo.EndpointChannelMessages(c.ChannelID))
+	msgsA, err := c.bot.api.ChannelMessages(c.ChannelID, backlogChunkLimit, "", "", "")
 	if err != nil {
 		fmt.Println("[ERR ] could not load backlog for", c, err)
 		return err
 	}
 	msgs := msgsA
-	limit := backlogLimitNonDonor
-	if c.IsDonor {
-		limit = backlogLimitDonor
-	}
+	limit := backlogLimit(c.IsDonor)
+	// Anything past the limit is left to the crawler
 	for len(msgsA) == backlogChunkLimit && len(msgs) < limit {
-		fmt.Println("[TEST] Loading extended backlog for", c, len(msgsA))
 		before := msgs[len(msgs)-1].ID
 
-		msgsA, err = c.bot.s.ChannelMessages(c.ChannelID, backlogChunkLimit, before, "", "")
+		msgsA, err = c.bot.api.ChannelMessages(c.ChannelID, backlogChunkLimit, before, "", "")
 		if err != nil {
 			fmt.Println("[ERR ] could not load backlog for", c, err)
 			return err
@@ -338,90 +434,98 @@ func (c *ManagedChannel) LoadBacklog() error {
 		msgs = append(msgs, msgsA...)
 	}
 
-	pins, pinsErr := c.loadPins()
+	c.mu.Lock()
+	needsPins := c.needsPins()
+	c.mu.Unlock()
+	var pins []*discordgo.Message
+	var pinsErr error
+	if needsPins {
+		pins, pinsErr = c.loadPins()
+	}
 	if pinsErr != nil {
 		fmt.Println("[ERR ] could not load pins for", c, pinsErr)
 
 		// experiment with a notice
-		//c.bot.s.ChannelMessageSend(c.ChannelID,
+		//c.bot.api.ChannelMessageSend(c.ChannelID,
 		//	":warning: Failed to load channel pins, may accidentally delete them",
 		//)
 		return pinsErr
 	}
 
 	defer c.bot.QueueReap(c) // requires mutex unlocked
+	defer c.bot.QueueSticky(c)
+	var unpin []*discordgo.Message
+	defer func() { c.unpinMessages(unpin) }() // requires mutex unlocked
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	keepPins, unpin := c.applyPinPolicy(pins)
 	c.keepLookup = make(map[string]bool)
-	for i := range pins {
-		c.keepLookup[pins[i].ID] = true
+	for i := range keepPins {
+		c.keepLookup[keepPins[i].ID] = true
 	}
 	for _, v := range c.KeepMessages {
 		c.keepLookup[v] = true
 	}
+	if c.StickyMessageID != "" {
+		c.keepLookup[c.StickyMessageID] = true
+	}
+	c.countStickyBacklog(msgs)
 
 	c.mergeBacklog(msgs)
 
+	if len(msgsA) == backlogChunkLimit {
+		depth := 0
+		for _, v := range msgs {
+			if !c.keepLookup[v.ID] {
+				depth++
+			}
+		}
+		c.startCrawlLocked(msgs[len(msgs)-1].ID, depth)
+		defer c.bot.QueueCrawl(c, c.bot.clock.Now())
+	} else {
+		c.stopCrawlLocked()
+	}
+
 	// mark as ready for AddMessage()
 	inited := "reloaded"
+	if c.markStartedLocked() {
+		inited = "initialized"
+	}
+	fmt.Printf("[load] %s %s, %d msgs %d keeps\n", c.String(), inited, c.liveMessages.Len(), len(c.keepLookup))
+	return nil
+}
+
+// markStartedLocked lets AddMessage through, and reports whether the channel
+// was not started before. Must be called with c.mu held.
+func (c *ManagedChannel) markStartedLocked() bool {
 	select {
 	case <-c.isStarted:
+		return false
 	default:
 		close(c.isStarted)
-		inited = "initialized"
+		return true
 	}
-	fmt.Printf("[load] %s %s, %d msgs %d keeps\n", c.String(), inited, len(c.liveMessages), len(c.keepLookup))
-	return nil
 }
 
 func (c *ManagedChannel) mergeBacklog(msgs []*discordgo.Message) {
-	var (
-		oldLiveMessages = c.liveMessages
-		newLiveMessages = make([]smallMessage, 0, len(msgs))
-		iOld            int
-	)
-	sort.Sort(liveMessagesSort(oldLiveMessages))
-	// Iterate backwards so we put oldest first
-	for i := len(msgs); i > 0; i-- {
-		v := msgs[i-1]
-
-		// Check for non-deletion
-		if c.keepLookup[v.ID] {
+	var keys []snowflake.ID
+	for _, v := range msgs {
+		// Check for non-deletion, or already being deleted
+		if c.keepLookup[v.ID] || c.isSingleDeletePending(v.ID) {
 			continue
 		}
-
-		ts, err := v.Timestamp.Parse()
-		if err != nil {
-			panic("Timestamp format change")
-		}
-		if ts.IsZero() {
+		if c.keptByEditPolicy(v) {
+			c.keepLookup[v.ID] = true
 			continue
 		}
-		// equal messages will break this loop
-		for iOld < len(oldLiveMessages) && ts.After(oldLiveMessages[iOld].PostedAt) {
-			newLiveMessages = append(newLiveMessages, oldLiveMessages[iOld])
-			iOld++
-		}
-		// handle equal messages
-		if iOld < len(oldLiveMessages) && oldLiveMessages[iOld].MessageID == v.ID {
-			iOld++
+		key, ok := c.messageKeyLocked(v)
+		if !ok {
+			continue
 		}
-		newLiveMessages = append(newLiveMessages, smallMessage{
-			MessageID: v.ID,
-			PostedAt:  ts,
-		})
+		keys = append(keys, key)
 	}
-	sort.Sort(liveMessagesSort(newLiveMessages))
-	c.liveMessages = newLiveMessages
-}
-
-type liveMessagesSort []smallMessage
-
-func (s liveMessagesSort) Len() int      { return len(s) }
-func (s liveMessagesSort) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s liveMessagesSort) Less(i, j int) bool {
-	return s[i].PostedAt.Before(s[j].PostedAt)
+	c.liveMessages.Reset(append(c.liveMessages.IDs(), keys...))
 }
 
 func (c *ManagedChannel) AddMessage(m *discordgo.Message) {
@@ -433,22 +537,41 @@ func (c *ManagedChannel) AddMessage(m *discordgo.Message) {
 	// }
 
 	c.mu.Lock()
+	// Suspended channels are reloaded when they resume
+	if c.Suspended {
+		c.mu.Unlock()
+		return
+	}
 	// Check for nondeletion
 	if c.keepLookup[m.ID] {
 		c.mu.Unlock()
 		return
 	}
 
-	if len(c.liveMessages) == 0 {
+	if c.stickyEnabled() {
+		c.sticky.newer++
+		defer c.bot.QueueSticky(c) // requires mutex unlocked
+	}
+
+	if c.keptByEditPolicy(m) {
+		c.keepLookup[m.ID] = true
+		c.mu.Unlock()
+		return
+	}
+
+	key, ok := c.messageKeyLocked(m)
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+
+	if c.liveMessages.Len() == 0 {
 		needReap = true
-	} else if c.MaxMessages > 0 && len(c.liveMessages) == c.MaxMessages {
+	} else if c.MaxMessages > 0 && c.liveMessages.Len() == c.MaxMessages {
 		needReap = true
 	}
 
-	c.liveMessages = append(c.liveMessages, smallMessage{
-		MessageID: m.ID,
-		PostedAt:  time.Now(),
-	})
+	c.liveMessages.Push(key)
 	c.mu.Unlock()
 
 	if needReap {
@@ -460,12 +583,15 @@ func (c *ManagedChannel) AddMessage(m *discordgo.Message) {
 // removed, or more than one of those happened too fast for us to notice.
 func (c *ManagedChannel) UpdatePins(newLpts string) {
 	var dropMsgs []string
+	var unpin []*discordgo.Message
 	defer func() {
+		c.unpinMessages(unpin)
+
 		// This is not the best, as the pins will be deleted
 		// non-chronologically, but it avoids chopping the backlog back to 100
 		// messages.
 		for _, v := range dropMsgs {
-			msg, err := c.bot.s.ChannelMessage(c.ChannelID, v)
+			msg, err := c.bot.api.ChannelMessage(c.ChannelID, v)
 			if err == nil {
 				c.AddMessage(msg)
 			}
@@ -474,11 +600,16 @@ func (c *ManagedChannel) UpdatePins(newLpts string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	pins, err := c.bot.s.ChannelMessagesPinned(c.ChannelID)
-	if err != nil {
-		fmt.Println("[pins] could not load pins for", c, err)
-		return
+	var pins []*discordgo.Message
+	if c.needsPins() {
+		var err error
+		pins, err = c.bot.api.ChannelMessagesPinned(c.ChannelID)
+		if err != nil {
+			fmt.Println("[pins] could not load pins for", c, err)
+			return
+		}
 	}
+	pins, unpin = c.applyPinPolicy(pins)
 
 	newKeep := make(map[string]bool)
 
@@ -488,6 +619,9 @@ func (c *ManagedChannel) UpdatePins(newLpts string) {
 	for _, v := range c.KeepMessages {
 		newKeep[v] = true
 	}
+	if c.StickyMessageID != "" {
+		newKeep[c.StickyMessageID] = true
+	}
 
 	for id := range c.keepLookup {
 		if !newKeep[id] {
@@ -505,22 +639,26 @@ func (c *ManagedChannel) UpdatePins(newLpts string) {
 func (c *ManagedChannel) DoNotDeleteMessage(msgID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	idx := -1
+	if c.removeLiveLocked(msgID) {
+		return
+	}
+	fmt.Println("[BUG] DoNotDeleteMessage called with non-live message")
+}
 
-	for i, v := range c.liveMessages {
-		if v.MessageID == msgID {
-			idx = i
+// RemoveMessages forgets messages that were deleted by someone else, so that
+// they no longer count towards MaxMessages. Returns the number of tracked
+// messages that were removed.
+func (c *ManagedChannel) RemoveMessages(msgIDs []string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for _, msgID := range msgIDs {
+		delete(c.keepLookup, msgID)
+		if c.removeLiveLocked(msgID) {
+			removed++
 		}
 	}
-	if idx == -1 {
-		fmt.Println("[BUG] DoNotDeleteMessage called with non-live message")
-		return
-	}
-	lenMinus1 := len(c.liveMessages) - 1
-	// Delete item
-	copy(c.liveMessages[idx:], c.liveMessages[idx+1:])
-	c.liveMessages[lenMinus1] = smallMessage{}
-	c.liveMessages = c.liveMessages[:lenMinus1]
+	return removed
 }
 
 func (c *ManagedChannel) Enabled() bool {
@@ -542,46 +680,60 @@ func (c *ManagedChannel) SetMaxMessages(max int) {
 }
 
 func (c *ManagedChannel) GetNextDeletionTime() (deadline time.Time) {
+	now := c.bot.clock.Now()
 	defer func() {
-		x := time.Until(deadline)
+		x := deadline.Sub(now)
 		if 863900*time.Second <= x && x <= 864100*time.Second {
 			mNoNextDeletionTimeCount.Inc()
 		} else if x <= 0 {
 			mNextDeletionTimes.Observe(0)
 		} else {
-			mNextDeletionTimes.Observe(float64(time.Until(deadline)) / float64(time.Second))
+			mNextDeletionTimes.Observe(float64(x) / float64(time.Second))
 		}
 	}()
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	defer func() {
+		// Wake up early to send warnings
+		if warnAt := c.nextWarnTimeLocked(); !warnAt.IsZero() && warnAt.Before(deadline) {
+			deadline = warnAt
+		}
+		// and for a voice channel wipe
+		if wipeAt := c.voiceWipeAt; !wipeAt.IsZero() && wipeAt.Before(deadline) {
+			deadline = wipeAt
+			if deadline.Before(c.minNextDelete) {
+				deadline = c.minNextDelete
+			}
+		}
+	}()
 
-	for len(c.liveMessages) > 0 {
+	for c.liveMessages.Len() > 0 {
 		// Recheck keepLookup
-		if c.keepLookup[c.liveMessages[0].MessageID] {
-			c.liveMessages = c.liveMessages[1:]
+		if c.keepLookup[c.liveMessageID(c.liveMessages.Front())] {
+			c.edits.forget(c.liveMessages.PopFront())
 			continue
 		}
 		break
 	}
-	if len(c.liveMessages) == 0 {
-		return time.Now().Add(240 * time.Hour)
+	if c.liveMessages.Len() == 0 {
+		return now.Add(240 * time.Hour)
 	}
 
-	if c.MaxMessages > 0 && len(c.liveMessages) > c.MaxMessages {
-		ts := c.liveMessages[c.MaxMessages].PostedAt
+	if c.MaxMessages > 0 && c.liveMessages.Len() > c.MaxMessages {
+		ts := c.liveMessages.At(c.MaxMessages).Time()
 		if ts.Before(c.minNextDelete) {
 			return c.minNextDelete
 		}
 		return ts
 	}
 	if c.MessageLiveTime != 0 {
-		ts := c.liveMessages[0].PostedAt.Add(c.MessageLiveTime)
+		ts := c.liveMessages.Front().Time().Add(c.MessageLiveTime)
 		if ts.Before(c.minNextDelete) {
 			return c.minNextDelete
 		}
 		return ts
 	}
-	return time.Now().Add(240 * time.Hour)
+	return now.Add(240 * time.Hour)
 }
 
 const errCodeBulkDeleteOld = 50034
@@ -591,8 +743,9 @@ type isTemporary interface {
 	Temporary() bool
 }
 
+// Reap bulk deletes the given messages. If Discord reports that some of them
+// are too old, the remainder is handed to the single-delete job.
 func (c *ManagedChannel) Reap(msgs []string) (int, error) {
-	var err error
 	count := 0
 
 	timer := prometheus.NewTimer(mReapLatency)
@@ -601,133 +754,117 @@ func (c *ManagedChannel) Reap(msgs []string) (int, error) {
 	mTopDeletionChannels.WithLabelValues(c.ChannelID).Observe(float64(len(msgs)))
 	mTopDeletionGuilds.WithLabelValues(c.GuildID).Observe(float64(len(msgs)))
 
-	if len(msgs) == 0 {
-		// All messages were deleted by other bots first
-		return 0, nil
-	}
-
-nobulk:
-	switch {
-	case true:
-		for len(msgs) > 50 {
-			err := c.bot.s.ChannelMessagesBulkDelete(c.ChannelID, msgs[:50])
-			if rErr, ok := err.(*discordgo.RESTError); ok {
-				if rErr.Message != nil {
-					mReapErrors.With(prometheus.Labels{"error_code": strconv.Itoa(rErr.Message.Code)}).Inc()
-					if rErr.Message.Code == errCodeBulkDeleteOld {
-						break nobulk
-					}
-				}
-				return count, err
-			} else if tErr, ok := err.(isTemporary); ok && tErr.Temporary() {
-				// Temporary error, try again
-				mReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
-				time.Sleep(50 * time.Millisecond)
-				continue
-			} else if err != nil {
-				mReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
-				return count, err
-			}
-			msgs = msgs[50:]
-			count += 50
+	for len(msgs) > 0 {
+		chunk := msgs
+		if len(chunk) > 50 {
+			chunk = chunk[:50]
+		}
+		if len(chunk) == 1 {
+			// discordgo sends these as a single delete
+			c.bot.noteBucket(discordgo.EndpointChannelMessage(c.ChannelID, ""))
+		} else {
+			c.bot.noteBucket(discordgo.EndpointChannelMessagesBulkDelete(c.ChannelID))
 		}
-		for {
-			err = c.bot.s.ChannelMessagesBulkDelete(c.ChannelID, msgs)
-			count += len(msgs)
-			if rErr, ok := err.(*discordgo.RESTError); ok {
-				if rErr.Message != nil {
-					mReapErrors.With(prometheus.Labels{"error_code": strconv.Itoa(rErr.Message.Code)}).Inc()
-					if rErr.Message.Code == errCodeBulkDeleteOld {
-						break nobulk
-					}
+		err := c.bot.api.ChannelMessagesBulkDelete(c.ChannelID, chunk)
+		if rErr, ok := err.(*discordgo.RESTError); ok {
+			if rErr.Message != nil {
+				mReapErrors.With(prometheus.Labels{"error_code": strconv.Itoa(rErr.Message.Code)}).Inc()
+				if rErr.Message.Code == errCodeBulkDeleteOld {
+					// Our clock disagrees with Discord's
+					fmt.Printf("[reap] %s: bulk delete refused as too old, moving %d messages to single delete\n", c, len(msgs))
+					c.queueSingleDelete(msgs)
+					return count, nil
 				}
-				return count, err
-			} else if tErr, ok := err.(isTemporary); ok && tErr.Temporary() {
-				// Temporary error, try again
-				mReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
-				time.Sleep(50 * time.Millisecond)
-				continue
-			} else if err != nil {
-				mReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
-				return count, err
 			}
-			return count, nil
+			return count, err
+		} else if tErr, ok := err.(isTemporary); ok && tErr.Temporary() {
+			// Temporary error, try again
+			mReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
+			time.Sleep(50 * time.Millisecond)
+			continue
+		} else if err != nil {
+			mReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
+			return count, err
 		}
+		msgs = msgs[len(chunk):]
+		count += len(chunk)
 	}
-
-	// single-message delete required
-	// Spin up a separate goroutine - this could take a while
-	go func() {
-		for _, msg := range msgs {
-			err = c.bot.s.ChannelMessageDelete(c.ChannelID, msg)
-			if rErr, ok := err.(*discordgo.RESTError); ok && rErr.Message != nil {
-				mSingleMessageReapErrors.With(prometheus.Labels{"error_code": strconv.Itoa(rErr.Message.Code)}).Inc()
-				fmt.Printf("[ERR ] %s: single-message delete: %v (on %v)\n", c, err, msg)
-			} else if err != nil {
-				mSingleMessageReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
-				fmt.Printf("[ERR ] %s: single-message delete: %v (on %v)\n", c, err, msg)
-			}
-		}
-		// re-load the backlog in case this surfaced more things to delete
-		c.bot.QueueLoadBacklog(c, QOSSingleMessageDelete)
-	}()
-	return -1, nil
+	return count, nil
 }
 
-// returns and removes the messages that need to be deleted right now.
+// returns and removes the messages that need to be deleted right now, split
+// into those that can be bulk deleted and those that are too old for it.
 //
 // also sets the minNextDelete and returns whether we think there could be more
 // messages past the backlog horizon
-func (c *ManagedChannel) collectMessagesToDelete() (m []string, needsQueueBacklog, isDisabled bool) {
+func (c *ManagedChannel) collectMessagesToDelete() (bulk, single []string, needsQueueBacklog, isDisabled bool) {
+	now := c.bot.clock.Now()
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.minNextDelete = time.Now().Add(minTimeBetweenDeletion)
+	c.minNextDelete = now.Add(minTimeBetweenDeletion)
 
 	// Mechanism for getting channels dropped from the reaper
 	if c.killBit {
-		return nil, false, true
+		return nil, nil, false, true
 	}
 
 	var toDelete []string
 	var oldest time.Time
 	var zero time.Time
 
-	nLiveMessages := len(c.liveMessages)
+	nLiveMessages := c.liveMessages.Len()
+
+	// popFront removes the oldest live message, adding it to toDelete unless
+	// it is being kept
+	popFront := func() {
+		id := c.liveMessages.PopFront()
+		msgID := c.liveMessageID(id)
+		c.edits.forget(id)
+		if !c.keepLookup[msgID] {
+			toDelete = append(toDelete, msgID)
+			if oldest == zero {
+				oldest = id.Time()
+			}
+		}
+	}
 
 	if c.MaxMessages > 0 {
-		for len(c.liveMessages) > c.MaxMessages {
-			if !c.keepLookup[c.liveMessages[0].MessageID] {
-				toDelete = append(toDelete, c.liveMessages[0].MessageID)
-				if oldest == zero {
-					oldest = c.liveMessages[0].PostedAt
-				}
-			}
-			c.liveMessages = c.liveMessages[1:]
+		for c.liveMessages.Len() > c.MaxMessages {
+			popFront()
 		}
 	}
 	if c.MessageLiveTime > 0 {
-		cutoff := time.Now().Add(-c.MessageLiveTime)
-		for len(c.liveMessages) > 0 && c.liveMessages[0].PostedAt.Before(cutoff) {
-			if !c.keepLookup[c.liveMessages[0].MessageID] {
-				toDelete = append(toDelete, c.liveMessages[0].MessageID)
-				if oldest == zero {
-					oldest = c.liveMessages[0].PostedAt
-				}
-			}
-			c.liveMessages = c.liveMessages[1:]
+		cutoff := now.Add(-c.MessageLiveTime)
+		for c.liveMessages.Len() > 0 && c.liveMessages.Front().Time().Before(cutoff) {
+			popFront()
 		}
 		// Collect additional messages within 1.5sec of deleted message
 		if oldest != zero {
 			cutoff = oldest.Add(1500 * time.Millisecond)
-			for len(c.liveMessages) > 0 && c.liveMessages[0].PostedAt.Before(cutoff) {
-				if !c.keepLookup[c.liveMessages[0].MessageID] {
-					toDelete = append(toDelete, c.liveMessages[0].MessageID)
-				}
-				c.liveMessages = c.liveMessages[1:]
+			for c.liveMessages.Len() > 0 && c.liveMessages.Front().Time().Before(cutoff) {
+				popFront()
 			}
 		}
 	}
 
-	return toDelete, ((nLiveMessages >= backlogChunkLimit*backlogAutoReloadPreFraction) &&
+	if !c.voiceWipeAt.IsZero() && !now.Before(c.voiceWipeAt) {
+		c.voiceWipeAt = time.Time{}
+		if c.liveMessages.Len() > 0 {
+			mVoiceWipes.Inc()
+		}
+		for c.liveMessages.Len() > 0 {
+			popFront()
+		}
+	}
+
+	for _, id := range toDelete {
+		if needsSingleDelete(id, now) {
+			single = append(single, id)
+		} else {
+			bulk = append(bulk, id)
+		}
+	}
+
+	return bulk, single, ((nLiveMessages >= backlogChunkLimit*backlogAutoReloadPreFraction) &&
 		(len(toDelete) > backlogChunkLimit*backlogAutoReloadDeleteFraction)), false
 }
@@ -0,0 +1,322 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// postAndAdd posts a message at the current fake time and feeds it to the
+// channel as if it arrived over the gateway.
+func postAndAdd(c *ManagedChannel, clock *fakeClock, api *fakeAPI) string {
+	m := api.post(c.ChannelID, clock.Now())
+	c.AddMessage(m)
+	return m.ID
+}
+
+func TestCollectMessagesToDeleteCount(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 3})
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, postAndAdd(c, clock, api))
+		clock.Advance(time.Second)
+	}
+
+	msgs, _, _, disabled := c.collectMessagesToDelete()
+	if disabled {
+		t.Fatal("channel reported as disabled")
+	}
+	if want := ids[:2]; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("collected %v, want %v", msgs, want)
+	}
+	if got, want := liveIDs(c), ids[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+
+	// Nothing more to do until another message arrives.
+	msgs, _, _, _ = c.collectMessagesToDelete()
+	if len(msgs) != 0 {
+		t.Errorf("second collect returned %v, want nothing", msgs)
+	}
+}
+
+func TestCollectMessagesToDeleteSkipsKeep(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 1})
+
+	keep := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	del := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	last := postAndAdd(c, clock, api)
+
+	c.mu.Lock()
+	c.keepLookup[keep] = true
+	c.mu.Unlock()
+
+	msgs, _, _, _ := c.collectMessagesToDelete()
+	if want := []string{del}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("collected %v, want %v", msgs, want)
+	}
+	if got, want := liveIDs(c), []string{last}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestCollectMessagesToDeleteTime(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	old := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	// Within 1.5s of the oldest deleted message: swept up early.
+	nearby := postAndAdd(c, clock, api)
+	clock.Advance(30 * time.Minute)
+	fresh := postAndAdd(c, clock, api)
+
+	if got, want := c.GetNextDeletionTime(), testEpoch.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("GetNextDeletionTime = %v, want %v", got, want)
+	}
+
+	clock.Advance(30*time.Minute - 1500*time.Millisecond)
+	msgs, _, _, _ := c.collectMessagesToDelete()
+	if len(msgs) != 0 {
+		t.Fatalf("collected %v before deadline", msgs)
+	}
+
+	clock.Advance(time.Second)
+	msgs, _, _, _ = c.collectMessagesToDelete()
+	if want := []string{old, nearby}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("collected %v, want %v", msgs, want)
+	}
+	if got, want := liveIDs(c), []string{fresh}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestAddMessageLate(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	// Delivered 50 minutes late, e.g. replayed after a gateway resume. The
+	// lifetime counts from when it was posted.
+	late := api.post(c.ChannelID, clock.Now().Add(-50*time.Minute))
+	fresh := postAndAdd(c, clock, api)
+	c.AddMessage(late)
+
+	if got, want := liveIDs(c), []string{late.ID, fresh}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	if got, want := c.GetNextDeletionTime(), clock.Now().Add(10*time.Minute); !got.Equal(want) {
+		t.Errorf("GetNextDeletionTime = %v, want %v", got, want)
+	}
+}
+
+func TestCollectMessagesToDeleteDisabled(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 1})
+	postAndAdd(c, clock, api)
+	postAndAdd(c, clock, api)
+
+	c.Disable()
+	msgs, _, _, disabled := c.collectMessagesToDelete()
+	if !disabled || msgs != nil {
+		t.Errorf("collect on disabled channel = %v, %v; want nil, true", msgs, disabled)
+	}
+}
+
+func TestGetNextDeletionTime(t *testing.T) {
+	b, clock, api := newTestBot(t)
+
+	t.Run("empty", func(t *testing.T) {
+		c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+		if got, want := c.GetNextDeletionTime(), clock.Now().Add(240*time.Hour); !got.Equal(want) {
+			t.Errorf("GetNextDeletionTime = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 2})
+		postAndAdd(c, clock, api)
+		postAndAdd(c, clock, api)
+		if got, want := c.GetNextDeletionTime(), clock.Now().Add(240*time.Hour); !got.Equal(want) {
+			t.Errorf("under count: GetNextDeletionTime = %v, want %v", got, want)
+		}
+		clock.Advance(time.Minute)
+		postAndAdd(c, clock, api)
+		// Due immediately, but not before minNextDelete.
+		c.mu.Lock()
+		minNext := c.minNextDelete
+		c.mu.Unlock()
+		got := c.GetNextDeletionTime()
+		if got.After(clock.Now()) && !got.Equal(minNext) {
+			t.Errorf("over count: GetNextDeletionTime = %v, want now or minNextDelete", got)
+		}
+	})
+
+	t.Run("minNextDelete", func(t *testing.T) {
+		c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Second})
+		postAndAdd(c, clock, api)
+		clock.Advance(2 * time.Second)
+		c.collectMessagesToDelete()
+		postAndAdd(c, clock, api)
+		// The new message is due in 1s, but a deletion just happened.
+		if got, want := c.GetNextDeletionTime(), clock.Now().Add(minTimeBetweenDeletion); !got.Equal(want) {
+			t.Errorf("GetNextDeletionTime = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("skips keep", func(t *testing.T) {
+		c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+		keep := postAndAdd(c, clock, api)
+		clock.Advance(time.Minute)
+		postAndAdd(c, clock, api)
+		c.mu.Lock()
+		c.keepLookup[keep] = true
+		c.mu.Unlock()
+		if got, want := c.GetNextDeletionTime(), clock.Now().Add(time.Hour); !got.Equal(want) {
+			t.Errorf("GetNextDeletionTime = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestMergeBacklog(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	a := api.post(c.ChannelID, clock.Now())
+	clock.Advance(time.Second)
+	pinned := api.post(c.ChannelID, clock.Now())
+	clock.Advance(time.Second)
+	live := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	d := api.post(c.ChannelID, clock.Now())
+
+	backlog, err := api.ChannelMessages(c.ChannelID, 100, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	c.keepLookup[pinned.ID] = true
+	c.mergeBacklog(backlog)
+	c.mu.Unlock()
+
+	if got, want := liveIDs(c), []string{a.ID, live, d.ID}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestLoadBacklog(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, api.post(testChannelID, clock.Now()).ID)
+		clock.Advance(time.Second)
+	}
+	api.pin(testChannelID, ids[1])
+	ch, _ := api.Channel(testChannelID)
+	ch.LastPinTimestamp = "2022-03-01T12:00:00Z"
+	api.addChannel(ch)
+
+	c, err := InitChannel(b, ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, MaxMessages: 10, KeepMessages: []string{"5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadBacklog(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.isStarted:
+	default:
+		t.Error("isStarted not closed after LoadBacklog")
+	}
+	if got, want := liveIDs(c), []string{ids[0], ids[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	c.mu.Lock()
+	keep := c.keepLookup
+	c.mu.Unlock()
+	if want := map[string]bool{ids[1]: true, "5": true}; !reflect.DeepEqual(keep, want) {
+		t.Errorf("keepLookup = %v, want %v", keep, want)
+	}
+}
+
+func TestUpdatePins(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 10, KeepMessages: []string{"5"}})
+
+	pinned := api.post(c.ChannelID, clock.Now())
+	clock.Advance(time.Second)
+	other := postAndAdd(c, clock, api)
+	api.pin(c.ChannelID, pinned.ID)
+
+	c.UpdatePins("2022-03-01T12:00:00Z")
+	c.mu.Lock()
+	if !c.keepLookup[pinned.ID] || !c.keepLookup["5"] {
+		t.Errorf("after pin: keepLookup = %v, want pin and conf message", c.keepLookup)
+	}
+	c.mu.Unlock()
+
+	// Unpinning makes the message deletable again.
+	api.unpin(c.ChannelID, pinned.ID)
+	c.UpdatePins("")
+	c.mu.Lock()
+	if c.keepLookup[pinned.ID] {
+		t.Errorf("after unpin: keepLookup = %v, still has pin", c.keepLookup)
+	}
+	c.mu.Unlock()
+	// It goes back in post order, not at the end.
+	if got, want := liveIDs(c), []string{pinned.ID, other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestReapBulkDelete(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 1})
+
+	var ids []string
+	for i := 0; i < 120; i++ {
+		ids = append(ids, api.post(c.ChannelID, clock.Now()).ID)
+	}
+	count, err := c.Reap(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(ids) {
+		t.Errorf("Reap count = %d, want %d", count, len(ids))
+	}
+	var sizes []int
+	for _, v := range api.bulkDeletes {
+		sizes = append(sizes, len(v))
+	}
+	if want := []int{50, 50, 20}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("bulk delete sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestReapPermissionError(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 1})
+	ids := []string{api.post(c.ChannelID, clock.Now()).ID, api.post(c.ChannelID, clock.Now()).ID}
+	api.bulkErr = restError(50013) // Missing Permissions
+
+	_, err := c.Reap(ids)
+	if err == nil {
+		t.Fatal("Reap succeeded despite error")
+	}
+	if !b.handleCriticalPermissionsErrors(c.ChannelID, err) {
+		t.Error("missing permissions not treated as critical")
+	}
+	// The configuration is kept for when the permission comes back
+	if !c.IsSuspended() {
+		t.Error("channel not suspended after critical error")
+	}
+	if conf, err := b.storage.GetChannel(c.ChannelID); err != nil || !conf.Suspended {
+		t.Errorf("saved config %+v, %v; want suspended", conf, err)
+	}
+}
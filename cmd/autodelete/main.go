@@ -67,6 +67,10 @@ func main() {
 	go func() {
 		privHttp.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 		privHttp.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}))
+		privHttp.HandleFunc("/healthz", b.HTTPHealthz)
+		privHttp.HandleFunc("/readyz", b.HTTPReadyz)
+		privHttp.HandleFunc("/status", b.HTTPStatus)
+		privHttp.HandleFunc(autodelete.AdminPath, b.HTTPAdmin)
 		metricSvr := &http.Server{
 			Handler: &privHttp,
 			Addr:    fmt.Sprintf("%s:%d", *flagMetricsListen, *flagMetricsPort+*flagShardID),
@@ -80,6 +84,8 @@ func main() {
 		fmt.Printf("url: %s%s\n", conf.HTTP.Public, "/discord_auto_delete/oauth/start")
 		pubHttp.HandleFunc("/discord_auto_delete/oauth/start", b.HTTPOAuthStart)
 		pubHttp.HandleFunc("/discord_auto_delete/oauth/callback", b.HTTPOAuthCallback)
+		pubHttp.HandleFunc(autodelete.APIPath, b.HTTPAPI)
+		pubHttp.HandleFunc(autodelete.DashboardPath, b.HTTPDashboard)
 		pubSrv := &http.Server{
 			Handler: &pubHttp,
 			Addr:    conf.HTTP.Listen,
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,9 +13,21 @@ import (
 )
 
 const textHelp = `Commands:
-  @AutoDelete set [duration: 30m] [count: 10] - starts this channel for message auto-deletion
+  @AutoDelete set [#channels or category IDs] [duration: 30m] [count: 10] - starts this channel, or the given channels, for message auto-deletion
       Duration or message count can be specified as ` + "`-`" + ` to not use that, but at least one must be specified. Use "set 0 0" to disable the bot.
+      Add edits=restart to restart a message's lifetime when it is edited, or edits=keep_attachments to keep messages that are edited to add an attachment.
+      Pinned messages are kept. Add pins=none to delete them too, or pins=3 to keep only the 3 newest pins.
+      Add warn=react or warn=notice to warn 10 minutes before messages are deleted, and warnbefore=30m to change when.
+      Add voice=#channel to delete all messages when the last member leaves that voice channel (voice=here in a voice channel's chat), and voicedelay=5m to wait first.
+  @AutoDelete sticky [count: 10] [duration: 1h] [text] - keeps a notice at the bottom of this channel, reposted after that many messages or that long
+      The text may use {{.Policy}}, {{.LiveTime}} and {{.MaxMessages}}. Use "sticky off" to remove it.
+  @AutoDelete check [full] - shows this channel's settings, and with "full", checks the bot's permissions and recent work
+  @AutoDelete list [page] - lists the channels in this server that are set up for deletion
+  @AutoDelete language [code or auto] - shows or changes the language of the bot's replies in this server
+  @AutoDelete prefix [text or off] - shows or sets a prefix, like !ad, that works instead of mentioning the bot
+  @AutoDelete apitoken [new, list or revoke ID] - manages tokens for the REST API, sent to you in a direct message
   @AutoDelete help - prints this help message
+Commands also work with a mention of the AutoDelete role, and in a direct message "set" works with channel IDs.
 For more help, check <https://github.com/riking/AutoDelete> or join the help server: <https://discord.gg/FUGn8yE>`
 
 const emojiBusy = `🔄`
@@ -33,7 +46,8 @@ func (b *Bot) GetMsgChGuild(m *discordgo.Message) (*discordgo.Channel, *discordg
 }
 
 func CommandHelp(b *Bot, m *discordgo.Message, rest []string) {
-	b.s.ChannelMessageSend(m.ChannelID, textHelp)
+	l := b.localeForChannel(m.ChannelID)
+	b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("help"))
 }
 
 func CommandAdminHelp(b *Bot, m *discordgo.Message, rest []string) {
@@ -66,11 +80,11 @@ func CommandAdminSay(b *Bot, m *discordgo.Message, rest []string) {
 
 	ch, err := b.Channel(channelID)
 	if err != nil {
-		b.s.ChannelMessageSend(m.ChannelID, "channel does not exist")
+		b.api.ChannelMessageSend(m.ChannelID, "channel does not exist")
 		return
 	}
 
-	b.s.ChannelMessageSendComplex(ch.ID, &discordgo.MessageSend{
+	b.api.ChannelMessageSendComplex(ch.ID, &discordgo.MessageSend{
 		Content: "[ADMIN]",
 		Embed: &discordgo.MessageEmbed{
 			Title:       "Message from bot administrator",
@@ -87,17 +101,18 @@ func CommandSetDonor(b *Bot, m *discordgo.Message, rest []string) {
 		channelID = rest[0]
 	}
 
+	l := b.localeForChannel(m.ChannelID)
 	if m.Author.ID != b.Config.AdminUser {
-		b.s.ChannelMessageSend(m.ChannelID, "patron checking not yet implemented")
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("donor.admin_only"))
 		return
 	}
 
 	b.mu.RLock()
-	mCh, ok := b.channels[channelID]
+	mCh := b.channels[channelID]
 	b.mu.RUnlock()
 
-	if !ok {
-		b.s.ChannelMessageSend(m.ChannelID, "not currently deleting in that channel")
+	if mCh == nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("donor.not_loaded"))
 		return
 	}
 
@@ -107,7 +122,7 @@ func CommandSetDonor(b *Bot, m *discordgo.Message, rest []string) {
 
 	b.saveChannelConfig(mCh.Export())
 
-	b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("set %v as a donor channel", channelID))
+	b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("donor.set", channelID))
 	b.QueueLoadBacklog(mCh, QOSInteractive)
 }
 
@@ -115,7 +130,7 @@ func (b *Bot) isDonor(userID string) (bool, error) {
 	if b.Config.DonorGuild == "" {
 		return false, nil
 	}
-	member, err := b.s.GuildMember(b.Config.DonorGuild, userID)
+	member, err := b.api.GuildMember(b.Config.DonorGuild, userID)
 	if err != nil {
 		return false, err
 	}
@@ -129,119 +144,642 @@ func (b *Bot) isDonor(userID string) (bool, error) {
 
 func CommandCheck(b *Bot, m *discordgo.Message, rest []string) {
 	const perm = discordgo.PermissionManageMessages
+	l := b.localeForChannel(m.ChannelID)
 
-	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
 	if err != nil {
-		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
 		return
 	}
 	if apermissions&perm == 0 {
-		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to change AutoDelete settings.")
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.need_manage_messages"))
 		return
 	}
 
 	mCh, err := b.GetChannel(m.ChannelID, QOSInteractive)
 	if err != nil {
-		b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Error checking settings: %v", err))
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("check.error", err.Error()))
 		return
 	}
 
 	if mCh == nil {
-		b.s.ChannelMessageSend(m.ChannelID, "This channel is not set up for deletion.")
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("check.not_set_up"))
 		return
 	}
 
-	duration := mCh.MessageLiveTime
-	count := mCh.MaxMessages
 	keeps := mCh.KeepMessages
+	conf := mCh.Export()
 
 	var msg bytes.Buffer
-	msg.WriteString("Settings: Messages in this channel will ")
-	if duration != 0 && count != 0 {
-		fmt.Fprintf(&msg, "be deleted after %s or %d messages, whichever comes first.", duration, count)
-	} else if duration != 0 {
-		fmt.Fprintf(&msg, "be deleted after %s.", duration)
-	} else if count != 0 {
-		fmt.Fprintf(&msg, "be deleted after %d other messages.", count)
+	if text, off := describeSettings(l, conf); off {
+		msg.WriteString(l.Sprintf("check.bug"))
 	} else {
-		fmt.Fprintf(&msg, "[BUG?] not be auto-deleted (but are still being incorrectly tracked???).")
+		msg.WriteString(l.Sprintf("check.settings", text))
+	}
+	if len(keeps) > 1 && conf.PinPolicy == PinPolicyKeepAll {
+		msg.WriteString(l.Plural("check.pins_known", len(keeps)-1, len(keeps)-1))
+	}
+	if conf.StickyText != "" {
+		msg.WriteString(l.Sprintf("check.sticky"))
+	}
+	if pending, deleted, _ := mCh.SingleDeleteProgress(); pending > 0 {
+		msg.WriteString(l.Sprintf("check.single", pending, deleted))
+	}
+	if active, scanned, deleted := mCh.CrawlProgress(); active {
+		msg.WriteString(l.Sprintf("check.crawl", scanned, deleted))
 	}
 
-	if len(keeps) > 1 {
-		fmt.Fprintf(&msg, " I am aware of %d pinned messages.", len(keeps)-1)
+	findings := mCh.Diagnose(l)
+	if len(rest) > 0 && (rest[0] == "full" || rest[0] == "details") {
+		msg.WriteString("\n\n")
+		msg.WriteString(formatFindings(findings))
+	} else {
+		for _, f := range findings {
+			if !f.ok {
+				msg.WriteString(l.Sprintf("check.needs_check"))
+				break
+			}
+		}
 	}
 
-	b.s.ChannelMessageSend(m.ChannelID, msg.String())
+	b.api.ChannelMessageSend(m.ChannelID, msg.String())
 }
 
-func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
-	var duration time.Duration
-	var count int
-	var anySet bool
+func CommandList(b *Bot, m *discordgo.Message, rest []string) {
+	perm := int64(discordgo.PermissionManageServer)
+	l := b.localeForChannel(m.ChannelID)
 
-	const perm = discordgo.PermissionManageMessages
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
+		return
+	}
+	if apermissions&perm != perm {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("list.need_manage_server"))
+		return
+	}
 
-	channel, err := b.Channel(m.ChannelID)
+	page := 1
+	if len(rest) > 0 {
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n < 1 {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("list.bad_page"))
+			return
+		}
+		page = n
+	}
+
+	ch, guild := b.GetMsgChGuild(m)
+	if guild == nil {
+		return
+	}
+	summaries, err := b.GuildSummaries(ch.GuildID)
 	if err != nil {
-		fmt.Println("[ERR ] Could not load channel of mention")
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("list.error", err.Error()))
+		return
+	}
+	b.api.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Embed: listEmbed(l, guild.Name, summaries, page),
+	})
+}
+
+// CommandLanguage shows or changes the language of the bot's replies in a
+// server.
+func CommandLanguage(b *Bot, m *discordgo.Message, rest []string) {
+	perm := int64(discordgo.PermissionManageServer)
+
+	ch, guild := b.GetMsgChGuild(m)
+	if guild == nil {
+		return
+	}
+	l := b.localeFor(ch.GuildID)
+	available := strings.Join(b.localeCodes(), ", ")
+
+	if len(rest) == 0 {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("language.current", l.Name(), available))
+		return
+	}
+
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
+		return
+	}
+	if apermissions&perm != perm {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.need_manage_server"))
+		return
+	}
+
+	code, reply := "", "language.auto"
+	if rest[0] != "auto" {
+		newLocale := b.findLocale(rest[0])
+		if newLocale == nil {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("language.unknown", rest[0], available))
+			return
+		}
+		code, reply = newLocale.Code, "language.set"
+	}
+	settings := b.guildSettings(ch.GuildID)
+	settings.Locale = code
+	if err := b.saveGuildSettings(ch.GuildID, settings); err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("language.error", err.Error()))
+		return
+	}
+	fmt.Printf("[i18n] guild %s language set to %q\n", ch.GuildID, code)
+	b.audit(AuditEntry{GuildID: ch.GuildID, UserID: m.Author.ID, Action: auditGuild, Detail: describeGuildSettings(settings)})
+	b.api.ChannelMessageSend(m.ChannelID, b.localeFor(ch.GuildID).Sprintf(reply))
+}
+
+// CommandPrefix shows or changes the text prefix for commands in a server.
+func CommandPrefix(b *Bot, m *discordgo.Message, rest []string) {
+	perm := int64(discordgo.PermissionManageServer)
+
+	ch, guild := b.GetMsgChGuild(m)
+	if guild == nil {
 		return
 	}
+	l := b.localeFor(ch.GuildID)
+	settings := b.guildSettings(ch.GuildID)
 
-	apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if len(rest) == 0 {
+		if settings.Prefix == "" {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("prefix.none"))
+		} else {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("prefix.current", settings.Prefix))
+		}
+		return
+	}
+
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
 	if err != nil {
-		b.s.ChannelMessageSend(m.ChannelID, "could not check your permissions: "+err.Error())
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
+		return
+	}
+	if apermissions&perm != perm {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.need_manage_server"))
+		return
+	}
+
+	reply := "prefix.off"
+	settings.Prefix = ""
+	if rest[0] != "off" {
+		if len(rest) > 1 || !validPrefix(rest[0]) {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("prefix.bad", maxPrefixLength))
+			return
+		}
+		settings.Prefix, reply = rest[0], "prefix.set"
+	}
+	if err := b.saveGuildSettings(ch.GuildID, settings); err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("prefix.error", err.Error()))
+		return
+	}
+	fmt.Printf("[ cmd] guild %s prefix set to %q\n", ch.GuildID, settings.Prefix)
+	b.audit(AuditEntry{GuildID: ch.GuildID, UserID: m.Author.ID, Action: auditGuild, Detail: describeGuildSettings(settings)})
+	b.api.ChannelMessageSend(m.ChannelID, l.Sprintf(reply, settings.Prefix))
+}
+
+// CommandAPIToken makes, lists and revokes the server's REST API tokens. New
+// tokens are sent in a direct message, to keep them out of the channel.
+func CommandAPIToken(b *Bot, m *discordgo.Message, rest []string) {
+	perm := int64(discordgo.PermissionManageServer)
+
+	ch, guild := b.GetMsgChGuild(m)
+	if guild == nil {
+		return
+	}
+	l := b.localeFor(ch.GuildID)
+
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
+		return
+	}
+	if apermissions&perm != perm {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.need_manage_server"))
+		return
+	}
+
+	switch {
+	case len(rest) == 1 && rest[0] == "new":
+		secret, token, err := newAPIToken(ch.GuildID, m.Author.ID, b.clock.Now())
+		if err != nil {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.error", err.Error()))
+			return
+		}
+		dm, err := b.api.UserChannelCreate(m.Author.ID)
+		if err == nil {
+			_, err = b.api.ChannelMessageSend(dm.ID, l.Sprintf("apitoken.dm", guild.Name, secret, token.ID))
+		}
+		if err != nil {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.dm_failed"))
+			return
+		}
+		if err := b.storage.SaveAPIToken(token); err != nil {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.error", err.Error()))
+			return
+		}
+		fmt.Printf("[api ] token %s made for guild %s by %s\n", token.ID, ch.GuildID, m.Author.ID)
+		b.audit(AuditEntry{GuildID: ch.GuildID, UserID: m.Author.ID, TokenID: token.ID, Action: auditNewToken})
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.sent", token.ID))
+	case len(rest) == 1 && rest[0] == "list":
+		tokens, err := b.guildAPITokens(ch.GuildID)
+		if err != nil {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.error", err.Error()))
+			return
+		}
+		if len(tokens) == 0 {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.none"))
+			return
+		}
+		var lines []string
+		for _, t := range tokens {
+			lines = append(lines, l.Sprintf("apitoken.list_line", t.ID, t.CreatedBy, t.Created.Unix()))
+		}
+		b.api.ChannelMessageSend(m.ChannelID, strings.Join(lines, "\n"))
+	case len(rest) == 2 && rest[0] == "revoke":
+		tokens, err := b.guildAPITokens(ch.GuildID)
+		if err != nil {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.error", err.Error()))
+			return
+		}
+		for _, t := range tokens {
+			if t.ID == rest[1] {
+				if err := b.storage.DeleteAPIToken(t.ID); err != nil {
+					b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.error", err.Error()))
+					return
+				}
+				fmt.Printf("[api ] token %s of guild %s revoked by %s\n", t.ID, ch.GuildID, m.Author.ID)
+				b.audit(AuditEntry{GuildID: ch.GuildID, UserID: m.Author.ID, TokenID: t.ID, Action: auditRevoke})
+				b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.revoked", t.ID))
+				return
+			}
+		}
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.unknown", rest[1]))
+	default:
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("apitoken.usage"))
+	}
+}
+
+func CommandSticky(b *Bot, m *discordgo.Message, rest []string) {
+	const perm = discordgo.PermissionManageMessages
+	l := b.localeForChannel(m.ChannelID)
+
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
 		return
 	}
 	if apermissions&perm == 0 {
-		b.s.ChannelMessageSend(m.ChannelID, "You must have the Manage Messages permission to change AutoDelete settings.")
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.need_manage_messages"))
 		return
 	}
 
+	b.mu.RLock()
+	mCh := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("check.not_set_up"))
+		return
+	}
+
+	if len(rest) == 1 && strings.ToLower(rest[0]) == "off" {
+		old := mCh.SetSticky("", 0, 0)
+		b.saveChannelConfig(mCh.Export())
+		if old != "" {
+			b.api.ChannelMessageDelete(m.ChannelID, old)
+		}
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("sticky.off"))
+		return
+	}
+
+	var every int
+	var interval time.Duration
+	for len(rest) > 0 {
+		if d, err := time.ParseDuration(rest[0]); err == nil && d > 0 {
+			interval = d
+		} else if n, err := strconv.Atoi(rest[0]); err == nil && n > 0 {
+			every = n
+		} else {
+			break
+		}
+		rest = rest[1:]
+	}
+	if every == 0 && interval == 0 {
+		every = defaultStickyEvery
+	}
+	text := strings.Join(rest, " ")
+	if text == "" {
+		text = DefaultStickyText
+	}
+	if _, err := mCh.RenderSticky(text); err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("sticky.bad_text", err.Error()))
+		return
+	}
+
+	mCh.SetSticky(text, every, interval)
+	if err := b.saveChannelConfig(mCh.Export()); err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("set.maybe_saved", err.Error()))
+	}
+	b.QueueSticky(mCh)
+	b.api.MessageReactionAdd(m.ChannelID, m.ID, emojiDone)
+}
+
+func editPolicyText(l *Locale, p EditPolicy) string {
+	switch p {
+	case EditPolicyRestart:
+		return l.Sprintf("policy.edits_restart")
+	case EditPolicyKeepAttachments:
+		return l.Sprintf("policy.edits_keep_attachments")
+	}
+	return ""
+}
+
+func pinPolicyText(l *Locale, p PinPolicy, n int) string {
+	switch p {
+	case PinPolicyNone:
+		return l.Sprintf("policy.pins_none")
+	case PinPolicyNewest:
+		return l.Plural("policy.pins_keep", n, n)
+	}
+	return ""
+}
+
+func warnModeText(l *Locale, w WarnMode, before, liveTime time.Duration) string {
+	if before == 0 {
+		before = defaultWarnBefore
+	}
+	switch {
+	case w == WarnModeOff:
+		return ""
+	case liveTime == 0:
+		return l.Sprintf("policy.warn_count_only")
+	case w == WarnModeReact:
+		return l.Sprintf("policy.warn_react", warnEmoji, before)
+	}
+	return l.Sprintf("policy.warn_notice", before)
+}
+
+// setOptions holds the options given to the set command. Options that were
+// not given keep each channel's current value.
+type setOptions struct {
+	duration       time.Duration
+	count          int
+	editPolicy     EditPolicy
+	pinPolicy      PinPolicy
+	pinKeepCount   int
+	warnMode       WarnMode
+	warnBefore     time.Duration
+	voiceChannelID string
+	voiceHere      bool
+	voiceWipeDelay time.Duration
+
+	editPolicySet, pinPolicySet, warnModeSet, warnBeforeSet bool
+	voiceSet, voiceDelaySet                                 bool
+}
+
+// parseChannelTarget recognizes a channel mention or a channel or category ID
+// given to the set command. IDs are told apart from message counts by length.
+func parseChannelTarget(s string) (string, bool) {
+	if !strings.HasPrefix(s, "<#") && len(s) < 17 {
+		return "", false
+	}
+	return parseChannelMention(s)
+}
+
+// parseSetArgs parses the arguments of the set command, returning the
+// channels to configure separately. On a format error, errKey is the message
+// key of the reply.
+func parseSetArgs(rest []string) (o setOptions, targets []string, errKey string) {
+	var anySet bool
 	for _, v := range rest {
+		if id, ok := parseChannelTarget(v); ok {
+			targets = append(targets, id)
+			continue
+		}
+		if strings.HasPrefix(v, "edits=") {
+			p, err := ParseEditPolicy(strings.TrimPrefix(v, "edits="))
+			if err != nil {
+				return o, nil, "set.bad_edits"
+			}
+			o.editPolicy = p
+			o.editPolicySet = true
+			continue
+		}
+		if strings.HasPrefix(v, "warn=") {
+			w, err := ParseWarnMode(strings.TrimPrefix(v, "warn="))
+			if err != nil {
+				return o, nil, "set.bad_warn"
+			}
+			o.warnMode = w
+			o.warnModeSet = true
+			continue
+		}
+		if strings.HasPrefix(v, "warnbefore=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(v, "warnbefore="))
+			if err != nil || d <= 0 {
+				return o, nil, "set.bad_warnbefore"
+			}
+			o.warnBefore = d
+			o.warnBeforeSet = true
+			continue
+		}
+		if strings.HasPrefix(v, "voice=") {
+			arg := strings.TrimPrefix(v, "voice=")
+			switch arg {
+			case "off":
+				o.voiceChannelID = ""
+			case "here":
+				o.voiceHere = true
+			default:
+				id, ok := parseChannelMention(arg)
+				if !ok {
+					return o, nil, "set.bad_voice"
+				}
+				o.voiceChannelID = id
+			}
+			o.voiceSet = true
+			// A link alone is enough to manage the channel
+			anySet = anySet || o.voiceHere || o.voiceChannelID != ""
+			continue
+		}
+		if strings.HasPrefix(v, "voicedelay=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(v, "voicedelay="))
+			if err != nil || d < 0 {
+				return o, nil, "set.bad_voicedelay"
+			}
+			o.voiceWipeDelay = d
+			o.voiceDelaySet = true
+			continue
+		}
+		if strings.HasPrefix(v, "pins=") {
+			p, n, err := ParsePinPolicy(strings.TrimPrefix(v, "pins="))
+			if err != nil {
+				return o, nil, "set.bad_pins"
+			}
+			o.pinPolicy, o.pinKeepCount = p, n
+			o.pinPolicySet = true
+			continue
+		}
 		d, err := time.ParseDuration(v)
 		if err == nil {
-			duration = d
+			o.duration = d
 			anySet = true
 			continue
 		}
 		n, err := strconv.ParseInt(v, 10, 64)
 		if err == nil {
-			count = int(n)
+			o.count = int(n)
 			anySet = true
 			continue
 		}
 	}
 	if !anySet {
-		b.s.ChannelMessageSend(m.ChannelID, "Bad format for `set` command. Provide a count (20) and/or a duration (90m) to purge messages after. Maximum unit is hours.")
-		return
+		return o, nil, "set.bad_format"
 	}
-	if duration < 0 || count < 0 {
-		b.s.ChannelMessageSend(m.ChannelID, "Count and/or duration cannot be negative.")
-		return
+	if o.duration < 0 || o.count < 0 {
+		return o, nil, "set.negative"
+	}
+	return o, targets, ""
+}
+
+// apply merges the options into a channel's configuration.
+func (o setOptions) apply(conf *ManagedChannelMarshal) {
+	conf.LiveTime = o.duration
+	conf.MaxMessages = o.count
+	if o.editPolicySet {
+		conf.EditPolicy = o.editPolicy
 	}
+	if o.pinPolicySet {
+		conf.PinPolicy, conf.PinKeepCount = o.pinPolicy, o.pinKeepCount
+	}
+	if o.warnModeSet {
+		conf.WarnMode = o.warnMode
+	}
+	if o.warnBeforeSet {
+		conf.WarnBefore = o.warnBefore
+	}
+	if o.voiceSet {
+		conf.VoiceChannelID = o.voiceChannelID
+		if o.voiceHere {
+			conf.VoiceChannelID = conf.ID
+		}
+	}
+	if o.voiceDelaySet {
+		conf.VoiceWipeDelay = o.voiceWipeDelay
+	}
+}
+
+// checkVoiceLink returns the message key of the reason the channel's voice
+// link is not usable, or the empty string.
+func (b *Bot) checkVoiceLink(conf ManagedChannelMarshal) string {
+	if conf.VoiceChannelID == "" {
+		return ""
+	}
+	voiceCh, err := b.Channel(conf.VoiceChannelID)
+	if err != nil || voiceCh.GuildID != conf.GuildID || voiceCh.Type != discordgo.ChannelTypeGuildVoice {
+		return "set.not_voice"
+	}
+	return ""
+}
 
-	var confMessage *discordgo.Message
-	doNotReload := false
+// describeSettings is the set command's confirmation for a configuration. off
+// is true if the configuration turns deletion off.
+func describeSettings(l *Locale, conf ManagedChannelMarshal) (text string, off bool) {
+	policyText := editPolicyText(l, conf.EditPolicy) + pinPolicyText(l, conf.PinPolicy, conf.PinKeepCount) +
+		warnModeText(l, conf.WarnMode, conf.WarnBefore, conf.LiveTime) +
+		voiceLinkText(l, conf.VoiceChannelID, conf.VoiceWipeDelay)
+	duration, count := conf.LiveTime, conf.MaxMessages
 
 	if duration != 0 && count != 0 {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will be deleted after %s or %d messages, whichever comes first.", duration, count))
+		return l.Plural("settings.both", count, duration, count) + policyText, false
 	} else if duration != 0 {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will be deleted after %s.", duration))
-
+		return l.Sprintf("settings.duration", duration) + policyText, false
 	} else if count != 0 {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will be deleted after %d other messages.", count))
-	} else {
-		confMessage, err = b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Messages in this channel will not be auto-deleted."))
-		doNotReload = true
+		return l.Plural("settings.count", count, count) + policyText, false
+	} else if conf.VoiceChannelID != "" {
+		return l.Sprintf("settings.voice_only") + policyText, false
+	}
+	return l.Sprintf("settings.off"), true
+}
+
+// channelConfigFor returns the configuration to change for a channel: the
+// current one if the channel is managed, or a new one. existing is the loaded
+// ManagedChannel, if any.
+func (b *Bot) channelConfigFor(channel *discordgo.Channel) (conf ManagedChannelMarshal, existing *ManagedChannel) {
+	b.mu.RLock()
+	mCh := b.channels[channel.ID]
+	b.mu.RUnlock()
+	if mCh != nil {
+		return mCh.Export(), mCh
+	}
+	// Configured, but not loaded yet
+	if conf, err := b.storage.GetChannel(channel.ID); err == nil {
+		conf.ID = channel.ID
+		return conf, nil
 	}
+	return ManagedChannelMarshal{
+		ID:      channel.ID,
+		GuildID: channel.GuildID,
+		HasPins: channel.LastPinTimestamp != "",
+	}, nil
+}
+
+func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
+	const perm = discordgo.PermissionManageMessages
+
+	channel, err := b.Channel(m.ChannelID)
+	if err != nil {
+		fmt.Println("[ERR ] Could not load channel of mention")
+		return
+	}
+
+	l := b.localeFor(channel.GuildID)
+
+	opts, targets, errKey := parseSetArgs(rest)
+	if channel.GuildID == "" && len(targets) == 0 {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("dm.need_target"))
+		return
+	}
+	if len(targets) > 0 {
+		if errKey != "" {
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf(errKey))
+			return
+		}
+		b.modifyChannels(m, channel.GuildID, opts, targets)
+		return
+	}
+
+	apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.check_failed", err.Error()))
+		return
+	}
+	if apermissions&perm == 0 {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("perm.need_manage_messages"))
+		return
+	}
+	if errKey != "" {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf(errKey))
+		return
+	}
+
+	newManagedChannel, mCh := b.channelConfigFor(channel)
+	opts.apply(&newManagedChannel)
+	if reason := b.checkVoiceLink(newManagedChannel); reason != "" {
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf(reason))
+		return
+	}
+	text, doNotReload := describeSettings(l, newManagedChannel)
+	count := newManagedChannel.MaxMessages
 
+	confMessage, err := b.api.ChannelMessageSend(m.ChannelID, text)
 	if err != nil {
 		fmt.Println("Error sending config message:", err)
-		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings were not changed.\n"+err.Error())
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("set.not_changed", err.Error()))
 		return
 	}
 
-	emojiErr := b.s.MessageReactionAdd(m.ChannelID, confMessage.ID, emojiBusy)
+	emojiErr := b.api.MessageReactionAdd(m.ChannelID, confMessage.ID, emojiBusy)
 	if emojiErr != nil {
 		fmt.Println("[Warn]", "could not react to config reply", emojiErr)
 	}
@@ -251,24 +789,9 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 		fmt.Println("[Warn]", "could not check donor status", err)
 	}
 
-	b.mu.RLock()
-	mCh := b.channels[m.ChannelID]
-	b.mu.RUnlock()
-
-	var newManagedChannel = ManagedChannelMarshal{
-		ID:           m.ChannelID,
-		GuildID:      channel.GuildID,
-		KeepMessages: []string{confMessage.ID},
-		LiveTime:     duration,
-		MaxMessages:  count,
-		HasPins:      channel.LastPinTimestamp != "",
-		IsDonor:      isDonor,
-	}
-
-	if mCh != nil {
-		newManagedChannel = mCh.Export()
-		newManagedChannel.LiveTime = duration
-		newManagedChannel.MaxMessages = count
+	if mCh == nil {
+		newManagedChannel.KeepMessages = []string{confMessage.ID}
+		newManagedChannel.IsDonor = isDonor
 	}
 
 	if doNotReload {
@@ -282,7 +805,15 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 
 	if err != nil {
 		fmt.Println("Error:", err)
-		b.s.ChannelMessageSend(m.ChannelID, "Encountered error, settings may or may not have saved.\n"+err.Error())
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("set.maybe_saved", err.Error()))
+	} else {
+		entry := AuditEntry{GuildID: channel.GuildID, ChannelID: m.ChannelID, UserID: m.Author.ID, Action: auditSet}
+		if doNotReload {
+			entry.Action = auditOff
+		} else {
+			entry.Detail = shortSettings(localeEnglish, newManagedChannel)
+		}
+		b.audit(entry)
 	}
 	fmt.Println("[load] Changed settings for channel", m.ChannelID, confMessage.Content)
 
@@ -292,48 +823,208 @@ func CommandModify(b *Bot, m *discordgo.Message, rest []string) {
 		}
 	}
 
-	// Wait for LoadBacklog() to complete by watching isStarted
+	limit := backlogLimit(isDonor)
 	go func() {
 		channelID := m.ChannelID
 		msgID := confMessage.ID
-		numMessages := 0
 
-		b.mu.RLock()
-		mCh := b.channels[channelID]
-		b.mu.RUnlock()
-		if mCh != nil {
-			select {
-			case <-mCh.isStarted:
-			case <-time.After(30 * time.Minute):
+		b.warnBacklog(l, channelID, count, limit)
+
+		// Give done reaction
+		b.api.MessageReactionRemove(channelID, msgID, emojiBusy, "@me")
+		emojiErr = b.api.MessageReactionAdd(channelID, msgID, emojiDone)
+		time.Sleep(30 * time.Second)
+		b.api.MessageReactionRemove(channelID, msgID, emojiDone, "@me")
+	}()
+}
+
+// warnBacklog tells a channel if it has more messages to delete than the bot
+// tracks at once. Unless the configured count is already too high, it waits
+// for LoadBacklog() to complete by watching isStarted.
+func (b *Bot) warnBacklog(l *Locale, channelID string, count, limit int) {
+	if count > limit {
+		b.api.ChannelMessageSend(channelID, l.Sprintf("backlog.configured_over", limit, count))
+		return
+	}
+
+	b.mu.RLock()
+	mCh := b.channels[channelID]
+	b.mu.RUnlock()
+	if mCh == nil {
+		return
+	}
+	select {
+	case <-mCh.isStarted:
+	case <-time.After(30 * time.Minute):
+	}
+	mCh.mu.Lock()
+	numMessages := mCh.liveMessages.Len()
+	mCh.mu.Unlock()
+	if numMessages >= limit {
+		b.api.ChannelMessageSend(channelID, l.Sprintf("backlog.channel_over", limit, numMessages))
+	}
+}
+
+// expandTargets resolves the channels and categories given to the set command
+// into the channels to configure. Categories stand for the text channels in
+// them. An empty guildID, for a direct message, accepts channels in any guild.
+func (b *Bot) expandTargets(guildID string, targets []string) (channels []*discordgo.Channel, notFound []string) {
+	seen := make(map[string]bool)
+	add := func(ch *discordgo.Channel) {
+		if !seen[ch.ID] {
+			seen[ch.ID] = true
+			channels = append(channels, ch)
+		}
+	}
+	for _, id := range targets {
+		ch, err := b.Channel(id)
+		if err != nil || ch.GuildID == "" || (guildID != "" && ch.GuildID != guildID) {
+			notFound = append(notFound, id)
+			continue
+		}
+		if ch.Type != discordgo.ChannelTypeGuildCategory {
+			add(ch)
+			continue
+		}
+		guild, err := b.s.State.Guild(ch.GuildID)
+		if err != nil {
+			notFound = append(notFound, id)
+			continue
+		}
+		var children []*discordgo.Channel
+		b.s.State.RLock()
+		for _, child := range guild.Channels {
+			if child.ParentID == ch.ID && (child.Type == discordgo.ChannelTypeGuildText || child.Type == discordgo.ChannelTypeGuildNews) {
+				children = append(children, child)
 			}
-			// Check for backlog length exceeded
-			mCh.mu.Lock()
-			numMessages = len(mCh.liveMessages)
-			mCh.mu.Unlock()
 		}
-
-		// Check for backlog length exceeded
-		limit := backlogLimitNonDonor
-		if isDonor {
-			limit = backlogLimitDonor
+		b.s.State.RUnlock()
+		sort.Slice(children, func(i, j int) bool { return children[i].Position < children[j].Position })
+		for _, child := range children {
+			add(child)
 		}
+	}
+	return channels, notFound
+}
+
+// modifyOneChannel applies the set command's options to one of several
+// target channels, and returns the line for the result table.
+func (b *Bot) modifyOneChannel(l *Locale, userID string, isDonor bool, channel *discordgo.Channel, opts setOptions) string {
+	const perm = discordgo.PermissionManageMessages
+
+	apermissions, err := b.api.UserChannelPermissions(userID, channel.ID)
+	if err != nil {
+		return l.Sprintf("multi.check_failed", channel.ID, err.Error())
+	}
+	if apermissions&perm == 0 {
+		return l.Sprintf("multi.no_permission", channel.ID)
+	}
 
-		if count > limit {
-			b.s.ChannelMessageSend(channelID, fmt.Sprintf("⚠️ The number of messages configured for deletion is over %d. Messages will not be reliably deleted. (Configured: %d)", limit, count))
-		} else if numMessages >= limit {
-			b.s.ChannelMessageSend(channelID, fmt.Sprintf("⚠️ The number of messages in this channel is over %d. Messages may not be reliably deleted. (Saw: %d)", limit, numMessages))
+	conf, rejectKey, err := b.applyChannelSettings(channel, opts, isDonor, AuditEntry{UserID: userID})
+	if rejectKey != "" {
+		return l.Sprintf("multi.rejected", channel.ID, l.Sprintf(rejectKey))
+	}
+	if err != nil {
+		fmt.Printf("[load] Error changing settings for channel %s: %v\n", channel.ID, err)
+		return l.Sprintf("multi.maybe_saved", channel.ID, err.Error())
+	}
+	fmt.Printf("[load] Changed settings for channel %s: %s\n", channel.ID, shortSettings(localeEnglish, conf))
+	if _, off := describeSettings(localeEnglish, conf); !off {
+		go b.warnBacklog(l, channel.ID, conf.MaxMessages, backlogLimit(conf.IsDonor))
+	}
+	return l.Sprintf("multi.ok", channel.ID, shortSettings(l, conf))
+}
+
+// applyChannelSettings changes a channel's configuration, turning deletion off
+// if the options leave nothing to delete by. rejectKey is the message key of
+// the reason the options cannot be used. A channel that was not set up yet is
+// a donor channel if isDonor. The change is recorded in the audit log with the
+// UserID or TokenID of who.
+func (b *Bot) applyChannelSettings(channel *discordgo.Channel, opts setOptions, isDonor bool, who AuditEntry) (conf ManagedChannelMarshal, rejectKey string, err error) {
+	conf, mCh := b.channelConfigFor(channel)
+	opts.apply(&conf)
+	if mCh == nil && isDonor {
+		conf.IsDonor = true
+	}
+	if reason := b.checkVoiceLink(conf); reason != "" {
+		return conf, reason, nil
+	}
+
+	who.GuildID, who.ChannelID = channel.GuildID, channel.ID
+	if _, off := describeSettings(localeEnglish, conf); off {
+		err = b.deleteChannelConfig(channel.ID)
+		if os.IsNotExist(err) {
+			err = nil
 		}
+		if mCh != nil {
+			mCh.Disable()
+		}
+		who.Action = auditOff
+	} else {
+		err = b.setChannelConfig(conf)
+		who.Action, who.Detail = auditSet, shortSettings(localeEnglish, conf)
+	}
+	if err == nil {
+		b.audit(who)
+	}
+	return conf, "", err
+}
 
-		// Give done reaction
-		b.s.MessageReactionRemove(channelID, msgID, emojiBusy, "@me")
-		emojiErr = b.s.MessageReactionAdd(channelID, msgID, emojiDone)
-		time.Sleep(30 * time.Second)
-		b.s.MessageReactionRemove(channelID, msgID, emojiDone, "@me")
-	}()
+// shortSettings summarizes a configuration for the result table.
+func shortSettings(l *Locale, conf ManagedChannelMarshal) string {
+	var parts []string
+	if conf.LiveTime != 0 {
+		parts = append(parts, conf.LiveTime.String())
+	}
+	if conf.MaxMessages != 0 {
+		parts = append(parts, l.Plural("short.count", conf.MaxMessages, conf.MaxMessages))
+	}
+	if conf.VoiceChannelID != "" {
+		parts = append(parts, l.Sprintf("short.voice", conf.VoiceChannelID))
+	}
+	if len(parts) == 0 {
+		return l.Sprintf("short.off")
+	}
+	return l.Sprintf("short.after", strings.Join(parts, l.Sprintf("short.or")))
+}
+
+// modifyChannels runs the set command on the given channels and categories,
+// and replies with a line for each channel.
+func (b *Bot) modifyChannels(m *discordgo.Message, guildID string, opts setOptions, targets []string) {
+	l := b.localeFor(guildID)
+	channels, notFound := b.expandTargets(guildID, targets)
+	isDonor, err := b.isDonor(m.Author.ID)
+	if err != nil {
+		fmt.Println("[Warn]", "could not check donor status", err)
+	}
+
+	var lines []string
+	for _, id := range notFound {
+		lines = append(lines, l.Sprintf("multi.not_found", id))
+	}
+	for _, ch := range channels {
+		lines = append(lines, b.modifyOneChannel(l, m.Author.ID, isDonor, ch, opts))
+	}
+	if len(channels) == 0 && len(notFound) == 0 {
+		lines = append(lines, l.Sprintf("multi.empty_category"))
+	}
+
+	// Stay under the message length limit
+	var msg bytes.Buffer
+	for _, line := range lines {
+		if msg.Len()+len(line)+1 > 2000 {
+			b.api.ChannelMessageSend(m.ChannelID, msg.String())
+			msg.Reset()
+		}
+		msg.WriteString(line)
+		msg.WriteByte('\n')
+	}
+	b.api.ChannelMessageSend(m.ChannelID, msg.String())
 }
 
 func CommandLeave(b *Bot, m *discordgo.Message, rest []string) {
 	var guildID string
+	l := b.localeForChannel(m.ChannelID)
 
 	if len(rest) == 0 {
 		channel, err := b.Channel(m.ChannelID)
@@ -342,58 +1033,61 @@ func CommandLeave(b *Bot, m *discordgo.Message, rest []string) {
 			return
 		}
 		guildID = channel.GuildID
-		apermissions, err := b.s.UserChannelPermissions(m.Author.ID, m.ChannelID)
+		apermissions, err := b.api.UserChannelPermissions(m.Author.ID, m.ChannelID)
 		if err != nil {
 			apermissions = 0
 		}
 		perm := int64(discordgo.PermissionManageServer)
 		if apermissions&perm != perm {
-			b.s.ChannelMessageSend(m.ChannelID, "Leaving the current server requires MANAGE_SERVER permission.")
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.need_manage_server"))
 			return
 		}
 	} else if rest[0] == "channel" && len(rest) == 2 {
 		if m.Author.ID != b.Config.AdminUser {
-			b.s.ChannelMessageSend(m.ChannelID, "Leaving other servers can only be done by the bot controller.")
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.admin_only"))
 			return
 		}
 		channel, err := b.Channel(rest[1])
 		if err != nil {
-			b.s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Could not find channel %q", rest[0]))
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.no_channel", rest[1]))
 			return
 		}
 		guildID = channel.GuildID
 	} else {
 		if m.Author.ID != b.Config.AdminUser {
-			b.s.ChannelMessageSend(m.ChannelID, "Leaving other servers can only be done by the bot controller.")
+			b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.admin_only"))
 			return
 		}
 		guildID = rest[0]
 	}
 
 	if guildID == b.Config.DonorGuild {
-		b.s.ChannelMessageSend(m.ChannelID, "Bot will never voluntarily leave the primary guild")
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.donor_guild"))
 		return
 	}
 
 	fmt.Println("[leav]", guildID, m.Author.String())
-	err := b.s.GuildLeave(guildID)
+	err := b.api.GuildLeave(guildID)
 	if err != nil {
-		msg := fmt.Sprintf("Error leaving guild ID %s: %v", guildID, err)
-		b.s.ChannelMessageSend(m.ChannelID, msg)
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.error", guildID, err.Error()))
 		fmt.Println("[cmdE] error leaving:", err)
 	} else {
-		msg := fmt.Sprintf("Leaving guild ID %s: ok", guildID)
-		b.s.ChannelMessageSend(m.ChannelID, msg)
+		b.api.ChannelMessageSend(m.ChannelID, l.Sprintf("leave.ok", guildID))
 	}
 }
 
 var commands = map[string]func(b *Bot, m *discordgo.Message, rest []string){
-	"help":  CommandHelp,
-	"set":   CommandModify,
-	"start": CommandModify,
-	"setup": CommandModify,
-	"leave": CommandLeave,
-	"check": CommandCheck,
+	"help":     CommandHelp,
+	"set":      CommandModify,
+	"sticky":   CommandSticky,
+	"start":    CommandModify,
+	"setup":    CommandModify,
+	"leave":    CommandLeave,
+	"check":    CommandCheck,
+	"list":     CommandList,
+	"language": CommandLanguage,
+	"prefix":   CommandPrefix,
+	"apitoken": CommandAPIToken,
 
 	"ahelp":     CommandAdminHelp,
 	"adminhelp": CommandAdminHelp,
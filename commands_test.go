@@ -0,0 +1,129 @@
+package autodelete
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseSetArgs(t *testing.T) {
+	o, targets, errMsg := parseSetArgs([]string{"<#301>", "400000000000000001", "24h", "10", "edits=restart"})
+	if errMsg != "" {
+		t.Fatal(errMsg)
+	}
+	if want := []string{"301", "400000000000000001"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("targets = %v, want %v", targets, want)
+	}
+	if o.duration != 24*time.Hour || o.count != 10 || !o.editPolicySet || o.editPolicy != EditPolicyRestart {
+		t.Errorf("options = %+v", o)
+	}
+
+	if _, targets, errMsg := parseSetArgs([]string{"<#301>"}); errMsg == "" {
+		t.Errorf("targets %v without settings accepted", targets)
+	}
+	if o, _, errMsg := parseSetArgs([]string{"voice=here"}); errMsg != "" || !o.voiceHere {
+		t.Errorf("voice=here: %+v, %q", o, errMsg)
+	}
+}
+
+func TestSetMultipleChannels(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	const categoryID = "400000000000000001"
+	for _, ch := range []*discordgo.Channel{
+		{ID: "301", GuildID: testGuildID, Name: "a"},
+		{ID: "302", GuildID: testGuildID, Name: "b", ParentID: categoryID, Position: 2},
+		{ID: "303", GuildID: testGuildID, Name: "c", ParentID: categoryID, Position: 1},
+		{ID: "304", GuildID: testGuildID, Name: "locked"},
+		{ID: "305", GuildID: "201", Name: "elsewhere"},
+		{ID: categoryID, GuildID: testGuildID, Name: "cat", Type: discordgo.ChannelTypeGuildCategory},
+	} {
+		api.addChannel(ch)
+		if ch.GuildID == testGuildID {
+			if err := b.s.State.ChannelAdd(ch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	api.channelPerms = map[string]int64{"304": discordgo.PermissionReadMessages}
+	if err := b.saveChannelConfig(ManagedChannelMarshal{ID: "301", GuildID: testGuildID, MaxMessages: 5, EditPolicy: EditPolicyRestart}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &discordgo.Message{
+		ID:        "900",
+		ChannelID: testChannelID,
+		Author:    &discordgo.User{ID: "1001"},
+		Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+	}
+	CommandModify(b, m, strings.Fields("<#301> "+categoryID+" <#304> <#305> 24h"))
+
+	sent := sentMessages(api)
+	if len(sent) != 1 {
+		t.Fatalf("sent %q, want one result table", sent)
+	}
+	lines := strings.Split(strings.TrimSpace(sent[0]), "\n")
+	want := []string{"❌ 305", "✅ <#301>", "✅ <#303>", "✅ <#302>", "❌ <#304>"}
+	if len(lines) != len(want) {
+		t.Fatalf("result table %q, want %d lines", sent[0], len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("line %d = %q, want %q...", i, lines[i], want[i])
+		}
+	}
+
+	for _, id := range []string{"301", "302", "303"} {
+		conf, err := b.storage.GetChannel(id)
+		if err != nil || conf.LiveTime != 24*time.Hour || conf.MaxMessages != 0 {
+			t.Errorf("channel %s: saved %+v, %v", id, conf, err)
+		}
+	}
+	if conf, _ := b.storage.GetChannel("301"); conf.EditPolicy != EditPolicyRestart {
+		t.Errorf("channel 301 lost its edit policy: %+v", conf)
+	}
+	if _, err := b.storage.GetChannel("304"); err == nil {
+		t.Error("channel 304 configured without permission")
+	}
+}
+
+func TestSetMultipleChannelsDonor(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	b.Config.DonorGuild = "999"
+	b.donorRoles = map[string]bool{"77": true}
+	api.memberRoles = []string{"77"}
+	for _, id := range []string{"301", "302"} {
+		ch := &discordgo.Channel{ID: id, GuildID: testGuildID, Name: "c" + id}
+		api.addChannel(ch)
+		if err := b.s.State.ChannelAdd(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &discordgo.Message{
+		ID:        "900",
+		ChannelID: testChannelID,
+		Author:    &discordgo.User{ID: "1001"},
+		Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+	}
+	CommandModify(b, m, strings.Fields("<#301> <#302> 1500"))
+
+	for _, id := range []string{"301", "302"} {
+		if conf, err := b.storage.GetChannel(id); err != nil || !conf.IsDonor {
+			t.Errorf("channel %s: saved %+v, %v", id, conf, err)
+		}
+		id := id
+		waitFor(t, "backlog warning in "+id, func() bool {
+			api.mu.Lock()
+			defer api.mu.Unlock()
+			for _, msg := range api.messages[id] {
+				if strings.Contains(msg.Content, "1000") {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
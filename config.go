@@ -1,7 +1,9 @@
 package autodelete
 
 import (
+	"crypto/rand"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"sync"
@@ -16,31 +18,113 @@ type Bot struct {
 	storage    Storage
 	donorRoles map[string]bool
 
-	s  *discordgo.Session
-	me *discordgo.User
+	// s is used for the gateway connection, the state cache and the
+	// ratelimiter. REST calls go through api, which is usually the same
+	// Session.
+	s     *discordgo.Session
+	api   DiscordAPI
+	clock Clock
+	me    *discordgo.User
+	// transport overrides the HTTP transport used by ConnectDiscord.
+	transport http.RoundTripper
 
 	mu       sync.RWMutex
 	channels map[string]*ManagedChannel
+	// Set when LoadChannelConfigs has finished, protected by mu.
+	configsLoaded bool
 
 	// The reapQueue for deleting messages.
 	reaper *reapQueue
 	// The reapQueue for channels that encountered a rate-limit error when we
 	// tried to load them.
 	loadRetries *reapQueue
+	// The reapQueue for messages too old to be bulk deleted.
+	singleDeleter *reapQueue
+	// The reapQueue for crawling history past the backlog limit.
+	crawler *reapQueue
+	// The reapQueue for reposting sticky messages.
+	stickies *reapQueue
+
+	// Ratelimit buckets the bot has made requests on, see noteBucket.
+	bucketsMu sync.Mutex
+	buckets   map[string]*discordgo.Bucket
+
+	// Message catalogs by language code.
+	locales map[string]*Locale
+	// Cache of storage.GetGuildSettings, protected by mu.
+	guilds map[string]GuildSettings
+	// Guilds waiting for a permission recheck, protected by mu. See
+	// scheduleGuildRecheck.
+	pendingRechecks map[string]bool
+
+	// Signs OAuth state, see oauth.go.
+	stateKey []byte
+	// Dashboard logins by session cookie.
+	sessionMu sync.Mutex
+	sessions  map[string]*dashboardSession
 }
 
 func New(c Config) *Bot {
-	b := &Bot{
-		Config:      c,
-		storage:     &DiskStorage{},
-		donorRoles:  makeSet(c.DonorRoleIDs),
-		channels:    make(map[string]*ManagedChannel),
-		reaper:      newReapQueue(4, queueReap),
-		loadRetries: newReapQueue(12, queueLoad),
-	}
-	prometheus.MustRegister(reapqCollector{[]*reapQueue{b.reaper, b.loadRetries}})
+	b := newBot(c, realClock{})
+	dir := c.LocaleDir
+	if dir == "" {
+		dir = defaultLocaleDir
+	}
+	locales, err := loadLocales(dir)
+	if err != nil {
+		fmt.Printf("[i18n] could not load translations from %s: %v\n", dir, err)
+	}
+	b.locales = locales
+	prometheus.MustRegister(reapqCollector{b.queues()})
+	b.startQueues()
+	return b
+}
+
+// queues lists the Bot's work queues.
+func (b *Bot) queues() []*reapQueue {
+	return []*reapQueue{b.reaper, b.loadRetries, b.singleDeleter, b.crawler, b.stickies}
+}
+
+func (b *Bot) startQueues() {
 	go reapScheduler(b.reaper, b.reapWorker)
 	go reapScheduler(b.loadRetries, b.loadWorker)
+	go reapScheduler(b.singleDeleter, b.singleDeleteWorker)
+	go reapScheduler(b.crawler, b.crawlWorker)
+	go reapScheduler(b.stickies, b.stickyWorker)
+}
+
+// newBot constructs a Bot without starting any goroutines.
+func newBot(c Config, clock Clock) *Bot {
+	b := &Bot{
+		Config:     c,
+		storage:    &DiskStorage{},
+		donorRoles: makeSet(c.DonorRoleIDs),
+		clock:      clock,
+		channels:   make(map[string]*ManagedChannel),
+		locales:    map[string]*Locale{localeEnglish.Code: localeEnglish},
+		guilds:     make(map[string]GuildSettings),
+		sessions:   make(map[string]*dashboardSession),
+
+		pendingRechecks: make(map[string]bool),
+		reaper:          newReapQueue(queueReap, c.ReapWorkers.withDefaults(1, 4), clock),
+		loadRetries:     newReapQueue(queueLoad, c.LoadWorkers.withDefaults(1, 12), clock),
+
+		singleDeleter: newReapQueue(queueSingle, c.SingleDeleteWorkers.withDefaults(1, 4), clock),
+		crawler:       newReapQueue(queueCrawl, c.CrawlWorkers.withDefaults(1, 4), clock),
+		stickies:      newReapQueue(queueSticky, c.StickyWorkers.withDefaults(1, 2), clock),
+	}
+	b.reaper.ratelimitDelay = b.reapRatelimitDelay
+	b.loadRetries.ratelimitDelay = b.loadRatelimitDelay
+	b.singleDeleter.ratelimitDelay = b.singleDeleteRatelimitDelay
+	b.crawler.ratelimitDelay = b.crawlRatelimitDelay
+	b.stickies.ratelimitDelay = b.stickyRatelimitDelay
+	b.stateKey = []byte(c.OAuthStateKey)
+	if len(b.stateKey) == 0 {
+		b.stateKey = make([]byte, 32)
+		if _, err := rand.Read(b.stateKey); err != nil {
+			panic(err)
+		}
+	}
 	if c.BacklogLengthLimit != 0 {
 		backlogLimitNonDonor = c.BacklogLengthLimit
 	}
@@ -74,12 +158,94 @@ type Config struct {
 
 	BacklogLengthLimit int `yaml:"backlog_limit"`
 	DonorBacklogLimit  int `yaml:"backlog_limit_donor"`
+
+	// Worker pool sizes for the reap, backlog load, single-delete, backlog
+	// crawl and sticky message queues.
+	ReapWorkers         WorkerPoolConfig `yaml:"reap_workers"`
+	LoadWorkers         WorkerPoolConfig `yaml:"load_workers"`
+	SingleDeleteWorkers WorkerPoolConfig `yaml:"single_delete_workers"`
+	CrawlWorkers        WorkerPoolConfig `yaml:"crawl_workers"`
+	StickyWorkers       WorkerPoolConfig `yaml:"sticky_workers"`
+
+	// Directory of translation files. Default "./locales".
+	LocaleDir string `yaml:"locale_dir"`
+
+	// The permissions and scopes the bot asks for when it is added to a
+	// server.
+	Invite InviteConfig `yaml:"invite"`
+	// Key for signing the state of OAuth logins and joins. If empty, a
+	// random key is made at startup, and flows in progress fail after a
+	// restart.
+	OAuthStateKey string `yaml:"oauth_state_key"`
+	// Secret for the admin console on the metrics listener, see admin.go.
+	// The console is off if empty.
+	AdminToken string `yaml:"admin_token"`
+}
+
+// InviteConfig sets up the bot's join link.
+type InviteConfig struct {
+	// Permission bits. Zero asks for defaultInvitePermissions.
+	Permissions int64 `yaml:"permissions"`
+	// OAuth scopes, like "bot" and "applications.commands". Default "bot".
+	Scopes []string `yaml:"scopes"`
+}
+
+// WorkerPoolConfig bounds the number of workers for a queue. Workers above
+// Min are started when all workers are busy and exit after being idle.
+type WorkerPoolConfig struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+func (p WorkerPoolConfig) withDefaults(min, max int) WorkerPoolConfig {
+	if p.Min == 0 {
+		p.Min = min
+	}
+	if p.Max == 0 {
+		p.Max = max
+	}
+	return p
 }
 
 type BansFile struct {
 	Guilds []string `yaml:"guilds"`
 }
 
+// An APIToken gives access to one guild's settings through the REST API. Only
+// a hash of the secret is stored.
+type APIToken struct {
+	// ID is the start of Hash, to tell tokens apart.
+	ID        string    `yaml:"id"`
+	Hash      string    `yaml:"hash"`
+	GuildID   string    `yaml:"guild_id"`
+	CreatedBy string    `yaml:"created_by"`
+	Created   time.Time `yaml:"created"`
+}
+
+// An AuditEntry records a change to a guild's configuration, for the
+// dashboard's history.
+type AuditEntry struct {
+	Time      time.Time `yaml:"time"`
+	GuildID   string    `yaml:"guild_id"`
+	ChannelID string    `yaml:"channel_id,omitempty"`
+	// The user who made the change. Empty for changes through the API.
+	UserID string `yaml:"user_id,omitempty"`
+	// The API token used, if any.
+	TokenID string `yaml:"token_id,omitempty"`
+	// One of the audit* constants, like auditSet.
+	Action string `yaml:"action"`
+	// The new settings, in English.
+	Detail string `yaml:"detail,omitempty"`
+}
+
+// GuildSettings are the settings that apply to a whole guild.
+type GuildSettings struct {
+	// Language code for replies, or empty to follow the guild's locale.
+	Locale string `yaml:"locale,omitempty"`
+	// Command prefix accepted besides a mention of the bot.
+	Prefix string `yaml:"prefix,omitempty"`
+}
+
 type ManagedChannelMarshal struct {
 	ID      string `yaml:"id"`
 	GuildID string `yaml:"guild_id"`
@@ -89,6 +255,34 @@ type ManagedChannelMarshal struct {
 	LastSentUpdate int           `yaml:"last_critical_msg"`
 	HasPins        bool          `yaml:"has_pins,omitempty"`
 	IsDonor        bool          `yaml:"is_donor,omitempty"`
+	EditPolicy     EditPolicy    `yaml:"edit_policy,omitempty"`
+	PinPolicy      PinPolicy     `yaml:"pin_policy,omitempty"`
+	PinKeepCount   int           `yaml:"pin_keep_count,omitempty"`
+
+	// Sticky message settings, see sticky.go.
+	StickyText      string        `yaml:"sticky_text,omitempty"`
+	StickyEvery     int           `yaml:"sticky_every,omitempty"`
+	StickyInterval  time.Duration `yaml:"sticky_interval,omitempty"`
+	StickyMessageID string        `yaml:"sticky_message_id,omitempty"`
+
+	// Pre-deletion warnings, see warn.go.
+	WarnMode   WarnMode      `yaml:"warn_mode,omitempty"`
+	WarnBefore time.Duration `yaml:"warn_before,omitempty"`
+
+	// Voice channel link, see voice.go.
+	VoiceChannelID string        `yaml:"voice_channel_id,omitempty"`
+	VoiceWipeDelay time.Duration `yaml:"voice_wipe_delay,omitempty"`
+
+	// Set while the bot is missing critical permissions, see permissions.go.
+	Suspended     bool   `yaml:"suspended,omitempty"`
+	SuspendReason string `yaml:"suspend_reason,omitempty"`
+	Paused        bool   `yaml:"paused,omitempty"`
+
+	// Backlog crawler position, see crawl.go.
+	CrawlCursor string `yaml:"crawl_cursor,omitempty"`
+	CrawlDepth  int    `yaml:"crawl_depth,omitempty"`
+	// Messages waiting to be deleted one at a time, see singledelete.go.
+	SingleDeletePending []string `yaml:"single_delete_pending,omitempty"`
 
 	// ConfMessageID is deprecated.
 	ConfMessageID string   `yaml:"conf_message_id,omitempty"`
@@ -106,7 +300,7 @@ func internalMigrateConfig(c ManagedChannelMarshal) ManagedChannelMarshal {
 }
 
 func (b *Bot) ReportToLogChannel(msg string) {
-	_, err := b.s.ChannelMessageSend(b.Config.ErrorLogCh, msg)
+	_, err := b.api.ChannelMessageSend(b.Config.ErrorLogCh, msg)
 	if err != nil {
 		fmt.Println("error while reporting to error log:", err)
 	}
@@ -156,6 +350,32 @@ func (b *Bot) saveChannelConfig(conf ManagedChannelMarshal) error {
 	return b.storage.SaveChannel(conf)
 }
 
+// guildSettings returns a guild's settings, reading them from storage once.
+func (b *Bot) guildSettings(guildID string) GuildSettings {
+	b.mu.RLock()
+	settings, ok := b.guilds[guildID]
+	b.mu.RUnlock()
+	if ok {
+		return settings
+	}
+	settings, err := b.storage.GetGuildSettings(guildID)
+	if err != nil {
+		fmt.Printf("[load] could not read settings of guild %s: %v\n", guildID, err)
+		return settings
+	}
+	b.mu.Lock()
+	b.guilds[guildID] = settings
+	b.mu.Unlock()
+	return settings
+}
+
+func (b *Bot) saveGuildSettings(guildID string, settings GuildSettings) error {
+	b.mu.Lock()
+	delete(b.guilds, guildID)
+	b.mu.Unlock()
+	return b.storage.SaveGuildSettings(guildID, settings)
+}
+
 func (b *Bot) deleteChannelConfig(chID string) error {
 	// i love layering violations
 	(&ManagedChannel{bot: b, ChannelID: chID}).Disable()
@@ -169,16 +389,68 @@ func (b *Bot) deleteChannelConfig(chID string) error {
 	return err
 }
 
+// isCurrent reports whether c is the loaded ManagedChannel for its channel,
+// and not one that was disabled or replaced.
+func (b *Bot) isCurrent(c *ManagedChannel) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.channels[c.ChannelID] == c
+}
+
+// saveCurrentChannelConfig saves a channel's state from a background worker.
+// Nothing is saved if c was replaced in the meantime, so that the old policy
+// does not overwrite the new one.
+func (b *Bot) saveCurrentChannelConfig(c *ManagedChannel) error {
+	conf := c.Export()
+	// Held during the save, see setChannelConfig
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.channels[c.ChannelID] != c {
+		return nil
+	}
+	return b.saveChannelConfig(conf)
+}
+
+const jobSaveInterval = 1 * time.Minute
+
+// saveJobProgress saves a channel's state from the crawl and single-delete
+// workers. Each save writes out the whole single-delete list, so between the
+// first chunk of a job and its end the state is saved at most every
+// jobSaveInterval. A restart repeats the work done since then.
+func (b *Bot) saveJobProgress(c *ManagedChannel, done bool) {
+	now := b.clock.Now()
+	c.mu.Lock()
+	save := done || c.lastJobSave.IsZero() || now.Sub(c.lastJobSave) >= jobSaveInterval
+	if done {
+		c.lastJobSave = time.Time{}
+	} else if save {
+		c.lastJobSave = now
+	}
+	c.mu.Unlock()
+	if save {
+		b.saveCurrentChannelConfig(c)
+	}
+}
+
 // Change the config to the provided one.
 func (b *Bot) setChannelConfig(conf ManagedChannelMarshal) error {
+	// Unloading the old channel and saving happen together, so that a
+	// worker still busy with it cannot save the old config afterwards.
+	b.mu.Lock()
+	old := b.channels[conf.ID]
+	delete(b.channels, conf.ID)
 	err := b.saveChannelConfig(conf)
 	if err != nil {
-		return err
+		b.channels[conf.ID] = old
 	}
-
-	b.mu.Lock()
-	delete(b.channels, conf.ID)
 	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		// Stop its queued work
+		old.Disable()
+	}
 
 	return b.loadChannel(conf.ID, QOSInteractive)
 }
@@ -191,35 +463,20 @@ func (b *Bot) handleCriticalPermissionsErrors(channelID string, srcErr error) bo
 
 	if rErr, ok := srcErr.(*discordgo.RESTError); ok && rErr != nil && rErr.Message != nil {
 		shouldRemoveChannel := false
-		shouldNotifyChannel := false
 		var logMsg string
 
 		switch rErr.Message.Code {
-		case discordgo.ErrCodeUnknownChannel, discordgo.ErrCodeMissingAccess:
+		case discordgo.ErrCodeUnknownChannel:
 			shouldRemoveChannel = true
 			logMsg = fmt.Sprintf("Removed unknown channel ID %s", channelID)
-		case discordgo.ErrCodeMissingPermissions:
-			shouldRemoveChannel = true
-			shouldNotifyChannel = true
-			channelObj, _ := b.Channel(channelID)
-			if channelObj != nil {
-				guildObj, _ := b.s.State.Guild(channelObj.GuildID)
-				if guildObj != nil {
-					logMsg = fmt.Sprintf("AutoDelete disabled from channel #%s (%s) (server %s (%s)) due to missing critical permissions", channelObj.Name, channelID, guildObj.Name, channelObj.GuildID)
-				} else {
-					logMsg = fmt.Sprintf("AutoDelete disabled from channel #%s (%s) (server ID %s) due to missing critical permissions", channelObj.Name, channelID, channelObj.GuildID)
-				}
-			} else {
-				logMsg = fmt.Sprintf("AutoDelete disabled from channel (%s) (server unknown) due to missing critical permissions", channelID)
-			}
+		case discordgo.ErrCodeMissingAccess, discordgo.ErrCodeMissingPermissions:
+			// Keep the configuration for when the permissions come back
+			b.suspendForError(channelID, rErr)
+			return true
 		}
 
 		if shouldRemoveChannel {
 			b.ReportToLogChannel(logMsg)
-			if shouldNotifyChannel {
-				_, err := b.s.ChannelMessageSend(channelID, logMsg)
-				fmt.Println("error reporting removal to channel", channelID, ":", err)
-			}
 			b.deleteChannelConfig(channelID)
 			return true
 		}
@@ -266,6 +523,10 @@ func (b *Bot) LoadChannelConfigs() error {
 	}
 	close(chanCh)
 	wg.Wait()
+
+	b.mu.Lock()
+	b.configsLoaded = true
+	b.mu.Unlock()
 	return nil
 }
 
@@ -368,10 +629,20 @@ func (b *Bot) loadChannel(channelID string, qos LoadQOS) error {
 		if absDuration < 0 {
 			absDuration = -absDuration
 		}
-		b.s.ChannelMessageSend(channelID, fmt.Sprintf(":warning: AutoDelete is now disabled in this channel due to corrupt configuration: negative values were found. It must be re-enabled manually.\nFound configuration: duration %v, messages %d\nAn administrator can fix this by typing the following command:\n`@%s#%s setup %v %d`", conf.LiveTime, conf.MaxMessages, b.me.Username, b.me.Discriminator, absDuration, absMessages))
+		l := b.localeFor(conf.GuildID)
+		b.api.ChannelMessageSend(channelID, l.Sprintf("config.negative", conf.LiveTime, conf.MaxMessages, b.me.Username, b.me.Discriminator, absDuration, absMessages))
 		return errNegativeConfigValues
 	}
 
+	if conf.Suspended && !conf.Paused {
+		perms, err := b.api.UserChannelPermissions(b.me.ID, channelID)
+		if err == nil && len(missingCriticalPermissions(perms)) == 0 {
+			fmt.Printf("[perm] %s has its permissions back, resuming\n", channelID)
+			conf.Suspended, conf.SuspendReason = false, ""
+			b.saveChannelConfig(conf)
+		}
+	}
+
 	mCh, err := InitChannel(b, conf)
 	if err != nil {
 		return err
@@ -388,6 +659,18 @@ func (b *Bot) loadChannel(channelID string, qos LoadQOS) error {
 	b.channels[channelID] = mCh
 	b.mu.Unlock()
 
+	if pending, _, _ := mCh.SingleDeleteProgress(); pending > 0 && !conf.Suspended {
+		b.QueueSingleDelete(mCh)
+	}
+	if conf.Suspended {
+		// Nothing to do until the permissions are back. The history is
+		// loaded when the channel resumes, but messages must not wait
+		// for it.
+		mCh.mu.Lock()
+		mCh.markStartedLocked()
+		mCh.mu.Unlock()
+		return nil
+	}
 	if ch.LastPinTimestamp == "" {
 		b.QueueLoadBacklog(mCh, qos.Upgrade(QOSInitNoPins))
 	} else {
@@ -0,0 +1,269 @@
+package autodelete
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+// The backlog crawler walks channel history older than what LoadBacklog keeps
+// in liveMessages, one page per work item, and deletes whatever the channel's
+// policy says should already be gone. Only the current page is held in memory;
+// the position is a message ID cursor that is saved with the channel config so
+// a restart picks up where it left off.
+//
+// Messages too old for bulk delete go to the single-delete job, which is much
+// slower than the crawl. The crawl waits while that job has more than
+// crawlMaxSinglePending messages, and the job restarts it when it catches up.
+//
+// The crawl has its own queue rather than sharing the load queue: a deep
+// crawl takes many pages, and channels waiting for their first load should
+// not queue behind it. Each page is one work item, so the crawls of several
+// channels take turns on the crawl workers.
+
+const crawlRetryWait = 1 * time.Minute
+
+// crawlMaxSinglePending is the size of the single-delete backlog at which the
+// crawl waits, a few pages' worth.
+const crawlMaxSinglePending = 3 * backlogChunkLimit
+
+var (
+	mCrawlPages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: nsAutodelete,
+		Name:      "backlog_crawl_pages_total",
+		Help:      "Number of history pages fetched by the backlog crawler",
+	})
+	mCrawlMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: nsAutodelete,
+		Name:      "backlog_crawl_messages_total",
+		Help:      "Messages seen by the backlog crawler, by what was done with them",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(mCrawlPages)
+	prometheus.MustRegister(mCrawlMessages)
+}
+
+// A backlogCrawl is the crawler position for a channel. It is protected by the
+// ManagedChannel's mu.
+type backlogCrawl struct {
+	// Crawl messages before this ID. Empty when no crawl is in progress.
+	cursor string
+	// Number of messages newer than cursor that count towards MaxMessages.
+	depth int
+	// Where the crawl starts: the oldest message held in liveMessages.
+	boundary      string
+	boundaryDepth int
+	// Earliest expiry of a message that was passed over because it was not
+	// due yet. The crawl is restarted from the boundary at this time.
+	skippedExpiry time.Time
+
+	scanned int
+	deleted int
+	// Set while the crawl waits for the single-delete job to catch up.
+	waiting bool
+}
+
+// CrawlProgress reports whether a backlog crawl is in progress, and how many
+// messages it has scanned and deleted.
+func (c *ManagedChannel) CrawlProgress() (active bool, scanned, deleted int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.crawl.cursor != "", c.crawl.scanned, c.crawl.deleted
+}
+
+// startCrawlLocked records the oldest message loaded by LoadBacklog and
+// starts a crawl from it, unless one is already past that point. Must be
+// called with mu held.
+func (c *ManagedChannel) startCrawlLocked(boundary string, depth int) {
+	c.crawl.boundary = boundary
+	c.crawl.boundaryDepth = depth
+	if c.crawl.cursor != "" && snowflake.Less(c.crawl.cursor, boundary) {
+		// Resuming. New messages have arrived since the depth was saved,
+		// so it can only be an undercount.
+		if c.crawl.depth < depth {
+			c.crawl.depth = depth
+		}
+		return
+	}
+	c.crawl.cursor = boundary
+	c.crawl.depth = depth
+	c.crawl.scanned, c.crawl.deleted = 0, 0
+	c.crawl.skippedExpiry = time.Time{}
+}
+
+// stopCrawlLocked is called when LoadBacklog saw the whole channel history.
+// Must be called with mu held.
+func (c *ManagedChannel) stopCrawlLocked() {
+	c.crawl = backlogCrawl{}
+}
+
+// crawlPage fetches one page of history before the cursor and deletes the
+// messages that are due. Returns whether there is more to crawl.
+func (c *ManagedChannel) crawlPage() (more bool, err error) {
+	now := c.bot.clock.Now()
+	c.mu.Lock()
+	cursor, depth := c.crawl.cursor, c.crawl.depth
+	c.mu.Unlock()
+	if cursor == "" {
+		return false, nil
+	}
+
+	// newest first
+	c.bot.noteBucket(discordgo.EndpointChannelMessages(c.ChannelID))
+	page, err := c.bot.api.ChannelMessages(c.ChannelID, backlogChunkLimit, cursor, "", "")
+	if err != nil {
+		return true, err
+	}
+	mCrawlPages.Inc()
+
+	var bulk, single []string
+	var skippedExpiry time.Time
+	newDepth := depth
+	c.mu.Lock()
+	if c.killBit {
+		c.mu.Unlock()
+		return false, nil
+	}
+	for _, v := range page {
+		if c.keepLookup[v.ID] || c.isSingleDeletePending(v.ID) {
+			mCrawlMessages.WithLabelValues("kept").Inc()
+			continue
+		}
+		if c.keptByEditPolicy(v) {
+			mCrawlMessages.WithLabelValues("kept").Inc()
+			continue
+		}
+		postedAt := c.effectiveTime(v)
+		due := c.MaxMessages > 0 && newDepth >= c.MaxMessages
+		newDepth++
+		if c.MessageLiveTime > 0 {
+			expiry := postedAt.Add(c.MessageLiveTime)
+			if !expiry.After(now) {
+				due = true
+			} else if !due {
+				// pages are newest first, so the last one expires first
+				skippedExpiry = expiry
+			}
+		}
+		if !due {
+			mCrawlMessages.WithLabelValues("skipped").Inc()
+			continue
+		}
+		if needsSingleDelete(v.ID, now) {
+			single = append(single, v.ID)
+		} else {
+			bulk = append(bulk, v.ID)
+		}
+	}
+	c.mu.Unlock()
+
+	mCrawlMessages.WithLabelValues("bulk").Add(float64(len(bulk)))
+	mCrawlMessages.WithLabelValues("single").Add(float64(len(single)))
+	c.queueSingleDelete(single)
+	count, err := c.Reap(bulk)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crawl.cursor != cursor {
+		// LoadBacklog restarted the crawl underneath us
+		return c.crawl.cursor != "", err
+	}
+	c.crawl.scanned += len(page)
+	c.crawl.deleted += count + len(single)
+	if !skippedExpiry.IsZero() && (c.crawl.skippedExpiry.IsZero() || skippedExpiry.Before(c.crawl.skippedExpiry)) {
+		c.crawl.skippedExpiry = skippedExpiry
+	}
+	if err != nil {
+		return true, err
+	}
+	if len(page) < backlogChunkLimit {
+		c.crawl.cursor = ""
+		return false, nil
+	}
+	c.crawl.cursor = page[len(page)-1].ID
+	c.crawl.depth = newDepth
+	return true, nil
+}
+
+// QueueCrawl schedules the next page of the channel's backlog crawl.
+func (b *Bot) QueueCrawl(c *ManagedChannel, at time.Time) {
+	b.crawler.Update(c, at)
+}
+
+// resumeCrawl queues a crawl that waits for the single-delete job, once the
+// job has caught up.
+func (b *Bot) resumeCrawl(c *ManagedChannel) {
+	c.mu.Lock()
+	resume := c.crawl.waiting && c.singleDelete.pending.Len() <= crawlMaxSinglePending
+	if resume {
+		c.crawl.waiting = false
+	}
+	c.mu.Unlock()
+	if resume {
+		b.QueueCrawl(c, b.clock.Now())
+	}
+}
+
+func (b *Bot) crawlWorker(q *reapQueue, work reapWorkItem) {
+	ch := work.ch
+	if ch.IsDisabled() {
+		mReapqDropChannel.WithLabelValues(q.label).Inc()
+		q.finishWork(ch)
+		return
+	}
+
+	ch.mu.Lock()
+	wait := ch.singleDelete.pending.Len() > crawlMaxSinglePending
+	ch.crawl.waiting = wait
+	ch.mu.Unlock()
+	if wait {
+		// singleDeleteWorker queues us again
+		q.finishWork(ch)
+		return
+	}
+
+	more, err := ch.crawlPage()
+	if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
+		q.finishWork(ch)
+		return // drop ch
+	}
+	q.finishWork(ch)
+
+	if !b.isCurrent(ch) {
+		// Replaced by a new config while we worked
+		return
+	}
+	now := b.clock.Now()
+	done := false
+	if err != nil {
+		fmt.Printf("[crwl] %s: error, retrying in %v: %v\n", ch, crawlRetryWait, err)
+		b.QueueCrawl(ch, now.Add(crawlRetryWait))
+	} else if more {
+		b.QueueCrawl(ch, now)
+	} else {
+		done = true
+		ch.mu.Lock()
+		scanned, deleted := ch.crawl.scanned, ch.crawl.deleted
+		restartAt := ch.crawl.skippedExpiry
+		if !restartAt.IsZero() && ch.crawl.boundary != "" {
+			// Come back for the messages that were not due yet.
+			ch.crawl.cursor = ch.crawl.boundary
+			ch.crawl.depth = ch.crawl.boundaryDepth
+			ch.crawl.skippedExpiry = time.Time{}
+		} else {
+			restartAt = time.Time{}
+		}
+		ch.mu.Unlock()
+		fmt.Printf("[crwl] %s: finished, scanned %d, deleted %d\n", ch, scanned, deleted)
+		if !restartAt.IsZero() {
+			b.QueueCrawl(ch, restartAt)
+		}
+	}
+
+	b.saveJobProgress(ch, done)
+}
@@ -0,0 +1,254 @@
+package autodelete
+
+import (
+	"testing"
+	"time"
+)
+
+// withBacklogLimit lowers the LoadBacklog limit so that crawling starts after
+// a single page.
+func withBacklogLimit(t *testing.T, limit int) func() {
+	old := backlogLimitNonDonor
+	backlogLimitNonDonor = limit
+	return func() { backlogLimitNonDonor = old }
+}
+
+func loadTestChannel(t *testing.T, b *Bot, conf ManagedChannelMarshal) *ManagedChannel {
+	t.Helper()
+	conf.ID, conf.GuildID = testChannelID, testGuildID
+	c, err := InitChannel(b, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.channels[c.ChannelID] = c
+	b.mu.Unlock()
+	if err := c.LoadBacklog(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// runCrawl runs the crawl queue until nothing is due, and returns the number
+// of pages fetched.
+func runCrawl(t *testing.T, b *Bot) (pages int) {
+	t.Helper()
+	for i := 0; ; i++ {
+		if it := b.crawler.items.Peek(); it == nil || it.nextReap.After(b.clock.Now()) {
+			return pages
+		}
+		if i > 20 {
+			t.Fatal("crawl did not finish")
+		}
+		ch, due := b.crawler.WaitForNext()
+		if !ch.IsDisabled() {
+			pages++
+		}
+		b.crawlWorker(b.crawler, reapWorkItem{ch: ch, due: due})
+	}
+}
+
+func countMessages(api *fakeAPI) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return len(api.messages[testChannelID])
+}
+
+func TestCrawlCount(t *testing.T) {
+	defer withBacklogLimit(t, backlogChunkLimit)()
+	b, clock, api := newTestBot(t)
+
+	start := clock.Now().Add(-time.Hour)
+	var ids []string
+	for i := 0; i < 350; i++ {
+		ids = append(ids, api.post(testChannelID, start.Add(time.Duration(i)*time.Second)).ID)
+	}
+	api.pin(testChannelID, ids[10])
+	ch, _ := api.Channel(testChannelID)
+	ch.LastPinTimestamp = "2022-03-01T12:00:00Z"
+	api.addChannel(ch)
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 50})
+	if active, _, _ := c.CrawlProgress(); !active {
+		t.Fatal("crawl not started for channel with more history than the backlog limit")
+	}
+	if it := b.crawler.items.Peek(); it == nil || it.ch != c {
+		t.Fatal("crawl not queued")
+	}
+	c.mu.Lock()
+	cursor, depth := c.crawl.cursor, c.crawl.depth
+	c.mu.Unlock()
+	if cursor != ids[250] || depth != 100 {
+		t.Errorf("crawl starts at %s depth %d, want %s depth 100", cursor, depth, ids[250])
+	}
+
+	if pages := runCrawl(t, b); pages != 3 {
+		t.Errorf("crawled %d pages, want 3", pages)
+	}
+	// The loaded window is the reaper's job; everything older goes, except
+	// the pin.
+	if got := countMessages(api); got != 101 {
+		t.Errorf("%d messages left, want 101", got)
+	}
+	if _, m := api.findLocked(testChannelID, ids[10]); m == nil {
+		t.Error("pinned message was deleted")
+	}
+	if _, scanned, deleted := c.CrawlProgress(); scanned != 250 || deleted != 249 {
+		t.Errorf("progress: scanned %d deleted %d, want 250 and 249", scanned, deleted)
+	}
+	if conf, _ := b.storage.GetChannel(testChannelID); conf.CrawlCursor != "" {
+		t.Errorf("saved cursor %q after crawl finished", conf.CrawlCursor)
+	}
+}
+
+func TestCrawlResume(t *testing.T) {
+	defer withBacklogLimit(t, backlogChunkLimit)()
+	b, clock, api := newTestBot(t)
+
+	start := clock.Now().Add(-time.Hour)
+	for i := 0; i < 350; i++ {
+		api.post(testChannelID, start.Add(time.Duration(i)*time.Second))
+	}
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 50})
+	ch, due := b.crawler.WaitForNext()
+	b.crawlWorker(b.crawler, reapWorkItem{ch: ch, due: due})
+	conf, err := b.storage.GetChannel(testChannelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.CrawlCursor == "" || conf.CrawlDepth != 200 {
+		t.Fatalf("saved cursor %q depth %d, want cursor and depth 200", conf.CrawlCursor, conf.CrawlDepth)
+	}
+
+	// Restart: the crawl continues from the saved cursor.
+	c.Disable()
+	clock.Advance(time.Minute)
+	c = loadTestChannel(t, b, conf)
+	c.mu.Lock()
+	cursor := c.crawl.cursor
+	c.mu.Unlock()
+	if cursor != conf.CrawlCursor {
+		t.Errorf("after reload cursor = %s, want saved %s", cursor, conf.CrawlCursor)
+	}
+	if pages := runCrawl(t, b); pages != 2 {
+		t.Errorf("resumed crawl took %d pages, want 2", pages)
+	}
+	if got := countMessages(api); got != 100 {
+		t.Errorf("%d messages left, want 100", got)
+	}
+}
+
+func TestCrawlTimeRestart(t *testing.T) {
+	defer withBacklogLimit(t, backlogChunkLimit)()
+	b, clock, api := newTestBot(t)
+
+	now := clock.Now()
+	for i := 0; i < 100; i++ {
+		api.post(testChannelID, now.Add(-3*time.Hour+time.Duration(i)*time.Second))
+	}
+	for i := 0; i < 50; i++ {
+		api.post(testChannelID, now.Add(-30*time.Minute+time.Duration(i)*time.Second))
+	}
+	for i := 0; i < 100; i++ {
+		api.post(testChannelID, now.Add(-10*time.Minute+time.Duration(i)*time.Second))
+	}
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	runCrawl(t, b)
+	if got := countMessages(api); got != 150 {
+		t.Errorf("%d messages left, want 150", got)
+	}
+
+	// The skipped messages are picked up by a new crawl once they expire.
+	c.mu.Lock()
+	cursor, boundary := c.crawl.cursor, c.crawl.boundary
+	c.mu.Unlock()
+	if cursor == "" || cursor != boundary {
+		t.Errorf("after crawl cursor = %q, want restart from boundary %q", cursor, boundary)
+	}
+	it := b.crawler.items.Peek()
+	if want := now.Add(30 * time.Minute); it == nil || !it.nextReap.Equal(want) {
+		t.Fatalf("crawl restart queued at %v, want %v", it, want)
+	}
+
+	clock.Advance(30*time.Minute + 30*time.Second)
+	runCrawl(t, b)
+	if got := countMessages(api); got != 119 {
+		t.Errorf("%d messages left, want 119", got)
+	}
+	it = b.crawler.items.Peek()
+	if want := now.Add(30*time.Minute + 31*time.Second); it == nil || !it.nextReap.Equal(want) {
+		t.Errorf("second restart queued at %v, want %v", it, want)
+	}
+}
+
+func TestCrawlAfterConfigChange(t *testing.T) {
+	defer withBacklogLimit(t, backlogChunkLimit)()
+	b, clock, api := newTestBot(t)
+
+	start := clock.Now().Add(-time.Hour)
+	for i := 0; i < 350; i++ {
+		api.post(testChannelID, start.Add(time.Duration(i)*time.Second))
+	}
+	old := loadTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 50})
+	ch, due := b.crawler.WaitForNext()
+
+	// A page is in flight while the config changes
+	newConf := ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, LiveTime: 24 * time.Hour}
+	if err := b.saveChannelConfig(newConf); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.channels[testChannelID] = &ManagedChannel{bot: b, ChannelID: testChannelID, GuildID: testGuildID}
+	b.mu.Unlock()
+	b.crawlWorker(b.crawler, reapWorkItem{ch: ch, due: due})
+
+	if conf, _ := b.storage.GetChannel(testChannelID); conf.MaxMessages != 0 || conf.LiveTime != 24*time.Hour {
+		t.Errorf("saved %+v, the old policy overwrote the new one", conf)
+	}
+	if _, queued := b.crawler.Scheduled(old); queued {
+		t.Error("replaced channel requeued for crawling")
+	}
+
+	// setChannelConfig stops the channel it replaces
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 50})
+	if err := b.setChannelConfig(newConf); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsDisabled() {
+		t.Error("replaced channel not disabled")
+	}
+}
+
+func TestCrawlWaitsForSingleDelete(t *testing.T) {
+	defer withBacklogLimit(t, backlogChunkLimit)()
+	b, clock, api := newTestBot(t)
+	postOld(clock, api, 700)
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	runCrawl(t, b)
+	pending, _, _ := c.SingleDeleteProgress()
+	c.mu.Lock()
+	waiting := c.crawl.waiting
+	c.mu.Unlock()
+	if pending != crawlMaxSinglePending+backlogChunkLimit || !waiting {
+		t.Fatalf("crawl went on to %d pending messages, waiting %v", pending, waiting)
+	}
+	if it := b.crawler.items.Peek(); it != nil {
+		t.Fatal("crawl still queued while waiting")
+	}
+
+	// The crawl comes back once the single deletes catch up
+	for pending > crawlMaxSinglePending {
+		if b.crawler.items.Peek() != nil {
+			t.Fatalf("crawl queued again at %d pending messages", pending)
+		}
+		ch, due := b.singleDeleter.WaitForNext()
+		b.singleDeleteWorker(b.singleDeleter, reapWorkItem{ch: ch, due: due})
+		pending, _, _ = c.SingleDeleteProgress()
+	}
+	if it := b.crawler.items.Peek(); it == nil || it.ch != c {
+		t.Fatal("crawl not queued again after the single deletes caught up")
+	}
+}
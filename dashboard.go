@@ -0,0 +1,624 @@
+package autodelete
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/oauth2"
+)
+
+// The dashboard is a server-rendered web page for changing settings. Users log
+// in through Discord with the identify and guilds scopes, and see the guilds
+// where they have Manage Messages or Manage Server. Changes go through the same
+// code as the set command, and need Manage Messages in the channel.
+
+// DashboardPath is where HTTPDashboard expects to be mounted.
+const DashboardPath = "/discord_auto_delete/dashboard/"
+
+const (
+	sessionCookie   = "ad_session"
+	sessionLifetime = 24 * time.Hour
+	// Entries of the audit log shown on a guild's page.
+	dashboardAuditRows = 50
+)
+
+// A dashboardSession is a logged in user.
+type dashboardSession struct {
+	UserID   string
+	Username string
+	// The user's guilds and their permissions in them, as of the login.
+	Guilds []*discordgo.UserGuild
+	// Sent with every form, so that other sites cannot post them with the
+	// session cookie.
+	CSRF    string
+	Expires time.Time
+
+	// The result of the last form, shown once on the next page of the guild
+	// it was about. Protected by the Bot's sessionMu.
+	notice      string
+	noticeGuild string
+}
+
+// canManage reports whether the user could manage AutoDelete in a guild when
+// they logged in.
+func (s *dashboardSession) canManage(guildID string) (*discordgo.UserGuild, bool) {
+	const perms = discordgo.PermissionAdministrator | discordgo.PermissionManageServer | discordgo.PermissionManageMessages
+	for _, g := range s.Guilds {
+		if g.ID == guildID {
+			return g, g.Owner || g.Permissions&perms != 0
+		}
+	}
+	return nil, false
+}
+
+func (b *Bot) loginOAuthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     b.ClientID,
+		ClientSecret: b.ClientSecret,
+		Endpoint:     discordOAuthEndpoint,
+		Scopes:       []string{"identify", "guilds"},
+		RedirectURL:  b.HTTP.Public + DashboardPath + "callback",
+	}
+}
+
+// oauthContext makes the oauth2 package use the bot's HTTP transport, if it
+// has its own.
+func (b *Bot) oauthContext(ctx context.Context) context.Context {
+	if b.transport == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: b.transport})
+}
+
+// fetchLoginUser looks up the user and their guilds with a login's token.
+func (b *Bot) fetchLoginUser(ctx context.Context, t *oauth2.Token) (*discordgo.User, []*discordgo.UserGuild, error) {
+	client := b.loginOAuthConfig().Client(ctx, t)
+	getJSON := func(url string, v interface{}) error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	var user discordgo.User
+	var guilds []*discordgo.UserGuild
+	if err := getJSON(discordgo.EndpointUser("@me"), &user); err != nil {
+		return nil, nil, err
+	}
+	if err := getJSON(discordgo.EndpointUserGuilds("@me"), &guilds); err != nil {
+		return nil, nil, err
+	}
+	return &user, guilds, nil
+}
+
+// newSession logs a user in, and returns the session cookie's value.
+func (b *Bot) newSession(user *discordgo.User, guilds []*discordgo.UserGuild) (string, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	csrf, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	now := b.clock.Now()
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	for k, s := range b.sessions {
+		if now.After(s.Expires) {
+			delete(b.sessions, k)
+		}
+	}
+	b.sessions[id] = &dashboardSession{
+		UserID:   user.ID,
+		Username: user.Username,
+		Guilds:   guilds,
+		CSRF:     csrf,
+		Expires:  now.Add(sessionLifetime),
+	}
+	return id, nil
+}
+
+// session returns the logged in user of a request, or nil.
+func (b *Bot) session(r *http.Request) *dashboardSession {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	s := b.sessions[c.Value]
+	if s == nil || b.clock.Now().After(s.Expires) {
+		return nil
+	}
+	return s
+}
+
+// setNotice keeps the result of a form for the next page of the guild. It is
+// not passed in the URL, so that links cannot put text on the page.
+func (b *Bot) setNotice(s *dashboardSession, guildID, notice string) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	s.notice, s.noticeGuild = notice, guildID
+}
+
+// takeNotice returns and forgets the notice for a guild's page.
+func (b *Bot) takeNotice(s *dashboardSession, guildID string) string {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	if s.noticeGuild != guildID {
+		return ""
+	}
+	notice := s.notice
+	s.notice, s.noticeGuild = "", ""
+	return notice
+}
+
+// setCookie sets a cookie, or removes it if maxAge is negative.
+func (b *Bot) setCookie(w http.ResponseWriter, name, path, value string, maxAge time.Duration) {
+	seconds := int(maxAge / time.Second)
+	if maxAge < 0 {
+		seconds = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   seconds,
+		Secure:   strings.HasPrefix(b.HTTP.Public, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HTTPDashboard serves the dashboard under DashboardPath.
+func (b *Bot) HTTPDashboard(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, DashboardPath), "/"), "/")
+	switch {
+	case parts[0] == "":
+		b.dashboardHome(w, r)
+	case parts[0] == "login":
+		b.dashboardLogin(w, r)
+	case parts[0] == "callback":
+		b.dashboardCallback(w, r)
+	case parts[0] == "logout":
+		b.dashboardLogout(w, r)
+	case parts[0] == "guilds" && len(parts) == 2:
+		b.dashboardGuild(w, r, parts[1])
+	case parts[0] == "guilds" && len(parts) == 3 && parts[2] == "channels":
+		b.dashboardChange(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// validNext reports whether a page to return to after logging in is a plain
+// path under DashboardPath.
+func validNext(next string) bool {
+	for _, c := range next {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '/') {
+			return false
+		}
+	}
+	return !strings.HasPrefix(next, "/")
+}
+
+func (b *Bot) dashboardLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !validNext(next) {
+		next = ""
+	}
+	state, err := b.newOAuthState(w, next)
+	if err != nil {
+		http.Error(w, "could not start the login", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, b.loginOAuthConfig().AuthCodeURL(state), http.StatusFound)
+}
+
+func (b *Bot) dashboardCallback(w http.ResponseWriter, r *http.Request) {
+	state, err := b.checkOAuthState(w, r)
+	if err != nil {
+		fmt.Printf("[dash] rejected login: %v\n", err)
+		http.Error(w, "The login expired or did not start here. Please try again.", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("code") == "" {
+		http.Redirect(w, r, DashboardPath, http.StatusFound)
+		return
+	}
+
+	ctx := b.oauthContext(r.Context())
+	t, err := b.loginOAuthConfig().Exchange(ctx, r.FormValue("code"))
+	if err != nil {
+		fmt.Printf("[dash] login failed: %v\n", err)
+		http.Error(w, "Discord did not accept the login. Please try again.", http.StatusBadGateway)
+		return
+	}
+	user, guilds, err := b.fetchLoginUser(ctx, t)
+	if err != nil {
+		fmt.Printf("[dash] could not look up the user: %v\n", err)
+		http.Error(w, "Could not get your account from Discord. Please try again.", http.StatusBadGateway)
+		return
+	}
+	id, err := b.newSession(user, guilds)
+	if err != nil {
+		http.Error(w, "could not start a session", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[dash] %s (%s#%s) logged in\n", user.ID, user.Username, user.Discriminator)
+	b.setCookie(w, sessionCookie, DashboardPath, id, sessionLifetime)
+	http.Redirect(w, r, DashboardPath+state.Next, http.StatusFound)
+}
+
+func (b *Bot) dashboardLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		b.sessionMu.Lock()
+		if s := b.sessions[c.Value]; s != nil && validCSRF(s, r) {
+			delete(b.sessions, c.Value)
+		}
+		b.sessionMu.Unlock()
+	}
+	b.setCookie(w, sessionCookie, DashboardPath, "", -1)
+	http.Redirect(w, r, DashboardPath, http.StatusSeeOther)
+}
+
+func validCSRF(s *dashboardSession, r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(s.CSRF), []byte(r.PostFormValue("csrf"))) == 1
+}
+
+type dashboardGuildLink struct {
+	ID, Name string
+}
+
+func (b *Bot) dashboardHome(w http.ResponseWriter, r *http.Request) {
+	s := b.session(r)
+	if s == nil {
+		renderDashboard(w, "login", nil)
+		return
+	}
+	var guilds []dashboardGuildLink
+	for _, g := range s.Guilds {
+		if _, ok := s.canManage(g.ID); !ok {
+			continue
+		}
+		if _, err := b.s.State.Guild(g.ID); err != nil {
+			continue
+		}
+		guilds = append(guilds, dashboardGuildLink{ID: g.ID, Name: g.Name})
+	}
+	sort.Slice(guilds, func(i, j int) bool { return strings.ToLower(guilds[i].Name) < strings.ToLower(guilds[j].Name) })
+	renderDashboard(w, "home", map[string]interface{}{
+		"Session": s,
+		"Guilds":  guilds,
+		"Invite":  b.HTTP.Public + "/discord_auto_delete/oauth/start",
+	})
+}
+
+// dashboardChannel is a configured channel on a guild's page.
+type dashboardChannel struct {
+	channelSummary
+	Policy   apiPolicy
+	Settings string
+}
+
+type dashboardAuditRow struct {
+	Time    time.Time
+	Channel string
+	Who     string
+	Action  string
+	Detail  string
+}
+
+func (b *Bot) dashboardGuild(w http.ResponseWriter, r *http.Request, guildID string) {
+	s := b.session(r)
+	if s == nil {
+		http.Redirect(w, r, DashboardPath+"login?next="+url.QueryEscape("guilds/"+guildID), http.StatusFound)
+		return
+	}
+	userGuild, ok := s.canManage(guildID)
+	if !ok {
+		http.Error(w, "You cannot manage AutoDelete in this server. If you just joined it, log out and in again.", http.StatusForbidden)
+		return
+	}
+	guild, err := b.s.State.Guild(guildID)
+	if err != nil {
+		http.Error(w, "AutoDelete is not in this server yet. If you just added it, reload this page in a moment.", http.StatusNotFound)
+		return
+	}
+	summaries, err := b.GuildSummaries(guildID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var channels []dashboardChannel
+	configured := make(map[string]bool)
+	totalDeleted, totalTracked := 0, 0
+	for _, sum := range summaries {
+		configured[sum.ChannelID] = true
+		totalDeleted += sum.Deleted
+		totalTracked += sum.Tracked
+		channels = append(channels, dashboardChannel{
+			channelSummary: sum,
+			Policy:         policyOf(sum.Conf),
+			Settings:       shortSettings(localeEnglish, sum.Conf),
+		})
+	}
+
+	var unconfigured []dashboardGuildLink
+	channelNames := make(map[string]string)
+	b.s.State.RLock()
+	for _, ch := range guild.Channels {
+		channelNames[ch.ID] = ch.Name
+		if !configured[ch.ID] && (ch.Type == discordgo.ChannelTypeGuildText || ch.Type == discordgo.ChannelTypeGuildNews) {
+			unconfigured = append(unconfigured, dashboardGuildLink{ID: ch.ID, Name: ch.Name})
+		}
+	}
+	b.s.State.RUnlock()
+	sort.Slice(unconfigured, func(i, j int) bool { return unconfigured[i].Name < unconfigured[j].Name })
+
+	entries, err := b.storage.ListAuditEntries(guildID)
+	if err != nil {
+		fmt.Printf("[dash] could not read the audit log of %s: %v\n", guildID, err)
+	}
+	if len(entries) > dashboardAuditRows {
+		entries = entries[:dashboardAuditRows]
+	}
+	var audit []dashboardAuditRow
+	for _, e := range entries {
+		row := dashboardAuditRow{Time: e.Time, Action: e.Action, Detail: e.Detail}
+		if e.ChannelID != "" {
+			row.Channel = "#" + e.ChannelID
+			if name, ok := channelNames[e.ChannelID]; ok {
+				row.Channel = "#" + name
+			}
+		}
+		row.Who = b.describeActor(guildID, e)
+		audit = append(audit, row)
+	}
+
+	renderDashboard(w, "guild", map[string]interface{}{
+		"Session":      s,
+		"Guild":        userGuild,
+		"Channels":     channels,
+		"Unconfigured": unconfigured,
+		"Audit":        audit,
+		"Deleted":      totalDeleted,
+		"Tracked":      totalTracked,
+		"Notice":       b.takeNotice(s, guildID),
+		"NewPolicy":    apiPolicy{},
+	})
+}
+
+// describeActor names who made a change in the audit log.
+func (b *Bot) describeActor(guildID string, e AuditEntry) string {
+	if e.UserID == "" && e.TokenID == "" {
+		return "the bot administrator"
+	}
+	if e.UserID == "" {
+		return "API token " + e.TokenID
+	}
+	if member, err := b.s.State.Member(guildID, e.UserID); err == nil && member.User != nil {
+		return member.User.Username
+	}
+	return "user " + e.UserID
+}
+
+// dashboardChange handles the forms on a guild's page.
+func (b *Bot) dashboardChange(w http.ResponseWriter, r *http.Request, guildID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	s := b.session(r)
+	if s == nil {
+		http.Redirect(w, r, DashboardPath, http.StatusSeeOther)
+		return
+	}
+	if !validCSRF(s, r) {
+		http.Error(w, "This form expired. Go back, reload the page and try again.", http.StatusForbidden)
+		return
+	}
+	if _, ok := s.canManage(guildID); !ok {
+		http.Error(w, "You cannot manage AutoDelete in this server.", http.StatusForbidden)
+		return
+	}
+	b.setNotice(s, guildID, b.changeFromDashboard(s, guildID, r))
+	http.Redirect(w, r, DashboardPath+"guilds/"+guildID, http.StatusSeeOther)
+}
+
+// changeFromDashboard applies a form, and returns the notice to show. Like
+// the rest of the dashboard, the notices are in English.
+func (b *Bot) changeFromDashboard(s *dashboardSession, guildID string, r *http.Request) string {
+	ch, err := b.Channel(r.PostFormValue("channel_id"))
+	if err != nil || ch.GuildID != guildID {
+		return "That channel is not in this server."
+	}
+	perms, err := b.api.UserChannelPermissions(s.UserID, ch.ID)
+	if err != nil {
+		return "Could not check your permissions: " + err.Error()
+	}
+	if perms&discordgo.PermissionManageMessages == 0 {
+		return fmt.Sprintf("You need the Manage Messages permission in #%s.", ch.Name)
+	}
+	who := AuditEntry{GuildID: guildID, ChannelID: ch.ID, UserID: s.UserID}
+
+	var p apiPolicy
+	switch r.PostFormValue("action") {
+	case "save":
+		p = apiPolicy{
+			LiveTime:       r.PostFormValue("live_time"),
+			Edits:          r.PostFormValue("edits"),
+			Pins:           r.PostFormValue("pins"),
+			Warn:           r.PostFormValue("warn"),
+			WarnBefore:     r.PostFormValue("warn_before"),
+			VoiceChannelID: r.PostFormValue("voice_channel_id"),
+			VoiceWipeDelay: r.PostFormValue("voice_wipe_delay"),
+		}
+		if count := r.PostFormValue("max_messages"); count != "" {
+			if p.MaxMessages, err = strconv.Atoi(count); err != nil {
+				return "The message count must be a number."
+			}
+		}
+		if p.LiveTime == "" && p.MaxMessages == 0 && p.VoiceChannelID == "" {
+			return "Set a time, a message count or a voice channel, or turn deletion off."
+		}
+	case "off":
+		// The zero policy turns deletion off
+	case "pause":
+		if _, ok := b.channelSummary(ch); !ok {
+			return fmt.Sprintf("#%s is not set up.", ch.Name)
+		}
+		b.pauseChannel(ch.ID)
+		who.Action = auditPause
+		b.audit(who)
+		return fmt.Sprintf("Paused #%s.", ch.Name)
+	case "resume":
+		if err := b.unpauseChannel(ch.ID); err != nil {
+			return fmt.Sprintf("Could not resume #%s: %v", ch.Name, err)
+		}
+		who.Action = auditResume
+		b.audit(who)
+		return fmt.Sprintf("Resumed #%s.", ch.Name)
+	default:
+		return "Unknown action."
+	}
+
+	opts, err := p.options()
+	if err != nil {
+		return err.Error()
+	}
+	isDonor, err := b.isDonor(s.UserID)
+	if err != nil {
+		fmt.Println("[Warn]", "could not check donor status", err)
+	}
+	conf, rejectKey, err := b.applyChannelSettings(ch, opts, isDonor, who)
+	if rejectKey != "" {
+		return localeEnglish.Sprintf(rejectKey)
+	} else if err != nil {
+		return "The settings may not have been saved: " + err.Error()
+	}
+	fmt.Printf("[dash] %s changed settings for channel %s: %s\n", s.UserID, ch.ID, shortSettings(localeEnglish, conf))
+	return fmt.Sprintf("#%s: %s.", ch.Name, shortSettings(localeEnglish, conf))
+}
+
+// policyFormData fills in the policy fields of a form.
+type policyFormData struct {
+	CSRF        string
+	Policy      apiPolicy
+	EditOptions []EditPolicy
+	WarnOptions []WarnMode
+}
+
+func policyForm(csrf string, p apiPolicy) policyFormData {
+	return policyFormData{
+		CSRF:        csrf,
+		Policy:      p,
+		EditOptions: []EditPolicy{EditPolicyIgnore, EditPolicyRestart, EditPolicyKeepAttachments},
+		WarnOptions: []WarnMode{WarnModeOff, WarnModeReact, WarnModeNotice},
+	}
+}
+
+func renderDashboard(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		fmt.Printf("[dash] could not render %s: %v\n", name, err)
+	}
+}
+
+var dashboardTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"path":       func(p string) string { return DashboardPath + p },
+	"policyForm": policyForm,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>AutoDelete</title>
+<style>body{font-family:sans-serif;max-width:60em;margin:auto;padding:1em}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:.3em;text-align:left}input[type=text]{width:6em}</style>
+</head><body>
+<h1><a href="{{path ""}}">AutoDelete</a></h1>
+{{with .Session}}<form method="post" action="{{path "logout"}}">Logged in as {{.Username}}. <input type="hidden" name="csrf" value="{{.CSRF}}"><button>Log out</button></form>{{end}}
+{{end}}
+
+{{define "footer"}}</body></html>
+{{end}}
+
+{{define "login"}}{{template "header" .}}
+<p>Log in with your Discord account to change AutoDelete's settings in your servers.</p>
+<p><a href="{{path "login"}}">Log in with Discord</a></p>
+{{template "footer"}}{{end}}
+
+{{define "home"}}{{template "header" .}}
+<h2>Your servers</h2>
+{{with .Guilds}}<ul>{{range .}}<li><a href="{{path "guilds/"}}{{.ID}}">{{.Name}}</a></li>{{end}}</ul>
+{{else}}<p>AutoDelete is not in any server where you have the Manage Messages or Manage Server permission.</p>{{end}}
+<p><a href="{{.Invite}}">Add AutoDelete to a server</a></p>
+{{template "footer"}}{{end}}
+
+{{define "policy"}}
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>Delete after <input type="text" name="live_time" value="{{.Policy.LiveTime}}" placeholder="24h"></label>
+<label>or after <input type="text" name="max_messages" value="{{if .Policy.MaxMessages}}{{.Policy.MaxMessages}}{{end}}"> messages</label>
+<label>Edits <select name="edits">{{$e := .Policy.Edits}}{{range $v := .EditOptions}}<option value="{{$v}}"{{if eq (print $v) $e}} selected{{end}}>{{if $v}}{{$v}}{{else}}ignore{{end}}</option>{{end}}</select></label>
+<label>Pins <input type="text" name="pins" value="{{.Policy.Pins}}" placeholder="all"></label>
+<label>Warn <select name="warn">{{$w := .Policy.Warn}}{{range $v := .WarnOptions}}<option value="{{$v}}"{{if eq (print $v) $w}} selected{{end}}>{{if $v}}{{$v}}{{else}}off{{end}}</option>{{end}}</select></label>
+<label>before <input type="text" name="warn_before" value="{{.Policy.WarnBefore}}" placeholder="10m"></label>
+<label>Voice channel ID <input type="text" name="voice_channel_id" value="{{.Policy.VoiceChannelID}}"></label>
+<label>delay <input type="text" name="voice_wipe_delay" value="{{.Policy.VoiceWipeDelay}}"></label>
+{{end}}
+
+{{define "guild"}}{{template "header" .}}
+<h2>{{.Guild.Name}}</h2>
+{{with .Notice}}<p><strong>{{.}}</strong></p>{{end}}
+<p>{{.Deleted}} messages deleted since the bot last started; {{.Tracked}} waiting to be deleted.</p>
+{{$csrf := .Session.CSRF}}{{$guild := .Guild.ID}}
+<h3>Channels</h3>
+{{range .Channels}}
+<h4 id="c{{.ChannelID}}">#{{.Name}}</h4>
+<p>{{.Settings}}. Status: {{.Status}}.{{if .Loaded}} {{.Tracked}} messages waiting, next deletion {{time .NextDeletion}}. {{.Deleted}} deleted since loaded; the last deletion, {{time .LastReap}}, removed {{.LastReapCount}}.{{end}}</p>
+<form method="post" action="{{path "guilds/"}}{{$guild}}/channels">
+<input type="hidden" name="channel_id" value="{{.ChannelID}}">
+{{template "policy" (policyForm $csrf .Policy)}}
+<button name="action" value="save">Save</button>
+<button name="action" value="off">Turn off</button>
+{{if .Conf.Paused}}<button name="action" value="resume">Resume</button>{{else}}<button name="action" value="pause">Pause</button>{{end}}
+</form>
+{{else}}<p>No channels are set up yet.</p>{{end}}
+{{with .Unconfigured}}
+<h3>Set up a channel</h3>
+<form method="post" action="{{path "guilds/"}}{{$guild}}/channels">
+<select name="channel_id">{{range .}}<option value="{{.ID}}">#{{.Name}}</option>{{end}}</select>
+{{template "policy" (policyForm $csrf $.NewPolicy)}}
+<button name="action" value="save">Start deleting</button>
+</form>
+{{end}}
+<h3>History</h3>
+{{with .Audit}}<table><tr><th>Time</th><th>Channel</th><th>By</th><th>Change</th></tr>
+{{range .}}<tr><td>{{time .Time}}</td><td>{{.Channel}}</td><td>{{.Who}}</td><td>{{.Action}}{{with .Detail}}: {{.}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>No changes yet.</p>{{end}}
+{{template "footer"}}{{end}}
+`))
@@ -0,0 +1,178 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeDiscordOAuth answers the token exchange and the user lookups of a
+// dashboard login.
+func fakeDiscordOAuth(t *testing.T, guilds []*discordgo.UserGuild) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/oauth2/token"):
+			if r.FormValue("code") != "good-code" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"user-token","token_type":"Bearer","expires_in":3600}`))
+		case r.Header.Get("Authorization") != "Bearer user-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasSuffix(r.URL.Path, "/users/@me"):
+			json.NewEncoder(w).Encode(&discordgo.User{ID: "1001", Username: "mod"})
+		case strings.HasSuffix(r.URL.Path, "/users/@me/guilds"):
+			json.NewEncoder(w).Encode(guilds)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+// dashboardRequest sends a request to HTTPDashboard with the given cookies.
+func dashboardRequest(b *Bot, method, path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == "POST" {
+		r = httptest.NewRequest(method, DashboardPath+path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, DashboardPath+path, nil)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.HTTPDashboard(w, r)
+	return w
+}
+
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// dashboardLogin logs in as user 1001 and returns the session cookie.
+func dashboardLogin(t *testing.T, b *Bot, guilds []*discordgo.UserGuild) *http.Cookie {
+	t.Helper()
+	b.transport = handlerTransport{fakeDiscordOAuth(t, guilds)}
+	w := dashboardRequest(b, "GET", "login", nil)
+	nonce := responseCookie(w, oauthNonceCookie)
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if nonce == nil || err != nil || loc.Query().Get("state") == "" {
+		t.Fatalf("login redirect %q without a state and nonce cookie", w.Header().Get("Location"))
+	}
+	state := url.QueryEscape(loc.Query().Get("state"))
+	if w := dashboardRequest(b, "GET", "callback?code=good-code&state="+state, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without the nonce cookie: %d", w.Code)
+	}
+	w = dashboardRequest(b, "GET", "callback?code=good-code&state="+state, nil, nonce)
+	session := responseCookie(w, sessionCookie)
+	if w.Code != http.StatusFound || session == nil {
+		t.Fatalf("callback: %d %s", w.Code, w.Body.String())
+	}
+	return session
+}
+
+func TestDashboardLogin(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	if err := b.s.State.GuildAdd(&discordgo.Guild{ID: "201", Name: "member only"}); err != nil {
+		t.Fatal(err)
+	}
+	session := dashboardLogin(t, b, []*discordgo.UserGuild{
+		{ID: testGuildID, Name: "test guild", Permissions: discordgo.PermissionManageMessages},
+		{ID: "201", Name: "member only", Permissions: discordgo.PermissionSendMessages},
+		{ID: "202", Name: "no bot", Owner: true},
+	})
+
+	w := dashboardRequest(b, "GET", "", nil, session)
+	body := w.Body.String()
+	if !strings.Contains(body, "test guild") || strings.Contains(body, "member only") || strings.Contains(body, "no bot") {
+		t.Errorf("home page lists the wrong guilds:\n%s", body)
+	}
+	if w := dashboardRequest(b, "GET", "guilds/201", nil, session); w.Code != http.StatusForbidden {
+		t.Errorf("guild without permission: %d", w.Code)
+	}
+	if w := dashboardRequest(b, "GET", "", nil); !strings.Contains(w.Body.String(), "Log in with Discord") {
+		t.Errorf("logged out home page:\n%s", w.Body.String())
+	}
+}
+
+func TestDashboardEditPolicy(t *testing.T) {
+	b, _, api := newTestBot(t)
+	session := dashboardLogin(t, b, []*discordgo.UserGuild{
+		{ID: testGuildID, Name: "test guild", Permissions: discordgo.PermissionManageMessages},
+	})
+	b.sessionMu.Lock()
+	csrf := b.sessions[session.Value].CSRF
+	b.sessionMu.Unlock()
+
+	form := url.Values{"channel_id": {testChannelID}, "action": {"save"}, "live_time": {"2h"}, "pins": {"3"}}
+	if w := dashboardRequest(b, "POST", "guilds/"+testGuildID+"/channels", form, session); w.Code != http.StatusForbidden {
+		t.Errorf("POST without the CSRF token: %d", w.Code)
+	}
+
+	// The dashboard is in English, whatever the guild's language
+	locales, err := loadLocales(defaultLocaleDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.locales = locales
+	if err := b.saveGuildSettings(testGuildID, GuildSettings{Locale: "de"}); err != nil {
+		t.Fatal(err)
+	}
+
+	form.Set("csrf", csrf)
+	api.perms = discordgo.PermissionAll &^ discordgo.PermissionManageMessages
+	w := dashboardRequest(b, "POST", "guilds/"+testGuildID+"/channels", form, session)
+	if loc := w.Header().Get("Location"); loc != DashboardPath+"guilds/"+testGuildID {
+		t.Errorf("without Manage Messages: redirected to %q", loc)
+	}
+	if _, err := b.storage.GetChannel(testChannelID); err == nil {
+		t.Error("saved without Manage Messages")
+	}
+	notice := "You need the Manage Messages permission in #general."
+	if body := dashboardRequest(b, "GET", "guilds/"+testGuildID, nil, session).Body.String(); !strings.Contains(body, notice) {
+		t.Errorf("guild page does not show %q:\n%s", notice, body)
+	}
+	if body := dashboardRequest(b, "GET", "guilds/"+testGuildID+"?notice=forged", nil, session).Body.String(); strings.Contains(body, notice) || strings.Contains(body, "forged") {
+		t.Errorf("guild page shows a notice twice, or from the URL:\n%s", body)
+	}
+
+	api.perms = discordgo.PermissionAll
+	w = dashboardRequest(b, "POST", "guilds/"+testGuildID+"/channels", form, session)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST: %d", w.Code)
+	}
+	if saved, err := b.storage.GetChannel(testChannelID); err != nil || saved.LiveTime.String() != "2h0m0s" || saved.PinKeepCount != 3 {
+		t.Errorf("saved %+v, %v", saved, err)
+	}
+	entries, _ := b.storage.ListAuditEntries(testGuildID)
+	if len(entries) != 1 || entries[0].UserID != "1001" || entries[0].Action != auditSet || entries[0].ChannelID != testChannelID {
+		t.Errorf("audit log %+v", entries)
+	}
+
+	body := dashboardRequest(b, "GET", "guilds/"+testGuildID, nil, session).Body.String()
+	for _, want := range []string{"#general", `value="2h0m0s"`, "user 1001", "set: deleted after 2h0m0s"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("guild page does not contain %q:\n%s", want, body)
+		}
+	}
+
+	form = url.Values{"csrf": {csrf}, "channel_id": {testChannelID}, "action": {"off"}}
+	dashboardRequest(b, "POST", "guilds/"+testGuildID+"/channels", form, session)
+	if _, err := b.storage.GetChannel(testChannelID); err == nil {
+		t.Error("config still saved after turning it off")
+	}
+}
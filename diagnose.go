@@ -0,0 +1,180 @@
+package autodelete
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelHealth records the results of recent background work on a channel,
+// for the check command. It is protected by the ManagedChannel's mu.
+type channelHealth struct {
+	lastLoadOK time.Time
+	loadErr    error
+
+	lastReap      time.Time
+	lastReapCount int
+	lastReapErr   error
+
+	// Messages deleted since the channel was loaded, by bulk or single
+	// deletes.
+	deleted int
+}
+
+func (c *ManagedChannel) recordLoad(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health.loadErr = err
+	if err == nil {
+		c.health.lastLoadOK = c.bot.clock.Now()
+	}
+}
+
+func (c *ManagedChannel) recordReap(count int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health.lastReap = c.bot.clock.Now()
+	c.health.lastReapCount = count
+	c.health.lastReapErr = err
+	c.health.deleted += count
+}
+
+// errorCode describes an error for the check command, with Discord's error
+// code if there is one.
+func errorCode(l *Locale, err error) string {
+	if rErr, ok := err.(*discordgo.RESTError); ok && rErr.Message != nil {
+		return l.Sprintf("diag.discord_error", rErr.Message.Code, rErr.Message.Message)
+	}
+	return err.Error()
+}
+
+// A finding is one line of the check command's full report. Problems come with
+// a hint on how to fix them.
+type finding struct {
+	ok   bool
+	text string
+	hint string
+}
+
+// requiredPermissions lists what the bot needs in a channel, and why, by
+// catalog key.
+var requiredPermissions = []struct {
+	perm int64
+	name string
+	hint string
+}{
+	{discordgo.PermissionViewChannel, "diag.perm_view_channel", "diag.why_view_channel"},
+	{discordgo.PermissionReadMessageHistory, "diag.perm_read_history", "diag.why_read_history"},
+	{discordgo.PermissionManageMessages, "diag.perm_manage_messages", "diag.why_manage_messages"},
+	{discordgo.PermissionSendMessages, "diag.perm_send_messages", "diag.why_send_messages"},
+}
+
+// Diagnose checks the bot's permissions and the health of the channel's
+// background work, and words the findings in l.
+func (c *ManagedChannel) Diagnose(l *Locale) []finding {
+	var fs []finding
+
+	c.mu.Lock()
+	suspended, reason := c.Suspended, c.SuspendReason
+	c.mu.Unlock()
+	if suspended {
+		fs = append(fs, finding{text: l.Sprintf("diag.suspended", reason), hint: l.Sprintf("diag.suspended_hint")})
+	}
+
+	perms, err := c.bot.api.UserChannelPermissions(c.bot.me.ID, c.ChannelID)
+	if err != nil {
+		fs = append(fs, finding{text: l.Sprintf("diag.perm_check_failed", err.Error())})
+	} else {
+		missing := 0
+		for _, p := range requiredPermissions {
+			if perms&p.perm == 0 {
+				missing++
+				fs = append(fs, finding{text: l.Sprintf("diag.missing_perm", l.Sprintf(p.name)), hint: l.Sprintf("diag.missing_perm_hint", l.Sprintf(p.hint))})
+			}
+		}
+		c.mu.Lock()
+		warnReact := c.WarnMode == WarnModeReact
+		c.mu.Unlock()
+		if warnReact && perms&discordgo.PermissionAddReactions == 0 {
+			fs = append(fs, finding{text: l.Sprintf("diag.missing_reactions"), hint: l.Sprintf("diag.missing_reactions_hint")})
+		}
+		if missing == 0 {
+			fs = append(fs, finding{ok: true, text: l.Sprintf("diag.perms_ok")})
+		}
+	}
+
+	now := c.bot.clock.Now()
+	c.mu.Lock()
+	tracked := c.liveMessages.Len()
+	limit := backlogLimit(c.IsDonor)
+	h := c.health
+	backoff := c.loadFailures
+	c.mu.Unlock()
+
+	switch {
+	case h.loadErr != nil:
+		text := l.Sprintf("diag.load_failed", errorCode(l, h.loadErr))
+		if !h.lastLoadOK.IsZero() {
+			text += l.Sprintf("diag.load_last_ok", now.Sub(h.lastLoadOK).Round(time.Second).String())
+		}
+		hint := l.Sprintf("diag.load_retry")
+		if backoff > 0 {
+			hint = l.Sprintf("diag.load_backoff", backoff.Round(time.Second).String())
+		}
+		fs = append(fs, finding{text: text, hint: hint})
+	case h.lastLoadOK.IsZero():
+		fs = append(fs, finding{text: l.Sprintf("diag.not_loaded"), hint: l.Sprintf("diag.not_loaded_hint")})
+	default:
+		fs = append(fs, finding{ok: true, text: l.Sprintf("diag.loaded", now.Sub(h.lastLoadOK).Round(time.Second).String())})
+	}
+
+	if tracked >= limit {
+		fs = append(fs, finding{
+			text: l.Sprintf("diag.backlog_full", tracked, limit),
+			hint: l.Sprintf("diag.backlog_full_hint"),
+		})
+	} else {
+		fs = append(fs, finding{ok: true, text: l.Plural("diag.tracked", tracked, tracked)})
+	}
+
+	switch {
+	case h.lastReap.IsZero():
+	case h.lastReapErr != nil:
+		fs = append(fs, finding{
+			text: l.Sprintf("diag.reap_failed", now.Sub(h.lastReap).Round(time.Second).String(), h.lastReapCount, errorCode(l, h.lastReapErr)),
+			hint: l.Sprintf("diag.reap_failed_hint"),
+		})
+	default:
+		fs = append(fs, finding{ok: true, text: l.Plural("diag.reaped", h.lastReapCount, now.Sub(h.lastReap).Round(time.Second).String(), h.lastReapCount)})
+	}
+
+	if pending, deleted, failed := c.SingleDeleteProgress(); pending > 0 || failed > 0 {
+		f := finding{ok: failed == 0, text: l.Sprintf("diag.single", pending, deleted, failed)}
+		if failed > 0 {
+			f.hint = l.Sprintf("diag.single_hint")
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// formatFindings writes the check command's full report.
+func formatFindings(fs []finding) string {
+	var buf bytes.Buffer
+	for _, f := range fs {
+		if f.ok {
+			buf.WriteString("✅ ")
+		} else {
+			buf.WriteString("⚠️ ")
+		}
+		buf.WriteString(f.text)
+		buf.WriteByte('\n')
+		if f.hint != "" {
+			buf.WriteString("   ↳ ")
+			buf.WriteString(f.hint)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.String()
+}
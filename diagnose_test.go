@@ -0,0 +1,44 @@
+package autodelete
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestDiagnose(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	for i := 0; i < 3; i++ {
+		api.post(testChannelID, clock.Now())
+	}
+	c := loadTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Minute, WarnMode: WarnModeReact})
+
+	report := formatFindings(c.Diagnose(localeEnglish))
+	for _, want := range []string{"✅ I have the permissions", "✅ The message history was loaded 0s ago", "✅ 3 messages are waiting"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("healthy report does not contain %q:\n%s", want, report)
+		}
+	}
+
+	api.perms = discordgo.PermissionAll &^ (discordgo.PermissionManageMessages | discordgo.PermissionAddReactions)
+	api.bulkErr = restError(50035)
+	clock.Advance(2 * time.Minute)
+	b.reapWorker(b.reaper, reapWorkItem{ch: c, due: clock.Now()})
+	clock.Advance(time.Minute)
+
+	report = formatFindings(c.Diagnose(localeEnglish))
+	for _, want := range []string{
+		"⚠️ I am missing the Manage Messages permission.\n   ↳ Without it",
+		"⚠️ I am missing the Add Reactions permission.",
+		"⚠️ The last deletion, 1m0s ago, failed after 0 messages (Discord error 50035: fake error).",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "I have the permissions") {
+		t.Errorf("report claims all permissions:\n%s", report)
+	}
+}
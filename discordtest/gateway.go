@@ -0,0 +1,171 @@
+package discordtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// HeartbeatInterval is sent in the gateway Hello, in milliseconds.
+const HeartbeatInterval = 41250
+
+type gatewayPayload struct {
+	Op   int             `json:"op"`
+	Seq  int64           `json:"s,omitempty"`
+	Type string          `json:"t,omitempty"`
+	Data json.RawMessage `json:"d"`
+}
+
+type gateway struct {
+	upgrader websocket.Upgrader
+
+	mu    sync.Mutex
+	conns map[*gatewayConn]struct{}
+	// Identify payloads received, in order.
+	identifies []json.RawMessage
+	ready      chan struct{}
+	readyOnce  sync.Once
+}
+
+type gatewayConn struct {
+	ws *websocket.Conn
+
+	mu  sync.Mutex
+	seq int64
+}
+
+func (g *gateway) init() {
+	g.conns = make(map[*gatewayConn]struct{})
+	g.ready = make(chan struct{})
+}
+
+func (g *gateway) closeAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for c := range g.conns {
+		c.ws.Close()
+	}
+}
+
+func (c *gatewayConn) send(op int, typ string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := gatewayPayload{Op: op, Type: typ, Data: raw}
+	if op == 0 {
+		c.seq++
+		p.Seq = c.seq
+	}
+	return c.ws.WriteJSON(p)
+}
+
+// Ready is closed once a client has identified and been sent READY and the
+// GUILD_CREATE events.
+func (s *Server) Ready() <-chan struct{} {
+	return s.gw.ready
+}
+
+// Identifies returns the raw identify payloads sent by clients.
+func (s *Server) Identifies() []json.RawMessage {
+	s.gw.mu.Lock()
+	defer s.gw.mu.Unlock()
+	return append([]json.RawMessage(nil), s.gw.identifies...)
+}
+
+// Dispatch sends a gateway event to every identified connection. data is
+// marshalled as the event's "d" field.
+func (s *Server) Dispatch(eventType string, data interface{}) {
+	s.gw.mu.Lock()
+	conns := make([]*gatewayConn, 0, len(s.gw.conns))
+	for c := range s.gw.conns {
+		conns = append(conns, c)
+	}
+	s.gw.mu.Unlock()
+
+	for _, c := range conns {
+		c.send(0, eventType, data)
+	}
+}
+
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.gw.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &gatewayConn{ws: ws}
+	defer ws.Close()
+
+	if err := c.send(10, "", map[string]interface{}{"heartbeat_interval": HeartbeatInterval}); err != nil {
+		return
+	}
+
+loop:
+	for {
+		var p gatewayPayload
+		if err := ws.ReadJSON(&p); err != nil {
+			break
+		}
+		switch p.Op {
+		case 1: // Heartbeat
+			c.send(11, "", nil)
+		case 2: // Identify
+			s.gw.mu.Lock()
+			s.gw.identifies = append(s.gw.identifies, p.Data)
+			s.gw.mu.Unlock()
+			if err := s.sendReady(c); err != nil {
+				break loop
+			}
+			s.gw.mu.Lock()
+			s.gw.conns[c] = struct{}{}
+			s.gw.mu.Unlock()
+			s.gw.readyOnce.Do(func() { close(s.gw.ready) })
+		case 6: // Resume
+			c.send(0, "RESUMED", map[string]interface{}{})
+			s.gw.mu.Lock()
+			s.gw.conns[c] = struct{}{}
+			s.gw.mu.Unlock()
+		}
+	}
+
+	s.gw.mu.Lock()
+	delete(s.gw.conns, c)
+	s.gw.mu.Unlock()
+}
+
+func (s *Server) sendReady(c *gatewayConn) error {
+	s.mu.Lock()
+	unavailable := make([]map[string]interface{}, 0, len(s.guilds))
+	guilds := make([][]byte, 0, len(s.guilds))
+	for id, g := range s.guilds {
+		unavailable = append(unavailable, map[string]interface{}{"id": id, "unavailable": true})
+		raw, err := json.Marshal(g)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		guilds = append(guilds, raw)
+	}
+	ready := map[string]interface{}{
+		"v":                8,
+		"session_id":       "fake-session",
+		"user":             s.botUser,
+		"guilds":           unavailable,
+		"private_channels": []interface{}{},
+	}
+	s.mu.Unlock()
+
+	if err := c.send(0, "READY", ready); err != nil {
+		return err
+	}
+	for _, raw := range guilds {
+		if err := c.send(0, "GUILD_CREATE", json.RawMessage(raw)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
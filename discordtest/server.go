@@ -0,0 +1,621 @@
+// Package discordtest is a fake Discord server for offline integration tests.
+//
+// It emulates the subset of the REST API used by AutoDelete - channels,
+// messages, bulk delete with the 14-day rule, pins, guild members and the
+// gateway lookup - plus a minimal gateway websocket. Requests can be made to
+// fail with JSON or CloudFlare-style HTML 429 responses.
+//
+// Point a discordgo.Session at the server by using Transport() as its HTTP
+// client transport; requests for discord.com are rewritten to the fake.
+package discordtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+// Discord error codes returned by the fake.
+const (
+	ErrCodeUnknownChannel  = 10003
+	ErrCodeUnknownGuild    = 10004
+	ErrCodeUnknownMember   = 10007
+	ErrCodeUnknownMessage  = 10008
+	ErrCodeMissingAccess   = 50001
+	ErrCodeInvalidBulk     = 50016
+	ErrCodeBulkDeleteOld   = 50034
+	ErrCodeTooManyMessages = 30003
+)
+
+// CloudFlareRateLimitPage is served for HTML ratelimit responses.
+const CloudFlareRateLimitPage = `<!DOCTYPE html>
+<html><head><title>Access denied | discord.com used Cloudflare to restrict access</title></head>
+<body><h1>Error 1015</h1><h2>You are being rate limited</h2></body></html>`
+
+// Server is a fake Discord API server. The zero value is not usable; call
+// NewServer.
+type Server struct {
+	// Now is used for the 14-day bulk delete rule and for new message IDs.
+	Now func() time.Time
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	seq      int
+	botUser  *discordgo.User
+	guilds   map[string]*discordgo.Guild
+	channels map[string]*discordgo.Channel
+	members  map[string]map[string]*discordgo.Member
+	// oldest first
+	messages map[string][]*discordgo.Message
+	// newest pin first
+	pins       map[string][]string
+	ratelimits []*ratelimitRule
+	requests   []string
+
+	gw gateway
+}
+
+type ratelimitRule struct {
+	method string
+	path   *regexp.Regexp
+	count  int
+	html   bool
+	retry  time.Duration
+}
+
+// NewServer starts a fake Discord server. The bot user defaults to ID "1".
+func NewServer() *Server {
+	s := &Server{
+		Now:      time.Now,
+		botUser:  &discordgo.User{ID: "1", Username: "AutoDelete", Discriminator: "0000", Bot: true},
+		guilds:   make(map[string]*discordgo.Guild),
+		channels: make(map[string]*discordgo.Channel),
+		members:  make(map[string]map[string]*discordgo.Member),
+		messages: make(map[string][]*discordgo.Message),
+		pins:     make(map[string][]string),
+	}
+	s.gw.init()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", s.serveAPI)
+	mux.HandleFunc("/gateway", s.serveGateway)
+	mux.HandleFunc("/gateway/", s.serveGateway)
+	s.srv = httptest.NewServer(mux)
+	return s
+}
+
+// Close shuts down the server and any gateway connections.
+func (s *Server) Close() {
+	s.gw.closeAll()
+	s.srv.Close()
+}
+
+// URL is the base URL of the fake, e.g. "http://127.0.0.1:1234".
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Transport returns an http.RoundTripper that sends requests for any host to
+// the fake server.
+func (s *Server) Transport() http.RoundTripper {
+	target, _ := url.Parse(s.srv.URL)
+	return &rewriteTransport{target: target, t: http.DefaultTransport}
+}
+
+type rewriteTransport struct {
+	target *url.URL
+	t      http.RoundTripper
+}
+
+func (r *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+	req.Host = r.target.Host
+	return r.t.RoundTrip(req)
+}
+
+/*************
+ *  Fixtures *
+ *************/
+
+// SetBotUser replaces the user returned for /users/@me and in READY.
+func (s *Server) SetBotUser(u *discordgo.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.botUser = u
+}
+
+// AddGuild adds a guild. Its Channels are added as well.
+func (s *Server) AddGuild(g *discordgo.Guild) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.guilds[g.ID] = g
+	if s.members[g.ID] == nil {
+		s.members[g.ID] = make(map[string]*discordgo.Member)
+	}
+	for _, ch := range g.Channels {
+		ch.GuildID = g.ID
+		s.channels[ch.ID] = ch
+	}
+}
+
+// AddChannel adds a channel to its guild.
+func (s *Server) AddChannel(ch *discordgo.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[ch.ID] = ch
+	if g := s.guilds[ch.GuildID]; g != nil {
+		g.Channels = append(g.Channels, ch)
+	}
+}
+
+// AddMember adds a guild member.
+func (s *Server) AddMember(guildID string, m *discordgo.Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.members[guildID] == nil {
+		s.members[guildID] = make(map[string]*discordgo.Member)
+	}
+	m.GuildID = guildID
+	s.members[guildID][m.User.ID] = m
+}
+
+// Snowflake returns a new, unique message ID for the given time.
+func (s *Server) Snowflake(ts time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snowflakeLocked(ts)
+}
+
+func (s *Server) snowflakeLocked(ts time.Time) string {
+	s.seq++
+	return snowflake.FromTime(ts, uint64(s.seq)).String()
+}
+
+// PostMessage adds a message as if it was posted at ts. It does not send a
+// gateway event; see Dispatch.
+func (s *Server) PostMessage(channelID, authorID, content string, ts time.Time) *discordgo.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.postLocked(channelID, &discordgo.User{ID: authorID}, content, ts)
+}
+
+func (s *Server) postLocked(channelID string, author *discordgo.User, content string, ts time.Time) *discordgo.Message {
+	m := &discordgo.Message{
+		ID:        s.snowflakeLocked(ts),
+		ChannelID: channelID,
+		Content:   content,
+		Timestamp: discordgo.Timestamp(ts.UTC().Format(time.RFC3339Nano)),
+		Author:    author,
+	}
+	if ch := s.channels[channelID]; ch != nil {
+		m.GuildID = ch.GuildID
+		ch.LastMessageID = m.ID
+	}
+	msgs := append(s.messages[channelID], m)
+	sort.Slice(msgs, func(i, j int) bool { return snowflake.Less(msgs[i].ID, msgs[j].ID) })
+	s.messages[channelID] = msgs
+	return m
+}
+
+// Messages returns the messages in a channel, oldest first.
+func (s *Server) Messages(channelID string) []*discordgo.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*discordgo.Message(nil), s.messages[channelID]...)
+}
+
+// Pin pins a message and updates the channel's last pin timestamp.
+func (s *Server) Pin(channelID, messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pinLocked(channelID, messageID)
+}
+
+func (s *Server) pinLocked(channelID, messageID string) {
+	for _, v := range s.pins[channelID] {
+		if v == messageID {
+			return
+		}
+	}
+	s.pins[channelID] = append([]string{messageID}, s.pins[channelID]...)
+	if ch := s.channels[channelID]; ch != nil {
+		ch.LastPinTimestamp = discordgo.Timestamp(s.Now().UTC().Format(time.RFC3339))
+	}
+}
+
+// RateLimit makes the next count requests matching method and the path
+// pattern fail with a 429. The pattern is matched against the path after the
+// API version, e.g. `^channels/\d+/messages$`. If html is true, the response
+// is a CloudFlare HTML page instead of a JSON body.
+func (s *Server) RateLimit(method, pathPattern string, count int, html bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ratelimits = append(s.ratelimits, &ratelimitRule{
+		method: method,
+		path:   regexp.MustCompile(pathPattern),
+		count:  count,
+		html:   html,
+		retry:  10 * time.Millisecond,
+	})
+}
+
+// Requests returns a log of "METHOD path" for every API request served.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+/**********
+ *  REST  *
+ **********/
+
+var apiPrefix = regexp.MustCompile(`^/api/v\d+/`)
+
+type route struct {
+	method  string
+	pattern *regexp.Regexp
+	handler func(s *Server, r *http.Request, args []string) (int, interface{})
+}
+
+func newRoute(method, pattern string, h func(s *Server, r *http.Request, args []string) (int, interface{})) route {
+	return route{method, regexp.MustCompile("^" + pattern + "$"), h}
+}
+
+var routes = []route{
+	newRoute("GET", `gateway`, (*Server).getGateway),
+	newRoute("GET", `gateway/bot`, (*Server).getGateway),
+	newRoute("GET", `users/@me`, (*Server).getMe),
+	newRoute("DELETE", `users/@me/guilds/(\d+)`, (*Server).leaveGuild),
+	newRoute("GET", `guilds/(\d+)`, (*Server).getGuild),
+	newRoute("GET", `guilds/(\d+)/channels`, (*Server).getGuildChannels),
+	newRoute("GET", `guilds/(\d+)/roles`, (*Server).getGuildRoles),
+	newRoute("GET", `guilds/(\d+)/members/(\d+)`, (*Server).getMember),
+	newRoute("GET", `channels/(\d+)`, (*Server).getChannel),
+	newRoute("GET", `channels/(\d+)/messages`, (*Server).getMessages),
+	newRoute("POST", `channels/(\d+)/messages`, (*Server).postMessage),
+	newRoute("GET", `channels/(\d+)/messages/(\d+)`, (*Server).getMessage),
+	newRoute("DELETE", `channels/(\d+)/messages/(\d+)`, (*Server).deleteMessage),
+	newRoute("POST", `channels/(\d+)/messages/bulk-delete`, (*Server).bulkDelete),
+	newRoute("GET", `channels/(\d+)/pins`, (*Server).getPins),
+	newRoute("PUT", `channels/(\d+)/pins/(\d+)`, (*Server).putPin),
+	newRoute("DELETE", `channels/(\d+)/pins/(\d+)`, (*Server).deletePin),
+	newRoute("PUT", `channels/(\d+)/messages/(\d+)/reactions/([^/]+)/@me`, (*Server).noContent),
+	newRoute("DELETE", `channels/(\d+)/messages/(\d+)/reactions/([^/]+)/([^/]+)`, (*Server).noContent),
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func errorBody(code int, msg string) apiError {
+	return apiError{Code: code, Message: msg}
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	path := apiPrefix.ReplaceAllString(r.URL.Path, "")
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+path)
+	rule := s.matchRatelimitLocked(r.Method, path)
+	s.mu.Unlock()
+
+	if rule != nil {
+		writeRatelimit(w, rule)
+		return
+	}
+
+	for _, rt := range routes {
+		if rt.method != r.Method {
+			continue
+		}
+		m := rt.pattern.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		status, body := rt.handler(s, r, m[1:])
+		writeJSON(w, status, body)
+		return
+	}
+	writeJSON(w, http.StatusNotFound, errorBody(0, "404: Not Found"))
+}
+
+func (s *Server) matchRatelimitLocked(method, path string) *ratelimitRule {
+	for i, rule := range s.ratelimits {
+		if rule.method != method || !rule.path.MatchString(path) {
+			continue
+		}
+		rule.count--
+		if rule.count <= 0 {
+			s.ratelimits = append(s.ratelimits[:i:i], s.ratelimits[i+1:]...)
+		}
+		return rule
+	}
+	return nil
+}
+
+func writeRatelimit(w http.ResponseWriter, rule *ratelimitRule) {
+	if rule.html {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, CloudFlareRateLimitPage)
+		return
+	}
+	retry := rule.retry.Seconds()
+	w.Header().Set("Retry-After", strconv.FormatFloat(retry, 'f', -1, 64))
+	writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"message":     "You are being rate limited.",
+		"retry_after": retry,
+		"global":      false,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) getGateway(r *http.Request, args []string) (int, interface{}) {
+	wsURL := "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/gateway"
+	return http.StatusOK, map[string]interface{}{"url": wsURL, "shards": 1}
+}
+
+func (s *Server) getMe(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return http.StatusOK, s.botUser
+}
+
+func (s *Server) leaveGuild(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.guilds[args[0]] == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownGuild, "Unknown Guild")
+	}
+	delete(s.guilds, args[0])
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) getGuild(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.guilds[args[0]]
+	if g == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownGuild, "Unknown Guild")
+	}
+	cp := *g
+	cp.Channels = nil
+	return http.StatusOK, &cp
+}
+
+func (s *Server) getGuildChannels(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.guilds[args[0]]
+	if g == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownGuild, "Unknown Guild")
+	}
+	out := make([]discordgo.Channel, len(g.Channels))
+	for i, ch := range g.Channels {
+		out[i] = *ch
+	}
+	return http.StatusOK, out
+}
+
+func (s *Server) getGuildRoles(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.guilds[args[0]]
+	if g == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownGuild, "Unknown Guild")
+	}
+	return http.StatusOK, g.Roles
+}
+
+func (s *Server) getMember(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.members[args[0]][args[1]]
+	if m == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownMember, "Unknown Member")
+	}
+	return http.StatusOK, m
+}
+
+func (s *Server) getChannel(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := s.channels[args[0]]
+	if ch == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	cp := *ch
+	return http.StatusOK, &cp
+}
+
+func (s *Server) getMessages(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channels[args[0]] == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	q := r.URL.Query()
+	limit := 50
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= 100 {
+		limit = v
+	}
+	before, after := q.Get("before"), q.Get("after")
+
+	msgs := s.messages[args[0]]
+	out := []*discordgo.Message{}
+	// newest first
+	for i := len(msgs) - 1; i >= 0 && len(out) < limit; i-- {
+		if before != "" && !snowflake.Less(msgs[i].ID, before) {
+			continue
+		}
+		if after != "" && !snowflake.Less(after, msgs[i].ID) {
+			continue
+		}
+		out = append(out, msgs[i])
+	}
+	return http.StatusOK, out
+}
+
+func (s *Server) postMessage(r *http.Request, args []string) (int, interface{}) {
+	var data discordgo.MessageSend
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &data); err != nil {
+		return http.StatusBadRequest, errorBody(50109, "Invalid JSON")
+	}
+	s.mu.Lock()
+	if s.channels[args[0]] == nil {
+		s.mu.Unlock()
+		return http.StatusNotFound, errorBody(ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	m := s.postLocked(args[0], s.botUser, data.Content, s.Now())
+	if data.Embed != nil {
+		m.Embeds = []*discordgo.MessageEmbed{data.Embed}
+	}
+	s.mu.Unlock()
+
+	s.Dispatch("MESSAGE_CREATE", m)
+	return http.StatusOK, m
+}
+
+func (s *Server) getMessage(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, m := s.findLocked(args[0], args[1])
+	if m == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownMessage, "Unknown Message")
+	}
+	return http.StatusOK, m
+}
+
+func (s *Server) deleteMessage(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	i, _ := s.findLocked(args[0], args[1])
+	if i == -1 {
+		s.mu.Unlock()
+		return http.StatusNotFound, errorBody(ErrCodeUnknownMessage, "Unknown Message")
+	}
+	s.removeLocked(args[0], i)
+	guildID := s.channels[args[0]].GuildID
+	s.mu.Unlock()
+
+	s.Dispatch("MESSAGE_DELETE", &discordgo.Message{ID: args[1], ChannelID: args[0], GuildID: guildID})
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) bulkDelete(r *http.Request, args []string) (int, interface{}) {
+	var data struct {
+		Messages []string `json:"messages"`
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &data); err != nil {
+		return http.StatusBadRequest, errorBody(50109, "Invalid JSON")
+	}
+	if len(data.Messages) < 2 || len(data.Messages) > 100 {
+		return http.StatusBadRequest, errorBody(ErrCodeInvalidBulk, "You can only bulk delete 2 to 100 messages.")
+	}
+
+	s.mu.Lock()
+	if s.channels[args[0]] == nil {
+		s.mu.Unlock()
+		return http.StatusNotFound, errorBody(ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	for _, id := range data.Messages {
+		if snowflake.OlderThan(id, snowflake.BulkDeleteMaxAge, s.Now()) {
+			s.mu.Unlock()
+			return http.StatusBadRequest, errorBody(ErrCodeBulkDeleteOld, "You can only bulk delete messages that are under 14 days old.")
+		}
+	}
+	var deleted []string
+	for _, id := range data.Messages {
+		if i, _ := s.findLocked(args[0], id); i != -1 {
+			s.removeLocked(args[0], i)
+			deleted = append(deleted, id)
+		}
+	}
+	guildID := s.channels[args[0]].GuildID
+	s.mu.Unlock()
+
+	s.Dispatch("MESSAGE_DELETE_BULK", &discordgo.MessageDeleteBulk{Messages: deleted, ChannelID: args[0], GuildID: guildID})
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) getPins(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channels[args[0]] == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownChannel, "Unknown Channel")
+	}
+	out := []*discordgo.Message{}
+	for _, id := range s.pins[args[0]] {
+		if _, m := s.findLocked(args[0], id); m != nil {
+			out = append(out, m)
+		}
+	}
+	return http.StatusOK, out
+}
+
+func (s *Server) putPin(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, m := s.findLocked(args[0], args[1]); m == nil {
+		return http.StatusNotFound, errorBody(ErrCodeUnknownMessage, "Unknown Message")
+	}
+	s.pinLocked(args[0], args[1])
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) deletePin(r *http.Request, args []string) (int, interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pins := s.pins[args[0]]
+	for i, v := range pins {
+		if v == args[1] {
+			s.pins[args[0]] = append(pins[:i:i], pins[i+1:]...)
+			return http.StatusNoContent, nil
+		}
+	}
+	return http.StatusNotFound, errorBody(ErrCodeUnknownMessage, "Unknown Message")
+}
+
+func (s *Server) noContent(r *http.Request, args []string) (int, interface{}) {
+	return http.StatusNoContent, nil
+}
+
+func (s *Server) findLocked(channelID, messageID string) (int, *discordgo.Message) {
+	for i, m := range s.messages[channelID] {
+		if m.ID == messageID {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+func (s *Server) removeLocked(channelID string, i int) {
+	msgs := s.messages[channelID]
+	s.messages[channelID] = append(msgs[:i:i], msgs[i+1:]...)
+}
@@ -0,0 +1,129 @@
+package autodelete
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A command can be invoked by starting a message with a mention of the bot,
+// a mention of the bot's managed role, or the guild's prefix. In a direct
+// message, no prefix is needed.
+
+// maxPrefixLength bounds the prefix command's argument.
+const maxPrefixLength = 16
+
+// dmCommands are the commands that work in a direct message. They name the
+// channels they act on by ID.
+var dmCommands = map[string]bool{
+	"help":  true,
+	"set":   true,
+	"start": true,
+	"setup": true,
+}
+
+// isOwnRoleMention reports whether word mentions the role Discord manages for
+// the bot in the guild.
+func (b *Bot) isOwnRoleMention(guildID, word string) bool {
+	if !strings.HasPrefix(word, "<@&") || !strings.HasSuffix(word, ">") {
+		return false
+	}
+	roleID := word[len("<@&") : len(word)-1]
+	role, err := b.s.State.Role(guildID, roleID)
+	if err != nil || !role.Managed {
+		return false
+	}
+	if member, err := b.s.State.Member(guildID, b.me.ID); err == nil {
+		for _, id := range member.Roles {
+			if id == roleID {
+				return true
+			}
+		}
+		return false
+	}
+	// Not in the State yet; the managed role is named after the bot
+	return role.Name == b.me.Username
+}
+
+// commandWords returns the command and its arguments if the message invokes
+// the bot, or nil. In a direct message, only a known command does; anything
+// else is someone chatting with the bot.
+func (b *Bot) commandWords(m *discordgo.Message, guildID string) []string {
+	words := strings.Fields(m.Content)
+	if len(words) == 0 {
+		return nil
+	}
+	switch first := words[0]; {
+	case first == "<@"+b.me.ID+">" || first == "<@!"+b.me.ID+">":
+		return words[1:]
+	case guildID == "":
+		if _, ok := commands[strings.ToLower(first)]; ok {
+			return words
+		}
+		return nil
+	case b.isOwnRoleMention(guildID, first):
+		return words[1:]
+	}
+	if prefix := b.guildSettings(guildID).Prefix; prefix != "" && strings.EqualFold(words[0], prefix) {
+		return words[1:]
+	}
+	return nil
+}
+
+// validPrefix reports whether a word can be used as a prefix. Mentions are
+// left out, as they already work.
+func validPrefix(prefix string) bool {
+	return len(prefix) <= maxPrefixLength && !strings.ContainsAny(prefix, "<>@#`")
+}
+
+// HandleMentions dispatches commands.
+func (b *Bot) HandleMentions(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author == nil || m.Author.ID == b.me.ID {
+		return
+	}
+	fun, args := b.dispatch(m.Message)
+	if fun != nil {
+		go fun(b, m.Message, args)
+	}
+}
+
+// dispatch finds the command a message invokes, and logs it. Other messages
+// are not logged, as they are not meant for the bot.
+func (b *Bot) dispatch(m *discordgo.Message) (fun func(b *Bot, m *discordgo.Message, rest []string), args []string) {
+	ch, err := b.Channel(m.ChannelID)
+	if err != nil {
+		fmt.Printf("[ cmd] got message from %s (%s#%s) in unknown channel %s\n",
+			m.Author.Mention(), m.Author.Username, m.Author.Discriminator,
+			m.ChannelID)
+		return nil, nil
+	}
+	words := b.commandWords(m, ch.GuildID)
+	if words == nil {
+		return nil, nil
+	}
+
+	where := "direct message " + ch.ID
+	if ch.GuildID != "" {
+		where = fmt.Sprintf("%s (id %s) guild %s", ch.Name, ch.ID, ch.GuildID)
+		if guild, err := b.s.State.Guild(ch.GuildID); err == nil {
+			where = fmt.Sprintf("%s (id %s) guild %s (id %s)", ch.Name, ch.ID, guild.Name, guild.ID)
+		}
+	}
+
+	if len(words) > 0 {
+		cmd := strings.ToLower(words[0])
+		fun, ok := commands[cmd]
+		if ok && (ch.GuildID != "" || dmCommands[cmd]) {
+			fmt.Printf("[ cmd] got command from %s (%s#%s) in %s:\n  %v\n",
+				m.Author.Mention(), m.Author.Username, m.Author.Discriminator,
+				where, words)
+			return fun, words[1:]
+		}
+		if ok {
+			b.api.ChannelMessageSend(m.ChannelID, localeEnglish.Sprintf("dm.guild_only"))
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,133 @@
+package autodelete
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestDispatch(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	const dmChannelID = "700"
+	api.addChannel(&discordgo.Channel{ID: dmChannelID, Type: discordgo.ChannelTypeDM})
+	if err := b.s.State.RoleAdd(testGuildID, &discordgo.Role{ID: "60", Name: "AutoDelete", Managed: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.s.State.RoleAdd(testGuildID, &discordgo.Role{ID: "61", Name: "Mods"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.s.State.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: b.me, Roles: []string{"60"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.saveGuildSettings(testGuildID, GuildSettings{Prefix: "!ad"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		channelID, content string
+		want               []string
+	}{
+		{testChannelID, "<@1> set 10", []string{"10"}},
+		{testChannelID, "<@!1> HELP", []string{}},
+		{testChannelID, "<@&60> check full", []string{"full"}},
+		{testChannelID, "<@&61> check", nil},
+		{testChannelID, "!AD set 5m", []string{"5m"}},
+		{testChannelID, "!adset 5m", nil},
+		{testChannelID, "set 10", nil},
+		{testChannelID, "<@1> hello there", nil},
+		{dmChannelID, "set 400000000000000001 10", []string{"400000000000000001", "10"}},
+		{dmChannelID, "<@1> help", []string{}},
+		{dmChannelID, "check", nil},
+		{dmChannelID, "hello there", nil},
+		{dmChannelID, "<@1> hello there", nil},
+	} {
+		m := &discordgo.Message{
+			ChannelID: tc.channelID,
+			Content:   tc.content,
+			Author:    &discordgo.User{ID: "1001"},
+			Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+		}
+		fun, args := b.dispatch(m)
+		if (fun != nil) != (tc.want != nil) {
+			t.Errorf("%q in %s: command found = %v", tc.content, tc.channelID, fun != nil)
+			continue
+		}
+		if tc.want != nil && !reflect.DeepEqual(args, tc.want) {
+			t.Errorf("%q in %s: args = %q, want %q", tc.content, tc.channelID, args, tc.want)
+		}
+	}
+	if words := b.commandWords(&discordgo.Message{Content: "hello there"}, ""); words != nil {
+		t.Errorf("chat in a direct message taken as command %q", words)
+	}
+	if sent := sentMessages(api); len(sent) != 1 || !strings.Contains(sent[0], "only works in a server") {
+		t.Errorf("sent %q, want one reply to the server-only command", sent)
+	}
+}
+
+func TestSetFromDirectMessage(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	const dmChannelID = "700"
+	api.addChannel(&discordgo.Channel{ID: dmChannelID, Type: discordgo.ChannelTypeDM})
+	m := &discordgo.Message{
+		ID:        "900",
+		ChannelID: dmChannelID,
+		Author:    &discordgo.User{ID: "1001"},
+		Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+	}
+
+	CommandModify(b, m, []string{"10"})
+	sent := sentMessages(api)
+	if len(sent) != 1 || !strings.Contains(sent[0], "by ID") {
+		t.Fatalf("sent %q, want a request for channel IDs", sent)
+	}
+
+	const channelID = "400000000000000002"
+	api.addChannel(&discordgo.Channel{ID: channelID, GuildID: testGuildID, Name: "by-id"})
+	CommandModify(b, m, []string{channelID, "10"})
+	sent = sentMessages(api)
+	if got, want := sent[len(sent)-1], "✅ <#"+channelID+">: deleted after 10 messages"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if conf, err := b.storage.GetChannel(channelID); err != nil || conf.MaxMessages != 10 {
+		t.Errorf("saved %+v, %v", conf, err)
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	m := &discordgo.Message{
+		ChannelID: testChannelID,
+		Author:    &discordgo.User{ID: "1001"},
+		Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+	}
+	lastSent := func() string {
+		sent := sentMessages(api)
+		return sent[len(sent)-1]
+	}
+
+	CommandPrefix(b, m, []string{"<@1>"})
+	if got := lastSent(); !strings.Contains(got, "cannot be a mention") {
+		t.Errorf("mention prefix: got %q", got)
+	}
+	api.perms = discordgo.PermissionAll &^ discordgo.PermissionManageServer
+	CommandPrefix(b, m, []string{"!ad"})
+	if got := lastSent(); !strings.Contains(got, "Manage Server") {
+		t.Errorf("without Manage Server: got %q", got)
+	}
+	api.perms = discordgo.PermissionAll
+	CommandPrefix(b, m, []string{"!ad"})
+	if got := b.guildSettings(testGuildID).Prefix; got != "!ad" {
+		t.Errorf("prefix = %q, want !ad", got)
+	}
+	CommandPrefix(b, m, nil)
+	if got := lastSent(); !strings.Contains(got, "`!ad`") {
+		t.Errorf("show prefix: got %q", got)
+	}
+	CommandPrefix(b, m, []string{"off"})
+	if saved, _ := b.storage.GetGuildSettings(testGuildID); saved.Prefix != "" {
+		t.Errorf("saved prefix %q after off", saved.Prefix)
+	}
+}
@@ -0,0 +1,177 @@
+package autodelete
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+// EditPolicy controls what happens to a tracked message when it is edited.
+type EditPolicy string
+
+const (
+	// Edits do not change when a message is deleted.
+	EditPolicyIgnore EditPolicy = ""
+	// The message's lifetime starts over from the edit, and it counts as
+	// the newest message for MaxMessages.
+	EditPolicyRestart EditPolicy = "restart"
+	// Messages that have been edited to carry an attachment are kept, as if
+	// they were pinned.
+	EditPolicyKeepAttachments EditPolicy = "keep_attachments"
+)
+
+// ParseEditPolicy accepts the names used by the set command.
+func ParseEditPolicy(s string) (EditPolicy, error) {
+	switch EditPolicy(s) {
+	case "ignore", EditPolicyIgnore:
+		return EditPolicyIgnore, nil
+	case EditPolicyRestart, EditPolicyKeepAttachments:
+		return EditPolicy(s), nil
+	}
+	return EditPolicyIgnore, fmt.Errorf("unknown edit policy %q", s)
+}
+
+// An edited message that restarted its lifetime is stored in liveMessages
+// under a synthetic key: a snowflake for the edit time, with the low bits of
+// the real ID. The ring stays sorted by effective time, and editedMessages
+// maps the keys back to the real message IDs.
+type editedMessages struct {
+	byID  map[string]snowflake.ID
+	byKey map[snowflake.ID]string
+}
+
+func (e *editedMessages) set(msgID string, key snowflake.ID) {
+	if e.byID == nil {
+		e.byID = make(map[string]snowflake.ID)
+		e.byKey = make(map[snowflake.ID]string)
+	}
+	e.byID[msgID] = key
+	e.byKey[key] = msgID
+}
+
+func (e *editedMessages) forget(key snowflake.ID) {
+	if msgID, ok := e.byKey[key]; ok {
+		delete(e.byKey, key)
+		delete(e.byID, msgID)
+	}
+}
+
+// liveKey returns the liveMessages key for a message ID. Must be called with
+// mu held.
+func (c *ManagedChannel) liveKey(msgID string) (snowflake.ID, bool) {
+	if key, ok := c.edits.byID[msgID]; ok {
+		return key, true
+	}
+	id, err := snowflake.Parse(msgID)
+	return id, err == nil
+}
+
+// liveMessageID returns the message ID for a liveMessages key. Must be called
+// with mu held.
+func (c *ManagedChannel) liveMessageID(key snowflake.ID) string {
+	if msgID, ok := c.edits.byKey[key]; ok {
+		return msgID
+	}
+	return key.String()
+}
+
+// removeLiveLocked removes a message from liveMessages. Must be called with mu
+// held.
+func (c *ManagedChannel) removeLiveLocked(msgID string) bool {
+	key, ok := c.liveKey(msgID)
+	if !ok {
+		return false
+	}
+	c.edits.forget(key)
+	if i, ok := c.liveMessages.Index(key); ok {
+		c.liveMessages.Remove(i)
+		return true
+	}
+	return false
+}
+
+// keptByEditPolicy reports whether the edit policy says to keep the message.
+// Must be called with mu held.
+func (c *ManagedChannel) keptByEditPolicy(m *discordgo.Message) bool {
+	return c.EditPolicy == EditPolicyKeepAttachments && m.EditedTimestamp != "" && len(m.Attachments) > 0
+}
+
+// effectiveTime is the time a message's lifetime counts from. Must be called
+// with mu held.
+func (c *ManagedChannel) effectiveTime(m *discordgo.Message) time.Time {
+	postedAt := snowflake.TimeOf(m.ID)
+	if c.EditPolicy != EditPolicyRestart || m.EditedTimestamp == "" {
+		return postedAt
+	}
+	editedAt, err := m.EditedTimestamp.Parse()
+	if err != nil || !editedAt.After(postedAt) {
+		return postedAt
+	}
+	return editedAt
+}
+
+// messageKeyLocked returns the key to track the message under in
+// liveMessages, recording it if the message restarted its lifetime. If the
+// message was tracked under an older key, that entry is removed. Must be
+// called with mu held.
+func (c *ManagedChannel) messageKeyLocked(m *discordgo.Message) (snowflake.ID, bool) {
+	id, err := snowflake.Parse(m.ID)
+	if err != nil {
+		return 0, false
+	}
+	key := id
+	if t := c.effectiveTime(m); t.After(id.Time()) {
+		key = snowflake.FromTime(t, uint64(id))
+	}
+
+	old, ok := c.edits.byID[m.ID]
+	if ok && key == id {
+		// Tracked under another key, e.g. a warning notice, and this copy
+		// says nothing new
+		return old, true
+	}
+	if !ok {
+		old = id
+	}
+	if old >= key {
+		return old, true
+	}
+	if i, ok := c.liveMessages.Index(old); ok {
+		c.liveMessages.Remove(i)
+	}
+	c.edits.forget(old)
+	c.edits.set(m.ID, key)
+	return key, true
+}
+
+// UpdateMessage re-evaluates a tracked message after an edit according to the
+// channel's EditPolicy.
+func (c *ManagedChannel) UpdateMessage(m *discordgo.Message) {
+	needReap := false
+
+	c.mu.Lock()
+	if c.killBit || c.EditPolicy == EditPolicyIgnore || m.EditedTimestamp == "" {
+		c.mu.Unlock()
+		return
+	}
+	if c.keptByEditPolicy(m) {
+		if c.removeLiveLocked(m.ID) {
+			c.keepLookup[m.ID] = true
+			needReap = true
+		}
+	} else if key, ok := c.liveKey(m.ID); ok {
+		if _, tracked := c.liveMessages.Index(key); tracked {
+			if newKey, _ := c.messageKeyLocked(m); newKey != key {
+				c.liveMessages.Push(newKey)
+				needReap = true
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if needReap {
+		c.bot.QueueReap(c)
+	}
+}
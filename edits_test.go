@@ -0,0 +1,142 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// editMessage marks a fake message as edited at ts and returns the update the
+// gateway would send.
+func editMessage(api *fakeAPI, channelID, msgID string, ts time.Time, attach bool) *discordgo.Message {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	_, m := api.findLocked(channelID, msgID)
+	m.EditedTimestamp = discordgo.Timestamp(ts.UTC().Format(time.RFC3339Nano))
+	if attach {
+		m.Attachments = append(m.Attachments, &discordgo.MessageAttachment{ID: "1", Filename: "a.png"})
+	}
+	cp := *m
+	return &cp
+}
+
+func TestEditRestartTime(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour, EditPolicy: EditPolicyRestart})
+	start := clock.Now()
+
+	a := postAndAdd(c, clock, api)
+	clock.Advance(5 * time.Second)
+	other := postAndAdd(c, clock, api)
+	clock.Advance(30 * time.Minute)
+	b.OnMessageUpdate(nil, &discordgo.MessageUpdate{Message: editMessage(api, c.ChannelID, a, clock.Now(), false)})
+
+	if got, want := liveIDs(c), []string{other, a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	if got, want := c.GetNextDeletionTime(), start.Add(time.Hour+5*time.Second); !got.Equal(want) {
+		t.Errorf("GetNextDeletionTime = %v, want %v", got, want)
+	}
+
+	clock.Advance(30*time.Minute + 10*time.Second)
+	if msgs, _, _, _ := c.collectMessagesToDelete(); !reflect.DeepEqual(msgs, []string{other}) {
+		t.Errorf("collected %v, want %v", msgs, other)
+	}
+	clock.Advance(30 * time.Minute)
+	if msgs, _, _, _ := c.collectMessagesToDelete(); !reflect.DeepEqual(msgs, []string{a}) {
+		t.Errorf("collected %v, want edited message %v", msgs, a)
+	}
+	c.mu.Lock()
+	if len(c.edits.byID) != 0 || len(c.edits.byKey) != 0 {
+		t.Errorf("edit keys not cleaned up: %v", c.edits)
+	}
+	c.mu.Unlock()
+}
+
+func TestEditRestartCount(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 2, EditPolicy: EditPolicyRestart})
+
+	a := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	other := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	c.UpdateMessage(editMessage(api, c.ChannelID, a, clock.Now(), false))
+	clock.Advance(time.Second)
+	postAndAdd(c, clock, api)
+
+	// The edited message counts as newer than the one posted after it.
+	if msgs, _, _, _ := c.collectMessagesToDelete(); !reflect.DeepEqual(msgs, []string{other}) {
+		t.Errorf("collected %v, want %v", msgs, other)
+	}
+}
+
+func TestEditIgnore(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	a := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	other := postAndAdd(c, clock, api)
+	c.UpdateMessage(editMessage(api, c.ChannelID, a, clock.Now(), true))
+	if got, want := liveIDs(c), []string{a, other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestEditKeepAttachments(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour, EditPolicy: EditPolicyKeepAttachments})
+
+	a := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	text := postAndAdd(c, clock, api)
+	c.UpdateMessage(editMessage(api, c.ChannelID, text, clock.Now(), false))
+	c.UpdateMessage(editMessage(api, c.ChannelID, a, clock.Now(), true))
+
+	if got, want := liveIDs(c), []string{text}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	c.mu.Lock()
+	if !c.keepLookup[a] {
+		t.Error("message with attachment not kept")
+	}
+	// Rebuilding from the backlog keeps it too.
+	c.keepLookup = make(map[string]bool)
+	c.liveMessages.Clear()
+	backlog, _ := api.ChannelMessages(c.ChannelID, 100, "", "", "")
+	c.mergeBacklog(backlog)
+	kept := c.keepLookup[a]
+	c.mu.Unlock()
+	if got, want := liveIDs(c), []string{text}; !kept || !reflect.DeepEqual(got, want) {
+		t.Errorf("after reload: liveMessages = %v, kept %v; want %v, true", got, kept, want)
+	}
+}
+
+func TestEditRestartMergeBacklog(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour, EditPolicy: EditPolicyRestart})
+
+	a := postAndAdd(c, clock, api)
+	clock.Advance(time.Second)
+	other := postAndAdd(c, clock, api)
+	clock.Advance(time.Minute)
+	// The edit event was missed, e.g. during a reconnect.
+	editMessage(api, c.ChannelID, a, clock.Now(), false)
+
+	backlog, _ := api.ChannelMessages(c.ChannelID, 100, "", "", "")
+	c.mu.Lock()
+	c.mergeBacklog(backlog)
+	c.mu.Unlock()
+	if got, want := liveIDs(c), []string{other, a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+
+	// An external delete still finds the edited message.
+	b.OnMessageDelete(nil, deleteEvent(c.ChannelID, a))
+	if got, want := liveIDs(c), []string{other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after delete: liveMessages = %v, want %v", got, want)
+	}
+}
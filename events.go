@@ -29,12 +29,13 @@ func (b *Bot) ConnectDiscord(shardID, shardCount int) error {
 		return err
 	}
 	b.s = s
+	b.api = s
 	state := discordgo.NewState()
 	state.TrackChannels = true
 	state.TrackEmojis = false
 	state.TrackMembers = false
-	state.TrackRoles = false
-	state.TrackVoice = false
+	state.TrackRoles = true
+	state.TrackVoice = true
 	state.TrackPresences = false
 	state.MaxMessageCount = 0
 	s.State = state
@@ -49,7 +50,7 @@ func (b *Bot) ConnectDiscord(shardID, shardCount int) error {
 	}
 	s.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages |
 		discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessages |
-		discordgo.IntentsDirectMessageReactions
+		discordgo.IntentsDirectMessageReactions | discordgo.IntentsGuildVoiceStates
 
 	// Configure the HTTP client
 	s.UserAgent = userAgent
@@ -58,6 +59,9 @@ func (b *Bot) ConnectDiscord(shardID, shardCount int) error {
 		return err
 	}
 	transport := &userAgentSetter{t: http.DefaultTransport}
+	if b.transport != nil {
+		transport.t = b.transport
+	}
 	s.Client = &http.Client{
 		Timeout:   20 * time.Second,
 		Jar:       runtimeCookieJar,
@@ -88,6 +92,14 @@ func (b *Bot) ConnectDiscord(shardID, shardCount int) error {
 	s.AddHandler(b.OnChannelPins)
 	s.AddHandler(b.HandleMentions)
 	s.AddHandler(b.OnMessage)
+	s.AddHandler(b.OnMessageUpdate)
+	s.AddHandler(b.OnMessageDelete)
+	s.AddHandler(b.OnMessageDeleteBulk)
+	s.AddHandler(b.OnVoiceStateUpdate)
+	s.AddHandler(b.OnGuildRoleUpdate)
+	s.AddHandler(b.OnGuildRoleDelete)
+	s.AddHandler(b.OnChannelUpdate)
+	s.AddHandler(b.OnGuildMemberUpdate)
 	me, err := s.User("@me")
 	if err != nil {
 		fmt.Println("get me:", err)
@@ -102,60 +114,6 @@ func (b *Bot) ConnectDiscord(shardID, shardCount int) error {
 	return nil
 }
 
-func (b *Bot) HandleMentions(s *discordgo.Session, m *discordgo.MessageCreate) {
-	found := false
-	for _, v := range m.Message.Mentions {
-		if v.ID == b.me.ID {
-			found = true
-			break
-		}
-	}
-	// TODO allow mentioning the bot role
-	// for _, roleID := range m.Message.MentionRoles {
-	// looks like <&1234roleid6789>
-	// }
-	if !found {
-		return
-	}
-
-	if len(m.Message.Content) == 0 {
-		return
-	}
-	split := strings.Fields(m.Message.Content)
-	if len(split) == 0 {
-		return
-	}
-	plainMention := "<@" + b.me.ID + ">"
-	nickMention := "<@!" + b.me.ID + ">"
-
-	ch, guild := b.GetMsgChGuild(m.Message)
-	if guild == nil {
-		fmt.Printf("[ cmd] got mention from %s (%s#%s) in unknown channel %s: %s\n",
-			m.Author.Mention(), m.Author.Username, m.Author.Discriminator,
-			m.Message.ChannelID, m.Message.Content)
-		return
-	}
-
-	if ((split[0] == plainMention) ||
-		(split[0] == nickMention)) && len(split) > 1 {
-		cmd := split[1]
-		cmd = strings.ToLower(cmd)
-		fun, ok := commands[cmd]
-		if ok {
-			fmt.Printf("[ cmd] got command from %s (%s#%s) in %s (id %s) guild %s (id %s):\n  %v\n",
-				m.Message.Author.Mention(), m.Message.Author.Username, m.Message.Author.Discriminator,
-				ch.Name, ch.ID, guild.Name, guild.ID,
-				split)
-			go fun(b, m.Message, split[2:])
-			return
-		}
-	}
-	fmt.Printf("[ cmd] got non-command from %s (%s#%s) in %s (id %s) guild %s (id %s):\n  %s\n",
-		m.Message.Author.Mention(), m.Message.Author.Username, m.Message.Author.Discriminator,
-		ch.Name, ch.ID, guild.Name, guild.ID,
-		m.Message.Content)
-}
-
 func (b *Bot) OnMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
 	b.mu.RLock()
 	mCh, ok := b.channels[m.Message.ChannelID]
@@ -173,6 +131,40 @@ func (b *Bot) OnMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
 	}
 }
 
+func (b *Bot) OnMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	b.mu.RLock()
+	mCh, ok := b.channels[m.ChannelID]
+	b.mu.RUnlock()
+	if !ok || mCh == nil {
+		return
+	}
+
+	mCh.UpdateMessage(m.Message)
+}
+
+func (b *Bot) OnMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	b.onMessagesDeleted(m.ChannelID, []string{m.ID})
+}
+
+func (b *Bot) OnMessageDeleteBulk(s *discordgo.Session, ev *discordgo.MessageDeleteBulk) {
+	b.onMessagesDeleted(ev.ChannelID, ev.Messages)
+}
+
+// onMessagesDeleted drops deleted messages from the channel's state. Our own
+// deletes land here too, but those messages are no longer tracked.
+func (b *Bot) onMessagesDeleted(channelID string, msgIDs []string) {
+	b.mu.RLock()
+	mCh, ok := b.channels[channelID]
+	b.mu.RUnlock()
+	if !ok || mCh == nil {
+		return
+	}
+
+	if mCh.RemoveMessages(msgIDs) > 0 && !mCh.IsDisabled() {
+		b.QueueReap(mCh)
+	}
+}
+
 func (b *Bot) OnChannelDelete(s *discordgo.Session, ev *discordgo.ChannelDelete) {
 	b.mu.RLock()
 	mCh, ok := b.channels[ev.Channel.ID]
@@ -0,0 +1,81 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func deleteEvent(channelID, msgID string) *discordgo.MessageDelete {
+	return &discordgo.MessageDelete{Message: &discordgo.Message{ID: msgID, ChannelID: channelID}}
+}
+
+func TestOnMessageDeleteCount(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 3})
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, postAndAdd(c, clock, api))
+		clock.Advance(time.Second)
+	}
+	if it := b.reaper.items.Peek(); it == nil || it.nextReap.After(clock.Now()) {
+		t.Fatalf("reap not due with 4 of 3 messages: %v", it)
+	}
+
+	// A moderator removes one; the channel is back under the limit, and the
+	// reap is pushed back.
+	b.OnMessageDelete(nil, deleteEvent(c.ChannelID, ids[2]))
+	if got, want := liveIDs(c), []string{ids[0], ids[1], ids[3]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	if it := b.reaper.items.Peek(); it == nil || !it.nextReap.After(clock.Now()) {
+		t.Errorf("reap still due after external delete: %v", it)
+	}
+	if msgs, _, _, _ := c.collectMessagesToDelete(); len(msgs) != 0 {
+		t.Errorf("collected %v with 3 of 3 messages", msgs)
+	}
+
+	next := postAndAdd(c, clock, api)
+	if msgs, _, _, _ := c.collectMessagesToDelete(); !reflect.DeepEqual(msgs, []string{ids[0]}) {
+		t.Errorf("collected %v, want only the oldest", msgs)
+	}
+	if got, want := liveIDs(c), []string{ids[1], ids[3], next}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestOnMessageDeleteBulk(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 3})
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, postAndAdd(c, clock, api))
+		clock.Advance(time.Second)
+	}
+	c.mu.Lock()
+	c.keepLookup["5"] = true
+	c.mu.Unlock()
+
+	b.OnMessageDeleteBulk(nil, &discordgo.MessageDeleteBulk{
+		ChannelID: c.ChannelID,
+		Messages:  []string{ids[0], ids[3], "5", "6"},
+	})
+	if got, want := liveIDs(c), []string{ids[1], ids[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	c.mu.Lock()
+	if c.keepLookup["5"] {
+		t.Error("deleted message still in keepLookup")
+	}
+	c.mu.Unlock()
+
+	// Events for other channels are ignored.
+	b.OnMessageDelete(nil, deleteEvent("999", ids[1]))
+	if got := liveIDs(c); len(got) != 2 {
+		t.Errorf("liveMessages = %v after delete in another channel", got)
+	}
+}
@@ -0,0 +1,629 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+/****************
+ *  Fake Clock  *
+ ****************/
+
+// fakeClock only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool
+	armed  map[time.Duration]int
+	total  int
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]bool),
+		armed:  make(map[time.Duration]int),
+	}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward and fires every timer that came due.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for t := range f.timers {
+		if !t.when.After(f.now) {
+			f.fireLocked(t)
+		}
+	}
+}
+
+func (f *fakeClock) fireLocked(t *fakeTimer) {
+	delete(f.timers, t)
+	select {
+	case t.c <- f.now:
+	default:
+	}
+}
+
+// count returns the number of timers of the given duration armed so far.
+func (f *fakeClock) count(d time.Duration) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.armed[d]
+}
+
+// countAll returns the number of timers armed so far.
+func (f *fakeClock) countAll() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.total
+}
+
+// active returns the number of timers that are armed and have not fired.
+func (f *fakeClock) active() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// waitArmed blocks until at least n timers of the given duration were armed.
+func (f *fakeClock) waitArmed(t *testing.T, d time.Duration, n int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("a %v timer", d), func() bool { return f.count(d) >= n })
+}
+
+// waitArmedAny blocks until at least n timers were armed.
+func (f *fakeClock) waitArmedAny(t *testing.T, n int) {
+	t.Helper()
+	waitFor(t, "a timer", func() bool { return f.countAll() >= n })
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := f.timers[t]
+	t.when = f.now.Add(d)
+	f.timers[t] = true
+	f.armed[d]++
+	f.total++
+	if d <= 0 {
+		f.fireLocked(t)
+	}
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := f.timers[t]
+	delete(f.timers, t)
+	return active
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/**************
+ *  Fake API  *
+ **************/
+
+// fakeAPI is an in-memory DiscordAPI.
+type fakeAPI struct {
+	mu       sync.Mutex
+	channels map[string]*discordgo.Channel
+	// oldest first
+	messages map[string][]*discordgo.Message
+	pins     map[string][]string
+	perms    int64
+	// Overrides perms for some channels
+	channelPerms map[string]int64
+	seq          int
+	clock        Clock
+
+	deleted     []string
+	bulkDeletes [][]string
+	sent        []string
+	sends       []*discordgo.MessageSend
+	embeds      []*discordgo.MessageEmbed
+	// "messageID emoji"
+	reactions []string
+	// Guilds left with GuildLeave
+	left []string
+	// Roles of every member, for GuildMember
+	memberRoles []string
+
+	// If set, returned from ChannelMessagesBulkDelete
+	bulkErr error
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		channels: make(map[string]*discordgo.Channel),
+		messages: make(map[string][]*discordgo.Message),
+		pins:     make(map[string][]string),
+		perms:    discordgo.PermissionAll,
+		clock:    realClock{},
+	}
+}
+
+func restError(code int) *discordgo.RESTError {
+	return &discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: code, Message: "fake error"}}
+}
+
+func (f *fakeAPI) addChannel(ch *discordgo.Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels[ch.ID] = ch
+}
+
+// post adds a message posted at the given time and returns it.
+func (f *fakeAPI) post(channelID string, ts time.Time) *discordgo.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	m := &discordgo.Message{
+		ID:        snowflake.FromTime(ts, uint64(f.seq)).String(),
+		ChannelID: channelID,
+		Timestamp: discordgo.Timestamp(ts.UTC().Format(time.RFC3339Nano)),
+		Author:    &discordgo.User{ID: "100"},
+	}
+	msgs := append(f.messages[channelID], m)
+	sort.Slice(msgs, func(i, j int) bool { return snowflake.Less(msgs[i].ID, msgs[j].ID) })
+	f.messages[channelID] = msgs
+	return m
+}
+
+func (f *fakeAPI) pin(channelID, messageID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pins[channelID] = append([]string{messageID}, f.pins[channelID]...)
+}
+
+func (f *fakeAPI) unpin(channelID, messageID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pins := f.pins[channelID][:0]
+	for _, v := range f.pins[channelID] {
+		if v != messageID {
+			pins = append(pins, v)
+		}
+	}
+	f.pins[channelID] = pins
+}
+
+func (f *fakeAPI) findLocked(channelID, messageID string) (int, *discordgo.Message) {
+	for i, m := range f.messages[channelID] {
+		if m.ID == messageID {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+func (f *fakeAPI) removeLocked(channelID, messageID string) bool {
+	i, _ := f.findLocked(channelID, messageID)
+	if i == -1 {
+		return false
+	}
+	msgs := f.messages[channelID]
+	f.messages[channelID] = append(msgs[:i:i], msgs[i+1:]...)
+	return true
+}
+
+func (f *fakeAPI) Channel(channelID string) (*discordgo.Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch, ok := f.channels[channelID]
+	if !ok {
+		return nil, restError(discordgo.ErrCodeUnknownChannel)
+	}
+	cp := *ch
+	return &cp, nil
+}
+
+func (f *fakeAPI) ChannelMessage(channelID, messageID string) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, m := f.findLocked(channelID, messageID)
+	if m == nil {
+		return nil, restError(discordgo.ErrCodeUnknownMessage)
+	}
+	return m, nil
+}
+
+func (f *fakeAPI) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msgs := f.messages[channelID]
+	var out []*discordgo.Message
+	// newest first, like Discord
+	for i := len(msgs) - 1; i >= 0 && len(out) < limit; i-- {
+		if beforeID != "" && !snowflake.Less(msgs[i].ID, beforeID) {
+			continue
+		}
+		out = append(out, msgs[i])
+	}
+	return out, nil
+}
+
+func (f *fakeAPI) ChannelMessagesPinned(channelID string) ([]*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*discordgo.Message
+	for _, id := range f.pins[channelID] {
+		if _, m := f.findLocked(channelID, id); m != nil {
+			out = append(out, m)
+		} else {
+			out = append(out, &discordgo.Message{ID: id, ChannelID: channelID})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeAPI) ChannelMessageSend(channelID string, content string) (*discordgo.Message, error) {
+	return f.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content})
+}
+
+func (f *fakeAPI) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	f.mu.Lock()
+	f.sent = append(f.sent, data.Content)
+	f.sends = append(f.sends, data)
+	if data.Embed != nil {
+		f.embeds = append(f.embeds, data.Embed)
+	}
+	f.mu.Unlock()
+	m := f.post(channelID, f.clock.Now())
+	f.mu.Lock()
+	m.Content = data.Content
+	f.mu.Unlock()
+	return m, nil
+}
+
+func (f *fakeAPI) ChannelMessageDelete(channelID, messageID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.removeLocked(channelID, messageID) {
+		return restError(discordgo.ErrCodeUnknownMessage)
+	}
+	f.deleted = append(f.deleted, messageID)
+	return nil
+}
+
+func (f *fakeAPI) ChannelMessagesBulkDelete(channelID string, messages []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.bulkErr != nil {
+		return f.bulkErr
+	}
+	f.bulkDeletes = append(f.bulkDeletes, append([]string(nil), messages...))
+	for _, id := range messages {
+		f.removeLocked(channelID, id)
+		f.deleted = append(f.deleted, id)
+	}
+	return nil
+}
+
+func (f *fakeAPI) ChannelMessageUnpin(channelID, messageID string) error {
+	f.unpin(channelID, messageID)
+	return nil
+}
+
+func (f *fakeAPI) MessageReactionAdd(channelID, messageID, emojiID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reactions = append(f.reactions, messageID+" "+emojiID)
+	return nil
+}
+
+func (f *fakeAPI) MessageReactionRemove(channelID, messageID, emojiID, userID string) error {
+	return nil
+}
+
+func (f *fakeAPI) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &discordgo.Member{GuildID: guildID, User: &discordgo.User{ID: userID}, Roles: f.memberRoles}, nil
+}
+
+func (f *fakeAPI) GuildLeave(guildID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.left = append(f.left, guildID)
+	return nil
+}
+
+// UserChannelCreate opens a DM channel with the ID "dm" + recipientID.
+func (f *fakeAPI) UserChannelCreate(recipientID string) (*discordgo.Channel, error) {
+	ch := &discordgo.Channel{ID: "dm" + recipientID, Type: discordgo.ChannelTypeDM}
+	f.addChannel(ch)
+	return ch, nil
+}
+
+func (f *fakeAPI) UserChannelPermissions(userID, channelID string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.channelPerms[channelID]; ok {
+		return p, nil
+	}
+	return f.perms, nil
+}
+
+// RequestWithBucketID supports the pins request made by loadPins.
+func (f *fakeAPI) RequestWithBucketID(method, urlStr string, data interface{}, bucketID string) ([]byte, error) {
+	f.mu.Lock()
+	var channelID string
+	for id := range f.channels {
+		if urlStr == discordgo.EndpointChannelMessagesPins(id) {
+			channelID = id
+		}
+	}
+	f.mu.Unlock()
+	if method != "GET" || channelID == "" {
+		return nil, fmt.Errorf("fakeAPI: unsupported raw request %s %s", method, urlStr)
+	}
+	pins, err := f.ChannelMessagesPinned(channelID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(pins)
+}
+
+func (f *fakeAPI) RequestWithLockedBucket(method, urlStr, contentType string, b []byte, bucket *discordgo.Bucket, sequence int) ([]byte, error) {
+	bucket.Release(nil)
+	return nil, fmt.Errorf("fakeAPI: unsupported raw request %s %s", method, urlStr)
+}
+
+/**************
+ *  Fixtures  *
+ **************/
+
+const (
+	testGuildID   = "200"
+	testChannelID = "300"
+	testBotID     = "1"
+)
+
+var testEpoch = time.Date(2022, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestBot returns a Bot wired to a fake clock and API. No goroutines are
+// started.
+func newTestBot(t *testing.T) (*Bot, *fakeClock, *fakeAPI) {
+	t.Helper()
+	clock := newFakeClock(testEpoch)
+	api := newFakeAPI()
+	api.clock = clock
+	b := newBot(Config{}, clock)
+	b.api = api
+	b.s = &discordgo.Session{
+		State:       discordgo.NewState(),
+		Ratelimiter: discordgo.NewRatelimiter(),
+	}
+	b.me = &discordgo.User{ID: testBotID, Username: "AutoDelete", Discriminator: "0000"}
+	b.storage = newMemStorage()
+	if err := b.s.State.GuildAdd(&discordgo.Guild{ID: testGuildID, Name: "test guild"}); err != nil {
+		t.Fatal(err)
+	}
+	api.addChannel(&discordgo.Channel{ID: testChannelID, GuildID: testGuildID, Name: "general"})
+	return b, clock, api
+}
+
+// newTestChannel sets up a started ManagedChannel with the given config.
+func newTestChannel(t *testing.T, b *Bot, conf ManagedChannelMarshal) *ManagedChannel {
+	t.Helper()
+	if conf.ID == "" {
+		conf.ID = testChannelID
+	}
+	if conf.GuildID == "" {
+		conf.GuildID = testGuildID
+	}
+	c, err := InitChannel(b, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(c.isStarted)
+	b.mu.Lock()
+	b.channels[c.ChannelID] = c
+	b.mu.Unlock()
+	return c
+}
+
+// liveIDs lists the IDs in liveMessages, oldest first.
+func liveIDs(c *ManagedChannel) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for _, v := range c.liveMessages.IDs() {
+		ids = append(ids, c.liveMessageID(v))
+	}
+	return ids
+}
+
+// memStorage is an in-memory Storage.
+type memStorage struct {
+	mu       sync.Mutex
+	channels map[string]ManagedChannelMarshal
+	bans     map[string]bool
+	guilds   map[string]GuildSettings
+	tokens   []APIToken
+	audit    map[string][]AuditEntry
+	// Number of SaveChannel calls
+	channelSaves int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		channels: make(map[string]ManagedChannelMarshal),
+		bans:     make(map[string]bool),
+		guilds:   make(map[string]GuildSettings),
+		audit:    make(map[string][]AuditEntry),
+	}
+}
+
+func (s *memStorage) ListChannels() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.channels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *memStorage) GetChannel(id string) (ManagedChannelMarshal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conf, ok := s.channels[id]
+	if !ok {
+		return conf, os.ErrNotExist
+	}
+	return conf, nil
+}
+
+func (s *memStorage) SaveChannel(conf ManagedChannelMarshal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[conf.ID] = internalMigrateConfig(conf)
+	s.channelSaves++
+	return nil
+}
+
+func (s *memStorage) DeleteChannel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[id]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.channels, id)
+	return nil
+}
+
+func (s *memStorage) IsBanned(guildID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bans[guildID], nil
+}
+
+func (s *memStorage) AddBan(guildID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[guildID] = true
+	return nil
+}
+
+func (s *memStorage) GetGuildSettings(guildID string) (GuildSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.guilds[guildID], nil
+}
+
+func (s *memStorage) SaveGuildSettings(guildID string, settings GuildSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if settings == (GuildSettings{}) {
+		delete(s.guilds, guildID)
+	} else {
+		s.guilds[guildID] = settings
+	}
+	return nil
+}
+
+func (s *memStorage) ListAPITokens() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]APIToken(nil), s.tokens...), nil
+}
+
+func (s *memStorage) SaveAPIToken(token APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, token)
+	return nil
+}
+
+func (s *memStorage) DeleteAPIToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tokens {
+		if t.ID == id {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			return nil
+		}
+	}
+	return os.ErrNotExist
+}
+
+func (s *memStorage) AddAuditEntry(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := append([]AuditEntry{entry}, s.audit[entry.GuildID]...)
+	if len(entries) > auditLogLength {
+		entries = entries[:auditLogLength]
+	}
+	s.audit[entry.GuildID] = entries
+	return nil
+}
+
+func (s *memStorage) ListAuditEntries(guildID string) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditEntry(nil), s.audit[guildID]...), nil
+}
+
+// handlerTransport answers every request with an http.Handler, whatever its
+// host.
+type handlerTransport struct {
+	http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.ServeHTTP(w, r)
+	return w.Result(), nil
+}
@@ -0,0 +1,98 @@
+package autodelete
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The health endpoints are served on the private listener, for container
+// orchestrators and monitoring. /healthz only shows the process is serving;
+// /readyz fails while the shard cannot do its work, so that it can be
+// restarted.
+
+// botStatus is the response of the status endpoint.
+type botStatus struct {
+	ShardID          int     `json:"shard_id"`
+	ShardCount       int     `json:"shard_count"`
+	GatewayConnected bool    `json:"gateway_connected"`
+	GatewayLatencyMS float64 `json:"gateway_latency_ms"`
+	Guilds           int     `json:"guilds"`
+	ManagedChannels  int     `json:"managed_channels"`
+	ConfigsLoaded    bool    `json:"configs_loaded"`
+	// By queue label, like "reap".
+	Queues map[string]queueStatus `json:"queues"`
+}
+
+func (b *Bot) status() botStatus {
+	st := botStatus{Queues: make(map[string]queueStatus)}
+	b.s.RLock()
+	st.ShardID, st.ShardCount = b.s.ShardID, b.s.ShardCount
+	st.GatewayConnected = b.s.DataReady
+	if !b.s.LastHeartbeatSent.IsZero() {
+		st.GatewayLatencyMS = float64(b.s.HeartbeatLatency()) / float64(time.Millisecond)
+	}
+	b.s.RUnlock()
+
+	b.s.State.RLock()
+	st.Guilds = len(b.s.State.Guilds)
+	b.s.State.RUnlock()
+
+	b.mu.RLock()
+	for _, mCh := range b.channels {
+		if mCh != nil {
+			st.ManagedChannels++
+		}
+	}
+	st.ConfigsLoaded = b.configsLoaded
+	b.mu.RUnlock()
+
+	for _, q := range b.queues() {
+		st.Queues[q.label] = q.status()
+	}
+	return st
+}
+
+// notReady lists the reasons the bot is not ready, if any.
+func (st botStatus) notReady() []string {
+	var reasons []string
+	if !st.GatewayConnected {
+		reasons = append(reasons, "gateway not connected")
+	}
+	if !st.ConfigsLoaded {
+		reasons = append(reasons, "channel configs not loaded")
+	}
+	labels := make([]string, 0, len(st.Queues))
+	for label := range st.Queues {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if q := st.Queues[label]; q.Wedged {
+			reasons = append(reasons, fmt.Sprintf("%s queue stuck since %s", label, q.LastPop.UTC().Format(time.RFC3339)))
+		}
+	}
+	return reasons
+}
+
+// HTTPHealthz answers as long as the process is serving.
+func (b *Bot) HTTPHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// HTTPReadyz fails with the reasons if the gateway is down, the channel
+// configs are not loaded yet or a work queue is stuck.
+func (b *Bot) HTTPReadyz(w http.ResponseWriter, r *http.Request) {
+	if reasons := b.status().notReady(); len(reasons) > 0 {
+		http.Error(w, strings.Join(reasons, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// HTTPStatus reports the shard's state as JSON.
+func (b *Bot) HTTPStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, b.status())
+}
@@ -0,0 +1,53 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	b, clock, _ := newTestBot(t)
+	readyz := func() (int, string) {
+		w := httptest.NewRecorder()
+		b.HTTPReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := readyz()
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "gateway not connected") || !strings.Contains(body, "configs not loaded") {
+		t.Errorf("before connecting: %d %q", code, body)
+	}
+
+	b.s.DataReady = true
+	if err := b.LoadChannelConfigs(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := readyz(); code != http.StatusOK {
+		t.Errorf("connected and loaded: %d %q", code, body)
+	}
+
+	// Nothing takes work off the queues in this test
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	b.reaper.Update(c, clock.Now())
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Errorf("with a due item: %d", code)
+	}
+	clock.Advance(queueWedgeTimeout + time.Minute)
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "reap queue stuck") {
+		t.Errorf("stuck queue: %d %q", code, body)
+	}
+
+	w := httptest.NewRecorder()
+	b.HTTPStatus(w, httptest.NewRequest("GET", "/status", nil))
+	var st botStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if reap := st.Queues[queueReap]; st.ManagedChannels != 1 || st.Guilds != 1 || reap.Length != 1 || reap.Due != 1 || !reap.Wedged || reap.Workers != 0 {
+		t.Errorf("status %+v", st)
+	}
+}
@@ -0,0 +1,445 @@
+package autodelete
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The REST API reads and changes the same configuration as the chat
+// commands. Each token is made with the apitoken command and only works for
+// its own guild. See docs/openapi.yml for the description of the endpoints.
+
+// APIPath is where HTTPAPI expects to be mounted.
+const APIPath = "/discord_auto_delete/api/"
+
+// apiTokenPrefix marks AutoDelete tokens, so they are easy to find if leaked.
+const apiTokenPrefix = "ad_"
+
+// newAPIToken makes a token for a guild. The secret is only returned here.
+func newAPIToken(guildID, userID string, now time.Time) (secret string, token APIToken, err error) {
+	random, err := randomHex(24)
+	if err != nil {
+		return "", token, err
+	}
+	secret = apiTokenPrefix + random
+	hash := hashAPIToken(secret)
+	return secret, APIToken{
+		ID:        hash[:8],
+		Hash:      hash,
+		GuildID:   guildID,
+		CreatedBy: userID,
+		Created:   now,
+	}, nil
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// guildAPITokens lists the tokens for a guild.
+func (b *Bot) guildAPITokens(guildID string) ([]APIToken, error) {
+	all, err := b.storage.ListAPITokens()
+	if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	for _, t := range all {
+		if t.GuildID == guildID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+// authorizeAPI finds the token of a request.
+func (b *Bot) authorizeAPI(r *http.Request) (APIToken, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return APIToken{}, false
+	}
+	hash := hashAPIToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	tokens, err := b.storage.ListAPITokens()
+	if err != nil {
+		fmt.Printf("[api ] could not read tokens: %v\n", err)
+		return APIToken{}, false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// apiPolicy is a channel's deletion policy in API requests and responses.
+// Durations use Go's syntax, like "24h" or "90m".
+type apiPolicy struct {
+	LiveTime       string `json:"live_time,omitempty"`
+	MaxMessages    int    `json:"max_messages,omitempty"`
+	Edits          string `json:"edits,omitempty"`
+	Pins           string `json:"pins,omitempty"`
+	Warn           string `json:"warn,omitempty"`
+	WarnBefore     string `json:"warn_before,omitempty"`
+	VoiceChannelID string `json:"voice_channel_id,omitempty"`
+	VoiceWipeDelay string `json:"voice_wipe_delay,omitempty"`
+}
+
+func durationText(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func policyOf(conf ManagedChannelMarshal) apiPolicy {
+	p := apiPolicy{
+		LiveTime:       durationText(conf.LiveTime),
+		MaxMessages:    conf.MaxMessages,
+		Edits:          string(conf.EditPolicy),
+		Warn:           string(conf.WarnMode),
+		WarnBefore:     durationText(conf.WarnBefore),
+		VoiceChannelID: conf.VoiceChannelID,
+		VoiceWipeDelay: durationText(conf.VoiceWipeDelay),
+	}
+	switch conf.PinPolicy {
+	case PinPolicyNone:
+		p.Pins = "none"
+	case PinPolicyNewest:
+		p.Pins = strconv.Itoa(conf.PinKeepCount)
+	}
+	return p
+}
+
+// options converts a policy to set command options. Every option is set, as
+// a PUT replaces the whole policy.
+func (p apiPolicy) options() (o setOptions, err error) {
+	parseDuration := func(field, s string) (time.Duration, error) {
+		if s == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("%s must be a duration like \"30m\"", field)
+		}
+		return d, nil
+	}
+	if o.duration, err = parseDuration("live_time", p.LiveTime); err != nil {
+		return o, err
+	}
+	if o.warnBefore, err = parseDuration("warn_before", p.WarnBefore); err != nil {
+		return o, err
+	}
+	if o.voiceWipeDelay, err = parseDuration("voice_wipe_delay", p.VoiceWipeDelay); err != nil {
+		return o, err
+	}
+	if p.MaxMessages < 0 {
+		return o, fmt.Errorf("max_messages cannot be negative")
+	}
+	o.count = p.MaxMessages
+	if o.editPolicy, err = ParseEditPolicy(p.Edits); err != nil {
+		return o, err
+	}
+	if p.Pins != "" {
+		if o.pinPolicy, o.pinKeepCount, err = ParsePinPolicy(p.Pins); err != nil {
+			return o, err
+		}
+	}
+	if o.warnMode, err = ParseWarnMode(p.Warn); err != nil {
+		return o, err
+	}
+	if p.VoiceChannelID != "" {
+		if _, ok := parseChannelTarget(p.VoiceChannelID); !ok {
+			return o, fmt.Errorf("voice_channel_id must be a channel ID")
+		}
+	}
+	o.voiceChannelID = p.VoiceChannelID
+	o.editPolicySet, o.pinPolicySet, o.warnModeSet, o.warnBeforeSet = true, true, true, true
+	o.voiceSet, o.voiceDelaySet = true, true
+	return o, nil
+}
+
+// apiChannel is a configured channel in API responses.
+type apiChannel struct {
+	ChannelID string    `json:"channel_id"`
+	Name      string    `json:"name"`
+	Policy    apiPolicy `json:"policy"`
+	// False for a stored configuration that has not been loaded yet.
+	Loaded          bool       `json:"loaded"`
+	Paused          bool       `json:"paused"`
+	Status          string     `json:"status"`
+	TrackedMessages int        `json:"tracked_messages"`
+	NextDeletion    *time.Time `json:"next_deletion,omitempty"`
+}
+
+func apiChannelOf(s channelSummary) apiChannel {
+	c := apiChannel{
+		ChannelID:       s.ChannelID,
+		Name:            s.Name,
+		Policy:          policyOf(s.Conf),
+		Loaded:          s.Loaded,
+		Paused:          s.Conf.Paused,
+		Status:          s.Status,
+		TrackedMessages: s.Tracked,
+	}
+	if !s.NextDeletion.IsZero() {
+		next := s.NextDeletion
+		c.NextDeletion = &next
+	}
+	return c
+}
+
+// apiGuild is a guild's settings in API requests and responses.
+type apiGuild struct {
+	GuildID string `json:"guild_id"`
+	// Empty to follow the guild's preferred locale.
+	Locale string `json:"locale"`
+	Prefix string `json:"prefix"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// HTTPAPI serves the REST API under APIPath.
+func (b *Bot) HTTPAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPath), "/"), "/")
+	if len(parts) < 2 || parts[0] != "guilds" {
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	guildID, rest := parts[1], parts[2:]
+
+	token, ok := b.authorizeAPI(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="AutoDelete"`)
+		apiError(w, http.StatusUnauthorized, "missing or unknown API token")
+		return
+	}
+	if token.GuildID != guildID {
+		apiError(w, http.StatusForbidden, "this token is for another guild")
+		return
+	}
+	if _, err := b.s.State.Guild(guildID); err != nil {
+		apiError(w, http.StatusNotFound, "the bot is not in this guild")
+		return
+	}
+	fmt.Printf("[api ] %s %s with token %s\n", r.Method, r.URL.Path, token.ID)
+
+	switch {
+	case len(rest) == 0:
+		b.apiGuild(w, r, guildID, token)
+	case len(rest) == 1 && rest[0] == "channels":
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		summaries, err := b.GuildSummaries(guildID)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		channels := make([]apiChannel, 0, len(summaries))
+		for _, s := range summaries {
+			channels = append(channels, apiChannelOf(s))
+		}
+		writeJSON(w, http.StatusOK, channels)
+	case len(rest) == 1 && rest[0] == "reload":
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		summaries, err := b.GuildSummaries(guildID)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, s := range summaries {
+			if err := b.reloadChannel(s.ChannelID); err != nil {
+				apiError(w, http.StatusInternalServerError, fmt.Sprintf("reloading %s: %v", s.ChannelID, err))
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"reloaded": len(summaries)})
+	case (len(rest) == 2 || len(rest) == 3) && rest[0] == "channels":
+		ch, err := b.Channel(rest[1])
+		if err != nil || ch.GuildID != guildID {
+			apiError(w, http.StatusNotFound, "no such channel in this guild")
+			return
+		}
+		if len(rest) == 2 {
+			b.apiChannel(w, r, ch, token)
+		} else {
+			b.apiChannelAction(w, r, ch, rest[2], token)
+		}
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (b *Bot) apiGuild(w http.ResponseWriter, r *http.Request, guildID string, token APIToken) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var g apiGuild
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			apiError(w, http.StatusBadRequest, "bad JSON: "+err.Error())
+			return
+		}
+		settings := b.guildSettings(guildID)
+		settings.Locale, settings.Prefix = "", g.Prefix
+		if g.Locale != "" {
+			l := b.findLocale(g.Locale)
+			if l == nil {
+				apiError(w, http.StatusBadRequest, fmt.Sprintf("no translation for %q; available: %s", g.Locale, strings.Join(b.localeCodes(), ", ")))
+				return
+			}
+			settings.Locale = l.Code
+		}
+		if g.Prefix != "" && !validPrefix(g.Prefix) {
+			apiError(w, http.StatusBadRequest, fmt.Sprintf("a prefix is one word of up to %d characters, and cannot be a mention", maxPrefixLength))
+			return
+		}
+		if err := b.saveGuildSettings(guildID, settings); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		b.audit(AuditEntry{GuildID: guildID, TokenID: token.ID, Action: auditGuild, Detail: describeGuildSettings(settings)})
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "use GET or PUT")
+		return
+	}
+	settings := b.guildSettings(guildID)
+	writeJSON(w, http.StatusOK, apiGuild{GuildID: guildID, Locale: settings.Locale, Prefix: settings.Prefix})
+}
+
+func (b *Bot) apiChannel(w http.ResponseWriter, r *http.Request, ch *discordgo.Channel, token APIToken) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var p apiPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			apiError(w, http.StatusBadRequest, "bad JSON: "+err.Error())
+			return
+		}
+		opts, err := p.options()
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts.duration == 0 && opts.count == 0 && opts.voiceChannelID == "" {
+			apiError(w, http.StatusBadRequest, "set live_time, max_messages or voice_channel_id, or use DELETE to stop deleting")
+			return
+		}
+		_, rejectKey, err := b.applyChannelSettings(ch, opts, false, AuditEntry{TokenID: token.ID})
+		if rejectKey != "" {
+			apiError(w, http.StatusBadRequest, localeEnglish.Sprintf(rejectKey))
+			return
+		} else if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		fmt.Printf("[load] Changed settings for channel %s through the API\n", ch.ID)
+	case http.MethodDelete:
+		err := b.deleteChannelConfig(ch.ID)
+		if os.IsNotExist(err) {
+			apiError(w, http.StatusNotFound, "this channel is not set up for deletion")
+			return
+		} else if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		b.audit(AuditEntry{GuildID: ch.GuildID, ChannelID: ch.ID, TokenID: token.ID, Action: auditOff})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+		return
+	}
+	b.writeAPIChannel(w, ch)
+}
+
+func (b *Bot) apiChannelAction(w http.ResponseWriter, r *http.Request, ch *discordgo.Channel, action string, token APIToken) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if _, ok := b.channelSummary(ch); !ok {
+		apiError(w, http.StatusNotFound, "this channel is not set up for deletion")
+		return
+	}
+	var err error
+	auditAction := ""
+	switch action {
+	case "pause":
+		b.pauseChannel(ch.ID)
+		auditAction = auditPause
+	case "resume":
+		err = b.unpauseChannel(ch.ID)
+		auditAction = auditResume
+	case "reload":
+		err = b.reloadChannel(ch.ID)
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if auditAction != "" {
+		b.audit(AuditEntry{GuildID: ch.GuildID, ChannelID: ch.ID, TokenID: token.ID, Action: auditAction})
+	}
+	b.writeAPIChannel(w, ch)
+}
+
+func (b *Bot) writeAPIChannel(w http.ResponseWriter, ch *discordgo.Channel) {
+	s, ok := b.channelSummary(ch)
+	if !ok {
+		apiError(w, http.StatusNotFound, "this channel is not set up for deletion")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiChannelOf(s))
+}
+
+// reloadChannel reads a channel's configuration from storage again and
+// reloads its message history.
+func (b *Bot) reloadChannel(channelID string) error {
+	b.mu.RLock()
+	mCh := b.channels[channelID]
+	b.mu.RUnlock()
+	if mCh != nil {
+		mCh.Disable()
+	} else {
+		b.mu.Lock()
+		delete(b.channels, channelID)
+		b.mu.Unlock()
+	}
+	return b.loadChannel(channelID, QOSInteractive)
+}
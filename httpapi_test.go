@@ -0,0 +1,177 @@
+package autodelete
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// apiRequest sends a request to HTTPAPI and decodes the JSON response into
+// out, if given.
+func apiRequest(t *testing.T, b *Bot, method, path, token, body string, out interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, APIPath+path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	b.HTTPAPI(w, r)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func addAPIToken(t *testing.T, b *Bot, guildID string) string {
+	t.Helper()
+	secret, token, err := newAPIToken(guildID, "1001", b.clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.storage.SaveAPIToken(token); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	token := addAPIToken(t, b, testGuildID)
+	other := addAPIToken(t, b, "201")
+
+	path := "guilds/" + testGuildID + "/channels"
+	if code := apiRequest(t, b, "GET", path, "", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("no token: %d", code)
+	}
+	if code := apiRequest(t, b, "GET", path, "ad_wrong", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: %d", code)
+	}
+	if code := apiRequest(t, b, "GET", path, other, "", nil); code != http.StatusForbidden {
+		t.Errorf("other guild's token: %d", code)
+	}
+	if code := apiRequest(t, b, "GET", "guilds/201/channels", other, "", nil); code != http.StatusNotFound {
+		t.Errorf("guild without the bot: %d", code)
+	}
+	var channels []apiChannel
+	if code := apiRequest(t, b, "GET", path, token, "", &channels); code != http.StatusOK || len(channels) != 0 {
+		t.Errorf("list: %d, %+v", code, channels)
+	}
+}
+
+func TestAPIChannelPolicy(t *testing.T) {
+	b, _, api := newTestBot(t)
+	token := addAPIToken(t, b, testGuildID)
+	path := "guilds/" + testGuildID + "/channels/" + testChannelID
+
+	if code := apiRequest(t, b, "GET", path, token, "", nil); code != http.StatusNotFound {
+		t.Errorf("GET before PUT: %d", code)
+	}
+	if code := apiRequest(t, b, "PUT", path, token, `{"pins":"3"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("PUT without a limit: %d", code)
+	}
+	if code := apiRequest(t, b, "PUT", path, token, `{"live_time":"soon"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("PUT with a bad duration: %d", code)
+	}
+
+	var got apiChannel
+	code := apiRequest(t, b, "PUT", path, token, `{"live_time":"24h","max_messages":50,"pins":"3"}`, &got)
+	want := apiPolicy{LiveTime: "24h0m0s", MaxMessages: 50, Pins: "3"}
+	if code != http.StatusOK || got.Policy != want {
+		t.Fatalf("PUT: %d, %+v; want policy %+v", code, got, want)
+	}
+	if saved, _ := b.storage.GetChannel(testChannelID); saved.LiveTime != 24*time.Hour || saved.PinKeepCount != 3 {
+		t.Errorf("saved %+v", saved)
+	}
+
+	// Pausing survives a permission recheck; resuming ends it
+	if code := apiRequest(t, b, "POST", path+"/pause", token, "", &got); code != http.StatusOK || !got.Paused {
+		t.Fatalf("pause: %d, %+v", code, got)
+	}
+	b.recheckGuildPermissions(testGuildID)
+	if c, _ := b.GetChannel(testChannelID, QOSInteractive); c == nil || !c.IsSuspended() {
+		t.Error("paused channel resumed by a permission recheck")
+	}
+	if code := apiRequest(t, b, "POST", path+"/resume", token, "", &got); code != http.StatusOK || got.Paused {
+		t.Errorf("resume: %d, %+v", code, got)
+	}
+	if c, _ := b.GetChannel(testChannelID, QOSInteractive); c == nil || c.IsSuspended() {
+		t.Error("channel still suspended after resume")
+	}
+	if sent := sentMessages(api); len(sent) != 0 {
+		t.Errorf("sent %q, want no notices for a pause", sent)
+	}
+
+	if code := apiRequest(t, b, "DELETE", path, token, "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE: %d", code)
+	}
+	if _, err := b.storage.GetChannel(testChannelID); err == nil {
+		t.Error("config still saved after DELETE")
+	}
+	if code := apiRequest(t, b, "DELETE", path, token, "", nil); code != http.StatusNotFound {
+		t.Errorf("second DELETE: %d", code)
+	}
+}
+
+func TestAPIGuildSettings(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	b.locales = map[string]*Locale{"en": localeEnglish, "de": {Code: "de"}}
+	token := addAPIToken(t, b, testGuildID)
+	path := "guilds/" + testGuildID
+
+	var got apiGuild
+	if code := apiRequest(t, b, "PUT", path, token, `{"locale":"de-DE","prefix":"!ad"}`, &got); code != http.StatusOK {
+		t.Fatalf("PUT: %d", code)
+	}
+	if want := (apiGuild{GuildID: testGuildID, Locale: "de", Prefix: "!ad"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if code := apiRequest(t, b, "PUT", path, token, `{"prefix":"<@1>"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("mention prefix: %d", code)
+	}
+	if saved, _ := b.storage.GetGuildSettings(testGuildID); saved.Prefix != "!ad" {
+		t.Errorf("saved %+v", saved)
+	}
+}
+
+func TestCommandAPIToken(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	m := &discordgo.Message{
+		ChannelID: testChannelID,
+		Author:    &discordgo.User{ID: "1001"},
+		Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+	}
+
+	CommandAPIToken(b, m, []string{"new"})
+	api.mu.Lock()
+	dm := api.messages["dm1001"]
+	api.mu.Unlock()
+	if len(dm) != 1 {
+		t.Fatalf("got %d direct messages, want 1", len(dm))
+	}
+	secret := regexp.MustCompile(`ad_[0-9a-f]+`).FindString(dm[0].Content)
+	tokens, _ := b.storage.ListAPITokens()
+	if secret == "" || len(tokens) != 1 {
+		t.Fatalf("direct message %q, tokens %+v", dm[0].Content, tokens)
+	}
+	for _, s := range sentMessages(api) {
+		if s != dm[0].Content && strings.Contains(s, secret) {
+			t.Errorf("secret posted in the server: %q", s)
+		}
+	}
+	if code := apiRequest(t, b, "GET", "guilds/"+testGuildID, secret, "", nil); code != http.StatusOK {
+		t.Errorf("new token: %d", code)
+	}
+
+	CommandAPIToken(b, m, []string{"revoke", tokens[0].ID})
+	if code := apiRequest(t, b, "GET", "guilds/"+testGuildID, secret, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: %d", code)
+	}
+}
@@ -0,0 +1,429 @@
+package autodelete
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// User-facing replies go through a Locale. English is compiled in, and other
+// languages are loaded from YAML files in the locale directory, named by
+// language code (de.yml, pt-BR.yml). Each key maps to a format string, or for
+// counted messages to a map of plural forms ("one", "other"). Format strings
+// use explicit argument indexes (%[1]s) so translations can reorder them.
+
+const defaultLocaleDir = "./locales"
+
+// A message is one catalog entry. Messages without plural forms only have
+// other set.
+type message struct {
+	one   string
+	other string
+}
+
+// Locale is the message catalog for one language.
+type Locale struct {
+	Code     string
+	messages map[string]message
+}
+
+// Sprintf formats the message for key. Keys missing from a translation fall
+// back to English.
+func (l *Locale) Sprintf(key string, args ...interface{}) string {
+	return format(l.lookup(key).other, args)
+}
+
+// Plural formats the counted message for key, picking the form for n.
+func (l *Locale) Plural(key string, n int, args ...interface{}) string {
+	msg := l.lookup(key)
+	if msg.one != "" && pluralForm(l.Code, n) == "one" {
+		return format(msg.one, args)
+	}
+	return format(msg.other, args)
+}
+
+// format is Sprintf, except that a translation may leave out the arguments,
+// like "the newest pin" for a count of one.
+func format(s string, args []interface{}) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	return fmt.Sprintf(s, args...)
+}
+
+// Name is the language's own name for itself.
+func (l *Locale) Name() string {
+	return l.Sprintf("locale.name")
+}
+
+func (l *Locale) lookup(key string) message {
+	if msg, ok := l.messages[key]; ok {
+		return msg
+	}
+	if msg, ok := localeEnglish.messages[key]; ok {
+		return msg
+	}
+	fmt.Printf("[i18n] missing message %q\n", key)
+	return message{other: key}
+}
+
+// pluralForm is the CLDR plural category of n, for the languages that do not
+// use the English rule.
+func pluralForm(code string, n int) string {
+	switch baseLanguage(code) {
+	case "ja", "ko", "zh", "th", "vi", "id":
+		return "other"
+	case "fr", "pt":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+		return "other"
+	}
+	if n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+func baseLanguage(code string) string {
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		return strings.ToLower(code[:i])
+	}
+	return strings.ToLower(code)
+}
+
+// parseLocale reads a catalog file.
+func parseLocale(code string, data []byte) (*Locale, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	l := &Locale{Code: code, messages: make(map[string]message, len(raw))}
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			l.messages[key] = message{other: v}
+		case map[interface{}]interface{}:
+			var msg message
+			for form, text := range v {
+				s, ok := text.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: %s.%v is not a string", code, key, form)
+				}
+				switch form {
+				case "one":
+					msg.one = s
+				case "other":
+					msg.other = s
+				default:
+					return nil, fmt.Errorf("%s: %s has unknown plural form %v", code, key, form)
+				}
+			}
+			if msg.other == "" {
+				return nil, fmt.Errorf("%s: %s has no \"other\" form", code, key)
+			}
+			l.messages[key] = msg
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string or plural forms", code, key)
+		}
+	}
+	return l, nil
+}
+
+// loadLocales reads every catalog in dir. English is always available.
+func loadLocales(dir string) (map[string]*Locale, error) {
+	locales := map[string]*Locale{localeEnglish.Code: localeEnglish}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return locales, nil
+	} else if err != nil {
+		return locales, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".yml") {
+			continue
+		}
+		code := strings.TrimSuffix(f.Name(), ".yml")
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return locales, err
+		}
+		l, err := parseLocale(code, data)
+		if err != nil {
+			return locales, err
+		}
+		locales[code] = l
+	}
+	return locales, nil
+}
+
+// findLocale matches a Discord locale code, like "en-US", to a catalog: the
+// exact code first, then the base language.
+func (b *Bot) findLocale(code string) *Locale {
+	if code == "" {
+		return nil
+	}
+	for c, l := range b.locales {
+		if strings.EqualFold(c, code) {
+			return l
+		}
+	}
+	base := baseLanguage(code)
+	for c, l := range b.locales {
+		if strings.EqualFold(c, base) {
+			return l
+		}
+	}
+	return nil
+}
+
+// localeCodes lists the available languages, for the language command.
+func (b *Bot) localeCodes() []string {
+	codes := make([]string, 0, len(b.locales))
+	for c := range b.locales {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// localeFor picks the language for replies in a guild: the one chosen with the
+// language command, else the guild's preferred locale, else English.
+func (b *Bot) localeFor(guildID string) *Locale {
+	if code := b.guildSettings(guildID).Locale; code != "" {
+		if l := b.findLocale(code); l != nil {
+			return l
+		}
+	}
+	if b.s != nil {
+		if guild, err := b.s.State.Guild(guildID); err == nil {
+			if l := b.findLocale(guild.PreferredLocale); l != nil {
+				return l
+			}
+		}
+	}
+	return localeEnglish
+}
+
+// localeForChannel is localeFor for the guild a channel is in.
+func (b *Bot) localeForChannel(channelID string) *Locale {
+	ch, err := b.Channel(channelID)
+	if err != nil {
+		return localeEnglish
+	}
+	return b.localeFor(ch.GuildID)
+}
+
+var localeEnglish = &Locale{Code: "en", messages: map[string]message{
+	"locale.name": {other: "English"},
+	"help":        {other: textHelp},
+
+	"perm.check_failed":         {other: "could not check your permissions: %[1]s"},
+	"perm.need_manage_messages": {other: "You must have the Manage Messages permission to change AutoDelete settings."},
+	"perm.suspended":            {other: ":warning: AutoDelete is paused in <#%[1]s> (%[2]s) because %[3]s. The settings are kept, and deletion starts again on its own when the permission is back."},
+	"perm.resumed":              {other: "✅ AutoDelete has the permissions it needs again, and is deleting messages in this channel."},
+	"perm.need_manage_server":   {other: "You must have the Manage Server permission to change AutoDelete's server settings."},
+
+	"dm.need_target": {other: "In a direct message, name the channels to change by ID, like `set 123456789012345678 30m`. Turn on Developer Mode in Discord's settings to copy channel IDs."},
+	"dm.guild_only":  {other: "That command only works in a server channel."},
+
+	"set.bad_edits":      {other: "Bad format for `set` command. The edit policy can be `edits=ignore`, `edits=restart` or `edits=keep_attachments`."},
+	"set.bad_warn":       {other: "Bad format for `set` command. The warning mode can be `warn=off`, `warn=react` or `warn=notice`."},
+	"set.bad_warnbefore": {other: "Bad format for `set` command. Give the warning time as a duration, like `warnbefore=30m`."},
+	"set.bad_voice":      {other: "Bad format for `set` command. Link a voice channel with `voice=#channel`, or use `voice=here` in a voice channel's text chat and `voice=off` to unlink."},
+	"set.bad_voicedelay": {other: "Bad format for `set` command. Give the voice wipe delay as a duration, like `voicedelay=5m`."},
+	"set.bad_pins":       {other: "Bad format for `set` command. The pin policy can be `pins=all`, `pins=none` or a number of pins to keep, like `pins=3`."},
+	"set.bad_format":     {other: "Bad format for `set` command. Provide a count (20) and/or a duration (90m) to purge messages after. Maximum unit is hours."},
+	"set.negative":       {other: "Count and/or duration cannot be negative."},
+	"set.not_voice":      {other: "That is not a voice channel in this server."},
+	"set.not_changed":    {other: "Encountered error, settings were not changed.\n%[1]s"},
+	"set.maybe_saved":    {other: "Encountered error, settings may or may not have saved.\n%[1]s"},
+
+	"settings.both": {
+		one:   "Messages in this channel will be deleted after %[1]s or %[2]d message, whichever comes first.",
+		other: "Messages in this channel will be deleted after %[1]s or %[2]d messages, whichever comes first.",
+	},
+	"settings.duration": {other: "Messages in this channel will be deleted after %[1]s."},
+	"settings.count": {
+		one:   "Messages in this channel will be deleted after %[1]d other message.",
+		other: "Messages in this channel will be deleted after %[1]d other messages.",
+	},
+	"settings.voice_only": {other: "Messages in this channel will not be deleted on a timer."},
+	"settings.off":        {other: "Messages in this channel will not be auto-deleted."},
+
+	"policy.edits_restart":          {other: " Editing a message restarts its lifetime."},
+	"policy.edits_keep_attachments": {other: " Messages edited to add an attachment are kept."},
+	"policy.pins_none":              {other: " Pinned messages are deleted too."},
+	"policy.pins_keep": {
+		one:   " Only the newest pin is kept.",
+		other: " Only the %[1]d newest pins are kept.",
+	},
+	"policy.warn_count_only": {other: " Warnings are only given for time-based deletion, so none will be shown."},
+	"policy.warn_react":      {other: " Messages get a %[1]s reaction %[2]s before they are deleted."},
+	"policy.warn_notice":     {other: " A notice is posted %[1]s before messages are deleted."},
+	"policy.voice":           {other: " All messages are deleted when the last member leaves <#%[1]s>."},
+	"policy.voice_delay":     {other: " All messages are deleted %[2]s after the last member leaves <#%[1]s>."},
+
+	"multi.check_failed":   {other: "❌ <#%[1]s>: could not check your permissions: %[2]s"},
+	"multi.no_permission":  {other: "❌ <#%[1]s>: you do not have the Manage Messages permission there"},
+	"multi.rejected":       {other: "❌ <#%[1]s>: %[2]s"},
+	"multi.maybe_saved":    {other: "⚠️ <#%[1]s>: settings may or may not have saved: %[2]s"},
+	"multi.ok":             {other: "✅ <#%[1]s>: %[2]s"},
+	"multi.not_found":      {other: "❌ %[1]s: not a channel or category in this server"},
+	"multi.empty_category": {other: "There are no text channels in that category."},
+
+	"short.off":   {other: "turned off"},
+	"short.after": {other: "deleted after %[1]s"},
+	"short.or":    {other: " or "},
+	"short.count": {
+		one:   "%[1]d message",
+		other: "%[1]d messages",
+	},
+	"short.voice": {other: "when <#%[1]s> empties"},
+
+	"backlog.configured_over": {other: "ℹ️ The number of messages configured for deletion is over %[1]d. Older messages are cleaned up by a slower background scan. (Configured: %[2]d)"},
+	"backlog.channel_over":    {other: "ℹ️ The number of messages in this channel is over %[1]d. Older messages are cleaned up by a slower background scan, which may take a while. (Saw: %[2]d)"},
+
+	"check.error":       {other: "Error checking settings: %[1]s"},
+	"check.not_set_up":  {other: "This channel is not set up for deletion."},
+	"check.settings":    {other: "Settings: %[1]s"},
+	"check.bug":         {other: "[BUG?] Messages in this channel will not be auto-deleted (but are still being incorrectly tracked???)."},
+	"check.pins_known":  {one: " I am aware of %[1]d pinned message.", other: " I am aware of %[1]d pinned messages."},
+	"check.sticky":      {other: "\nA sticky notice is kept at the bottom of the channel."},
+	"check.single":      {other: "\n%[1]d messages are older than 14 days and are being deleted one at a time (%[2]d done so far)."},
+	"check.crawl":       {other: "\nScanning older channel history: %[1]d messages checked, %[2]d deleted so far."},
+	"check.needs_check": {other: "\n⚠️ Something needs attention. Say `@AutoDelete check full` for details."},
+
+	"diag.suspended":              {other: "Deletion is paused because %[1]s."},
+	"diag.suspended_hint":         {other: "It starts again on its own once the permissions below are fixed."},
+	"diag.perm_check_failed":      {other: "Could not check my permissions: %[1]s"},
+	"diag.discord_error":          {other: "Discord error %[1]d: %[2]s"},
+	"diag.perm_view_channel":      {other: "View Channel"},
+	"diag.perm_read_history":      {other: "Read Message History"},
+	"diag.perm_manage_messages":   {other: "Manage Messages"},
+	"diag.perm_send_messages":     {other: "Send Messages"},
+	"diag.missing_perm":           {other: "I am missing the %[1]s permission."},
+	"diag.missing_perm_hint":      {other: "%[1]s Grant it to the AutoDelete role in this channel's settings."},
+	"diag.why_view_channel":       {other: "Without it, the bot cannot see the channel at all."},
+	"diag.why_read_history":       {other: "Without it, messages posted while the bot was offline are never deleted."},
+	"diag.why_manage_messages":    {other: "Without it, the bot cannot delete other people's messages."},
+	"diag.why_send_messages":      {other: "Without it, the bot cannot tell you when something goes wrong."},
+	"diag.missing_reactions":      {other: "I am missing the Add Reactions permission."},
+	"diag.missing_reactions_hint": {other: "Without it, warn=react cannot mark messages. Grant it, or use warn=notice."},
+	"diag.perms_ok":               {other: "I have the permissions I need here."},
+	"diag.load_failed":            {other: "Loading the message history failed (%[1]s)."},
+	"diag.load_last_ok":           {other: " It last worked %[1]s ago."},
+	"diag.load_retry":             {other: "The bot retries on its own."},
+	"diag.load_backoff":           {other: "The bot retries on its own, currently waiting %[1]s between tries."},
+	"diag.not_loaded":             {other: "The message history has not been loaded yet."},
+	"diag.not_loaded_hint":        {other: "This happens shortly after the bot starts. If it stays this way, check the permissions above."},
+	"diag.loaded":                 {other: "The message history was loaded %[1]s ago."},
+	"diag.backlog_full":           {other: "%[1]d messages are waiting to be deleted, which is the most the bot tracks at once (%[2]d)."},
+	"diag.backlog_full_hint":      {other: "Older messages are handled by a slower background scan. A shorter duration or a lower message count keeps the channel under the limit."},
+	"diag.tracked": {
+		one:   "%[1]d message is waiting to be deleted.",
+		other: "%[1]d messages are waiting to be deleted.",
+	},
+	"diag.reap_failed":      {other: "The last deletion, %[1]s ago, failed after %[2]d messages (%[3]s)."},
+	"diag.reap_failed_hint": {other: "The bot retries on its own. If this keeps happening, check the permissions above or ask for help with adminhelp."},
+	"diag.reaped": {
+		one:   "The last deletion, %[1]s ago, removed %[2]d message.",
+		other: "The last deletion, %[1]s ago, removed %[2]d messages.",
+	},
+	"diag.single":      {other: "%[1]d messages older than 14 days are being deleted one at a time (%[2]d done, %[3]d failed)."},
+	"diag.single_hint": {other: "Messages that could not be deleted are usually already gone, or the bot lost Manage Messages while working."},
+
+	"list.need_manage_server": {other: "Listing the channels in this server requires the Manage Server permission."},
+	"list.bad_page":           {other: "Bad format for `list` command. Give a page number, like `list 2`."},
+	"list.error":              {other: "Error listing channels: %[1]s"},
+	"list.title":              {other: "AutoDelete channels in %[1]s"},
+	"list.empty":              {other: "No channels in this server are set up for deletion."},
+	"list.count": {
+		one:   "%[1]d channel is set up for deletion.",
+		other: "%[1]d channels are set up for deletion.",
+	},
+	"list.tracked": {
+		one:   "%[1]d message tracked",
+		other: "%[1]d messages tracked",
+	},
+	"list.next_deletion": {other: ", next deletion <t:%[1]d:R>"},
+	"list.status":        {other: "Status: %[1]s"},
+	"list.donor":         {other: " · donor"},
+	"list.page":          {other: "Page %[1]d of %[2]d"},
+	"list.next_page":     {other: ". Say \"list %[1]d\" for the next page."},
+
+	"status.active":      {other: "active"},
+	"status.loading":     {other: "loading message history"},
+	"status.load_failed": {other: "could not load message history: %[1]s"},
+	"status.paused":      {other: "paused: %[1]s"},
+	"status.disabled":    {other: "disabled"},
+	"status.not_loaded":  {other: "not loaded yet"},
+
+	"sticky.off":      {other: "The sticky message is turned off."},
+	"sticky.bad_text": {other: "Could not use that sticky message: %[1]s"},
+	"sticky.policy_both": {
+		one:   "Messages in this channel are deleted after %[1]s or %[2]d message, whichever comes first.",
+		other: "Messages in this channel are deleted after %[1]s or %[2]d messages, whichever comes first.",
+	},
+	"sticky.policy_duration": {other: "Messages in this channel are deleted after %[1]s."},
+	"sticky.policy_count": {
+		one:   "Messages in this channel are deleted after %[1]d other message.",
+		other: "Messages in this channel are deleted after %[1]d other messages.",
+	},
+	"sticky.policy_off": {other: "Messages in this channel are not auto-deleted."},
+
+	"warn.notice": {
+		one:   "%[1]s %[2]d message, starting from %[3]s, will be removed in %[4]s.",
+		other: "%[1]s %[2]d messages, starting from %[3]s, will be removed in %[4]s.",
+	},
+	"warn.minute": {other: "about a minute"},
+	"warn.minutes": {
+		one:   "%[1]d minute",
+		other: "%[1]d minutes",
+	},
+	"warn.hours": {
+		one:   "%[1]d hour",
+		other: "%[1]d hours",
+	},
+
+	"leave.need_manage_server": {other: "Leaving the current server requires the Manage Server permission."},
+	"leave.admin_only":         {other: "Leaving other servers can only be done by the bot controller."},
+	"leave.no_channel":         {other: "Could not find channel %[1]q"},
+	"leave.donor_guild":        {other: "Bot will never voluntarily leave the primary guild"},
+	"leave.error":              {other: "Error leaving guild ID %[1]s: %[2]s"},
+	"leave.ok":                 {other: "Leaving guild ID %[1]s: ok"},
+
+	"donor.admin_only": {other: "patron checking not yet implemented"},
+	"donor.not_loaded": {other: "not currently deleting in that channel"},
+	"donor.set":        {other: "set %[1]s as a donor channel"},
+
+	"config.negative": {other: ":warning: AutoDelete is now disabled in this channel due to corrupt configuration: negative values were found. It must be re-enabled manually.\nFound configuration: duration %[1]v, messages %[2]d\nAn administrator can fix this by typing the following command:\n`@%[3]s#%[4]s setup %[5]v %[6]d`"},
+
+	"language.current": {other: "AutoDelete replies in %[1]s here. Available languages: %[2]s. Say `@AutoDelete language <code>` to change it, or `@AutoDelete language auto` to follow the server's language."},
+	"language.unknown": {other: "There is no translation for %[1]q. Available languages: %[2]s."},
+	"language.set":     {other: "AutoDelete now replies in English here."},
+	"language.auto":    {other: "AutoDelete now follows the server's language, and replies in English here."},
+	"language.error":   {other: "Encountered error, the language was not changed.\n%[1]s"},
+
+	"prefix.none":    {other: "Commands here start with a mention of AutoDelete. Say `@AutoDelete prefix !ad` to also accept `!ad`."},
+	"prefix.current": {other: "Commands here start with a mention of AutoDelete, or with `%[1]s`. Say `@AutoDelete prefix off` to remove the prefix."},
+	"prefix.bad":     {other: "A prefix is one word of up to %[1]d characters, and cannot be a mention."},
+	"prefix.set":     {other: "Commands here can now also start with `%[1]s`, like `%[1]s help`."},
+	"prefix.off":     {other: "Commands here now need a mention of AutoDelete."},
+	"prefix.error":   {other: "Encountered error, the prefix was not changed.\n%[1]s"},
+
+	"apitoken.usage":     {other: "Say `@AutoDelete apitoken new` to make a token for the REST API, `@AutoDelete apitoken list` to see this server's tokens, or `@AutoDelete apitoken revoke <id>` to remove one."},
+	"apitoken.sent":      {other: "I sent you a new API token in a direct message. Its ID is `%[1]s`."},
+	"apitoken.dm":        {other: "Your AutoDelete API token for %[1]s is `%[2]s` (ID `%[3]s`). Send it in an `Authorization: Bearer` header. It is not shown again; say `@AutoDelete apitoken revoke %[3]s` in the server to remove it."},
+	"apitoken.dm_failed": {other: "I could not send you a direct message, so no token was made. Allow direct messages from server members and try again."},
+	"apitoken.none":      {other: "This server has no API tokens."},
+	"apitoken.list_line": {other: "`%[1]s` made by <@%[2]s> <t:%[3]d:R>"},
+	"apitoken.revoked":   {other: "The token `%[1]s` was revoked."},
+	"apitoken.unknown":   {other: "This server has no token with the ID `%[1]s`."},
+	"apitoken.error":     {other: "Encountered error, the tokens were not changed.\n%[1]s"},
+}}
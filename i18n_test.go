@@ -0,0 +1,178 @@
+package autodelete
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var formatVerb = regexp.MustCompile(`%(\[\d+\])?[a-zA-Z]`)
+
+func formatVerbs(s string) []string {
+	verbs := formatVerb.FindAllString(s, -1)
+	sort.Strings(verbs)
+	return verbs
+}
+
+func isSubset(sub, set []string) bool {
+	for _, v := range sub {
+		i := sort.SearchStrings(set, v)
+		if i == len(set) || set[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestShippedLocalesComplete(t *testing.T) {
+	locales, err := loadLocales(defaultLocaleDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locales) < 2 {
+		t.Fatalf("no translations found in %s", defaultLocaleDir)
+	}
+	for code, l := range locales {
+		if l == localeEnglish {
+			continue
+		}
+		for key, en := range localeEnglish.messages {
+			msg, ok := l.messages[key]
+			if !ok {
+				t.Errorf("%s: missing %s", code, key)
+				continue
+			}
+			want := formatVerbs(en.other)
+			if got := formatVerbs(msg.other); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s uses %v, want %v", code, key, got, want)
+			}
+			if en.one != "" && msg.one == "" && pluralForm(code, 1) == "one" {
+				t.Errorf("%s: %s has no \"one\" form", code, key)
+			}
+			if en.one == "" && msg.one != "" {
+				t.Errorf("%s: %s is not a counted message", code, key)
+			}
+			if !isSubset(formatVerbs(msg.one), want) {
+				t.Errorf("%s: %s \"one\" form uses %v, want some of %v", code, key, formatVerbs(msg.one), want)
+			}
+		}
+		for key := range l.messages {
+			if _, ok := localeEnglish.messages[key]; !ok {
+				t.Errorf("%s: unknown key %s", code, key)
+			}
+		}
+	}
+}
+
+func TestPlural(t *testing.T) {
+	if got, want := pinPolicyText(localeEnglish, PinPolicyNewest, 1), " Only the newest pin is kept."; got != want {
+		t.Errorf("one pin: %q, want %q", got, want)
+	}
+	if got, want := pinPolicyText(localeEnglish, PinPolicyNewest, 3), " Only the 3 newest pins are kept."; got != want {
+		t.Errorf("three pins: %q, want %q", got, want)
+	}
+	ja := &Locale{Code: "ja", messages: map[string]message{"short.count": {one: "one", other: "%[1]d 件"}}}
+	if got := ja.Plural("short.count", 1, 1); got != "1 件" {
+		t.Errorf("ja plural = %q", got)
+	}
+	if got := (&Locale{Code: "de"}).Sprintf("short.off"); got != "turned off" {
+		t.Errorf("missing key gave %q, want the English text", got)
+	}
+}
+
+func TestGuildLocale(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	locales, err := loadLocales(defaultLocaleDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.locales = locales
+	guild, _ := b.s.State.Guild(testGuildID)
+	guild.PreferredLocale = "de"
+
+	m := &discordgo.Message{
+		ID:        "900",
+		ChannelID: testChannelID,
+		Author:    &discordgo.User{ID: "1001"},
+		Timestamp: discordgo.Timestamp(clock.Now().Format(time.RFC3339)),
+	}
+	lastSent := func() string {
+		sent := sentMessages(api)
+		return sent[len(sent)-1]
+	}
+
+	CommandModify(b, m, []string{"<#" + testChannelID + ">", "10"})
+	if got, want := lastSent(), "✅ <#300>: gelöscht nach 10 Nachrichten"; !strings.Contains(got, want) {
+		t.Errorf("preferred locale de: got %q, want %q", got, want)
+	}
+
+	CommandLanguage(b, m, []string{"en-US"})
+	if got := lastSent(); got != "AutoDelete now replies in English here." {
+		t.Errorf("language en-US: got %q", got)
+	}
+	CommandModify(b, m, []string{"<#" + testChannelID + ">", "1"})
+	if got, want := lastSent(), "✅ <#300>: deleted after 1 message"; !strings.Contains(got, want) {
+		t.Errorf("chosen locale en: got %q, want %q", got, want)
+	}
+
+	CommandLanguage(b, m, []string{"xx"})
+	if got := lastSent(); !strings.Contains(got, "de, en") {
+		t.Errorf("unknown language: got %q", got)
+	}
+	CommandLanguage(b, m, []string{"auto"})
+	if got := lastSent(); !strings.Contains(got, "auf Deutsch") {
+		t.Errorf("language auto: got %q", got)
+	}
+	if settings, _ := b.storage.GetGuildSettings(testGuildID); settings.Locale != "" {
+		t.Errorf("stored locale %q after auto", settings.Locale)
+	}
+
+	CommandSticky(b, m, []string{"off"})
+	if got, want := lastSent(), "Der Hinweis am Ende des Kanals ist abgeschaltet."; got != want {
+		t.Errorf("sticky off: got %q, want %q", got, want)
+	}
+	CommandList(b, m, []string{"x"})
+	if got := lastSent(); !strings.Contains(got, "Seitenzahl") {
+		t.Errorf("list with a bad page: got %q", got)
+	}
+}
+
+var catalogKeyLiteral = regexp.MustCompile(`"([a-z]+)\.([a-z_]+(\.[a-z_]+)*)"`)
+
+// TestCatalogKeysUsed checks that every message key the code asks for is in
+// the English catalog, so a typo does not reach users as a bare key.
+func TestCatalogKeysUsed(t *testing.T) {
+	namespaces := make(map[string]bool)
+	for key := range localeEnglish.messages {
+		namespaces[strings.SplitN(key, ".", 2)[0]] = true
+	}
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range catalogKeyLiteral.FindAllStringSubmatch(string(src), -1) {
+			key := m[1] + "." + m[2]
+			if !namespaces[m[1]] {
+				continue
+			}
+			if _, ok := localeEnglish.messages[key]; !ok {
+				t.Errorf("%s: %s is not in the catalog", file, key)
+			}
+		}
+	}
+}
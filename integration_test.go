@@ -0,0 +1,152 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/riking/AutoDelete/discordtest"
+)
+
+const (
+	itGuildID    = "400"
+	itTimeCh     = "401"
+	itCountCh    = "402"
+	itBotRoleID  = "410"
+	itUserID     = "500"
+	itEventually = 30 * time.Second
+)
+
+// newIntegrationBot starts a Bot connected to a fake Discord server.
+func newIntegrationBot(t *testing.T, srv *discordtest.Server, storage Storage) *Bot {
+	t.Helper()
+	b := newBot(Config{BotToken: "fake-token"}, realClock{})
+	b.storage = storage
+	b.transport = srv.Transport()
+	b.startQueues()
+	if err := b.ConnectDiscord(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newIntegrationGuild(srv *discordtest.Server) {
+	const perms = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages |
+		discordgo.PermissionReadMessageHistory
+	srv.AddGuild(&discordgo.Guild{
+		ID:   itGuildID,
+		Name: "integration",
+		Roles: []*discordgo.Role{
+			{ID: itGuildID, Name: "@everyone", Permissions: perms},
+			{ID: itBotRoleID, Name: "AutoDelete", Permissions: discordgo.PermissionManageMessages},
+		},
+		Channels: []*discordgo.Channel{
+			{ID: itTimeCh, Name: "time", Type: discordgo.ChannelTypeGuildText},
+			{ID: itCountCh, Name: "count", Type: discordgo.ChannelTypeGuildText},
+		},
+	})
+	srv.AddMember(itGuildID, &discordgo.Member{
+		User:  &discordgo.User{ID: "1", Username: "AutoDelete", Bot: true},
+		Roles: []string{itBotRoleID},
+	})
+}
+
+func messageIDs(msgs []*discordgo.Message) []string {
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// waitForMessages polls the fake server until the channel holds exactly want.
+func waitForMessages(t *testing.T, srv *discordtest.Server, channelID string, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(itEventually)
+	for {
+		got := messageIDs(srv.Messages(channelID))
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("channel %s has messages %v, want %v\nrequests: %v", channelID, got, want, srv.Requests())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestIntegration runs the bot against the fake Discord server. The gateway
+// connection is shared by the subtests, as discordgo allows only one
+// connection attempt per 80 seconds.
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("integration test uses real time")
+	}
+	srv := discordtest.NewServer()
+	defer srv.Close()
+	newIntegrationGuild(srv)
+
+	now := time.Now()
+	// Over 14 days old: must be deleted individually.
+	ancient := srv.PostMessage(itTimeCh, itUserID, "ancient", now.Add(-20*24*time.Hour))
+	srv.PostMessage(itTimeCh, itUserID, "expired", now.Add(-3*time.Hour))
+	pinned := srv.PostMessage(itTimeCh, itUserID, "pinned", now.Add(-2*time.Hour))
+	srv.PostMessage(itTimeCh, itUserID, "expired", now.Add(-2*time.Hour))
+	fresh := srv.PostMessage(itTimeCh, itUserID, "fresh", now.Add(-time.Minute))
+	srv.Pin(itTimeCh, pinned.ID)
+
+	var countMsgs []*discordgo.Message
+	for i := 0; i < 3; i++ {
+		countMsgs = append(countMsgs, srv.PostMessage(itCountCh, itUserID, "count", now.Add(time.Duration(i-10)*time.Minute)))
+	}
+
+	// The first backlog load is answered with a CloudFlare ban page.
+	srv.RateLimit("GET", `^channels/`+itTimeCh+`/messages$`, 1, true)
+
+	storage := newMemStorage()
+	storage.SaveChannel(ManagedChannelMarshal{ID: itTimeCh, GuildID: itGuildID, LiveTime: time.Hour})
+	storage.SaveChannel(ManagedChannelMarshal{ID: itCountCh, GuildID: itGuildID, MaxMessages: 2})
+
+	b := newIntegrationBot(t, srv, storage)
+	defer b.s.Close()
+	select {
+	case <-srv.Ready():
+	case <-time.After(itEventually):
+		t.Fatal("bot did not identify")
+	}
+
+	t.Run("backlog", func(t *testing.T) {
+		waitForMessages(t, srv, itTimeCh, []string{pinned.ID, fresh.ID})
+		waitForMessages(t, srv, itCountCh, messageIDs(countMsgs[1:]))
+
+		var loads, singleDeletes int
+		for _, r := range srv.Requests() {
+			switch r {
+			case "GET channels/" + itTimeCh + "/messages":
+				loads++
+			case "DELETE channels/" + itTimeCh + "/messages/" + ancient.ID:
+				singleDeletes++
+			}
+		}
+		if loads < 2 {
+			t.Errorf("backlog fetched %d times, want a retry after the HTML 429", loads)
+		}
+		if singleDeletes != 1 {
+			t.Errorf("message older than 14 days deleted individually %d times, want 1", singleDeletes)
+		}
+	})
+
+	t.Run("new message", func(t *testing.T) {
+		b.mu.RLock()
+		c := b.channels[itCountCh]
+		b.mu.RUnlock()
+		if c == nil {
+			t.Fatal("count channel not loaded")
+		}
+
+		m := srv.PostMessage(itCountCh, itUserID, "new", time.Now())
+		srv.Dispatch("MESSAGE_CREATE", m)
+		waitForMessages(t, srv, itCountCh, []string{countMsgs[2].ID, m.ID})
+	})
+}
@@ -0,0 +1,196 @@
+package autodelete
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Channels shown on each page of the list command. An embed can hold 25
+// fields, but a long list is easier to read in smaller pages.
+const listPageSize = 10
+
+// channelSummary is one channel in the list command's output.
+type channelSummary struct {
+	ChannelID string
+	Name      string
+	Conf      ManagedChannelMarshal
+	// False for a stored configuration that has not been loaded yet.
+	Loaded       bool
+	Tracked      int
+	NextDeletion time.Time
+	// Status is in English, for the API and the dashboard. The list
+	// command uses statusKey, a catalog key, and statusDetail.
+	Status       string
+	statusKey    string
+	statusDetail string
+	// Messages deleted since the channel was loaded, and the time and size
+	// of the last bulk deletion.
+	Deleted       int
+	LastReap      time.Time
+	LastReapCount int
+}
+
+// Summary describes the channel's settings and current state.
+func (c *ManagedChannel) Summary() channelSummary {
+	conf := c.Export()
+	next, scheduled := c.bot.reaper.Scheduled(c)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := channelSummary{
+		ChannelID: c.ChannelID,
+		Name:      c.ChannelName,
+		Conf:      conf,
+		Loaded:    true,
+		Tracked:   c.liveMessages.Len(),
+		statusKey: "status.active",
+
+		Deleted:       c.health.deleted,
+		LastReap:      c.health.lastReap,
+		LastReapCount: c.health.lastReapCount,
+	}
+	if scheduled {
+		s.NextDeletion = next
+	}
+	select {
+	case <-c.isStarted:
+	default:
+		s.statusKey = "status.loading"
+	}
+	if c.health.loadErr != nil {
+		s.statusKey, s.statusDetail = "status.load_failed", c.health.loadErr.Error()
+	}
+	if c.Suspended {
+		s.statusKey, s.statusDetail = "status.paused", c.SuspendReason
+	}
+	if c.killBit {
+		s.statusKey = "status.disabled"
+	}
+	s.Status = s.statusText(localeEnglish)
+	return s
+}
+
+// statusText is the channel's status in the given language.
+func (s channelSummary) statusText(l *Locale) string {
+	if s.statusKey == "" {
+		return s.Status
+	}
+	return l.Sprintf(s.statusKey, s.statusDetail)
+}
+
+// GuildSummaries describes every channel in the guild that has a stored or
+// loaded configuration, in channel list order.
+func (b *Bot) GuildSummaries(guildID string) ([]channelSummary, error) {
+	guild, err := b.s.State.Guild(guildID)
+	if err != nil {
+		return nil, err
+	}
+	b.s.State.RLock()
+	channels := make([]*discordgo.Channel, 0, len(guild.Channels))
+	for _, ch := range guild.Channels {
+		if ch.Type != discordgo.ChannelTypeGuildCategory {
+			channels = append(channels, ch)
+		}
+	}
+	b.s.State.RUnlock()
+	sort.SliceStable(channels, func(i, j int) bool { return channels[i].Position < channels[j].Position })
+
+	var summaries []channelSummary
+	for _, ch := range channels {
+		if s, ok := b.channelSummary(ch); ok {
+			summaries = append(summaries, s)
+		}
+	}
+	return summaries, nil
+}
+
+// channelSummary describes a channel with a stored or loaded configuration.
+// ok is false if the channel is not configured.
+func (b *Bot) channelSummary(ch *discordgo.Channel) (s channelSummary, ok bool) {
+	b.mu.RLock()
+	mCh, known := b.channels[ch.ID]
+	b.mu.RUnlock()
+	if mCh != nil {
+		return mCh.Summary(), true
+	}
+	if known {
+		// Checked before and not configured
+		return s, false
+	}
+	conf, err := b.storage.GetChannel(ch.ID)
+	if err != nil {
+		return s, false
+	}
+	conf.ID = ch.ID
+	s = channelSummary{
+		ChannelID: ch.ID,
+		Name:      ch.Name,
+		Conf:      conf,
+		statusKey: "status.not_loaded",
+	}
+	if conf.Suspended {
+		s.statusKey, s.statusDetail = "status.paused", conf.SuspendReason
+	}
+	s.Status = s.statusText(localeEnglish)
+	return s, true
+}
+
+// summaryField formats a channel for the list embed.
+func summaryField(l *Locale, s channelSummary) *discordgo.MessageEmbedField {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("<#%s>: %s", s.ChannelID, shortSettings(l, s.Conf)))
+	if s.Loaded {
+		line := l.Plural("list.tracked", s.Tracked, s.Tracked)
+		if !s.NextDeletion.IsZero() && s.Tracked > 0 {
+			line += l.Sprintf("list.next_deletion", s.NextDeletion.Unix())
+		}
+		lines = append(lines, line)
+	}
+	status := l.Sprintf("list.status", s.statusText(l))
+	if s.Conf.IsDonor {
+		status += l.Sprintf("list.donor")
+	}
+	lines = append(lines, status)
+	return &discordgo.MessageEmbedField{
+		Name:  "#" + s.Name,
+		Value: strings.Join(lines, "\n"),
+	}
+}
+
+// listEmbed builds one page of the list command's output. page counts from 1.
+func listEmbed(l *Locale, guildName string, summaries []channelSummary, page int) *discordgo.MessageEmbed {
+	pages := (len(summaries) + listPageSize - 1) / listPageSize
+	if pages == 0 {
+		return &discordgo.MessageEmbed{
+			Title:       l.Sprintf("list.title", guildName),
+			Description: l.Sprintf("list.empty"),
+		}
+	}
+	if page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:       l.Sprintf("list.title", guildName),
+		Description: l.Plural("list.count", len(summaries), len(summaries)),
+	}
+	end := page * listPageSize
+	if end > len(summaries) {
+		end = len(summaries)
+	}
+	for _, s := range summaries[(page-1)*listPageSize : end] {
+		embed.Fields = append(embed.Fields, summaryField(l, s))
+	}
+	if pages > 1 {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: l.Sprintf("list.page", page, pages)}
+		if page < pages {
+			embed.Footer.Text += l.Sprintf("list.next_page", page+1)
+		}
+	}
+	return embed
+}
@@ -0,0 +1,77 @@
+package autodelete
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCommandList(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	postAndAdd(c, clock, api)
+	postAndAdd(c, clock, api)
+	b.QueueReap(c)
+
+	for _, ch := range []*discordgo.Channel{
+		{ID: "301", GuildID: testGuildID, Name: "stored", Position: 1},
+		{ID: "302", GuildID: testGuildID, Name: "plain", Position: 2},
+	} {
+		api.addChannel(ch)
+		if err := b.s.State.ChannelAdd(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.saveChannelConfig(ManagedChannelMarshal{ID: "301", GuildID: testGuildID, MaxMessages: 20, IsDonor: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &discordgo.Message{ChannelID: testChannelID, Author: &discordgo.User{ID: "1001"}}
+	CommandList(b, m, nil)
+	api.mu.Lock()
+	embeds := api.embeds
+	api.mu.Unlock()
+	if len(embeds) != 1 {
+		t.Fatalf("sent %d embeds, want 1", len(embeds))
+	}
+	fields := embeds[0].Fields
+	if len(fields) != 2 || fields[0].Name != "#general" || fields[1].Name != "#stored" {
+		t.Fatalf("fields = %+v, want #general and #stored", fields)
+	}
+	next := clock.Now().Add(time.Hour).Unix()
+	for _, want := range []string{"deleted after 1h0m0s", "2 messages tracked", fmt.Sprintf("<t:%d:R>", next), "Status: active"} {
+		if !strings.Contains(fields[0].Value, want) {
+			t.Errorf("loaded channel %q does not mention %q", fields[0].Value, want)
+		}
+	}
+	for _, want := range []string{"deleted after 20 messages", "not loaded", "donor"} {
+		if !strings.Contains(fields[1].Value, want) {
+			t.Errorf("stored channel %q does not mention %q", fields[1].Value, want)
+		}
+	}
+
+	api.perms = discordgo.PermissionManageMessages
+	CommandList(b, m, nil)
+	if sent := sentMessages(api); !strings.Contains(sent[len(sent)-1], "Manage Server") {
+		t.Errorf("list without Manage Server replied %q", sent[len(sent)-1])
+	}
+}
+
+func TestListEmbedPages(t *testing.T) {
+	var summaries []channelSummary
+	for i := 0; i < 23; i++ {
+		summaries = append(summaries, channelSummary{ChannelID: fmt.Sprint(i), Name: fmt.Sprint("ch", i), Status: "active"})
+	}
+	for page, want := range map[int]int{1: 10, 3: 3, 9: 3} {
+		embed := listEmbed(localeEnglish, "test guild", summaries, page)
+		if len(embed.Fields) != want || embed.Footer == nil {
+			t.Errorf("page %d: %d fields, footer %v; want %d", page, len(embed.Fields), embed.Footer, want)
+		}
+	}
+	if embed := listEmbed(localeEnglish, "test guild", nil, 1); len(embed.Fields) != 0 || embed.Description == "" {
+		t.Errorf("empty list embed = %+v", embed)
+	}
+}
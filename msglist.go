@@ -0,0 +1,136 @@
+package autodelete
+
+import (
+	"sort"
+
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+const minRingSize = 8
+
+// A messageRing is a list of message IDs, sorted oldest first, stored in a
+// ring buffer. Removing from the front does not leak the backing array the
+// way re-slicing does, and the buffer shrinks when it is mostly empty.
+type messageRing struct {
+	buf  []snowflake.ID
+	head int
+	n    int
+}
+
+func (r *messageRing) Len() int {
+	return r.n
+}
+
+// At returns the i'th oldest message.
+func (r *messageRing) At(i int) snowflake.ID {
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+// Front returns the oldest message. The ring must not be empty.
+func (r *messageRing) Front() snowflake.ID {
+	return r.buf[r.head]
+}
+
+// PopFront removes and returns the oldest message.
+func (r *messageRing) PopFront() snowflake.ID {
+	id := r.buf[r.head]
+	r.buf[r.head] = 0
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	r.maybeShrink()
+	return id
+}
+
+// Push adds a message, keeping the list sorted. New messages normally
+// arrive in order, making this an append.
+func (r *messageRing) Push(id snowflake.ID) {
+	if r.n == len(r.buf) {
+		r.resize(2 * len(r.buf))
+	}
+	// Find the insertion point, searching from the back
+	i := r.n
+	for i > 0 && r.At(i-1) > id {
+		i--
+	}
+	if i > 0 && r.At(i-1) == id {
+		return
+	}
+	for j := r.n; j > i; j-- {
+		r.buf[(r.head+j)%len(r.buf)] = r.At(j - 1)
+	}
+	r.buf[(r.head+i)%len(r.buf)] = id
+	r.n++
+}
+
+// Index returns the position of id in the list, or where it would be
+// inserted.
+func (r *messageRing) Index(id snowflake.ID) (int, bool) {
+	i := sort.Search(r.n, func(i int) bool { return r.At(i) >= id })
+	return i, i < r.n && r.At(i) == id
+}
+
+// Remove deletes the i'th oldest message.
+func (r *messageRing) Remove(i int) {
+	for j := i; j < r.n-1; j++ {
+		r.buf[(r.head+j)%len(r.buf)] = r.At(j + 1)
+	}
+	r.buf[(r.head+r.n-1)%len(r.buf)] = 0
+	r.n--
+	r.maybeShrink()
+}
+
+// IDs returns a copy of the list, oldest first.
+func (r *messageRing) IDs() []snowflake.ID {
+	out := make([]snowflake.ID, r.n)
+	for i := range out {
+		out[i] = r.At(i)
+	}
+	return out
+}
+
+// Reset replaces the contents of the list. ids is sorted and deduplicated
+// in place.
+func (r *messageRing) Reset(ids []snowflake.ID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	n := 0
+	for i, v := range ids {
+		if i > 0 && v == ids[n-1] {
+			continue
+		}
+		ids[n] = v
+		n++
+	}
+	size := minRingSize
+	for size < n {
+		size *= 2
+	}
+	r.buf = make([]snowflake.ID, size)
+	copy(r.buf, ids[:n])
+	r.head = 0
+	r.n = n
+}
+
+// Clear empties the list and releases its memory.
+func (r *messageRing) Clear() {
+	*r = messageRing{}
+}
+
+func (r *messageRing) maybeShrink() {
+	if r.n == 0 {
+		r.Clear()
+	} else if len(r.buf) > minRingSize && r.n <= len(r.buf)/4 {
+		r.resize(len(r.buf) / 2)
+	}
+}
+
+func (r *messageRing) resize(size int) {
+	if size < minRingSize {
+		size = minRingSize
+	}
+	buf := make([]snowflake.ID, size)
+	for i := 0; i < r.n; i++ {
+		buf[i] = r.At(i)
+	}
+	r.buf = buf
+	r.head = 0
+}
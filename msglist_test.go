@@ -0,0 +1,177 @@
+package autodelete
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+func ringIDs(r *messageRing) []snowflake.ID {
+	if r.Len() == 0 {
+		return nil
+	}
+	return r.IDs()
+}
+
+func TestMessageRingPush(t *testing.T) {
+	var r messageRing
+	for _, id := range []snowflake.ID{10, 20, 40, 30, 20, 5} {
+		r.Push(id)
+	}
+	if got, want := ringIDs(&r), []snowflake.ID{5, 10, 20, 30, 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after push: %v, want %v", got, want)
+	}
+	if r.Front() != 5 || r.At(3) != 30 {
+		t.Errorf("Front() = %d, At(3) = %d, want 5 and 30", r.Front(), r.At(3))
+	}
+}
+
+func TestMessageRingWrap(t *testing.T) {
+	var r messageRing
+	next := snowflake.ID(1)
+	// Keep the ring at a steady size so head walks around the buffer.
+	for i := 0; i < 5; i++ {
+		r.Push(next)
+		next++
+	}
+	for i := 0; i < 100; i++ {
+		r.Push(next)
+		next++
+		if got := r.PopFront(); got != next-6 {
+			t.Fatalf("PopFront() = %d, want %d", got, next-6)
+		}
+	}
+	if len(r.buf) != minRingSize {
+		t.Errorf("buffer grew to %d with 5 messages", len(r.buf))
+	}
+	// Out-of-order insert across the wrap point.
+	r.Push(next - 3)
+	r.Push(next - 7)
+	if got, want := ringIDs(&r), []snowflake.ID{next - 7, next - 5, next - 4, next - 3, next - 2, next - 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after wrap: %v, want %v", got, want)
+	}
+}
+
+func TestMessageRingShrink(t *testing.T) {
+	var r messageRing
+	for i := snowflake.ID(1); i <= 1000; i++ {
+		r.Push(i)
+	}
+	if len(r.buf) != 1024 {
+		t.Errorf("buffer size %d for 1000 messages, want 1024", len(r.buf))
+	}
+	for r.Len() > 10 {
+		r.PopFront()
+	}
+	if len(r.buf) > 64 {
+		t.Errorf("buffer size %d after popping down to 10 messages", len(r.buf))
+	}
+	if got := r.Front(); got != 991 {
+		t.Errorf("Front() = %d after shrinking, want 991", got)
+	}
+	for r.Len() > 0 {
+		r.PopFront()
+	}
+	if r.buf != nil {
+		t.Errorf("empty ring still holds a %d-entry buffer", len(r.buf))
+	}
+}
+
+func TestMessageRingRemoveReset(t *testing.T) {
+	var r messageRing
+	r.Reset([]snowflake.ID{30, 10, 20, 10, 50, 40})
+	if got, want := ringIDs(&r), []snowflake.ID{10, 20, 30, 40, 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after reset: %v, want %v", got, want)
+	}
+	if i, ok := r.Index(30); i != 2 || !ok {
+		t.Errorf("Index(30) = %d, %v, want 2, true", i, ok)
+	}
+	if i, ok := r.Index(35); i != 3 || ok {
+		t.Errorf("Index(35) = %d, %v, want 3, false", i, ok)
+	}
+	r.Remove(2)
+	r.Remove(0)
+	if got, want := ringIDs(&r), []snowflake.ID{20, 40, 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after remove: %v, want %v", got, want)
+	}
+	r.Clear()
+	if r.Len() != 0 || r.buf != nil {
+		t.Errorf("Clear() left %d messages", r.Len())
+	}
+}
+
+// legacyMessageList is the layout liveMessages had before messageRing: string
+// IDs with a separate timestamp, popped by re-slicing.
+type legacyMessageList []struct {
+	MessageID string
+	PostedAt  time.Time
+}
+
+const (
+	benchChannels   = 1000
+	benchWindow     = 100
+	benchChurnSteps = 500
+)
+
+// benchSnowflake returns message i in channel ch, one message per second.
+func benchSnowflake(ch, i int) snowflake.ID {
+	return snowflake.FromTime(time.Unix(1600000000+int64(i), 0), uint64(ch))
+}
+
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// The benchmarks simulate benchChannels channels each holding a window of
+// benchWindow messages, after messages have been added and deleted for a
+// while, and report the retained heap per tracked message.
+
+func BenchmarkLiveMessagesLegacy(b *testing.B) {
+	b.ReportAllocs()
+	var retained uint64
+	for n := 0; n < b.N; n++ {
+		before := heapInUse()
+		chans := make([]legacyMessageList, benchChannels)
+		for step := 0; step < benchWindow+benchChurnSteps; step++ {
+			for ch := range chans {
+				id := benchSnowflake(ch, step)
+				chans[ch] = append(chans[ch], struct {
+					MessageID string
+					PostedAt  time.Time
+				}{id.String(), id.Time()})
+				if len(chans[ch]) > benchWindow {
+					chans[ch] = chans[ch][1:]
+				}
+			}
+		}
+		retained += heapInUse() - before
+		runtime.KeepAlive(chans)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N)/(benchChannels*benchWindow), "B/msg")
+}
+
+func BenchmarkLiveMessagesRing(b *testing.B) {
+	b.ReportAllocs()
+	var retained uint64
+	for n := 0; n < b.N; n++ {
+		before := heapInUse()
+		chans := make([]messageRing, benchChannels)
+		for step := 0; step < benchWindow+benchChurnSteps; step++ {
+			for ch := range chans {
+				chans[ch].Push(benchSnowflake(ch, step))
+				if chans[ch].Len() > benchWindow {
+					chans[ch].PopFront()
+				}
+			}
+		}
+		retained += heapInUse() - before
+		runtime.KeepAlive(chans)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N)/(benchChannels*benchWindow), "B/msg")
+}
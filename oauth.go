@@ -1,57 +1,167 @@
 package autodelete
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
-
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"golang.org/x/oauth2"
 )
 
-var oauthConfig *oauth2.Config
+var discordOAuthEndpoint = oauth2.Endpoint{
+	AuthURL:  discordgo.EndpointOauth2 + "authorize",
+	TokenURL: discordgo.EndpointOauth2 + "token",
+}
+
+// defaultInvitePermissions are the permissions the bot uses: reading and
+// deleting messages, and the replies, reactions and embeds of its commands.
+const defaultInvitePermissions = discordgo.PermissionViewChannel |
+	discordgo.PermissionReadMessageHistory |
+	discordgo.PermissionManageMessages |
+	discordgo.PermissionSendMessages |
+	discordgo.PermissionEmbedLinks |
+	discordgo.PermissionAddReactions
+
+const (
+	// The cookie holding the nonce of the browser's OAuth state.
+	oauthNonceCookie = "ad_oauth_nonce"
+	oauthCookiePath  = "/discord_auto_delete/"
+	oauthStateExpiry = 10 * time.Minute
+)
 
 func (b *Bot) oauthConfig() *oauth2.Config {
-	if oauthConfig != nil {
-		return oauthConfig
+	scopes := b.Invite.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"bot"}
 	}
-	oauthConfig = &oauth2.Config{
+	return &oauth2.Config{
 		ClientID:     b.ClientID,
 		ClientSecret: b.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  discordgo.EndpointOauth2 + "authorize",
-			TokenURL: discordgo.EndpointOauth2 + "token",
-		},
-		Scopes:      []string{"bot"},
-		RedirectURL: fmt.Sprintf("%s%s", b.HTTP.Public, "/discord_auto_delete/oauth/callback"),
-	}
-	return oauthConfig
+		Endpoint:     discordOAuthEndpoint,
+		Scopes:       scopes,
+		RedirectURL:  fmt.Sprintf("%s%s", b.HTTP.Public, "/discord_auto_delete/oauth/callback"),
+	}
+}
+
+func (b *Bot) invitePermissions() int64 {
+	if b.Invite.Permissions != 0 {
+		return b.Invite.Permissions
+	}
+	return defaultInvitePermissions
 }
 
-func (b *Bot) OAuthStartURL() string {
-	return b.oauthConfig().AuthCodeURL("not_necessary_for_discord",
-		oauth2.SetAuthURLParam("permissions", strconv.Itoa(discordgo.PermissionManageMessages)))
+// oauthState is carried through Discord in the state parameter of an OAuth
+// flow. It is signed, and its nonce must match the browser's cookie, so that
+// a callback cannot be forged or replayed in another browser.
+type oauthState struct {
+	Nonce   string `json:"n"`
+	Expires int64  `json:"e"`
+	// Where to go after a dashboard login, relative to DashboardPath.
+	Next string `json:"x,omitempty"`
+}
+
+func (b *Bot) signState(payload string) string {
+	mac := hmac.New(sha256.New, b.stateKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newOAuthState starts an OAuth flow: it sets the nonce cookie and returns the
+// state parameter.
+func (b *Bot) newOAuthState(w http.ResponseWriter, next string) (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	by, err := json.Marshal(oauthState{
+		Nonce:   nonce,
+		Expires: b.clock.Now().Add(oauthStateExpiry).Unix(),
+		Next:    next,
+	})
+	if err != nil {
+		return "", err
+	}
+	b.setCookie(w, oauthNonceCookie, oauthCookiePath, nonce, oauthStateExpiry)
+	payload := base64.RawURLEncoding.EncodeToString(by)
+	return payload + "." + b.signState(payload), nil
+}
+
+// checkOAuthState verifies the state parameter of an OAuth callback, and
+// clears the nonce cookie.
+func (b *Bot) checkOAuthState(w http.ResponseWriter, r *http.Request) (oauthState, error) {
+	var st oauthState
+	parts := strings.Split(r.FormValue("state"), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(b.signState(parts[0]))) {
+		return st, fmt.Errorf("bad signature")
+	}
+	by, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(by, &st); err != nil {
+		return st, err
+	}
+	if b.clock.Now().Unix() > st.Expires {
+		return st, fmt.Errorf("expired")
+	}
+	cookie, err := r.Cookie(oauthNonceCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(st.Nonce)) != 1 {
+		return st, fmt.Errorf("nonce does not match the cookie")
+	}
+	b.setCookie(w, oauthNonceCookie, oauthCookiePath, "", -1)
+	return st, nil
+}
+
+func (b *Bot) OAuthStartURL(state string) string {
+	return b.oauthConfig().AuthCodeURL(state,
+		oauth2.SetAuthURLParam("permissions", strconv.FormatInt(b.invitePermissions(), 10)))
 }
 
 func (b *Bot) HTTPOAuthStart(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Location", b.OAuthStartURL())
+	state, err := b.newOAuthState(w, "")
+	if err != nil {
+		http.Error(w, "An error occured, please try again.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", b.OAuthStartURL(state))
 	w.WriteHeader(http.StatusFound)
 }
 
+// joinedURL is the page to show after the bot joins a guild: the guild's
+// dashboard page, after logging in.
+func joinedURL(guildID string) string {
+	if guildID == "" {
+		return DashboardPath
+	}
+	return DashboardPath + "login?next=" + url.QueryEscape("guilds/"+guildID)
+}
+
 func (b *Bot) HTTPOAuthCallback(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "bad form", 400)
 		return
 	}
+	if _, err := b.checkOAuthState(w, r); err != nil {
+		fmt.Printf("[INFO] rejected OAuth callback: %v\n", err)
+		http.Error(w, "This link expired or did not start here. Please add the bot again.", http.StatusBadRequest)
+		return
+	}
 	if r.Form.Get("code") == "" {
 		http.Error(w, "no authcode", 400)
 		return
 	}
 
-	t, err := b.oauthConfig().Exchange(r.Context(), r.Form.Get("code"))
+	t, err := b.oauthConfig().Exchange(b.oauthContext(r.Context()), r.Form.Get("code"))
 	if err != nil && strings.Contains(err.Error(), "invalid_client") {
 		fmt.Fprint(w, "OK, bot joined\nUse '@AutoDelete setup' to get started")
 		return
@@ -60,18 +170,20 @@ func (b *Bot) HTTPOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "An error occured and the bot could not join the server.", http.StatusUnprocessableEntity)
 		return
 	}
+	guildID := ""
 	if guildInfo, ok := t.Extra("guild").(map[string]interface{}); ok {
-		if guildID, ok := guildInfo["id"].(string); ok {
-			if banned, err := b.storage.IsBanned(guildID); banned {
-				b.s.GuildLeave(guildID)
+		if id, ok := guildInfo["id"].(string); ok {
+			if banned, err := b.storage.IsBanned(id); banned {
+				b.api.GuildLeave(id)
 				http.Error(w, "AutoDelete is not available on this server.", http.StatusForbidden)
-				fmt.Printf("[INFO] join attempt for banned server %s\n", guildID)
+				fmt.Printf("[INFO] join attempt for banned server %s\n", id)
 				return
 			} else if err != nil {
 				fmt.Printf("[ERR] Could not check banlist: %T %v", err, err)
 				http.Error(w, "An error occured and the bot may not have joined the server.", http.StatusUnprocessableEntity)
 				return
 			}
+			guildID = id
 		} else {
 			fmt.Printf("[ERR] Unexpected type for guild.id: got %T\n", guildInfo["id"])
 		}
@@ -79,7 +191,6 @@ func (b *Bot) HTTPOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("[ERR] Unexpected type for guild: got %T\n", t.Extra("guild"))
 	}
 
-	fmt.Println(t)
-	w.WriteHeader(200)
-	fmt.Fprint(w, "OK, bot joined\nUse '@AutoDelete setup' to get started")
+	fmt.Printf("[INFO] bot joined server %s\n", guildID)
+	http.Redirect(w, r, joinedURL(guildID), http.StatusFound)
 }
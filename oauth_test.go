@@ -0,0 +1,123 @@
+package autodelete
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeJoinTokenEndpoint answers the token exchange of a bot join with the
+// guild the bot joined.
+func fakeJoinTokenEndpoint(t *testing.T, exchanges *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/oauth2/token") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		*exchanges++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"x","token_type":"Bearer","guild":{"id":"` + r.FormValue("code") + `"}}`))
+	})
+}
+
+// startJoin follows the start link, and returns the state and nonce cookie.
+func startJoin(t *testing.T, b *Bot) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	b.HTTPOAuthStart(w, httptest.NewRequest("GET", "/discord_auto_delete/oauth/start", nil))
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound {
+		t.Fatalf("start: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	return loc.Query().Get("state"), responseCookie(w, oauthNonceCookie)
+}
+
+func joinCallback(b *Bot, code, state string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/discord_auto_delete/oauth/callback?code="+code+"&state="+url.QueryEscape(state), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.HTTPOAuthCallback(w, r)
+	return w
+}
+
+func TestOAuthStartURL(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	state, nonce := startJoin(t, b)
+	if nonce == nil || nonce.Path != oauthCookiePath || !nonce.HttpOnly {
+		t.Errorf("nonce cookie %+v", nonce)
+	}
+	q, _ := url.ParseQuery(strings.SplitN(b.OAuthStartURL(state), "?", 2)[1])
+	if got, want := q.Get("permissions"), strconv.FormatInt(defaultInvitePermissions, 10); got != want {
+		t.Errorf("default permissions = %s, want %s", got, want)
+	}
+	if got := q.Get("scope"); got != "bot" {
+		t.Errorf("default scope = %q", got)
+	}
+
+	b.Invite = InviteConfig{
+		Permissions: discordgo.PermissionManageMessages | discordgo.PermissionViewChannel,
+		Scopes:      []string{"bot", "applications.commands"},
+	}
+	q, _ = url.ParseQuery(strings.SplitN(b.OAuthStartURL(state), "?", 2)[1])
+	if got, want := q.Get("permissions"), strconv.FormatInt(b.Invite.Permissions, 10); got != want {
+		t.Errorf("permissions = %s, want %s", got, want)
+	}
+	if got := q.Get("scope"); got != "bot applications.commands" {
+		t.Errorf("scope = %q", got)
+	}
+}
+
+func TestOAuthCallback(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	exchanges := 0
+	b.transport = handlerTransport{fakeJoinTokenEndpoint(t, &exchanges)}
+	if err := b.storage.AddBan("666"); err != nil {
+		t.Fatal(err)
+	}
+
+	state, nonce := startJoin(t, b)
+	other := newBot(Config{}, clock)
+	forged, _ := startJoin(t, other)
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"no state":        joinCallback(b, testGuildID, "", nonce),
+		"tampered state":  joinCallback(b, testGuildID, "x"+state, nonce),
+		"other key":       joinCallback(b, testGuildID, forged, nonce),
+		"no nonce cookie": joinCallback(b, testGuildID, state),
+		"wrong nonce":     joinCallback(b, testGuildID, state, &http.Cookie{Name: oauthNonceCookie, Value: "00"}),
+	} {
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", name, w.Code)
+		}
+	}
+	if exchanges != 0 {
+		t.Errorf("%d code exchanges for rejected callbacks", exchanges)
+	}
+
+	w := joinCallback(b, testGuildID, state, nonce)
+	if want := DashboardPath + "login?next=guilds%2F" + testGuildID; w.Code != http.StatusFound || w.Header().Get("Location") != want {
+		t.Errorf("join: %d to %q, want a redirect to %q", w.Code, w.Header().Get("Location"), want)
+	}
+	if c := responseCookie(w, oauthNonceCookie); c == nil || c.MaxAge >= 0 {
+		t.Errorf("nonce cookie not cleared: %+v", c)
+	}
+
+	state, nonce = startJoin(t, b)
+	if w := joinCallback(b, "666", state, nonce); w.Code != http.StatusForbidden || len(api.left) != 1 || api.left[0] != "666" {
+		t.Errorf("banned guild: %d, left %q", w.Code, api.left)
+	}
+
+	state, nonce = startJoin(t, b)
+	clock.Advance(oauthStateExpiry + time.Second)
+	if w := joinCallback(b, testGuildID, state, nonce); w.Code != http.StatusBadRequest {
+		t.Errorf("expired state: %d", w.Code)
+	}
+}
@@ -0,0 +1,314 @@
+package autodelete
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The bot watches for changes to its own permissions. When it loses one it
+// cannot work without, the channel is suspended: the configuration is kept,
+// but no work is done until the permission comes back.
+
+// criticalPermissions are needed to delete messages at all.
+var criticalPermissions = []struct {
+	perm int64
+	name string
+}{
+	{discordgo.PermissionViewChannel, "View Channel"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+}
+
+var mSuspensions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: nsAutodelete,
+	Name:      "channel_suspensions_total",
+	Help:      "Number of times a channel was suspended or resumed because of permission changes, or paused through the API",
+}, []string{"action"})
+
+func init() {
+	prometheus.MustRegister(mSuspensions)
+}
+
+// missingCriticalPermissions names the critical permissions not in perms.
+func missingCriticalPermissions(perms int64) []string {
+	var missing []string
+	for _, p := range criticalPermissions {
+		if perms&p.perm == 0 {
+			missing = append(missing, p.name)
+		}
+	}
+	return missing
+}
+
+func (c *ManagedChannel) IsSuspended() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Suspended
+}
+
+// suspendNotice tells the guild that a channel was suspended, in the guild's
+// language. The channel itself may not accept messages any more, so the
+// guild's system channel is tried next.
+func (b *Bot) suspendNotice(channelID, key string, args ...interface{}) {
+	b.ReportToLogChannel(localeEnglish.Sprintf(key, args...))
+	msg := b.localeForChannel(channelID).Sprintf(key, args...)
+	if _, err := b.api.ChannelMessageSend(channelID, msg); err == nil {
+		return
+	}
+	ch, err := b.Channel(channelID)
+	if err != nil {
+		return
+	}
+	guild, err := b.s.State.Guild(ch.GuildID)
+	if err != nil || guild.SystemChannelID == "" || guild.SystemChannelID == channelID {
+		return
+	}
+	if _, err := b.api.ChannelMessageSend(guild.SystemChannelID, msg); err != nil {
+		fmt.Printf("[perm] could not notify guild %s about %s: %v\n", ch.GuildID, channelID, err)
+	}
+}
+
+// pausedReason is the suspension reason of a channel paused through the API.
+const pausedReason = "an API client paused it"
+
+// markSuspended stops work in a channel and saves it as suspended. paused
+// marks a suspension that only ends when asked for. It returns false if the
+// channel is not configured or was already suspended that way.
+func (b *Bot) markSuspended(channelID, reason string, paused bool) bool {
+	b.mu.RLock()
+	mCh := b.channels[channelID]
+	b.mu.RUnlock()
+
+	var conf ManagedChannelMarshal
+	if mCh != nil {
+		mCh.mu.Lock()
+		already := mCh.Suspended && (mCh.Paused || !paused)
+		if !already {
+			if paused || !mCh.Paused {
+				mCh.SuspendReason = reason
+			}
+			mCh.Suspended = true
+			mCh.Paused = mCh.Paused || paused
+			// A load still in the queue is dropped
+			mCh.markStartedLocked()
+		}
+		mCh.mu.Unlock()
+		if already {
+			return false
+		}
+		// Queued work is dropped by the schedulers
+		b.CancelReap(mCh)
+		conf = mCh.Export()
+	} else {
+		var err error
+		conf, err = b.storage.GetChannel(channelID)
+		if err != nil || (conf.Suspended && (conf.Paused || !paused)) {
+			return false
+		}
+		conf.ID = channelID
+		if paused || !conf.Paused {
+			conf.SuspendReason = reason
+		}
+		conf.Suspended = true
+		conf.Paused = conf.Paused || paused
+	}
+	if err := b.saveChannelConfig(conf); err != nil {
+		fmt.Printf("[perm] could not save suspension of %s: %v\n", channelID, err)
+	}
+	return true
+}
+
+// suspendChannel suspends a channel that is missing permissions, and tells the
+// guild.
+func (b *Bot) suspendChannel(channelID, reason string) {
+	if !b.markSuspended(channelID, reason, false) {
+		return
+	}
+	mSuspensions.WithLabelValues("suspend").Inc()
+
+	name := channelID
+	if ch, err := b.Channel(channelID); err == nil {
+		name = "#" + ch.Name
+	}
+	b.suspendNotice(channelID, "perm.suspended", channelID, name, reason)
+}
+
+// pauseChannel suspends a channel until unpauseChannel is called, whatever
+// the bot's permissions are.
+func (b *Bot) pauseChannel(channelID string) {
+	if b.markSuspended(channelID, pausedReason, true) {
+		mSuspensions.WithLabelValues("pause").Inc()
+		fmt.Printf("[perm] paused %s\n", channelID)
+	}
+}
+
+// unpauseChannel ends a pause. The channel stays suspended if the bot is
+// missing permissions.
+func (b *Bot) unpauseChannel(channelID string) error {
+	conf, err := b.storage.GetChannel(channelID)
+	if err != nil {
+		return err
+	}
+	if !conf.Paused {
+		return nil
+	}
+	conf.ID = channelID
+	conf.Paused = false
+	perms, err := b.api.UserChannelPermissions(b.me.ID, channelID)
+	if err != nil {
+		return err
+	}
+	if missing := missingCriticalPermissions(perms); len(missing) > 0 {
+		conf.SuspendReason = missingReason(missing)
+		return b.setChannelConfig(conf)
+	}
+	if err := b.saveChannelConfig(conf); err != nil {
+		return err
+	}
+	return b.resumeChannel(channelID)
+}
+
+// suspendForError suspends a channel after Discord refused a request for lack
+// of permissions.
+func (b *Bot) suspendForError(channelID string, rErr *discordgo.RESTError) {
+	reason := fmt.Sprintf("Discord refused a request with error %d (%s)", rErr.Message.Code, rErr.Message.Message)
+	if perms, err := b.api.UserChannelPermissions(b.me.ID, channelID); err == nil {
+		if missing := missingCriticalPermissions(perms); len(missing) > 0 {
+			reason = missingReason(missing)
+		}
+	}
+	b.suspendChannel(channelID, reason)
+}
+
+func missingReason(missing []string) string {
+	return "it is missing the " + strings.Join(missing, ", ") + " permission"
+}
+
+// resumeChannel clears a suspension and reloads the channel.
+func (b *Bot) resumeChannel(channelID string) error {
+	conf, err := b.storage.GetChannel(channelID)
+	if err != nil {
+		return err
+	}
+	conf.ID = channelID
+	conf.Suspended = false
+	conf.SuspendReason = ""
+	if err := b.setChannelConfig(conf); err != nil {
+		return err
+	}
+	mSuspensions.WithLabelValues("resume").Inc()
+	fmt.Printf("[perm] resumed %s\n", channelID)
+	return nil
+}
+
+// recheckPermissions suspends or resumes a channel after a permission change.
+// Paused channels are not resumed.
+func (b *Bot) recheckPermissions(channelID string, suspended, paused bool) {
+	perms, err := b.api.UserChannelPermissions(b.me.ID, channelID)
+	if err != nil {
+		fmt.Printf("[perm] could not check permissions in %s: %v\n", channelID, err)
+		return
+	}
+	missing := missingCriticalPermissions(perms)
+	if len(missing) > 0 && !suspended {
+		b.suspendChannel(channelID, missingReason(missing))
+	} else if len(missing) == 0 && suspended && !paused {
+		if err := b.resumeChannel(channelID); err != nil {
+			fmt.Printf("[perm] could not resume %s: %v\n", channelID, err)
+			return
+		}
+		b.api.ChannelMessageSend(channelID, b.localeForChannel(channelID).Sprintf("perm.resumed"))
+	}
+}
+
+// guildRecheckDelay gathers the role and member updates of a guild, which come
+// in bursts when someone edits roles, into one permission recheck.
+const guildRecheckDelay = 5 * time.Second
+
+// scheduleGuildRecheck rechecks a guild's permissions after guildRecheckDelay,
+// unless a recheck is already waiting.
+func (b *Bot) scheduleGuildRecheck(guildID string) {
+	b.mu.Lock()
+	pending := b.pendingRechecks[guildID]
+	b.pendingRechecks[guildID] = true
+	b.mu.Unlock()
+	if pending {
+		return
+	}
+	go func() {
+		<-b.clock.After(guildRecheckDelay)
+		b.mu.Lock()
+		delete(b.pendingRechecks, guildID)
+		b.mu.Unlock()
+		b.recheckGuildPermissions(guildID)
+	}()
+}
+
+// recheckGuildPermissions rechecks the loaded channels of a guild. Configured
+// channels that are not loaded check their permissions when they load.
+func (b *Bot) recheckGuildPermissions(guildID string) {
+	var channels []*ManagedChannel
+	b.mu.RLock()
+	for _, mCh := range b.channels {
+		if mCh != nil && mCh.GuildID == guildID {
+			channels = append(channels, mCh)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, mCh := range channels {
+		mCh.mu.Lock()
+		suspended, paused := mCh.Suspended, mCh.Paused
+		mCh.mu.Unlock()
+		b.recheckPermissions(mCh.ChannelID, suspended, paused)
+	}
+}
+
+// recheckChannelPermissions rechecks one channel if it is managed.
+func (b *Bot) recheckChannelPermissions(channelID string) {
+	b.mu.RLock()
+	mCh, known := b.channels[channelID]
+	b.mu.RUnlock()
+	if mCh != nil {
+		mCh.mu.Lock()
+		suspended, paused := mCh.Suspended, mCh.Paused
+		mCh.mu.Unlock()
+		b.recheckPermissions(channelID, suspended, paused)
+		return
+	}
+	if known {
+		return // not configured
+	}
+	if conf, err := b.storage.GetChannel(channelID); err == nil && conf.Suspended {
+		b.recheckPermissions(channelID, true, conf.Paused)
+	}
+}
+
+func (b *Bot) OnGuildRoleUpdate(s *discordgo.Session, ev *discordgo.GuildRoleUpdate) {
+	b.scheduleGuildRecheck(ev.GuildID)
+}
+
+func (b *Bot) OnGuildRoleDelete(s *discordgo.Session, ev *discordgo.GuildRoleDelete) {
+	b.scheduleGuildRecheck(ev.GuildID)
+}
+
+func (b *Bot) OnChannelUpdate(s *discordgo.Session, ev *discordgo.ChannelUpdate) {
+	b.recheckChannelPermissions(ev.ID)
+}
+
+// OnGuildMemberUpdate only gets events for the bot itself, as the bot does not
+// have the members intent.
+func (b *Bot) OnGuildMemberUpdate(s *discordgo.Session, ev *discordgo.GuildMemberUpdate) {
+	if ev.User == nil || ev.User.ID != b.me.ID {
+		return
+	}
+	// The State does not track members, except this one
+	if err := b.s.State.MemberAdd(ev.Member); err != nil {
+		fmt.Printf("[perm] could not update own roles in guild %s: %v\n", ev.GuildID, err)
+	}
+	b.scheduleGuildRecheck(ev.GuildID)
+}
@@ -0,0 +1,124 @@
+package autodelete
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSuspendAndResume(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	conf := ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, LiveTime: time.Hour}
+	if err := b.setChannelConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := b.Channel(testChannelID)
+
+	// Losing Send Messages is not critical
+	api.perms = discordgo.PermissionAll &^ discordgo.PermissionSendMessages
+	b.OnChannelUpdate(b.s, &discordgo.ChannelUpdate{Channel: ch})
+	if c, _ := b.GetChannel(testChannelID, QOSInteractive); c == nil || c.IsSuspended() {
+		t.Fatal("suspended without a critical permission missing")
+	}
+
+	api.perms = discordgo.PermissionAll &^ discordgo.PermissionManageMessages
+	b.OnChannelUpdate(b.s, &discordgo.ChannelUpdate{Channel: ch})
+	c, _ := b.GetChannel(testChannelID, QOSInteractive)
+	if c == nil || !c.IsSuspended() {
+		t.Fatal("channel not suspended after losing Manage Messages")
+	}
+	if saved, _ := b.storage.GetChannel(testChannelID); !saved.Suspended || saved.LiveTime != time.Hour {
+		t.Errorf("saved config %+v, want suspended with settings kept", saved)
+	}
+	sent := sentMessages(api)
+	if len(sent) == 0 || !strings.Contains(sent[len(sent)-1], "Manage Messages") {
+		t.Errorf("sent %q, want a notice naming the permission", sent)
+	}
+
+	// A restart keeps it suspended, without loading the channel
+	(&ManagedChannel{bot: b, ChannelID: testChannelID}).Disable()
+	if err := b.loadChannel(testChannelID, QOSInit); err != nil {
+		t.Fatal(err)
+	}
+	suspended, _ := b.GetChannel(testChannelID, QOSInteractive)
+	if suspended == nil || !suspended.IsSuspended() {
+		t.Fatal("suspension lost on reload")
+	}
+
+	// A burst of role updates is one recheck
+	api.perms = discordgo.PermissionAll
+	n := clock.count(guildRecheckDelay)
+	for i := 0; i < 3; i++ {
+		b.OnGuildRoleUpdate(b.s, &discordgo.GuildRoleUpdate{GuildRole: &discordgo.GuildRole{GuildID: testGuildID, Role: &discordgo.Role{ID: "50"}}})
+	}
+	clock.waitArmed(t, guildRecheckDelay, n+1)
+	if got := clock.count(guildRecheckDelay); got != n+1 {
+		t.Errorf("%d rechecks scheduled, want 1", got-n)
+	}
+	if c, _ := b.GetChannel(testChannelID, QOSInteractive); c == nil || !c.IsSuspended() {
+		t.Error("channel resumed before the recheck delay")
+	}
+	clock.Advance(guildRecheckDelay)
+	waitFor(t, "channel to resume", func() bool {
+		c, _ := b.GetChannel(testChannelID, QOSInteractive)
+		return c != nil && !c.IsSuspended()
+	})
+	if saved, _ := b.storage.GetChannel(testChannelID); saved.Suspended {
+		t.Errorf("saved config %+v still suspended", saved)
+	}
+	if !suspended.IsDisabled() {
+		t.Error("suspended instance not disabled after resume")
+	}
+}
+
+func TestSuspendUnloadedChannel(t *testing.T) {
+	b, _, api := newTestBot(t)
+	if err := b.saveChannelConfig(ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, MaxMessages: 10}); err != nil {
+		t.Fatal(err)
+	}
+	api.perms = 0
+	if !b.handleCriticalPermissionsErrors(testChannelID, restError(discordgo.ErrCodeMissingAccess)) {
+		t.Fatal("missing access not treated as critical")
+	}
+	saved, err := b.storage.GetChannel(testChannelID)
+	if err != nil || !saved.Suspended || !strings.Contains(saved.SuspendReason, "View Channel") {
+		t.Errorf("saved config %+v, %v; want suspended for View Channel", saved, err)
+	}
+
+	// Loading with the permissions back resumes right away
+	api.perms = discordgo.PermissionAll
+	if err := b.loadChannel(testChannelID, QOSInit); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := b.GetChannel(testChannelID, QOSInteractive); c == nil || c.IsSuspended() {
+		t.Error("channel still suspended after loading with permissions")
+	}
+}
+
+func TestMessageInSuspendedChannel(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	conf := ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, LiveTime: time.Hour, Suspended: true, Paused: true, SuspendReason: pausedReason}
+	if err := b.saveChannelConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.loadChannel(testChannelID, QOSInit); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.OnMessage(b.s, &discordgo.MessageCreate{Message: api.post(testChannelID, clock.Now())})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message in a suspended channel waits for a history load that never comes")
+	}
+	c, _ := b.GetChannel(testChannelID, QOSInteractive)
+	if c == nil || len(liveIDs(c)) != 0 {
+		t.Errorf("suspended channel tracks %v", liveIDs(c))
+	}
+}
@@ -0,0 +1,73 @@
+package autodelete
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// PinPolicy controls which pinned messages are protected from deletion.
+type PinPolicy string
+
+const (
+	// Every pinned message is kept.
+	PinPolicyKeepAll PinPolicy = ""
+	// Pins are deleted like any other message.
+	PinPolicyNone PinPolicy = "none"
+	// Only the PinKeepCount most recently pinned messages are kept. Older
+	// pins are unpinned and deleted like any other message.
+	PinPolicyNewest PinPolicy = "newest"
+)
+
+// ParsePinPolicy accepts the names used by the set command: "all", "none", or
+// a number of pins to keep.
+func ParsePinPolicy(s string) (PinPolicy, int, error) {
+	switch s {
+	case "all", "keep":
+		return PinPolicyKeepAll, 0, nil
+	case "none", "0":
+		return PinPolicyNone, 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return PinPolicyKeepAll, 0, fmt.Errorf("unknown pin policy %q", s)
+	}
+	return PinPolicyNewest, n, nil
+}
+
+// needsPins reports whether the pin list matters for this channel. Must be
+// called with mu held.
+func (c *ManagedChannel) needsPins() bool {
+	return c.PinPolicy != PinPolicyNone
+}
+
+// applyPinPolicy splits the channel's pins, newest first as returned by
+// Discord, into the ones to protect and the ones to unpin. Must be called
+// with mu held.
+func (c *ManagedChannel) applyPinPolicy(pins []*discordgo.Message) (keep, unpin []*discordgo.Message) {
+	switch c.PinPolicy {
+	case PinPolicyNone:
+		return nil, nil
+	case PinPolicyNewest:
+		if len(pins) > c.PinKeepCount {
+			return pins[:c.PinKeepCount], pins[c.PinKeepCount:]
+		}
+	}
+	return pins, nil
+}
+
+// unpinMessages removes pins that the pin policy no longer protects. The
+// messages are then deleted on the channel's normal schedule.
+func (c *ManagedChannel) unpinMessages(msgs []*discordgo.Message) {
+	for _, v := range msgs {
+		err := c.bot.api.ChannelMessageUnpin(c.ChannelID, v.ID)
+		if err != nil {
+			fmt.Printf("[pins] %s: could not unpin %s: %v\n", c, v.ID, err)
+			return
+		}
+	}
+	if len(msgs) > 0 {
+		fmt.Printf("[pins] %s: unpinned %d messages over the pin limit\n", c, len(msgs))
+	}
+}
@@ -0,0 +1,103 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// postPinned posts n messages and pins them in order, so the last one is the
+// newest pin.
+func postPinned(t *testing.T, clock *fakeClock, api *fakeAPI, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		id := api.post(testChannelID, clock.Now()).ID
+		api.pin(testChannelID, id)
+		ids = append(ids, id)
+		clock.Advance(time.Second)
+	}
+	ch, _ := api.Channel(testChannelID)
+	ch.LastPinTimestamp = "2022-03-01T12:00:00Z"
+	api.addChannel(ch)
+	return ids
+}
+
+func pinnedIDs(api *fakeAPI) []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]string(nil), api.pins[testChannelID]...)
+}
+
+func TestParsePinPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		policy PinPolicy
+		n      int
+		ok     bool
+	}{
+		{"all", PinPolicyKeepAll, 0, true},
+		{"none", PinPolicyNone, 0, true},
+		{"0", PinPolicyNone, 0, true},
+		{"3", PinPolicyNewest, 3, true},
+		{"-1", PinPolicyKeepAll, 0, false},
+		{"some", PinPolicyKeepAll, 0, false},
+	} {
+		p, n, err := ParsePinPolicy(tc.in)
+		if p != tc.policy || n != tc.n || (err == nil) != tc.ok {
+			t.Errorf("ParsePinPolicy(%q) = %q, %d, %v", tc.in, p, n, err)
+		}
+	}
+}
+
+func TestPinPolicyNone(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	pins := postPinned(t, clock, api, 2)
+	other := api.post(testChannelID, clock.Now()).ID
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 10, PinPolicy: PinPolicyNone, KeepMessages: []string{"5"}})
+	if got, want := liveIDs(c), []string{pins[0], pins[1], other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want pins included %v", got, want)
+	}
+	if c.hasPins() {
+		t.Error("hasPins() with pins=none")
+	}
+	c.UpdatePins("2022-03-01T12:00:00Z")
+	c.mu.Lock()
+	if want := map[string]bool{"5": true}; !reflect.DeepEqual(c.keepLookup, want) {
+		t.Errorf("keepLookup = %v, want only the conf message", c.keepLookup)
+	}
+	c.mu.Unlock()
+	if got := pinnedIDs(api); len(got) != 2 {
+		t.Errorf("pins = %v, want pins left alone", got)
+	}
+}
+
+func TestPinPolicyNewest(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	pins := postPinned(t, clock, api, 3)
+	other := api.post(testChannelID, clock.Now()).ID
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 10, PinPolicy: PinPolicyNewest, PinKeepCount: 2})
+	if got, want := pinnedIDs(api), []string{pins[2], pins[1]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pins = %v, want oldest unpinned %v", got, want)
+	}
+	if got, want := liveIDs(c), []string{pins[0], other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+
+	// A new pin pushes out the oldest kept one.
+	clock.Advance(time.Second)
+	api.pin(testChannelID, other)
+	c.UpdatePins("2022-03-01T12:00:01Z")
+	if got, want := pinnedIDs(api), []string{other, pins[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after pin: pins = %v, want %v", got, want)
+	}
+	c.mu.Lock()
+	if !c.keepLookup[other] || !c.keepLookup[pins[2]] || c.keepLookup[pins[1]] {
+		t.Errorf("after pin: keepLookup = %v", c.keepLookup)
+	}
+	c.mu.Unlock()
+	if got, want := liveIDs(c), []string{pins[0], pins[1], other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after pin: liveMessages = %v, want %v", got, want)
+	}
+}
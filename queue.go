@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"fmt"
 	mrand "math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,9 +17,12 @@ const (
 	workerTimeout    = 5 * time.Second
 	maxLoadBackoff   = 30 * time.Minute
 
-	labelQueue = "queue"
-	queueReap  = "reap"
-	queueLoad  = "load"
+	labelQueue  = "queue"
+	queueReap   = "reap"
+	queueLoad   = "load"
+	queueSingle = "single"
+	queueCrawl  = "crawl"
+	queueSticky = "sticky"
 )
 
 // Quality of service for the load queues. Lower numbers are higher priority.
@@ -165,37 +169,70 @@ type reapWorkItem struct {
 	due time.Time
 }
 
-type workerToken struct{}
+// A workFunc processes a single item taken off the reapQueue.
+type workFunc func(q *reapQueue, work reapWorkItem)
 
 type reapQueue struct {
 	items  *priorityQueue
 	cond   *sync.Cond
-	timer  *time.Timer
+	clock  Clock
+	timer  Timer
 	label  string
 	workCh chan reapWorkItem
 
-	// Send when a worker starts, receive when a worker quits
-	controlCh chan workerToken
+	// If set, consulted before dispatching work so that channels with an
+	// exhausted ratelimit bucket wait in the queue instead of in a worker.
+	ratelimitDelay ratelimitCheck
+
+	// Worker pool bounds and the current number of workers.
+	poolMu     sync.Mutex
+	minWorkers int
+	maxWorkers int
+	workers    int
+
+	// How long the scheduler waits for a free worker before starting a new
+	// one, and how long a worker sits idle before exiting.
+	dispatchTimeout time.Duration
+	idleTimeout     time.Duration
+	// Only used by the scheduler, see sendWorkItem.
+	dispatchTimer Timer
 
 	curMu   sync.Mutex
 	curWork map[*ManagedChannel]struct{}
+
+	// When the scheduler last took an item off the queue, protected by
+	// cond.L. Used to tell if the queue is stuck, see status.
+	lastPop time.Time
 }
 
-func newReapQueue(maxWorkerCount int, label string) *reapQueue {
+func newReapQueue(label string, pool WorkerPoolConfig, clock Clock) *reapQueue {
 	var locker sync.Mutex
 	q := &reapQueue{
-		items:     new(priorityQueue),
-		cond:      sync.NewCond(&locker),
-		timer:     time.NewTimer(0),
-		label:     label,
-		workCh:    make(chan reapWorkItem),
-		controlCh: make(chan workerToken, maxWorkerCount),
-		curWork:   make(map[*ManagedChannel]struct{}),
+		items:           new(priorityQueue),
+		cond:            sync.NewCond(&locker),
+		clock:           clock,
+		timer:           clock.NewTimer(0),
+		label:           label,
+		workCh:          make(chan reapWorkItem),
+		minWorkers:      pool.Min,
+		maxWorkers:      pool.Max,
+		dispatchTimeout: schedulerTimeout,
+		idleTimeout:     workerTimeout,
+		curWork:         make(map[*ManagedChannel]struct{}),
+		lastPop:         clock.Now(),
+	}
+	q.dispatchTimer = clock.NewTimer(q.dispatchTimeout)
+	q.dispatchTimer.Stop()
+	if q.minWorkers < 1 {
+		q.minWorkers = 1
+	}
+	if q.maxWorkers < q.minWorkers {
+		q.maxWorkers = q.minWorkers
 	}
 	go func() {
 		// Signal the condition variable every time the timer expires.
 		for {
-			<-q.timer.C
+			<-q.timer.C()
 			q.cond.Signal()
 		}
 	}()
@@ -223,8 +260,8 @@ func (c reapqCollector) Collect(ch chan<- prometheus.Metric) {
 	for _, q := range c.qs {
 		q.cond.L.Lock()
 		mReapqLen.WithLabelValues(q.label).Set(float64(len(*q.items)))
-		mReapqWorkerCount.WithLabelValues(q.label).Set(float64(len(q.controlCh)))
 		q.cond.L.Unlock()
+		mReapqWorkerCount.WithLabelValues(q.label).Set(float64(q.workerCount()))
 		q.curMu.Lock()
 		mReapqInFlight.WithLabelValues(q.label).Set(float64(len(q.curWork)))
 		q.curMu.Unlock()
@@ -268,6 +305,91 @@ func (q *reapQueue) Update(ch *ManagedChannel, t time.Time) {
 	q.cond.Signal()
 }
 
+// Scheduled returns when the channel is next due in the queue.
+func (q *reapQueue) Scheduled(ch *ManagedChannel) (time.Time, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for _, v := range *q.items {
+		if v.ch.ChannelID == ch.ChannelID {
+			return v.nextReap, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// queueStatus is a snapshot of a reapQueue for the status endpoint.
+type queueStatus struct {
+	Length int `json:"length"`
+	// Items whose time has come.
+	Due        int       `json:"due"`
+	InFlight   int       `json:"in_flight"`
+	Workers    int       `json:"workers"`
+	MaxWorkers int       `json:"max_workers"`
+	LastPop    time.Time `json:"last_pop"`
+	// Due items have waited more than queueWedgeTimeout without the
+	// scheduler taking any item.
+	Wedged bool `json:"wedged"`
+}
+
+// queueWedgeTimeout is how long a queue may go without taking an item while
+// items are due before it counts as stuck.
+const queueWedgeTimeout = 10 * time.Minute
+
+func (q *reapQueue) status() queueStatus {
+	now := q.clock.Now()
+	var st queueStatus
+	q.cond.L.Lock()
+	st.Length = len(*q.items)
+	for _, it := range *q.items {
+		if !it.nextReap.After(now) {
+			st.Due++
+		}
+	}
+	st.LastPop = q.lastPop
+	q.cond.L.Unlock()
+	st.Wedged = st.Due > 0 && now.Sub(st.LastPop) > queueWedgeTimeout
+
+	q.curMu.Lock()
+	st.InFlight = len(q.curWork)
+	q.curMu.Unlock()
+	q.poolMu.Lock()
+	st.Workers, st.MaxWorkers = q.workers, q.maxWorkers
+	q.poolMu.Unlock()
+	return st
+}
+
+// queueEntry is a channel waiting in a reapQueue, for the admin console.
+type queueEntry struct {
+	ChannelID string    `json:"channel_id"`
+	GuildID   string    `json:"guild_id"`
+	Due       time.Time `json:"due"`
+}
+
+// entries lists the waiting channels, soonest first, and the channels being
+// worked on.
+func (q *reapQueue) entries() (waiting []queueEntry, inFlight []string) {
+	q.cond.L.Lock()
+	waiting = make([]queueEntry, 0, len(*q.items))
+	for _, it := range *q.items {
+		waiting = append(waiting, queueEntry{
+			ChannelID: it.ch.ChannelID,
+			GuildID:   it.ch.GuildID,
+			Due:       it.nextReap,
+		})
+	}
+	q.cond.L.Unlock()
+	sort.Slice(waiting, func(i, j int) bool { return waiting[i].Due.Before(waiting[j].Due) })
+
+	q.curMu.Lock()
+	inFlight = make([]string, 0, len(q.curWork))
+	for ch := range q.curWork {
+		inFlight = append(inFlight, ch.ChannelID)
+	}
+	q.curMu.Unlock()
+	sort.Strings(inFlight)
+	return waiting, inFlight
+}
+
 func (q *reapQueue) WaitForNext() (*ManagedChannel, time.Time) {
 	q.cond.L.Lock()
 start:
@@ -277,17 +399,18 @@ start:
 		q.cond.Wait()
 		goto start
 	}
-	now := time.Now()
+	now := q.clock.Now()
 	if it.nextReap.After(now) {
 		waitTime := it.nextReap.Sub(now)
 		fmt.Println("[reap] sleeping for ", waitTime-(waitTime%time.Second))
 		q.timer.Reset(waitTime + 2*time.Millisecond)
 		q.cond.Wait()
-		actualWait := time.Now().Sub(now)
+		actualWait := q.clock.Now().Sub(now)
 		mReapqWaitDuration.WithLabelValues(q.label).Observe(float64(actualWait) / float64(time.Second))
 		goto start
 	}
 	x := heap.Pop(q.items)
+	q.lastPop = now
 	q.cond.L.Unlock()
 	it = x.(*pqItem)
 	return it.ch, it.nextReap
@@ -298,11 +421,15 @@ func (b *Bot) QueueReap(c *ManagedChannel) {
 	b.reaper.Update(c, reapTime)
 }
 
-// Removes the given channel from the reaper, assuming that IsDisabled() will
-// return true for the passed ManagedChannel.
+// Removes the given channel from the reaper and the other per-channel work
+// queues, assuming that IsDisabled() will return true for the passed
+// ManagedChannel.
 func (b *Bot) CancelReap(c *ManagedChannel) {
 	var zeroTime time.Time
 	b.reaper.Update(c, zeroTime)
+	b.singleDeleter.Update(c, zeroTime)
+	b.crawler.Update(c, zeroTime)
+	b.stickies.Update(c, zeroTime)
 }
 
 // Queue up work to reload the backlog of every channel.
@@ -311,7 +438,7 @@ func (b *Bot) CancelReap(c *ManagedChannel) {
 // there's no point in preserving the old entries if we're just doing
 // everything over again.
 func (b *Bot) LoadAllBacklogs() {
-	now := time.Now()
+	now := b.clock.Now()
 
 	b.mu.RLock()
 	newQueue := make(priorityQueue, 0, len(b.channels))
@@ -343,7 +470,7 @@ func (b *Bot) QueueLoadBacklog(c *ManagedChannel, qos LoadQOS) {
 			loadDelay = maxLoadBackoff
 		}
 		c.loadFailures = loadDelay
-		queuePosition = time.Now().Add(loadDelay)
+		queuePosition = b.clock.Now().Add(loadDelay)
 
 		c.mu.Unlock()
 	}
@@ -351,15 +478,20 @@ func (b *Bot) QueueLoadBacklog(c *ManagedChannel, qos LoadQOS) {
 	b.loadRetries.Update(c, queuePosition)
 }
 
-func reapScheduler(q *reapQueue, workerFunc func(*reapQueue, bool)) {
-	q.controlCh <- workerToken{}
-	go workerFunc(q, false)
-
-	timer := time.NewTimer(0)
+func reapScheduler(q *reapQueue, process workFunc) {
+	q.startWorkers(process)
 
 	for {
 		ch, due := q.WaitForNext()
 
+		if ch.IsSuspended() {
+			mReapqDropChannel.WithLabelValues(q.label).Inc()
+			continue
+		}
+		if q.delayForRatelimit(ch) {
+			continue
+		}
+
 		q.curMu.Lock()
 		_, channelAlreadyBeingProcessed := q.curWork[ch]
 		if !channelAlreadyBeingProcessed {
@@ -371,115 +503,162 @@ func reapScheduler(q *reapQueue, workerFunc func(*reapQueue, bool)) {
 			continue
 		}
 
-		sendWorkItem(q, workerFunc, timer, reapWorkItem{ch: ch, due: due})
+		q.sendWorkItem(process, reapWorkItem{ch: ch, due: due})
 	}
 }
 
-func sendWorkItem(q *reapQueue, workerFunc func(*reapQueue, bool), timer *time.Timer, work reapWorkItem) {
-	if !timer.Stop() {
-		select {
-		case <-timer.C:
-		default:
-			// BUG: got false from timer.Stop but nothing waiting in the channel
-			fmt.Println("[BUG ] sendWorkItem got false from timer.Stop but no value to recv.")
-		}
+// startWorkers brings the pool up to its minimum size.
+func (q *reapQueue) startWorkers(process workFunc) {
+	for q.workerCount() < q.minWorkers && q.tryGrow() {
+		go q.worker(process)
+	}
+}
+
+func (q *reapQueue) workerCount() int {
+	q.poolMu.Lock()
+	defer q.poolMu.Unlock()
+	return q.workers
+}
+
+// tryGrow reserves a slot for a new worker. Returns false if the pool is full.
+func (q *reapQueue) tryGrow() bool {
+	q.poolMu.Lock()
+	defer q.poolMu.Unlock()
+	if q.workers >= q.maxWorkers {
+		return false
+	}
+	q.workers++
+	mReapqWorkerStart.WithLabelValues(q.label).Inc()
+	return true
+}
+
+// tryShrink releases the slot of an idle worker. Returns false if the worker
+// must stay to keep the pool at its minimum size.
+func (q *reapQueue) tryShrink() bool {
+	q.poolMu.Lock()
+	defer q.poolMu.Unlock()
+	if q.workers <= q.minWorkers {
+		return false
 	}
-	timer.Reset(schedulerTimeout)
+	q.workers--
+	mReapqWorkerStop.WithLabelValues(q.label).Inc()
+	return true
+}
 
+func (q *reapQueue) sendWorkItem(process workFunc, work reapWorkItem) {
 	select {
 	case q.workCh <- work:
 		return
-	case <-timer.C:
-		// Timer expired; all workers busy. Attempt to start a new worker, or block if we're maxed
-		timer.Reset(0) // prime a value for the next call
-		select {
-		case q.controlCh <- workerToken{}:
-			fmt.Printf("[reap] %p: starting new worker\n", q)
-			mReapqWorkerStart.WithLabelValues(q.label).Inc()
-			go workerFunc(q, true)
-			q.workCh <- work
-			return
-		case q.workCh <- work:
-			return
-		}
+	default:
+	}
+	resetTimer(q.dispatchTimer, q.dispatchTimeout)
+	select {
+	case q.workCh <- work:
+		q.dispatchTimer.Stop()
+		return
+	case <-q.dispatchTimer.C():
 	}
-}
-
-func (b *Bot) loadWorker(q *reapQueue, mayTimeout bool) {
-	timer := time.NewTimer(0)
 
-	if mayTimeout {
-		defer func() {
-			<-q.controlCh // remove a worker token
-			fmt.Printf("[reap] %p: worker exiting\n", q)
-			mReapqWorkerStop.WithLabelValues(q.label).Inc()
-		}()
+	// All workers busy. Attempt to start a new worker, or block if we're maxed
+	if q.tryGrow() {
+		fmt.Printf("[reap] %s: starting new worker\n", q.label)
+		go q.worker(process)
 	}
+	q.workCh <- work
+}
 
+// worker processes items until it has been idle for idleTimeout and the pool
+// is above its minimum size.
+func (q *reapQueue) worker(process workFunc) {
+	idle := q.clock.NewTimer(q.idleTimeout)
+	defer idle.Stop()
 	for {
-		if mayTimeout {
-			if !timer.Stop() {
-				<-timer.C
+		select {
+		case work := <-q.workCh:
+			process(q, work)
+			resetTimer(idle, q.idleTimeout)
+		case <-idle.C():
+			if q.tryShrink() {
+				fmt.Printf("[reap] %s: worker exiting\n", q.label)
+				return
 			}
-			timer.Reset(workerTimeout)
+			idle.Reset(q.idleTimeout)
 		}
+	}
+}
 
+// resetTimer re-arms a timer that may have fired without being received
+// from.
+func resetTimer(t Timer, d time.Duration) {
+	if !t.Stop() {
 		select {
-		case <-timer.C:
-			return
-		case work := <-q.workCh:
-			ch := work.ch
-			if ch.IsDisabled() {
-				continue
-			}
+		case <-t.C():
+		default:
+		}
+	}
+	t.Reset(d)
+}
 
-			err := ch.LoadBacklog()
+func (q *reapQueue) finishWork(ch *ManagedChannel) {
+	q.curMu.Lock()
+	delete(q.curWork, ch)
+	q.curMu.Unlock()
+}
 
-			q.curMu.Lock()
-			delete(q.curWork, ch)
-			q.curMu.Unlock()
+func (b *Bot) loadWorker(q *reapQueue, work reapWorkItem) {
+	ch := work.ch
+	if ch.IsDisabled() {
+		q.finishWork(ch)
+		return
+	}
 
-			if isRetryableLoadError(err) {
-				b.QueueLoadBacklog(ch, QOSLoadError)
-			}
-		}
+	err := ch.LoadBacklog()
+	q.finishWork(ch)
+
+	if isRetryableLoadError(err) {
+		b.QueueLoadBacklog(ch, QOSLoadError)
 	}
 }
 
-func (b *Bot) reapWorker(q *reapQueue, mayTimeout bool) {
-	// TODO: implement mayTimeout
-	for work := range q.workCh {
-		ch, due := work.ch, work.due
-		msgs, shouldQueueBacklog, isDisabled := ch.collectMessagesToDelete()
-		if isDisabled {
-			mReapqDropChannel.WithLabelValues(q.label).Inc()
-			continue // drop ch
-		}
+func (b *Bot) reapWorker(q *reapQueue, work reapWorkItem) {
+	ch, due := work.ch, work.due
+	msgs, single, shouldQueueBacklog, isDisabled := ch.collectMessagesToDelete()
+	if isDisabled {
+		mReapqDropChannel.WithLabelValues(q.label).Inc()
+		q.finishWork(ch)
+		return // drop ch
+	}
 
-		start := time.Now()
-		startLatency := start.Sub(due)
-		mReapqE2eLatency.WithLabelValues(q.label).Observe(float64(startLatency) / float64(time.Second))
+	start := b.clock.Now()
+	startLatency := start.Sub(due)
+	mReapqE2eLatency.WithLabelValues(q.label).Observe(float64(startLatency) / float64(time.Second))
 
-		fmt.Printf("[reap] %s: deleting %d messages\n", ch, len(msgs))
-		count, err := ch.Reap(msgs)
-		if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
-			continue // drop ch
-		}
-		if err != nil {
-			fmt.Printf("[reap] %s: deleted %d, got error: %v\n", ch, count, err)
-			shouldQueueBacklog = true
-		} else if count == -1 {
-			fmt.Printf("[reap] %s: doing single-message delete\n", ch)
-			shouldQueueBacklog = false
-		}
+	if len(single) > 0 {
+		fmt.Printf("[reap] %s: %d messages too old for bulk delete\n", ch, len(single))
+		ch.queueSingleDelete(single)
+	}
+	fmt.Printf("[reap] %s: deleting %d messages\n", ch, len(msgs))
+	count, err := ch.Reap(msgs)
+	ch.recordReap(count, err)
+	if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
+		q.finishWork(ch)
+		return // drop ch
+	}
+	if err != nil {
+		fmt.Printf("[reap] %s: deleted %d, got error: %v\n", ch, count, err)
+		shouldQueueBacklog = true
+	}
 
-		q.curMu.Lock()
-		delete(q.curWork, ch)
-		q.curMu.Unlock()
-		b.QueueReap(ch)
-		if shouldQueueBacklog {
-			b.QueueLoadBacklog(ch, QOSLargeDelete)
-		}
+	err = ch.sendWarnings()
+	if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
+		q.finishWork(ch)
+		return // drop ch
+	}
+
+	q.finishWork(ch)
+	b.QueueReap(ch)
+	if shouldQueueBacklog {
+		b.QueueLoadBacklog(ch, QOSLargeDelete)
 	}
 }
 
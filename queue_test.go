@@ -0,0 +1,232 @@
+package autodelete
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testDispatchTimeout = 1 * time.Second
+	testIdleTimeout     = 5 * time.Second
+)
+
+func newTestPool(min, max int) (*reapQueue, *fakeClock) {
+	f := newFakeClock(testEpoch)
+	q := newReapQueue("test", WorkerPoolConfig{Min: min, Max: max}, f)
+	q.dispatchTimeout = testDispatchTimeout
+	q.idleTimeout = testIdleTimeout
+	return q, f
+}
+
+func recvString(t *testing.T, c <-chan string) string {
+	t.Helper()
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for work to be processed")
+		return ""
+	}
+}
+
+func TestWorkerPoolBounds(t *testing.T) {
+	q, _ := newTestPool(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !q.tryGrow() {
+			t.Fatalf("tryGrow #%d: pool of max 3 refused to grow", i+1)
+		}
+	}
+	if q.tryGrow() {
+		t.Fatal("tryGrow: pool grew past max")
+	}
+	if !q.tryShrink() {
+		t.Fatal("tryShrink: pool above min refused to shrink")
+	}
+	if q.tryShrink() {
+		t.Fatal("tryShrink: pool shrank below min")
+	}
+	if got := q.workerCount(); got != 2 {
+		t.Errorf("workerCount = %d, want 2", got)
+	}
+}
+
+func TestWorkerPoolDefaults(t *testing.T) {
+	q := newReapQueue("test", WorkerPoolConfig{Min: 5, Max: 2}, realClock{})
+	if q.minWorkers != 5 || q.maxWorkers != 5 {
+		t.Errorf("min/max = %d/%d, want max raised to min", q.minWorkers, q.maxWorkers)
+	}
+	q = newReapQueue("test", WorkerPoolConfig{}, realClock{})
+	if q.minWorkers != 1 || q.maxWorkers != 1 {
+		t.Errorf("min/max = %d/%d, want 1/1", q.minWorkers, q.maxWorkers)
+	}
+	p := WorkerPoolConfig{Max: 8}.withDefaults(1, 4)
+	if p.Min != 1 || p.Max != 8 {
+		t.Errorf("withDefaults = %+v, want {1 8}", p)
+	}
+}
+
+func TestWorkerPoolScaling(t *testing.T) {
+	q, clock := newTestPool(1, 2)
+
+	processed := make(chan string, 10)
+	release := make(chan struct{})
+	process := func(q *reapQueue, work reapWorkItem) {
+		processed <- work.ch.ChannelID
+		<-release
+	}
+	item := func(id string) reapWorkItem {
+		return reapWorkItem{ch: &ManagedChannel{ChannelID: id}}
+	}
+
+	q.startWorkers(process)
+	if got := q.workerCount(); got != 1 {
+		t.Fatalf("after start: workerCount = %d, want 1", got)
+	}
+
+	// The idle worker takes the first item without a timeout.
+	go q.sendWorkItem(process, item("1"))
+	if got := recvString(t, processed); got != "1" {
+		t.Fatalf("processed %q, want 1", got)
+	}
+
+	// The only worker is busy: the scheduler grows the pool after the
+	// dispatch timeout.
+	sent := make(chan struct{})
+	n := clock.count(testDispatchTimeout)
+	go func() {
+		q.sendWorkItem(process, item("2"))
+		close(sent)
+	}()
+	clock.waitArmed(t, testDispatchTimeout, n+1)
+	clock.Advance(testDispatchTimeout)
+	if got := recvString(t, processed); got != "2" {
+		t.Fatalf("processed %q, want 2", got)
+	}
+	<-sent
+	if got := q.workerCount(); got != 2 {
+		t.Fatalf("after backlog: workerCount = %d, want 2", got)
+	}
+
+	// At max, the scheduler blocks until a worker frees up.
+	n = clock.count(testDispatchTimeout)
+	go q.sendWorkItem(process, item("3"))
+	clock.waitArmed(t, testDispatchTimeout, n+1)
+	clock.Advance(testDispatchTimeout)
+	select {
+	case id := <-processed:
+		t.Fatalf("processed %q while all workers were busy", id)
+	default:
+	}
+	if got := q.workerCount(); got != 2 {
+		t.Fatalf("at max: workerCount = %d, want 2", got)
+	}
+	close(release)
+	if got := recvString(t, processed); got != "3" {
+		t.Fatalf("processed %q, want 3", got)
+	}
+
+	// Idle workers exit, down to the minimum.
+	deadline := time.Now().Add(5 * time.Second)
+	for q.workerCount() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle: workerCount = %d, want 1", q.workerCount())
+		}
+		clock.Advance(testIdleTimeout)
+		time.Sleep(time.Millisecond)
+	}
+
+	// The last worker survives its idle timeout and re-arms.
+	for i := 0; i < 2; i++ {
+		n = clock.count(testIdleTimeout)
+		clock.Advance(testIdleTimeout)
+		clock.waitArmed(t, testIdleTimeout, n+1)
+	}
+	if got := q.workerCount(); got != 1 {
+		t.Errorf("at min: workerCount = %d, want 1", got)
+	}
+}
+
+func TestWorkerReusesTimers(t *testing.T) {
+	q, clock := newTestPool(1, 1)
+	done := make(chan struct{})
+	process := func(q *reapQueue, work reapWorkItem) { done <- struct{}{} }
+	q.startWorkers(process)
+
+	for i := 0; i < 20; i++ {
+		q.sendWorkItem(process, reapWorkItem{ch: &ManagedChannel{ChannelID: "a"}})
+		<-done
+	}
+	// The worker's idle timer, and at most the dispatch timer
+	if got := clock.active(); got > 2 {
+		t.Errorf("%d timers armed after 20 items, want at most 2", got)
+	}
+}
+
+func TestWaitForNext(t *testing.T) {
+	clock := newFakeClock(testEpoch)
+	q := newReapQueue("test", WorkerPoolConfig{}, clock)
+	a := &ManagedChannel{ChannelID: "a"}
+	b := &ManagedChannel{ChannelID: "b"}
+
+	q.Update(b, testEpoch.Add(20*time.Second))
+	q.Update(a, testEpoch.Add(10*time.Second))
+
+	type result struct {
+		ch  *ManagedChannel
+		due time.Time
+	}
+	results := make(chan result)
+	n := clock.countAll()
+	go func() {
+		for i := 0; i < 2; i++ {
+			ch, due := q.WaitForNext()
+			results <- result{ch, due}
+		}
+	}()
+
+	clock.waitArmedAny(t, n+1)
+	select {
+	case r := <-results:
+		t.Fatalf("WaitForNext returned %s early", r.ch.ChannelID)
+	default:
+	}
+
+	clock.Advance(11 * time.Second)
+	r := <-results
+	if r.ch != a || !r.due.Equal(testEpoch.Add(10*time.Second)) {
+		t.Errorf("first item = %s at %v, want a at +10s", r.ch.ChannelID, r.due)
+	}
+
+	// Rescheduling b earlier takes effect while waiting.
+	n = clock.countAll()
+	q.Update(b, testEpoch.Add(15*time.Second))
+	clock.waitArmedAny(t, n+1)
+	clock.Advance(5 * time.Second)
+	r = <-results
+	if r.ch != b || !r.due.Equal(testEpoch.Add(15*time.Second)) {
+		t.Errorf("second item = %s at %v, want b at +15s", r.ch.ChannelID, r.due)
+	}
+}
+
+func TestQueueLoadBacklogBackoff(t *testing.T) {
+	b, clock, _ := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 1})
+
+	b.QueueLoadBacklog(c, QOSInteractive)
+	it := b.loadRetries.items.Peek()
+	if it == nil || !it.nextReap.Equal(QOSInteractive.Time()) {
+		t.Fatalf("interactive load queued at %v, want QOS epoch", it)
+	}
+
+	b.QueueLoadBacklog(c, QOSLoadError)
+	first := b.loadRetries.items.Peek().nextReap.Sub(clock.Now())
+	b.QueueLoadBacklog(c, QOSLoadError)
+	second := b.loadRetries.items.Peek().nextReap.Sub(clock.Now())
+	if first <= 0 || second < 2*first {
+		t.Errorf("backoff went %v then %v, want exponential growth", first, second)
+	}
+	if len(*b.loadRetries.items) != 1 {
+		t.Errorf("queue has %d items, want 1", len(*b.loadRetries.items))
+	}
+}
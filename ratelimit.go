@@ -0,0 +1,172 @@
+package autodelete
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Ratelimit bucket kinds. These are used as metric labels instead of the
+// actual bucket keys, which contain channel IDs.
+const (
+	rlBucketBulkDelete = "bulk_delete"
+	rlBucketMessages   = "messages"
+	rlBucketPins       = "pins"
+	rlBucketSingle     = "single_delete"
+	rlBucketGlobal     = "global"
+
+	// Don't bother rescheduling for waits shorter than this; the library
+	// sleep is cheaper than a trip through the queue.
+	minRatelimitDelay = 50 * time.Millisecond
+)
+
+// The bucket used for the pins request in loadPins().
+const bucketPinsGlobal = "/custom/pinsGlobal"
+
+var (
+	mRatelimitDelays = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: nsAutodelete,
+		Name:      "ratelimit_delays_total",
+		Help:      "Number of work items pushed back because their ratelimit bucket was exhausted",
+	}, []string{"queue", "bucket"})
+	mRatelimitWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: nsAutodelete,
+		Name:      "ratelimit_wait_seconds",
+		Help:      "Time that work items were delayed waiting for a ratelimit bucket to reset",
+		Buckets:   bucketsDiscordAPI,
+	}, []string{"queue", "bucket"})
+)
+
+func init() {
+	prometheus.MustRegister(mRatelimitDelays)
+	prometheus.MustRegister(mRatelimitWait)
+}
+
+// A ratelimitCheck reports how long a work item for the channel would block
+// on ratelimits, and which bucket kind is responsible.
+type ratelimitCheck func(c *ManagedChannel) (time.Duration, string)
+
+// noteBucket records that the bot makes requests on a ratelimit bucket.
+// Buckets are only checked once they are noted, so that the checks do not add
+// a bucket to the library's map for every key they look at.
+func (b *Bot) noteBucket(key string) {
+	if b.s == nil || b.s.Ratelimiter == nil {
+		return
+	}
+	b.bucketsMu.Lock()
+	defer b.bucketsMu.Unlock()
+	if _, ok := b.buckets[key]; ok {
+		return
+	}
+	if b.buckets == nil {
+		b.buckets = make(map[string]*discordgo.Bucket)
+	}
+	b.buckets[key] = b.s.Ratelimiter.GetBucket(key)
+}
+
+// bucketWaitTime inspects the library's ratelimiter state without taking a
+// request slot.
+//
+// A request holds the bucket lock until the response is in, so this can wait
+// for a request on the same bucket from another queue.
+func (b *Bot) bucketWaitTime(key string) time.Duration {
+	b.bucketsMu.Lock()
+	bucket := b.buckets[key]
+	b.bucketsMu.Unlock()
+	if bucket == nil {
+		return 0
+	}
+	bucket.Lock()
+	defer bucket.Unlock()
+	return b.s.Ratelimiter.GetWaitTime(bucket, 1)
+}
+
+// globalWaitTime returns the time until the global ratelimit lifts.
+func (b *Bot) globalWaitTime() time.Duration {
+	// A detached bucket with requests remaining only observes the global limit.
+	return b.s.Ratelimiter.GetWaitTime(&discordgo.Bucket{Remaining: 1}, 1)
+}
+
+// reapRatelimitDelay is the ratelimitCheck for the reap queue. A reap of a
+// single message uses the single delete endpoint instead of bulk delete, so
+// the longer of the two waits counts.
+func (b *Bot) reapRatelimitDelay(c *ManagedChannel) (time.Duration, string) {
+	if b.s == nil || b.s.Ratelimiter == nil {
+		return 0, ""
+	}
+	if wait := b.globalWaitTime(); wait > 0 {
+		return wait, rlBucketGlobal
+	}
+	bulk := b.bucketWaitTime(discordgo.EndpointChannelMessagesBulkDelete(c.ChannelID))
+	single := b.bucketWaitTime(discordgo.EndpointChannelMessage(c.ChannelID, ""))
+	if single > bulk {
+		return single, rlBucketSingle
+	}
+	return bulk, rlBucketBulkDelete
+}
+
+// singleDeleteRatelimitDelay is the ratelimitCheck for the single-delete
+// queue.
+func (b *Bot) singleDeleteRatelimitDelay(c *ManagedChannel) (time.Duration, string) {
+	if b.s == nil || b.s.Ratelimiter == nil {
+		return 0, ""
+	}
+	if wait := b.globalWaitTime(); wait > 0 {
+		return wait, rlBucketGlobal
+	}
+	return b.bucketWaitTime(discordgo.EndpointChannelMessage(c.ChannelID, "")), rlBucketSingle
+}
+
+// stickyRatelimitDelay is the ratelimitCheck for the sticky message queue.
+// Posting a message shares the messages bucket with reading them.
+func (b *Bot) stickyRatelimitDelay(c *ManagedChannel) (time.Duration, string) {
+	return b.crawlRatelimitDelay(c)
+}
+
+// crawlRatelimitDelay is the ratelimitCheck for the backlog crawler.
+func (b *Bot) crawlRatelimitDelay(c *ManagedChannel) (time.Duration, string) {
+	if b.s == nil || b.s.Ratelimiter == nil {
+		return 0, ""
+	}
+	if wait := b.globalWaitTime(); wait > 0 {
+		return wait, rlBucketGlobal
+	}
+	return b.bucketWaitTime(discordgo.EndpointChannelMessages(c.ChannelID)), rlBucketMessages
+}
+
+// loadRatelimitDelay is the ratelimitCheck for the backlog load queue.
+func (b *Bot) loadRatelimitDelay(c *ManagedChannel) (time.Duration, string) {
+	if b.s == nil || b.s.Ratelimiter == nil {
+		return 0, ""
+	}
+	if wait := b.globalWaitTime(); wait > 0 {
+		return wait, rlBucketGlobal
+	}
+	if wait := b.bucketWaitTime(discordgo.EndpointChannelMessages(c.ChannelID)); wait > 0 {
+		return wait, rlBucketMessages
+	}
+	if useRatelimitWorkaround && c.hasPins() {
+		return b.bucketWaitTime(bucketPinsGlobal), rlBucketPins
+	}
+	return 0, ""
+}
+
+// delayForRatelimit pushes the channel back in the queue if dispatching it now
+// would only park a worker inside the ratelimiter. Messages that arrive in the
+// meantime are batched into the same request when the bucket resets.
+//
+// Returns true if the channel was rescheduled.
+func (q *reapQueue) delayForRatelimit(c *ManagedChannel) bool {
+	if q.ratelimitDelay == nil || c.IsDisabled() {
+		return false
+	}
+	wait, bucket := q.ratelimitDelay(c)
+	if wait < minRatelimitDelay {
+		return false
+	}
+	mRatelimitDelays.WithLabelValues(q.label, bucket).Inc()
+	mRatelimitWait.WithLabelValues(q.label, bucket).Observe(float64(wait) / float64(time.Second))
+	q.Update(c, q.clock.Now().Add(wait))
+	return true
+}
@@ -0,0 +1,86 @@
+package autodelete
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// exhaustBucket makes the ratelimiter believe a bucket has no requests left
+// for the given time.
+func exhaustBucket(t *testing.T, b *Bot, key string, resetAfter string) {
+	t.Helper()
+	b.noteBucket(key)
+	bucket := b.s.Ratelimiter.LockBucket(key)
+	headers := http.Header{}
+	headers.Set("X-RateLimit-Remaining", "0")
+	headers.Set("X-RateLimit-Reset-After", resetAfter)
+	if err := bucket.Release(headers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReapRatelimitDelay(t *testing.T) {
+	b, clock, _ := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	if wait, _ := b.reapRatelimitDelay(c); wait != 0 {
+		t.Errorf("fresh buckets: wait %v", wait)
+	}
+
+	exhaustBucket(t, b, discordgo.EndpointChannelMessagesBulkDelete(testChannelID), "5")
+	exhaustBucket(t, b, discordgo.EndpointChannelMessage(testChannelID, ""), "60")
+	wait, bucket := b.reapRatelimitDelay(c)
+	if bucket != rlBucketSingle || wait < 50*time.Second {
+		t.Errorf("single delete bucket waits longer: got %v in %s", wait, bucket)
+	}
+
+	if !b.reaper.delayForRatelimit(c) {
+		t.Fatal("not delayed")
+	}
+	due, ok := b.reaper.Scheduled(c)
+	if !ok || due.Before(clock.Now().Add(50*time.Second)) || due.After(clock.Now().Add(time.Minute)) {
+		t.Errorf("rescheduled for %v, %v; want about a minute after %v", due, ok, clock.Now())
+	}
+}
+
+// The scheduler checks buckets while workers release them.
+func TestRatelimitDelayConcurrentRelease(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	key := discordgo.EndpointChannelMessage(testChannelID, "")
+	b.noteBucket(key)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		headers := http.Header{}
+		headers.Set("X-RateLimit-Remaining", "5")
+		headers.Set("X-RateLimit-Reset-After", "0.001")
+		for i := 0; i < 100; i++ {
+			bucket := b.s.Ratelimiter.LockBucket(key)
+			if err := bucket.Release(headers); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		b.singleDeleteRatelimitDelay(c)
+	}
+	<-done
+}
+
+func TestRatelimitDelayUnusedBucket(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	if wait, _ := b.reapRatelimitDelay(c); wait != 0 {
+		t.Errorf("wait %v on buckets never used", wait)
+	}
+	// Only the keys the bot requests get a bucket.
+	if len(b.buckets) != 0 {
+		t.Errorf("check noted %d buckets", len(b.buckets))
+	}
+}
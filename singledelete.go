@@ -0,0 +1,270 @@
+package autodelete
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+const (
+	// Discord refuses to bulk delete messages older than 14 days. The margin
+	// covers clock skew and time spent waiting in the reap queue.
+	bulkDeleteMaxAge = snowflake.BulkDeleteMaxAge - 10*time.Minute
+
+	// Number of messages deleted per single-delete work item. Between
+	// chunks the channel goes back through the queue, so other channels
+	// get a turn and ratelimits are respected by the scheduler.
+	singleDeleteChunkSize = 10
+	singleDeleteRetryWait = 30 * time.Second
+)
+
+var (
+	mSingleDeletes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: nsAutodelete,
+		Name:      "message_single_deletes_total",
+		Help:      "Number of messages deleted one at a time because they were too old to bulk delete",
+	})
+	mSingleDeletePending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: nsAutodelete,
+		Name:      "single_delete_pending",
+		Help:      "Number of messages waiting to be deleted one at a time",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(mSingleDeletes)
+	prometheus.MustRegister(mSingleDeletePending)
+}
+
+// needsSingleDelete reports whether a message is too old to bulk delete.
+func needsSingleDelete(id string, now time.Time) bool {
+	return snowflake.OlderThan(id, bulkDeleteMaxAge, now)
+}
+
+// A singleDeleteJob tracks the messages in a channel that have to be deleted
+// one request at a time. It is protected by the ManagedChannel's mu.
+type singleDeleteJob struct {
+	// oldest first. Saved with the channel config, so that a restart
+	// resumes the job.
+	pending messageRing
+	// Progress since the job was last idle.
+	deleted int
+	failed  int
+	started time.Time
+}
+
+// SingleDeleteProgress returns the number of messages waiting to be deleted
+// individually, and how many have been deleted or skipped since the current
+// job started.
+func (c *ManagedChannel) SingleDeleteProgress() (pending, deleted, failed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	j := &c.singleDelete
+	return j.pending.Len(), j.deleted, j.failed
+}
+
+// restoreSingleDelete resumes a saved job. Must be called with mu held.
+func (c *ManagedChannel) restoreSingleDelete(msgs []string) {
+	j := &c.singleDelete
+	ids := make([]snowflake.ID, 0, len(msgs))
+	for _, v := range msgs {
+		if id, err := snowflake.Parse(v); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	j.pending.Reset(ids)
+	j.started = c.bot.clock.Now()
+	mSingleDeletePending.Add(float64(j.pending.Len()))
+}
+
+// singleDeletePendingIDs lists the pending messages for saving. Must be
+// called with mu held.
+func (c *ManagedChannel) singleDeletePendingIDs() []string {
+	if c.singleDelete.pending.Len() == 0 {
+		return nil
+	}
+	ids := c.singleDelete.pending.IDs()
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = id.String()
+	}
+	return out
+}
+
+// queueSingleDelete adds messages to the channel's single-delete job and
+// schedules it.
+func (c *ManagedChannel) queueSingleDelete(msgs []string) {
+	if len(msgs) == 0 {
+		return
+	}
+	now := c.bot.clock.Now()
+	c.mu.Lock()
+	if c.killBit {
+		c.mu.Unlock()
+		return
+	}
+	j := &c.singleDelete
+	if j.pending.Len() == 0 {
+		j.deleted, j.failed = 0, 0
+		j.started = now
+	}
+	added := 0
+	for _, v := range msgs {
+		id, err := snowflake.Parse(v)
+		if err != nil {
+			continue
+		}
+		if _, found := j.pending.Index(id); found {
+			continue
+		}
+		j.pending.Push(id)
+		added++
+	}
+	c.mu.Unlock()
+
+	mSingleDeletePending.Add(float64(added))
+	c.bot.QueueSingleDelete(c)
+}
+
+// isSingleDeletePending reports whether the message is owned by the
+// single-delete job. Must be called with mu held.
+func (c *ManagedChannel) isSingleDeletePending(id string) bool {
+	sf, err := snowflake.Parse(id)
+	if err != nil {
+		return false
+	}
+	_, found := c.singleDelete.pending.Index(sf)
+	return found
+}
+
+// popSingleDelete removes the first pending message. Must be called with mu
+// held.
+func (c *ManagedChannel) popSingleDelete(failed bool) {
+	j := &c.singleDelete
+	j.pending.PopFront()
+	if failed {
+		j.failed++
+	} else {
+		j.deleted++
+		c.health.deleted++
+	}
+	mSingleDeletePending.Dec()
+}
+
+// clearSingleDelete drops the pending job. Must be called with mu held.
+func (c *ManagedChannel) clearSingleDelete() {
+	mSingleDeletePending.Sub(float64(c.singleDelete.pending.Len()))
+	c.singleDelete = singleDeleteJob{}
+}
+
+// isCriticalDeleteError reports whether the error means we can no longer work
+// on the channel at all, as opposed to a problem with one message.
+func isCriticalDeleteError(err error) bool {
+	if rErr, ok := err.(*discordgo.RESTError); ok && rErr.Message != nil {
+		switch rErr.Message.Code {
+		case discordgo.ErrCodeUnknownChannel, discordgo.ErrCodeMissingAccess, discordgo.ErrCodeMissingPermissions:
+			return true
+		}
+	}
+	return false
+}
+
+// deleteSingleChunk deletes up to n pending messages, oldest first. It stops
+// early if the single-delete bucket runs out, so the scheduler can hold the
+// channel back instead of blocking a worker.
+//
+// Messages that Discord refuses to delete are skipped. Network errors and
+// critical errors leave the message pending and are returned.
+func (c *ManagedChannel) deleteSingleChunk(n int) (more bool, err error) {
+	for i := 0; i < n; i++ {
+		c.mu.Lock()
+		if c.killBit || c.singleDelete.pending.Len() == 0 {
+			c.mu.Unlock()
+			return false, nil
+		}
+		front := c.singleDelete.pending.Front()
+		c.mu.Unlock()
+		msg := front.String()
+
+		if i > 0 {
+			if wait, _ := c.bot.singleDeleteRatelimitDelay(c); wait >= minRatelimitDelay {
+				return true, nil
+			}
+		}
+
+		c.bot.noteBucket(discordgo.EndpointChannelMessage(c.ChannelID, ""))
+		err := c.bot.api.ChannelMessageDelete(c.ChannelID, msg)
+		failed := false
+		if rErr, ok := err.(*discordgo.RESTError); ok && rErr.Message != nil {
+			mSingleMessageReapErrors.With(prometheus.Labels{"error_code": strconv.Itoa(rErr.Message.Code)}).Inc()
+			if isCriticalDeleteError(err) {
+				return true, err
+			}
+			// Already gone counts as deleted; anything else is skipped.
+			if rErr.Message.Code != discordgo.ErrCodeUnknownMessage {
+				fmt.Printf("[ERR ] %s: single-message delete: %v (on %v)\n", c, err, msg)
+				failed = true
+			}
+		} else if err != nil {
+			mSingleMessageReapErrors.With(prometheus.Labels{"error_code": fmt.Sprintf("other(%T)", err)}).Inc()
+			return true, err
+		}
+		if !failed {
+			mSingleDeletes.Inc()
+		}
+
+		c.mu.Lock()
+		if c.singleDelete.pending.Len() > 0 && c.singleDelete.pending.Front() == front {
+			c.popSingleDelete(failed)
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.singleDelete.pending.Len() > 0, nil
+}
+
+// QueueSingleDelete schedules the channel's single-delete job to run now.
+func (b *Bot) QueueSingleDelete(c *ManagedChannel) {
+	b.singleDeleter.Update(c, b.clock.Now())
+}
+
+func (b *Bot) singleDeleteWorker(q *reapQueue, work reapWorkItem) {
+	ch := work.ch
+	if ch.IsDisabled() {
+		mReapqDropChannel.WithLabelValues(q.label).Inc()
+		q.finishWork(ch)
+		return
+	}
+
+	more, err := ch.deleteSingleChunk(singleDeleteChunkSize)
+	if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
+		q.finishWork(ch)
+		return // drop ch
+	}
+	q.finishWork(ch)
+
+	if !b.isCurrent(ch) {
+		// Replaced by a new config while we worked
+		return
+	}
+	if err != nil {
+		fmt.Printf("[del1] %s: single-message delete error, retrying in %v: %v\n", ch, singleDeleteRetryWait, err)
+		q.Update(ch, b.clock.Now().Add(singleDeleteRetryWait))
+	} else if more {
+		b.QueueSingleDelete(ch)
+		b.resumeCrawl(ch)
+	} else {
+		b.resumeCrawl(ch)
+		_, deleted, failed := ch.SingleDeleteProgress()
+		fmt.Printf("[del1] %s: single-message delete finished, %d deleted, %d skipped\n", ch, deleted, failed)
+		// re-load the backlog in case this surfaced more things to delete
+		b.QueueLoadBacklog(ch, QOSSingleMessageDelete)
+	}
+	b.saveJobProgress(ch, !more)
+}
@@ -0,0 +1,217 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const twentyDays = 20 * 24 * time.Hour
+
+// postOld posts messages to the fake API that are too old to bulk delete.
+func postOld(clock *fakeClock, api *fakeAPI, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, api.post(testChannelID, clock.Now().Add(-twentyDays+time.Duration(i)*time.Second)).ID)
+	}
+	return ids
+}
+
+func TestCollectMessagesToDeletePartition(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	old := postOld(clock, api, 2)
+	// Just inside the bulk delete window.
+	edge := api.post(c.ChannelID, clock.Now().Add(-bulkDeleteMaxAge+time.Minute)).ID
+	recent := api.post(c.ChannelID, clock.Now().Add(-2*time.Hour)).ID
+	fresh := api.post(c.ChannelID, clock.Now()).ID
+
+	backlog, _ := api.ChannelMessages(c.ChannelID, 100, "", "", "")
+	c.mu.Lock()
+	c.mergeBacklog(backlog)
+	c.mu.Unlock()
+
+	bulk, single, _, _ := c.collectMessagesToDelete()
+	if want := []string{edge, recent}; !reflect.DeepEqual(bulk, want) {
+		t.Errorf("bulk = %v, want %v", bulk, want)
+	}
+	if !reflect.DeepEqual(single, old) {
+		t.Errorf("single = %v, want %v", single, old)
+	}
+	if got, want := liveIDs(c), []string{fresh}; !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+}
+
+func TestSingleDeleteJob(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	ids := postOld(clock, api, 25)
+	// Someone else deleted one already.
+	api.ChannelMessageDelete(c.ChannelID, ids[3])
+	api.deleted = nil
+
+	c.queueSingleDelete(ids)
+	c.queueSingleDelete(ids[:5]) // duplicates are ignored
+	if pending, _, _ := c.SingleDeleteProgress(); pending != 25 {
+		t.Fatalf("pending = %d, want 25", pending)
+	}
+	if it := b.singleDeleter.items.Peek(); it == nil || it.ch != c {
+		t.Fatal("channel not queued for single delete")
+	}
+
+	// Backlog reloads must not hand pending messages back to the reaper.
+	backlog, _ := api.ChannelMessages(c.ChannelID, 100, "", "", "")
+	c.mu.Lock()
+	c.mergeBacklog(backlog)
+	c.mu.Unlock()
+	if got := liveIDs(c); len(got) != 0 {
+		t.Errorf("liveMessages = %v, want pending messages excluded", got)
+	}
+
+	more, err := c.deleteSingleChunk(singleDeleteChunkSize)
+	if err != nil || !more {
+		t.Fatalf("first chunk = %v, %v; want more, no error", more, err)
+	}
+	if pending, deleted, _ := c.SingleDeleteProgress(); pending != 15 || deleted != 10 {
+		t.Errorf("after one chunk: pending %d deleted %d, want 15 and 10", pending, deleted)
+	}
+
+	// The worker finishes the job a chunk at a time, then reloads the backlog.
+	for i := 0; i < 2; i++ {
+		b.singleDeleteWorker(b.singleDeleter, reapWorkItem{ch: c, due: clock.Now()})
+	}
+	if pending, deleted, failed := c.SingleDeleteProgress(); pending != 0 || deleted != 25 || failed != 0 {
+		t.Errorf("finished: pending %d deleted %d failed %d, want 0/25/0", pending, deleted, failed)
+	}
+	if got := len(api.deleted); got != 24 {
+		t.Errorf("deleted %d messages, want 24", got)
+	}
+	if it := b.loadRetries.items.Peek(); it == nil || it.ch != c {
+		t.Error("backlog not reloaded after single delete finished")
+	}
+}
+
+func TestSingleDeleteUnknownMessage(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	ids := postOld(clock, api, 2)
+	// Already gone: counts as done and does not stop the job.
+	c.queueSingleDelete(append([]string{"5"}, ids...))
+
+	more, err := c.deleteSingleChunk(singleDeleteChunkSize)
+	if err != nil || more {
+		t.Fatalf("chunk = %v, %v; want done", more, err)
+	}
+	if got := api.deleted; !reflect.DeepEqual(got, ids) {
+		t.Errorf("deleted %v, want %v", got, ids)
+	}
+	if _, deleted, failed := c.SingleDeleteProgress(); deleted != 3 || failed != 0 {
+		t.Errorf("deleted %d failed %d, want 3 and 0", deleted, failed)
+	}
+}
+
+func TestReapFallsBackToSingleDelete(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 1})
+	ids := postOld(clock, api, 3)
+	api.bulkErr = restError(errCodeBulkDeleteOld)
+
+	count, err := c.Reap(ids)
+	if err != nil || count != 0 {
+		t.Fatalf("Reap = %d, %v; want 0, nil", count, err)
+	}
+	if pending, _, _ := c.SingleDeleteProgress(); pending != 3 {
+		t.Errorf("pending = %d, want 3", pending)
+	}
+
+	c.Disable()
+	if pending, _, _ := c.SingleDeleteProgress(); pending != 0 {
+		t.Errorf("after Disable: pending = %d, want 0", pending)
+	}
+}
+
+func TestSingleDeleteResume(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	conf := ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, LiveTime: time.Hour}
+	if err := b.saveChannelConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestChannel(t, b, conf)
+	ids := postOld(clock, api, 25)
+	c.queueSingleDelete(ids)
+	ch, due := b.singleDeleter.WaitForNext()
+	b.singleDeleteWorker(b.singleDeleter, reapWorkItem{ch: ch, due: due})
+
+	saved, err := b.storage.GetChannel(testChannelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.SingleDeletePending, ids[singleDeleteChunkSize:]) {
+		t.Fatalf("saved pending %v, want %v", saved.SingleDeletePending, ids[singleDeleteChunkSize:])
+	}
+
+	// Restart: the job picks up where it stopped.
+	c.Disable()
+	if err := b.loadChannel(testChannelID, QOSInit); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = b.GetChannel(testChannelID, QOSInteractive)
+	if pending, _, _ := c.SingleDeleteProgress(); pending != 15 {
+		t.Errorf("pending after reload = %d, want 15", pending)
+	}
+	if _, queued := b.singleDeleter.Scheduled(c); !queued {
+		t.Error("resumed job not queued")
+	}
+	for i := 0; i < 2; i++ {
+		if more, err := c.deleteSingleChunk(singleDeleteChunkSize); err != nil || more != (i == 0) {
+			t.Fatalf("chunk %d = %v, %v", i, more, err)
+		}
+	}
+	if got := countMessages(api); got != 0 {
+		t.Errorf("%d messages left", got)
+	}
+}
+
+func TestSingleDeleteSaveInterval(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	storage := b.storage.(*memStorage)
+	c := loadTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	c.queueSingleDelete(postOld(clock, api, 100))
+
+	saves := func() int {
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		return storage.channelSaves
+	}
+	before := saves()
+	runChunk := func() {
+		ch, due := b.singleDeleter.WaitForNext()
+		b.singleDeleteWorker(b.singleDeleter, reapWorkItem{ch: ch, due: due})
+	}
+
+	// Saved after the first chunk, then not again until the interval passes
+	for i := 0; i < 5; i++ {
+		runChunk()
+	}
+	if got := saves() - before; got != 1 {
+		t.Errorf("%d saves after 5 chunks, want 1", got)
+	}
+	clock.Advance(jobSaveInterval)
+	runChunk()
+	if got := saves() - before; got != 2 {
+		t.Errorf("%d saves after the interval, want 2", got)
+	}
+	// and once more when the job finishes
+	for i := 0; i < 4; i++ {
+		runChunk()
+	}
+	if pending, _, _ := c.SingleDeleteProgress(); pending != 0 {
+		t.Fatalf("pending = %d after all chunks", pending)
+	}
+	if got := saves() - before; got != 3 {
+		t.Errorf("%d saves after the job finished, want 3", got)
+	}
+}
@@ -0,0 +1,70 @@
+// Package snowflake decodes Discord IDs.
+//
+// Discord IDs are 64-bit integers with the creation time in the upper 42
+// bits, so they sort by age and carry their own timestamp. Use the timestamp
+// in the ID rather than the time a message was seen; gateway events can
+// arrive late after a reconnect.
+package snowflake
+
+import (
+	"strconv"
+	"time"
+)
+
+// Epoch is the first millisecond of 2015, in Unix milliseconds.
+const Epoch = 1420070400000
+
+// BulkDeleteMaxAge is the age past which Discord refuses to bulk delete a
+// message.
+const BulkDeleteMaxAge = 14 * 24 * time.Hour
+
+const timestampShift = 22
+
+// An ID is a parsed Discord snowflake.
+type ID uint64
+
+// Parse parses a snowflake in its decimal string form.
+func Parse(s string) (ID, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	return ID(n), err
+}
+
+// FromTime returns the smallest ID created at t, plus seq in the low bits to
+// disambiguate IDs from the same millisecond.
+func FromTime(t time.Time, seq uint64) ID {
+	ms := t.UnixNano()/int64(time.Millisecond) - Epoch
+	return ID(uint64(ms)<<timestampShift | seq&(1<<timestampShift-1))
+}
+
+func (id ID) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// Time returns the creation time of the ID.
+func (id ID) Time() time.Time {
+	ms := int64(id>>timestampShift) + Epoch
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// TimeOf returns the creation time of a string ID, or the zero time if it
+// does not parse.
+func TimeOf(s string) time.Time {
+	id, err := Parse(s)
+	if err != nil {
+		return time.Time{}
+	}
+	return id.Time()
+}
+
+// Less reports whether string ID a is older than b, without parsing.
+func Less(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// OlderThan reports whether the ID was created more than d before now.
+func OlderThan(s string, d time.Duration, now time.Time) bool {
+	return TimeOf(s).Before(now.Add(-d))
+}
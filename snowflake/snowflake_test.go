@@ -0,0 +1,47 @@
+package snowflake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTime(t *testing.T) {
+	// https://discord.com/developers/docs/reference#snowflakes
+	id, err := Parse("175928847299117063")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2016, 4, 30, 11, 18, 25, 796*int(time.Millisecond), time.UTC)
+	if got := id.Time(); !got.Equal(want) {
+		t.Errorf("Time() = %v, want %v", got, want)
+	}
+	if got := id.String(); got != "175928847299117063" {
+		t.Errorf("String() = %s", got)
+	}
+	if got := TimeOf("abc"); !got.IsZero() {
+		t.Errorf("TimeOf(abc) = %v, want zero", got)
+	}
+}
+
+func TestFromTime(t *testing.T) {
+	ts := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	a, b := FromTime(ts, 1), FromTime(ts, 2)
+	if !a.Time().Equal(ts) || !b.Time().Equal(ts) {
+		t.Errorf("FromTime round trip: %v, %v, want %v", a.Time(), b.Time(), ts)
+	}
+	if !(a < b) || !Less(a.String(), b.String()) {
+		t.Errorf("seq does not order IDs: %v, %v", a, b)
+	}
+	if !Less("99", "100") || Less("100", "99") {
+		t.Error("Less compares as strings")
+	}
+}
+
+func TestOlderThan(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	old := FromTime(now.Add(-BulkDeleteMaxAge-time.Second), 0).String()
+	fresh := FromTime(now.Add(-BulkDeleteMaxAge+time.Second), 0).String()
+	if !OlderThan(old, BulkDeleteMaxAge, now) || OlderThan(fresh, BulkDeleteMaxAge, now) {
+		t.Error("OlderThan wrong at the bulk delete boundary")
+	}
+}
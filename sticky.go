@@ -0,0 +1,281 @@
+package autodelete
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+// A sticky message is a notice that the bot keeps near the bottom of the
+// channel. After StickyEvery messages, or StickyInterval after the last
+// repost if anything was said since, the bot posts a new copy and deletes the
+// old one. The text is a text/template executed with stickyData.
+
+// DefaultStickyText is used when a sticky message is enabled without text.
+const DefaultStickyText = "ℹ️ {{.Policy}}"
+
+// Default repost threshold when neither a count nor an interval is given.
+const defaultStickyEvery = 10
+
+var mStickyReposts = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: nsAutodelete,
+	Name:      "sticky_reposts_total",
+	Help:      "Number of times a sticky message was reposted",
+})
+
+func init() {
+	prometheus.MustRegister(mStickyReposts)
+}
+
+// stickyData is available to sticky message templates.
+type stickyData struct {
+	// Policy describes the channel's deletion settings in a sentence.
+	Policy      string
+	LiveTime    time.Duration
+	MaxMessages int
+	Channel     string
+}
+
+// stickyState is the runtime state of a channel's sticky message. It is
+// protected by the ManagedChannel's mu.
+type stickyState struct {
+	// Messages seen since the last repost.
+	newer    int
+	lastPost time.Time
+}
+
+// describePolicy summarizes deletion settings for the sticky message.
+func describePolicy(l *Locale, liveTime time.Duration, maxMessages int) string {
+	switch {
+	case liveTime != 0 && maxMessages != 0:
+		return l.Plural("sticky.policy_both", maxMessages, liveTime, maxMessages)
+	case liveTime != 0:
+		return l.Sprintf("sticky.policy_duration", liveTime)
+	case maxMessages != 0:
+		return l.Plural("sticky.policy_count", maxMessages, maxMessages)
+	}
+	return l.Sprintf("sticky.policy_off")
+}
+
+// maxStickyLength is Discord's limit on the length of a message.
+const maxStickyLength = 2000
+
+var errStickyTooLong = fmt.Errorf("sticky message is longer than the limit of %d characters", maxStickyLength)
+
+// stickyWriter stops a template as soon as its output is too long, so that a
+// template that loops or pads cannot make the bot build a huge string.
+type stickyWriter struct {
+	bytes.Buffer
+}
+
+func (w *stickyWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > maxStickyLength {
+		return 0, errStickyTooLong
+	}
+	return w.Buffer.Write(p)
+}
+
+// stickyFuncs takes printf away from templates: it pads to any width before
+// anything is written.
+var stickyFuncs = template.FuncMap{
+	"printf": func(string, ...interface{}) (string, error) {
+		return "", fmt.Errorf("printf cannot be used in sticky messages")
+	},
+}
+
+// renderSticky executes a sticky message template.
+func renderSticky(text string, data stickyData) (string, error) {
+	tmpl, err := template.New("sticky").Option("missingkey=error").Funcs(stickyFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf stickyWriter
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("sticky message is empty")
+	}
+	return buf.String(), nil
+}
+
+// stickyEnabled reports whether the channel has a sticky message. Must be
+// called with mu held.
+func (c *ManagedChannel) stickyEnabled() bool {
+	return c.StickyText != ""
+}
+
+// stickyDataLocked returns the template data for the channel, with the policy
+// in the guild's language. Must be called with mu held.
+func (c *ManagedChannel) stickyDataLocked(l *Locale) stickyData {
+	return stickyData{
+		Policy:      describePolicy(l, c.MessageLiveTime, c.MaxMessages),
+		LiveTime:    c.MessageLiveTime,
+		MaxMessages: c.MaxMessages,
+		Channel:     "<#" + c.ChannelID + ">",
+	}
+}
+
+// RenderSticky executes a sticky message template with the channel's current
+// settings.
+func (c *ManagedChannel) RenderSticky(text string) (string, error) {
+	l := c.bot.localeFor(c.GuildID)
+	c.mu.Lock()
+	data := c.stickyDataLocked(l)
+	c.mu.Unlock()
+	return renderSticky(text, data)
+}
+
+// SetSticky changes the sticky message settings. An empty text turns the
+// sticky message off and returns the ID of the copy to delete.
+func (c *ManagedChannel) SetSticky(text string, every int, interval time.Duration) (oldMsg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.StickyText = text
+	c.StickyEvery = every
+	c.StickyInterval = interval
+	if text == "" {
+		oldMsg = c.StickyMessageID
+		c.StickyMessageID = ""
+		delete(c.keepLookup, oldMsg)
+		c.sticky = stickyState{}
+		return oldMsg
+	}
+	// Post the new text right away
+	c.sticky.newer = 1
+	c.sticky.lastPost = time.Time{}
+	return ""
+}
+
+// stickyDueLocked returns when the sticky message should be reposted, or the
+// zero time if it is up to date. Must be called with mu held.
+func (c *ManagedChannel) stickyDueLocked() time.Time {
+	if !c.stickyEnabled() || c.killBit || c.sticky.newer == 0 {
+		return time.Time{}
+	}
+	now := c.bot.clock.Now()
+	if c.StickyMessageID == "" || c.sticky.lastPost.IsZero() {
+		return now
+	}
+	if c.StickyEvery > 0 && c.sticky.newer >= c.StickyEvery {
+		return now
+	}
+	if c.StickyInterval > 0 {
+		return c.sticky.lastPost.Add(c.StickyInterval)
+	}
+	return time.Time{}
+}
+
+// countStickyBacklog sets the number of messages newer than the sticky
+// message from a freshly loaded backlog, newest first. Must be called with mu
+// held.
+func (c *ManagedChannel) countStickyBacklog(msgs []*discordgo.Message) {
+	if !c.stickyEnabled() {
+		return
+	}
+	c.sticky.newer = len(msgs)
+	for i, v := range msgs {
+		if v.ID == c.StickyMessageID {
+			c.sticky.newer = i
+			c.sticky.lastPost = snowflake.TimeOf(v.ID)
+			break
+		}
+	}
+}
+
+// QueueSticky schedules a repost of the sticky message if one is due.
+func (b *Bot) QueueSticky(c *ManagedChannel) {
+	c.mu.Lock()
+	due := c.stickyDueLocked()
+	c.mu.Unlock()
+	if !due.IsZero() {
+		b.stickies.Update(c, due)
+	}
+}
+
+// repostSticky posts a new copy of the sticky message if one is due, and
+// deletes the old one.
+func (c *ManagedChannel) repostSticky() (posted bool, err error) {
+	l := c.bot.localeFor(c.GuildID)
+	c.mu.Lock()
+	due := c.stickyDueLocked()
+	if due.IsZero() || due.After(c.bot.clock.Now()) {
+		c.mu.Unlock()
+		return false, nil
+	}
+	content, err := renderSticky(c.StickyText, c.stickyDataLocked(l))
+	if err != nil {
+		fmt.Printf("[stky] %s: bad sticky template, using the default: %v\n", c, err)
+		content, _ = renderSticky(DefaultStickyText, c.stickyDataLocked(l))
+	}
+	c.mu.Unlock()
+
+	// The text comes from a moderator, but the bot repeats it on its own:
+	// no pings
+	c.bot.noteBucket(discordgo.EndpointChannelMessages(c.ChannelID))
+	msg, err := c.bot.api.ChannelMessageSendComplex(c.ChannelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		return false, err
+	}
+	mStickyReposts.Inc()
+
+	c.mu.Lock()
+	old := c.StickyMessageID
+	c.StickyMessageID = msg.ID
+	c.sticky = stickyState{lastPost: c.bot.clock.Now()}
+	if c.keepLookup != nil {
+		delete(c.keepLookup, old)
+		c.keepLookup[msg.ID] = true
+	}
+	// The gateway may have delivered our own message before the keep was set.
+	c.removeLiveLocked(msg.ID)
+	c.mu.Unlock()
+
+	if old != "" {
+		err = c.bot.api.ChannelMessageDelete(c.ChannelID, old)
+		if rErr, ok := err.(*discordgo.RESTError); ok && rErr.Message != nil && rErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+			err = nil
+		}
+		if err != nil {
+			fmt.Printf("[stky] %s: could not delete old sticky message: %v\n", c, err)
+		}
+	}
+	return true, nil
+}
+
+func (b *Bot) stickyWorker(q *reapQueue, work reapWorkItem) {
+	ch := work.ch
+	if ch.IsDisabled() {
+		mReapqDropChannel.WithLabelValues(q.label).Inc()
+		q.finishWork(ch)
+		return
+	}
+
+	posted, err := ch.repostSticky()
+	if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
+		q.finishWork(ch)
+		return // drop ch
+	}
+	q.finishWork(ch)
+
+	if !b.isCurrent(ch) {
+		// Replaced by a new config while we worked
+		return
+	}
+	if err != nil {
+		fmt.Printf("[stky] %s: could not post sticky message, retrying in %v: %v\n", ch, time.Minute, err)
+		q.Update(ch, b.clock.Now().Add(time.Minute))
+		return
+	}
+	if posted {
+		b.saveCurrentChannelConfig(ch)
+	}
+}
@@ -0,0 +1,174 @@
+package autodelete
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// runStickies runs the sticky queue until nothing is due, and returns the
+// number of items processed.
+func runStickies(t *testing.T, b *Bot) (n int) {
+	t.Helper()
+	for ; ; n++ {
+		if it := b.stickies.items.Peek(); it == nil || it.nextReap.After(b.clock.Now()) {
+			return n
+		}
+		if n > 20 {
+			t.Fatal("sticky queue did not settle")
+		}
+		ch, due := b.stickies.WaitForNext()
+		b.stickyWorker(b.stickies, reapWorkItem{ch: ch, due: due})
+	}
+}
+
+func sentMessages(api *fakeAPI) []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]string(nil), api.sent...)
+}
+
+func TestRenderSticky(t *testing.T) {
+	data := stickyData{Policy: describePolicy(localeEnglish, 24*time.Hour, 0), LiveTime: 24 * time.Hour}
+	got, err := renderSticky(DefaultStickyText, data)
+	if want := "ℹ️ Messages in this channel are deleted after 24h0m0s."; err != nil || got != want {
+		t.Errorf("default template = %q, %v; want %q", got, err, want)
+	}
+	got, err = renderSticky("Kept for {{.LiveTime}}, max {{.MaxMessages}}", data)
+	if want := "Kept for 24h0m0s, max 0"; err != nil || got != want {
+		t.Errorf("custom template = %q, %v; want %q", got, err, want)
+	}
+	for _, bad := range []string{"{{.Nope}}", "{{.Policy", "{{/* */}}", strings.Repeat("x", 2001),
+		strings.Repeat("{{.Policy}}", 100), `{{printf "%999999d" 1}}`} {
+		if _, err := renderSticky(bad, data); err == nil {
+			t.Errorf("renderSticky(%.20q) did not fail", bad)
+		}
+	}
+}
+
+func TestStickyEvery(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+
+	c.SetSticky("{{.Policy}}", 3, 0)
+	b.QueueSticky(c)
+	if n := runStickies(t, b); n != 1 {
+		t.Fatalf("initial post: ran %d items, want 1", n)
+	}
+	sent := sentMessages(api)
+	if len(sent) != 1 || sent[0] != "Messages in this channel are deleted after 1h0m0s." {
+		t.Fatalf("sent %q", sent)
+	}
+	api.mu.Lock()
+	mentions := api.sends[0].AllowedMentions
+	api.mu.Unlock()
+	if mentions == nil || len(mentions.Parse) != 0 || len(mentions.Roles) != 0 || len(mentions.Users) != 0 {
+		t.Errorf("sticky message sent with allowed mentions %+v, want none", mentions)
+	}
+	first := c.Export().StickyMessageID
+	c.mu.Lock()
+	kept := c.keepLookup[first]
+	c.mu.Unlock()
+	if first == "" || !kept {
+		t.Fatalf("sticky message %q not kept", first)
+	}
+	if conf, _ := b.storage.GetChannel(testChannelID); conf.StickyMessageID != first {
+		t.Errorf("saved sticky message %q, want %q", conf.StickyMessageID, first)
+	}
+
+	postAndAdd(c, clock, api)
+	postAndAdd(c, clock, api)
+	if n := runStickies(t, b); n != 0 {
+		t.Errorf("reposted after 2 of 3 messages")
+	}
+	postAndAdd(c, clock, api)
+	if n := runStickies(t, b); n != 1 {
+		t.Fatalf("ran %d items after 3 messages, want 1", n)
+	}
+	second := c.Export().StickyMessageID
+	if second == first {
+		t.Fatal("sticky message not reposted")
+	}
+	if _, m := api.findLocked(testChannelID, first); m != nil {
+		t.Error("old sticky message not deleted")
+	}
+	if got := liveIDs(c); len(got) != 3 {
+		t.Errorf("liveMessages = %v, want the 3 user messages only", got)
+	}
+
+	// Turning it off removes it from the keep list.
+	if old := c.SetSticky("", 0, 0); old != second {
+		t.Errorf("SetSticky off returned %q, want %q", old, second)
+	}
+	postAndAdd(c, clock, api)
+	if n := runStickies(t, b); n != 0 {
+		t.Error("sticky queued after turning it off")
+	}
+}
+
+func TestStickyInterval(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{MaxMessages: 50})
+	c.SetSticky(DefaultStickyText, 0, 10*time.Minute)
+	b.QueueSticky(c)
+	runStickies(t, b)
+
+	// Nothing said: no repost, however long it has been.
+	clock.Advance(time.Hour)
+	b.QueueSticky(c)
+	if n := runStickies(t, b); n != 0 {
+		t.Error("reposted with no new messages")
+	}
+
+	postAndAdd(c, clock, api)
+	it := b.stickies.items.Peek()
+	if want := clock.Now().Add(-time.Hour + 10*time.Minute); it == nil || !it.nextReap.Equal(want) {
+		t.Errorf("repost queued at %v, want %v", it, want)
+	}
+	if n := runStickies(t, b); n != 1 || len(sentMessages(api)) != 2 {
+		t.Errorf("ran %d items, sent %q; want a repost", n, sentMessages(api))
+	}
+}
+
+func TestStickyLoadBacklog(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	sticky := api.post(testChannelID, clock.Now()).ID
+	clock.Advance(time.Second)
+	api.post(testChannelID, clock.Now())
+	api.post(testChannelID, clock.Now())
+
+	c := loadTestChannel(t, b, ManagedChannelMarshal{
+		LiveTime:        time.Hour,
+		StickyText:      DefaultStickyText,
+		StickyEvery:     2,
+		StickyMessageID: sticky,
+	})
+	if got := liveIDs(c); len(got) != 2 {
+		t.Errorf("liveMessages = %v, want sticky message excluded", got)
+	}
+	if n := runStickies(t, b); n != 1 {
+		t.Errorf("ran %d items after restart with 2 newer messages, want 1", n)
+	}
+}
+
+func TestStickyAfterConfigChange(t *testing.T) {
+	b, _, _ := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour})
+	c.SetSticky("old text", 3, 0)
+	b.QueueSticky(c)
+	ch, due := b.stickies.WaitForNext()
+
+	// The repost is in flight while the config changes
+	newConf := ManagedChannelMarshal{ID: testChannelID, GuildID: testGuildID, LiveTime: 2 * time.Hour}
+	if err := b.saveChannelConfig(newConf); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.channels[testChannelID] = &ManagedChannel{bot: b, ChannelID: testChannelID, GuildID: testGuildID}
+	b.mu.Unlock()
+	b.stickyWorker(b.stickies, reapWorkItem{ch: ch, due: due})
+
+	if conf, _ := b.storage.GetChannel(testChannelID); conf.StickyText != "" || conf.LiveTime != 2*time.Hour {
+		t.Errorf("saved %+v, the old config overwrote the new one", conf)
+	}
+}
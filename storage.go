@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
@@ -20,6 +21,24 @@ type Storage interface {
 
 	IsBanned(guildID string) (bool, error)
 	AddBan(guildID string) error
+
+	// GetGuildSettings returns the zero GuildSettings for guilds that did not
+	// change any.
+	GetGuildSettings(guildID string) (GuildSettings, error)
+	// SaveGuildSettings with the zero GuildSettings forgets the guild.
+	SaveGuildSettings(guildID string, settings GuildSettings) error
+
+	ListAPITokens() ([]APIToken, error)
+	SaveAPIToken(token APIToken) error
+	// Special errors:
+	//  - os.IsNotExist() - no token with that ID
+	DeleteAPIToken(id string) error
+
+	// AddAuditEntry records a change. Only the newest auditLogLength
+	// entries of each guild are kept.
+	AddAuditEntry(entry AuditEntry) error
+	// ListAuditEntries returns a guild's entries, newest first.
+	ListAuditEntries(guildID string) ([]AuditEntry, error)
 }
 
 /******************
@@ -28,11 +47,17 @@ type Storage interface {
 
 // Stores channel configurations on disk as YAML files.
 type DiskStorage struct {
+	// Protects the guild settings, API token and audit log files.
+	mu sync.Mutex
 }
 
 const pathChannelConfDir = "./data"
 const pathChannelConfig = "./data/%s.yml"
 const pathBanList = "./data/bans.yml"
+const pathGuildSettings = "./data/guilds.yml"
+const pathAPITokens = "./data/api_tokens.yml"
+const pathAuditDir = "./data/audit"
+const pathAuditLog = "./data/audit/%s.yml"
 
 func (s *DiskStorage) ListChannels() ([]string, error) {
 	files, err := ioutil.ReadDir(pathChannelConfDir)
@@ -45,7 +70,7 @@ func (s *DiskStorage) ListChannels() ([]string, error) {
 		if !strings.HasSuffix(n, ".yml") {
 			continue
 		}
-		if strings.HasPrefix(n, "bans.yml") {
+		if strings.HasPrefix(n, "bans.yml") || n == "guilds.yml" || n == "api_tokens.yml" {
 			continue
 		}
 		chID := strings.TrimSuffix(n, ".yml")
@@ -129,3 +154,143 @@ func (s *DiskStorage) IsBanned(guildID string) (bool, error) {
 func (s *DiskStorage) AddBan(guildID string) error {
 	return fmt.Errorf("unimplemented!")
 }
+
+func (s *DiskStorage) readGuildSettings() (map[string]GuildSettings, error) {
+	guilds := make(map[string]GuildSettings)
+	by, err := ioutil.ReadFile(pathGuildSettings)
+	if os.IsNotExist(err) {
+		return guilds, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(by, &guilds)
+	if err != nil {
+		return nil, err
+	}
+	return guilds, nil
+}
+
+func (s *DiskStorage) GetGuildSettings(guildID string) (GuildSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guilds, err := s.readGuildSettings()
+	if err != nil {
+		return GuildSettings{}, err
+	}
+	return guilds[guildID], nil
+}
+
+func (s *DiskStorage) SaveGuildSettings(guildID string, settings GuildSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guilds, err := s.readGuildSettings()
+	if err != nil {
+		return err
+	}
+	if settings == (GuildSettings{}) {
+		delete(guilds, guildID)
+	} else {
+		guilds[guildID] = settings
+	}
+	by, err := yaml.Marshal(guilds)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pathGuildSettings, by, 0644)
+}
+
+func (s *DiskStorage) readAPITokens() ([]APIToken, error) {
+	by, err := ioutil.ReadFile(pathAPITokens)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tokens []APIToken
+	err = yaml.Unmarshal(by, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *DiskStorage) writeAPITokens(tokens []APIToken) error {
+	by, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pathAPITokens, by, 0600)
+}
+
+func (s *DiskStorage) ListAPITokens() ([]APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readAPITokens()
+}
+
+func (s *DiskStorage) SaveAPIToken(token APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.readAPITokens()
+	if err != nil {
+		return err
+	}
+	return s.writeAPITokens(append(tokens, token))
+}
+
+func (s *DiskStorage) DeleteAPIToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.readAPITokens()
+	if err != nil {
+		return err
+	}
+	for i, t := range tokens {
+		if t.ID == id {
+			return s.writeAPITokens(append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+	return os.ErrNotExist
+}
+
+func (s *DiskStorage) readAuditLog(guildID string) ([]AuditEntry, error) {
+	by, err := ioutil.ReadFile(fmt.Sprintf(pathAuditLog, guildID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	err = yaml.Unmarshal(by, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *DiskStorage) AddAuditEntry(entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := s.readAuditLog(entry.GuildID)
+	if err != nil {
+		return err
+	}
+	entries = append([]AuditEntry{entry}, entries...)
+	if len(entries) > auditLogLength {
+		entries = entries[:auditLogLength]
+	}
+	by, err := yaml.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(pathAuditDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fmt.Sprintf(pathAuditLog, entry.GuildID), by, 0644)
+}
+
+func (s *DiskStorage) ListAuditEntries(guildID string) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readAuditLog(guildID)
+}
@@ -0,0 +1,133 @@
+package autodelete
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A channel can be linked to a voice channel with VoiceChannelID. When the
+// last member leaves the voice channel, every tracked message in the channel
+// is deleted after VoiceWipeDelay, unless someone joins again first. A voice
+// channel's own text chat is linked by setting VoiceChannelID to its ChannelID.
+//
+// Pending wipes are not saved; a wipe that was waiting when the bot restarted
+// does not happen.
+
+var mVoiceWipes = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: nsAutodelete,
+	Name:      "voice_wipes_total",
+	Help:      "Number of channels wiped after their voice channel emptied",
+})
+
+func init() {
+	prometheus.MustRegister(mVoiceWipes)
+}
+
+// parseChannelMention accepts a channel mention or a bare channel ID.
+func parseChannelMention(s string) (string, bool) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "<#"), ">")
+	if s == "" {
+		return "", false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+	return s, true
+}
+
+// voiceOccupancy counts the members in a voice channel, not counting the bot.
+func (b *Bot) voiceOccupancy(guildID, voiceChannelID string) int {
+	guild, err := b.s.State.Guild(guildID)
+	if err != nil {
+		return 0
+	}
+	b.s.State.RLock()
+	defer b.s.State.RUnlock()
+	n := 0
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID == voiceChannelID && vs.UserID != b.me.ID {
+			n++
+		}
+	}
+	return n
+}
+
+// linkedChannels returns the managed channels linked to a voice channel.
+func (b *Bot) linkedChannels(guildID, voiceChannelID string) []*ManagedChannel {
+	var inGuild []*ManagedChannel
+	b.mu.RLock()
+	for _, mCh := range b.channels {
+		if mCh != nil && mCh.GuildID == guildID {
+			inGuild = append(inGuild, mCh)
+		}
+	}
+	b.mu.RUnlock()
+
+	var linked []*ManagedChannel
+	for _, mCh := range inGuild {
+		mCh.mu.Lock()
+		ok := mCh.VoiceChannelID == voiceChannelID
+		mCh.mu.Unlock()
+		if ok {
+			linked = append(linked, mCh)
+		}
+	}
+	return linked
+}
+
+// SetVoiceWipe schedules the channel to be wiped at the given time. A zero
+// time cancels a pending wipe.
+func (c *ManagedChannel) SetVoiceWipe(at time.Time) {
+	c.mu.Lock()
+	if c.killBit || c.voiceWipeAt.Equal(at) {
+		c.mu.Unlock()
+		return
+	}
+	c.voiceWipeAt = at
+	c.mu.Unlock()
+	c.bot.QueueReap(c)
+}
+
+// OnVoiceStateUpdate schedules or cancels wipes for the channels linked to
+// the voice channels that the member left and joined. The library State has
+// already applied the update.
+func (b *Bot) OnVoiceStateUpdate(s *discordgo.Session, ev *discordgo.VoiceStateUpdate) {
+	var left string
+	if ev.BeforeUpdate != nil {
+		left = ev.BeforeUpdate.ChannelID
+	}
+	if left == ev.ChannelID {
+		return // mute, deafen, etc.
+	}
+	now := b.clock.Now()
+	if left != "" && b.voiceOccupancy(ev.GuildID, left) == 0 {
+		for _, mCh := range b.linkedChannels(ev.GuildID, left) {
+			mCh.mu.Lock()
+			delay := mCh.VoiceWipeDelay
+			mCh.mu.Unlock()
+			fmt.Printf("[voic] %s: voice channel %s is empty, wiping in %v\n", mCh, left, delay)
+			mCh.SetVoiceWipe(now.Add(delay))
+		}
+	}
+	if ev.ChannelID != "" {
+		for _, mCh := range b.linkedChannels(ev.GuildID, ev.ChannelID) {
+			mCh.SetVoiceWipe(time.Time{})
+		}
+	}
+}
+
+func voiceLinkText(l *Locale, voiceChannelID string, delay time.Duration) string {
+	if voiceChannelID == "" {
+		return ""
+	}
+	if delay == 0 {
+		return l.Sprintf("policy.voice", voiceChannelID)
+	}
+	return l.Sprintf("policy.voice_delay", voiceChannelID, delay)
+}
@@ -0,0 +1,77 @@
+package autodelete
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const testVoiceChannelID = "300000000000000002"
+
+// voiceEvent moves a member to a voice channel, or out of voice if channelID
+// is empty, the way the gateway does.
+func voiceEvent(t *testing.T, b *Bot, userID, channelID string) {
+	t.Helper()
+	ev := &discordgo.VoiceStateUpdate{VoiceState: &discordgo.VoiceState{
+		UserID:    userID,
+		GuildID:   testGuildID,
+		ChannelID: channelID,
+	}}
+	b.s.StateEnabled = true
+	if err := b.s.State.OnInterface(b.s, ev); err != nil {
+		t.Fatal(err)
+	}
+	b.OnVoiceStateUpdate(b.s, ev)
+}
+
+func TestParseChannelMention(t *testing.T) {
+	for in, want := range map[string]string{"<#123>": "123", "123": "123", "<#>": "", "<#12a>": "", "#general": ""} {
+		if got, ok := parseChannelMention(in); got != want || ok != (want != "") {
+			t.Errorf("parseChannelMention(%q) = %q, %v; want %q", in, got, ok, want)
+		}
+	}
+}
+
+func TestVoiceWipe(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{
+		LiveTime:       time.Hour,
+		VoiceChannelID: testVoiceChannelID,
+		VoiceWipeDelay: 5 * time.Minute,
+	})
+	start := clock.Now()
+	msgs := []string{postAndAdd(c, clock, api), postAndAdd(c, clock, api)}
+
+	voiceEvent(t, b, "1001", testVoiceChannelID)
+	voiceEvent(t, b, "1002", testVoiceChannelID)
+	voiceEvent(t, b, "1001", "")
+	voiceEvent(t, b, testBotID, testVoiceChannelID)
+	if got, want := c.GetNextDeletionTime(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("with a member left: GetNextDeletionTime = %v, want %v", got, want)
+	}
+
+	// The last member leaving starts the wipe delay, and a join cancels it.
+	clock.Advance(10 * time.Minute)
+	voiceEvent(t, b, "1002", "")
+	if got, want := c.GetNextDeletionTime(), clock.Now().Add(5*time.Minute); !got.Equal(want) {
+		t.Errorf("after leaving: GetNextDeletionTime = %v, want %v", got, want)
+	}
+	voiceEvent(t, b, "1003", testVoiceChannelID)
+	if got, want := c.GetNextDeletionTime(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("after rejoining: GetNextDeletionTime = %v, want %v", got, want)
+	}
+	voiceEvent(t, b, "1003", "")
+
+	clock.Advance(5 * time.Minute)
+	bulk, _, _, _ := c.collectMessagesToDelete()
+	if !reflect.DeepEqual(bulk, msgs) {
+		t.Errorf("wiped %v, want %v", bulk, msgs)
+	}
+	later := postAndAdd(c, clock, api)
+	clock.Advance(time.Minute)
+	if bulk, _, _, _ := c.collectMessagesToDelete(); len(bulk) != 0 {
+		t.Errorf("wiped %v after the wipe was done, want %s kept", bulk, later)
+	}
+}
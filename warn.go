@@ -0,0 +1,189 @@
+package autodelete
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/riking/AutoDelete/snowflake"
+)
+
+// WarnMode controls how users are told that messages are about to be
+// deleted. Warnings are only given for time-based deletion; a message pushed
+// out by MaxMessages goes without notice.
+type WarnMode string
+
+const (
+	WarnModeOff WarnMode = ""
+	// React to each message with warnEmoji.
+	WarnModeReact WarnMode = "react"
+	// Post one notice for each batch of messages. The notice is deleted
+	// along with the last message it warns about.
+	WarnModeNotice WarnMode = "notice"
+)
+
+const (
+	warnEmoji         = "⏰"
+	defaultWarnBefore = 10 * time.Minute
+	// Messages expiring this close together share a notice.
+	warnBatchWindow = time.Minute
+	// Reactions have a tight ratelimit, so each pass only does this many.
+	warnReactLimit = 20
+)
+
+var mWarnings = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: nsAutodelete,
+	Name:      "deletion_warnings_total",
+	Help:      "Number of messages warned about before deletion",
+}, []string{"mode"})
+
+func init() {
+	prometheus.MustRegister(mWarnings)
+}
+
+// ParseWarnMode accepts the names used by the set command.
+func ParseWarnMode(s string) (WarnMode, error) {
+	switch WarnMode(s) {
+	case "off", WarnModeOff:
+		return WarnModeOff, nil
+	case WarnModeReact, WarnModeNotice:
+		return WarnMode(s), nil
+	}
+	return WarnModeOff, fmt.Errorf("unknown warning mode %q", s)
+}
+
+// warnState tracks which messages have been warned about. It is protected by
+// the ManagedChannel's mu.
+type warnState struct {
+	// Every liveMessages key up to this one has been warned about.
+	through snowflake.ID
+}
+
+// warnBeforeLocked returns how long before deletion to warn. Must be called
+// with mu held.
+func (c *ManagedChannel) warnBeforeLocked() time.Duration {
+	if c.WarnBefore > 0 {
+		return c.WarnBefore
+	}
+	return defaultWarnBefore
+}
+
+// nextWarnTimeLocked returns when the next message should be warned about, or
+// the zero time if there is nothing to warn about. Must be called with mu
+// held.
+func (c *ManagedChannel) nextWarnTimeLocked() time.Time {
+	if c.WarnMode == WarnModeOff || c.MessageLiveTime == 0 {
+		return time.Time{}
+	}
+	i, _ := c.liveMessages.Index(c.warn.through + 1)
+	for ; i < c.liveMessages.Len(); i++ {
+		key := c.liveMessages.At(i)
+		if !c.keepLookup[c.liveMessageID(key)] {
+			return key.Time().Add(c.MessageLiveTime - c.warnBeforeLocked())
+		}
+	}
+	return time.Time{}
+}
+
+// collectWarningsLocked returns the messages to warn about now, oldest first,
+// and marks them as warned. Must be called with mu held.
+func (c *ManagedChannel) collectWarningsLocked(now time.Time, limit int) (msgs []string, last snowflake.ID, firstExpiry time.Time) {
+	horizon := now.Add(c.warnBeforeLocked() + warnBatchWindow)
+	i, _ := c.liveMessages.Index(c.warn.through + 1)
+	for ; i < c.liveMessages.Len() && len(msgs) < limit; i++ {
+		key := c.liveMessages.At(i)
+		expiry := key.Time().Add(c.MessageLiveTime)
+		if expiry.After(horizon) {
+			break
+		}
+		c.warn.through = key
+		msgID := c.liveMessageID(key)
+		if c.keepLookup[msgID] || !expiry.After(now) {
+			continue
+		}
+		if len(msgs) == 0 {
+			firstExpiry = expiry
+		}
+		msgs = append(msgs, msgID)
+		last = key
+	}
+	return msgs, last, firstExpiry
+}
+
+// formatWarnDelay rounds a duration for display in a notice.
+func formatWarnDelay(l *Locale, d time.Duration) string {
+	switch {
+	case d < 90*time.Second:
+		return l.Sprintf("warn.minute")
+	case d < 90*time.Minute:
+		n := int(d.Round(time.Minute) / time.Minute)
+		return l.Plural("warn.minutes", n, n)
+	}
+	n := int(d.Round(time.Hour) / time.Hour)
+	return l.Plural("warn.hours", n, n)
+}
+
+// sendWarnings warns about messages that will be deleted within WarnBefore.
+func (c *ManagedChannel) sendWarnings() error {
+	now := c.bot.clock.Now()
+	c.mu.Lock()
+	if c.killBit || c.WarnMode == WarnModeOff || c.MessageLiveTime == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	mode := c.WarnMode
+	limit := c.liveMessages.Len()
+	if mode == WarnModeReact {
+		limit = warnReactLimit
+	}
+	msgs, last, firstExpiry := c.collectWarningsLocked(now, limit)
+	c.mu.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	mWarnings.WithLabelValues(string(mode)).Add(float64(len(msgs)))
+
+	if mode == WarnModeReact {
+		for _, msgID := range msgs {
+			err := c.bot.api.MessageReactionAdd(c.ChannelID, msgID, warnEmoji)
+			if isCriticalDeleteError(err) {
+				return err
+			} else if err != nil {
+				fmt.Printf("[warn] %s: could not react to %s: %v\n", c, msgID, err)
+			}
+		}
+		return nil
+	}
+
+	l := c.bot.localeFor(c.GuildID)
+	link := fmt.Sprintf("https://discord.com/channels/%s/%s/%s", c.GuildID, c.ChannelID, msgs[0])
+	content := l.Plural("warn.notice", len(msgs), warnEmoji, len(msgs), link, formatWarnDelay(l, firstExpiry.Sub(now)))
+	notice, err := c.bot.api.ChannelMessageSend(c.ChannelID, content)
+	if err != nil {
+		if isCriticalDeleteError(err) {
+			return err
+		}
+		fmt.Printf("[warn] %s: could not post notice: %v\n", c, err)
+		return nil
+	}
+
+	// Track the notice so that it expires with the last message it warns
+	// about.
+	noticeID, err := snowflake.Parse(notice.ID)
+	if err != nil {
+		return nil
+	}
+	key := snowflake.FromTime(last.Time(), uint64(noticeID))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.killBit {
+		return nil
+	}
+	c.removeLiveLocked(notice.ID)
+	c.edits.set(notice.ID, key)
+	c.liveMessages.Push(key)
+	if key > c.warn.through {
+		c.warn.through = key
+	}
+	return nil
+}
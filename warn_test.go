@@ -0,0 +1,106 @@
+package autodelete
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarnReact(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour, WarnMode: WarnModeReact})
+	start := clock.Now()
+
+	a := postAndAdd(c, clock, api)
+	clock.Advance(30 * time.Minute)
+	later := postAndAdd(c, clock, api)
+
+	if got, want := c.GetNextDeletionTime(), start.Add(50*time.Minute); !got.Equal(want) {
+		t.Errorf("GetNextDeletionTime = %v, want warning time %v", got, want)
+	}
+	clock.Advance(20 * time.Minute)
+	if err := c.sendWarnings(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{a + " " + warnEmoji}; !reflect.DeepEqual(api.reactions, want) {
+		t.Errorf("reactions = %v, want %v", api.reactions, want)
+	}
+	// Warned: the next wakeup is the deletion.
+	if got, want := c.GetNextDeletionTime(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("GetNextDeletionTime = %v, want deletion time %v", got, want)
+	}
+
+	clock.Advance(10*time.Minute + time.Second)
+	msgs, _, _, _ := c.collectMessagesToDelete()
+	if !reflect.DeepEqual(msgs, []string{a}) {
+		t.Errorf("collected %v, want %v", msgs, a)
+	}
+	if got, want := c.GetNextDeletionTime(), start.Add(80*time.Minute); !got.Equal(want) {
+		t.Errorf("GetNextDeletionTime = %v, want warning for %s at %v", got, later, want)
+	}
+}
+
+func TestWarnNotice(t *testing.T) {
+	b, clock, api := newTestBot(t)
+	c := newTestChannel(t, b, ManagedChannelMarshal{LiveTime: time.Hour, WarnMode: WarnModeNotice, WarnBefore: 5 * time.Minute})
+
+	var batch []string
+	for i := 0; i < 3; i++ {
+		batch = append(batch, postAndAdd(c, clock, api))
+		clock.Advance(10 * time.Second)
+	}
+	clock.Advance(20 * time.Minute)
+	later := postAndAdd(c, clock, api)
+
+	clock.Advance(35 * time.Minute)
+	if err := c.sendWarnings(); err != nil {
+		t.Fatal(err)
+	}
+	sent := sentMessages(api)
+	if len(sent) != 1 || !strings.Contains(sent[0], "3 messages") || !strings.Contains(sent[0], batch[0]) {
+		t.Fatalf("sent %q, want one notice for 3 messages", sent)
+	}
+	api.mu.Lock()
+	msgs := api.messages[testChannelID]
+	notice := msgs[len(msgs)-1]
+	api.mu.Unlock()
+
+	// The gateway delivers the notice; it stays with its batch.
+	c.AddMessage(notice)
+	if got, want := liveIDs(c), append(append([]string(nil), batch...), notice.ID, later); !reflect.DeepEqual(got, want) {
+		t.Errorf("liveMessages = %v, want %v", got, want)
+	}
+	if err := c.sendWarnings(); err != nil || len(sentMessages(api)) != 1 {
+		t.Errorf("second pass sent %q, %v; want nothing new", sentMessages(api), err)
+	}
+
+	clock.Advance(5 * time.Minute)
+	collected, _, _, _ := c.collectMessagesToDelete()
+	if want := append(batch, notice.ID); !reflect.DeepEqual(collected, want) {
+		t.Errorf("collected %v, want batch and notice %v", collected, want)
+	}
+}
+
+func TestFormatWarnDelay(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		30 * time.Second:                "about a minute",
+		10*time.Minute + 20*time.Second: "10 minutes",
+		3 * time.Hour:                   "3 hours",
+	} {
+		if got := formatWarnDelay(localeEnglish, d); got != want {
+			t.Errorf("formatWarnDelay(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestParseWarnMode(t *testing.T) {
+	for in, want := range map[string]WarnMode{"off": WarnModeOff, "": WarnModeOff, "react": WarnModeReact, "notice": WarnModeNotice} {
+		if got, err := ParseWarnMode(in); err != nil || got != want {
+			t.Errorf("ParseWarnMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseWarnMode("loud"); err == nil {
+		t.Error("ParseWarnMode accepted an unknown mode")
+	}
+}